@@ -0,0 +1,123 @@
+package global
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"util"
+)
+
+/*
+Claves públicas de los contactos, fijadas la primera vez que se ven. Se guardan en keys/<usuario>.contacts y si luego el
+servidor devuelve otra clave para el mismo contacto no se usa: o la ha cambiado el contacto o alguien está en medio, y
+solo el usuario puede saberlo comparando el número de seguridad.
+*/
+var (
+	contactsMu   sync.Mutex
+	contacts     map[string]Contact
+	contactsUser string
+)
+
+// ErrKeyChanged indica que el servidor ha devuelto una clave distinta de la fijada para el contacto
+var ErrKeyChanged = errors.New("la clave del contacto ha cambiado")
+
+type Contact struct {
+	PubKey []byte
+	// el usuario ha comparado el número de seguridad con el contacto
+	Verified bool
+}
+
+func contactsPath(username string) string {
+	return fmt.Sprintf("keys/%s.contacts", username)
+}
+
+// LoadContacts carga las claves fijadas por el usuario
+func LoadContacts(username string) error {
+	contactsMu.Lock()
+	defer contactsMu.Unlock()
+
+	if contacts != nil && contactsUser == username {
+		return nil
+	}
+
+	loaded := make(map[string]Contact)
+
+	data, err := os.ReadFile(contactsPath(username))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			return fmt.Errorf("archivo de contactos corrupto")
+		}
+	}
+
+	contacts, contactsUser = loaded, username
+	return nil
+}
+
+// se llama con contactsMu bloqueado
+func saveContacts() error {
+	tmp := contactsPath(contactsUser) + ".tmp"
+	if err := os.WriteFile(tmp, util.EncodeJSON(contacts), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, contactsPath(contactsUser))
+}
+
+/*
+CheckContactKey comprueba pubKey contra la clave fijada de username, fijándola si es la primera vez. Devuelve
+ErrKeyChanged si no coincide. Sin contactos cargados (sin sesión) no comprueba nada.
+*/
+func CheckContactKey(username string, pubKey []byte) error {
+	contactsMu.Lock()
+	defer contactsMu.Unlock()
+
+	if contacts == nil {
+		return nil
+	}
+
+	c, ok := contacts[username]
+	if !ok {
+		contacts[username] = Contact{PubKey: pubKey}
+		return saveContacts()
+	}
+
+	if !bytes.Equal(c.PubKey, pubKey) {
+		return ErrKeyChanged
+	}
+	return nil
+}
+
+// TrustContactKey fija pubKey como la clave de username y la marca como verificada
+func TrustContactKey(username string, pubKey []byte) error {
+	contactsMu.Lock()
+	defer contactsMu.Unlock()
+
+	if contacts == nil {
+		return fmt.Errorf("no hay contactos cargados")
+	}
+
+	contacts[username] = Contact{PubKey: pubKey, Verified: true}
+	return saveContacts()
+}
+
+// GetContact devuelve la clave fijada de username, si hay
+func GetContact(username string) (Contact, bool) {
+	contactsMu.Lock()
+	defer contactsMu.Unlock()
+
+	c, ok := contacts[username]
+	return c, ok
+}
+
+func clearContacts() {
+	contactsMu.Lock()
+	defer contactsMu.Unlock()
+
+	contacts = nil
+	contactsUser = ""
+}
@@ -0,0 +1,127 @@
+package global
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"util"
+	"util/ratchet"
+)
+
+/*
+Claves X25519 del usuario para los chats cifrados (util/ratchet). Se guardan en keys/<usuario>.prekeys cifradas con una
+clave AES aleatoria, que va delante cifrada con su clave RSA, así que hace falta tener cargadas las claves RSA.
+
+Los chats abiertos y la publicación de prekeys las usan a la vez, por eso todo pasa por UpdateIdentity.
+*/
+var (
+	identityMu   sync.Mutex
+	identity     *ratchet.Identity
+	identityUser string
+)
+
+func identityPath(username string) string {
+	return fmt.Sprintf("keys/%s.prekeys", username)
+}
+
+// LoadIdentity carga la identidad del usuario o crea una nueva si aún no tiene
+func LoadIdentity(username string) error {
+	identityMu.Lock()
+	defer identityMu.Unlock()
+
+	if identity != nil && identityUser == username {
+		return nil
+	}
+
+	if defaultPriv == nil {
+		return fmt.Errorf("no hay claves RSA cargadas")
+	}
+
+	enc, err := os.ReadFile(identityPath(username))
+	if os.IsNotExist(err) {
+		id, err := ratchet.NewIdentity()
+		if err != nil {
+			return err
+		}
+
+		identity, identityUser = id, username
+		return saveIdentity()
+	}
+	if err != nil {
+		return err
+	}
+
+	size := defaultPriv.Size()
+	if len(enc) < size {
+		return fmt.Errorf("archivo de prekeys corrupto")
+	}
+
+	key, err := util.DecryptWithRSA(enc[:size], defaultPriv)
+	if err != nil {
+		return fmt.Errorf("no se ha podido descifrar el archivo de prekeys")
+	}
+
+	data, err := util.DecryptAD(enc[size:], key, []byte("prekeys:"+username))
+	if err != nil {
+		return fmt.Errorf("no se ha podido descifrar el archivo de prekeys")
+	}
+
+	var id ratchet.Identity
+	if err := json.Unmarshal(data, &id); err != nil {
+		return err
+	}
+
+	identity, identityUser = &id, username
+	return nil
+}
+
+// se llama con identityMu bloqueado
+func saveIdentity() error {
+	if defaultPub == nil {
+		return fmt.Errorf("no hay claves RSA cargadas")
+	}
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	encKey, err := util.EncryptWithRSA(key, defaultPub)
+	if err != nil {
+		return err
+	}
+
+	enc := append(encKey, util.EncryptAD(util.EncodeJSON(identity), key, []byte("prekeys:"+identityUser))...)
+
+	// se escribe aparte y se renombra para no perder las claves si se corta a medias
+	tmp := identityPath(identityUser) + ".tmp"
+	if err := os.WriteFile(tmp, enc, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, identityPath(identityUser))
+}
+
+// UpdateIdentity ejecuta fn con la identidad cargada y la guarda si fn devuelve que la ha cambiado
+func UpdateIdentity(fn func(id *ratchet.Identity) (bool, error)) error {
+	identityMu.Lock()
+	defer identityMu.Unlock()
+
+	if identity == nil {
+		return fmt.Errorf("no hay identidad de chat cargada")
+	}
+
+	changed, err := fn(identity)
+	if err != nil || !changed {
+		return err
+	}
+
+	return saveIdentity()
+}
+
+func clearIdentity() {
+	identityMu.Lock()
+	defer identityMu.Unlock()
+
+	identity = nil
+	identityUser = ""
+}
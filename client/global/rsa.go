@@ -31,6 +31,8 @@ func SetPub(key *rsa.PublicKey) {
 func ClearKeys() {
 	defaultPriv = nil
 	defaultPub = nil
+	clearIdentity()
+	clearContacts()
 }
 
 func GetPublicKey() *rsa.PublicKey {
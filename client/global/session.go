@@ -0,0 +1,57 @@
+package global
+
+import "sync"
+
+/*
+Tokens de la sesión abierta. El token de acceso cambia cada vez que se renueva, así que las peticiones cogen de aquí el
+vigente en vez del que se guardó en model.User al hacer login.
+*/
+var (
+	sessionMu      sync.Mutex
+	sessionUser    string
+	sessionToken   []byte
+	sessionRefresh []byte
+)
+
+func SetSession(user string, token []byte, refresh []byte) {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+
+	sessionUser, sessionToken, sessionRefresh = user, token, refresh
+}
+
+// SetSessionToken cambia el token de acceso de user cuando el servidor lo renueva, sin tocar el refresh token
+func SetSessionToken(user string, token []byte) {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+
+	if user != "" && user == sessionUser {
+		sessionToken = token
+	}
+}
+
+func ClearSession() {
+	SetSession("", nil, nil)
+}
+
+// SessionToken devuelve el token de acceso vigente de user, o nil si no tiene la sesión abierta
+func SessionToken(user string) []byte {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+
+	if user == "" || user != sessionUser {
+		return nil
+	}
+	return sessionToken
+}
+
+// SessionRefresh devuelve el refresh token de user, o nil si no tiene la sesión abierta
+func SessionRefresh(user string) []byte {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+
+	if user == "" || user != sessionUser {
+		return nil
+	}
+	return sessionRefresh
+}
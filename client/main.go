@@ -18,7 +18,7 @@ func main() {
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
 
-	client := &http.Client{Transport: tr}
+	client := &http.Client{Transport: &mvc.SessionTransport{Base: tr}}
 
 	p := tea.NewProgram(mvc.InitialHomeModel(model.User{}, client))
 	if _, err := p.Run(); err != nil {
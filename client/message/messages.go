@@ -13,6 +13,9 @@ type ReceiveMessageMsg model.Message
 type ChatMsg model.Chat
 type UnreadMsg []model.Message
 type FirstChatMsg struct{}
+type TypingMsg string // usuario que está escribiendo
+type ReceiptMsg model.Receipt
+type ExpiryMsg model.Expiry // el otro ha cambiado los mensajes temporales
 
 func SendTimedMessage(msg interface{}, t time.Duration) func() tea.Msg {
 	return func() tea.Msg {
@@ -80,6 +80,18 @@ func (m AccessGroupPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				} else {
 					m.msg = "Debes introducir una cadena"
 				}
+			case 4:
+				if groupname != "" {
+					return InitialGroupChatPageModel(m.user, m.client, groupname), LoadGroupChat(m.user, groupname, m.client)
+				} else {
+					m.msg = "Debes introducir una cadena"
+				}
+			case 5:
+				if groupname != "" {
+					leaveGroup(&m)
+				} else {
+					m.msg = "Debes introducir una cadena"
+				}
 			}
 		}
 	}
@@ -93,6 +105,8 @@ func (m AccessGroupPage) View() string {
 		s = "Create group\n\n"
 	} else if m.action == 2 {
 		s = "Join group\n\n"
+	} else if m.action == 5 {
+		s = "Leave group\n\n"
 	} else {
 		s = "Access group\n\n"
 	}
@@ -155,3 +169,25 @@ func joinGroup(m *AccessGroupPage) {
 		m.msg = r.Msg
 	}
 }
+
+func leaveGroup(m *AccessGroupPage) {
+	req, err := http.NewRequest("POST", "https://localhost:10443/groups/"+m.groupName.Value()+"/leave", nil)
+	util.FailOnError(err)
+
+	req.Header.Add("Authorization", util.Encode64(m.user.Token))
+	req.Header.Add("Username", m.user.Name)
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		m.msg = err.Error()
+		return
+	}
+
+	var r model.Resp
+	util.DecodeJSON(resp.Body, &r)
+	if r.Ok {
+		m.msg = "Has salido del grupo " + m.groupName.Value()
+	} else {
+		m.msg = r.Msg
+	}
+}
@@ -0,0 +1,298 @@
+package mvc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"util"
+	"util/model"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+/*
+Adjuntos de los chats. El archivo se cifra por trozos con una clave aleatoria y se sube a /blobs; al otro solo le llega
+por el chat cifrado un mensaje con el id, la clave y el nombre. Si la subida se corta, al volver a adjuntar el mismo
+archivo se continúa con los trozos que falten.
+*/
+
+// marca el texto de un mensaje que lleva un adjunto en vez de texto
+const attachmentPrefix = "\x00adjunto\n"
+
+// intentos por trozo antes de dejar la subida o la bajada para más tarde
+const chunkRetries = 3
+
+// subidas sin terminar en esta sesión, por ruta del archivo
+var (
+	pendingUploadsMu sync.Mutex
+	pendingUploads   = make(map[string]model.Attachment)
+)
+
+// cada trozo queda ligado a su adjunto, su posición y el total, así no se pueden reordenar ni quitar
+func chunkAD(id string, n int, chunks int) []byte {
+	return []byte(fmt.Sprintf("blob:%s/%d/%d", id, n, chunks))
+}
+
+// attachmentMsg confirma que se ha subido un adjunto para enviárselo a username
+type attachmentMsg struct {
+	username   string
+	attachment model.Attachment
+}
+
+// attachmentSavedMsg trae la ruta donde se ha guardado un adjunto
+type attachmentSavedMsg string
+
+func encodeAttachment(a model.Attachment) string {
+	return attachmentPrefix + string(util.EncodeJSON(a))
+}
+
+// parseAttachment rellena Attachment si el mensaje lleva uno y deja en Message su descripción
+func parseAttachment(m model.Message) model.Message {
+	data, ok := strings.CutPrefix(m.Message, attachmentPrefix)
+	if !ok {
+		return m
+	}
+
+	var a model.Attachment
+	if err := json.Unmarshal([]byte(data), &a); err != nil || a.Id == "" {
+		m.Message = "[adjunto no válido]"
+		return m
+	}
+
+	m.Attachment = &a
+	m.Message = describeAttachment(a)
+	return m
+}
+
+func describeAttachment(a model.Attachment) string {
+	return fmt.Sprintf("📎 %s (%s) - /save %s para guardarlo", a.Name, formatSize(a.Size), a.Name)
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", size)
+}
+
+// doRaw hace una petición autenticada con el cuerpo tal cual y devuelve el de la respuesta
+func doRaw(method string, url string, username string, token []byte, body []byte, client *http.Client) ([]byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Authorization", util.Encode64(token))
+	req.Header.Add("Username", username)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error conectando con el servidor")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, model.BlobChunkSize+1024))
+}
+
+// UploadAttachment cifra y sube el archivo de path para adjuntarlo en el chat con username
+func UploadAttachment(user model.User, username string, path string, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("no se puede abrir el archivo. %s", err.Error())
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil || info.IsDir() {
+			return fmt.Errorf("%s no es un archivo", path)
+		}
+
+		if info.Size() == 0 || info.Size() > model.MaxBlobSize {
+			return fmt.Errorf("el adjunto tiene que ocupar entre 1 B y %s", formatSize(model.MaxBlobSize))
+		}
+
+		a, uploaded, err := startUpload(user, path, info, client)
+		if err != nil {
+			return err
+		}
+
+		chunk := make([]byte, model.BlobChunkSize)
+		for n := range a.Chunks {
+			if uploaded[n] {
+				continue
+			}
+
+			read, err := file.ReadAt(chunk, int64(n)*model.BlobChunkSize)
+			if err != nil && err != io.EOF {
+				return err
+			}
+
+			enc := util.EncryptAD(chunk[:read], a.Key, chunkAD(a.Id, n, a.Chunks))
+			url := fmt.Sprintf("https://localhost:10443/blobs/%s/%d", a.Id, n)
+
+			for attempt := 1; ; attempt++ {
+				if _, err = doRaw("PUT", url, user.Name, user.Token, enc, client); err == nil {
+					break
+				}
+				if attempt == chunkRetries {
+					return fmt.Errorf("error subiendo el adjunto (%d/%d). Vuelve a adjuntarlo para continuar. %s", n, a.Chunks, err.Error())
+				}
+			}
+		}
+
+		pendingUploadsMu.Lock()
+		delete(pendingUploads, path)
+		pendingUploadsMu.Unlock()
+
+		return attachmentMsg{username, a}
+	}
+}
+
+/*
+startUpload devuelve el adjunto a subir y los trozos que ya tiene el servidor. Si ya se empezó a subir el mismo archivo
+se continúa con esa subida, si no se reserva uno nuevo con una clave nueva.
+*/
+func startUpload(user model.User, path string, info fs.FileInfo, client *http.Client) (model.Attachment, []bool, error) {
+	pendingUploadsMu.Lock()
+	a, ok := pendingUploads[path]
+	pendingUploadsMu.Unlock()
+
+	if ok && a.Size == info.Size() {
+		var blob model.Blob
+		if err := doJSON("GET", "https://localhost:10443/blobs/"+a.Id, user.Name, user.Token, nil, &blob, client); err == nil && len(blob.Uploaded) == a.Chunks {
+			return a, blob.Uploaded, nil
+		}
+	}
+
+	a = model.Attachment{Key: make([]byte, 32), Name: filepath.Base(path), Size: info.Size(), Chunks: model.BlobChunks(info.Size())}
+	rand.Read(a.Key)
+
+	var blob model.Blob
+	err := doJSON("POST", "https://localhost:10443/blobs", user.Name, user.Token, model.Blob{Size: a.Size, Chunks: a.Chunks}, &blob, client)
+	if errors.Is(err, statusError(http.StatusInsufficientStorage)) {
+		return a, nil, fmt.Errorf("no te queda espacio para adjuntos, borra alguno o espera a que caduquen")
+	} else if err != nil {
+		return a, nil, fmt.Errorf("error reservando el adjunto. %s", err.Error())
+	}
+	a.Id = blob.Id
+
+	pendingUploadsMu.Lock()
+	pendingUploads[path] = a
+	pendingUploadsMu.Unlock()
+
+	return a, make([]bool, a.Chunks), nil
+}
+
+// DeleteAttachment borra del servidor un adjunto propio, al borrar para todos el mensaje que lo lleva
+func DeleteAttachment(user model.User, id string, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		_, err := doRaw("DELETE", "https://localhost:10443/blobs/"+id, user.Name, user.Token, nil, client)
+		if err != nil && !errors.Is(err, statusError(http.StatusNotFound)) {
+			return fmt.Errorf("error borrando el adjunto del servidor. %s", err.Error())
+		}
+		return nil
+	}
+}
+
+// SaveAttachment baja y descifra un adjunto y lo guarda en ./downloads/<usuario>, sin sobrescribir nada
+func SaveAttachment(user model.User, a model.Attachment, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		dir := fmt.Sprintf("./downloads/%s", user.Name)
+		if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
+			return err
+		}
+
+		tmp, err := os.CreateTemp(dir, ".adjunto*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		var written int64
+		for n := range a.Chunks {
+			url := fmt.Sprintf("https://localhost:10443/blobs/%s/%d", a.Id, n)
+
+			var enc []byte
+			for attempt := 1; ; attempt++ {
+				if enc, err = doRaw("GET", url, user.Name, user.Token, nil, client); err == nil {
+					break
+				}
+				if attempt == chunkRetries {
+					return fmt.Errorf("error bajando el adjunto. %s", err.Error())
+				}
+			}
+
+			chunk, err := util.DecryptAD(enc, a.Key, chunkAD(a.Id, n, a.Chunks))
+			if err != nil {
+				return fmt.Errorf("el adjunto está dañado o manipulado. %s", err.Error())
+			}
+
+			if _, err := tmp.Write(chunk); err != nil {
+				return err
+			}
+			written += int64(len(chunk))
+		}
+
+		if written != a.Size {
+			return fmt.Errorf("el adjunto no tiene el tamaño indicado")
+		}
+
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+
+		path, err := freePath(dir, a.Name)
+		if err != nil {
+			return err
+		}
+
+		// el nombre viene del otro, con Base no puede salirse de la carpeta
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			return err
+		}
+
+		return attachmentSavedMsg(path)
+	}
+}
+
+// freePath devuelve una ruta en dir para name que no exista, añadiendo un número si hace falta
+func freePath(dir string, name string) (string, error) {
+	name = filepath.Base(name)
+	if name == "." || name == "/" || name == ".." {
+		name = "adjunto"
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	for i := 0; i < 1000; i++ {
+		path := filepath.Join(dir, name)
+		if i > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		}
+
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path, nil
+		}
+	}
+
+	return "", fmt.Errorf("ya hay demasiados archivos llamados %s", name)
+}
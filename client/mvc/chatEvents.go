@@ -0,0 +1,226 @@
+package mvc
+
+import (
+	"bufio"
+	"bytes"
+	"client/message"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"util"
+	"util/model"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// espera máxima entre reintentos cuando se corta el stream
+const maxReconnectDelay = 30 * time.Second
+
+/*
+ListenChat abre el stream SSE de los mensajes que usernameOther envía al usuario y los va dejando en el canal que
+devuelve como message.ReceiveMessageMsg, junto con las confirmaciones de lo que el usuario le ha enviado como
+message.ReceiptMsg, los cambios en los mensajes temporales como message.ExpiryMsg y los avisos de escritura como
+message.TypingMsg. Si la conexión se cae vuelve a conectar con Last-Event-ID, así el servidor no repite lo ya recibido.
+Termina y cierra el canal al cancelar ctx.
+
+Es la alternativa al websocket cuando no se puede abrir.
+*/
+func ListenChat(ctx context.Context, username string, token []byte, usernameOther string, lastId int64, client *http.Client) <-chan tea.Msg {
+	events := make(chan tea.Msg)
+
+	go func() {
+		defer close(events)
+
+		delay := time.Second
+		for {
+			received, err := streamChat(ctx, username, token, usernameOther, &lastId, client, events)
+			if received {
+				delay = time.Second
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err != nil {
+				delay = min(delay*2, maxReconnectDelay)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+	}()
+
+	return events
+}
+
+// streamChat lee una conexión del stream hasta que se corta. received indica si ha llegado algún mensaje
+func streamChat(ctx context.Context, username string, token []byte, usernameOther string, lastId *int64, client *http.Client, events chan<- tea.Msg) (received bool, err error) {
+	url := fmt.Sprintf("https://localhost:10443/chat/%s/events", usernameOther)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Add("Authorization", util.Encode64(token))
+	req.Header.Add("Username", username)
+	req.Header.Add("Accept", "text/event-stream")
+	if *lastId > 0 {
+		req.Header.Add("Last-Event-ID", strconv.FormatInt(*lastId, 10))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("status: %v", resp.StatusCode)
+	}
+
+	var event, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && data != "":
+			var msg tea.Msg
+			var id int64
+
+			switch event {
+			case "receipt":
+				var r model.Receipt
+				if err := json.Unmarshal([]byte(data), &r); err != nil {
+					return received, err
+				}
+				msg = message.ReceiptMsg(r)
+			case "expiry":
+				var e model.Expiry
+				if err := json.Unmarshal([]byte(data), &e); err != nil {
+					return received, err
+				}
+				msg = message.ExpiryMsg(e)
+			case "typing":
+				var from string
+				if err := json.Unmarshal([]byte(data), &from); err != nil {
+					return received, err
+				}
+				msg = message.TypingMsg(from)
+			default:
+				var m model.Message
+				if err := json.Unmarshal([]byte(data), &m); err != nil {
+					return received, err
+				}
+				msg, id = message.ReceiveMessageMsg(m), m.Id
+			}
+			event, data = "", ""
+
+			select {
+			case events <- msg:
+			case <-ctx.Done():
+				return received, ctx.Err()
+			}
+
+			if id > 0 {
+				*lastId = id
+				received = true
+			}
+		}
+		// las líneas que empiezan por ':' son el heartbeat y se ignoran
+	}
+
+	return received, scanner.Err()
+}
+
+// el stream o el websocket de events se ha cerrado
+type chatStreamClosedMsg struct {
+	events <-chan tea.Msg
+}
+
+// WaitChatEvent espera al siguiente evento del chat (mensaje, confirmación o aviso de escritura)
+func WaitChatEvent(events <-chan tea.Msg) tea.Cmd {
+	return func() tea.Msg {
+		msg, ok := <-events
+		if !ok {
+			return chatStreamClosedMsg{events}
+		}
+		return msg
+	}
+}
+
+// ReadMessages avisa al servidor de que los mensajes hasta id ya se han mostrado: deja de guardarlos y se lo confirma
+// al emisor
+func ReadMessages(username string, token []byte, usernameOther string, id int64, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		url := fmt.Sprintf("https://localhost:10443/chat/%s/read", usernameOther)
+
+		req, err := http.NewRequest("POST", url, bytes.NewReader(util.EncodeJSON(model.MessageAck{Id: id})))
+		if err != nil {
+			return err
+		}
+
+		req.Header.Add("Authorization", util.Encode64(token))
+		req.Header.Add("Username", username)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("status: %v", resp.StatusCode)
+		}
+
+		return nil
+	}
+}
+
+// respuesta de GetReceipts, no viene del stream así que no hay que volver a esperar el siguiente evento
+type receiptsMsg model.Receipt
+
+// GetReceipts pide hasta qué mensaje ha recibido y leído usernameOther lo que le ha enviado el usuario
+func GetReceipts(username string, token []byte, usernameOther string, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		url := fmt.Sprintf("https://localhost:10443/chat/%s/receipts", usernameOther)
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+
+		req.Header.Add("Authorization", util.Encode64(token))
+		req.Header.Add("Username", username)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("status: %v", resp.StatusCode)
+		}
+
+		var r model.Receipt
+		if err := util.DecodeJSON(resp.Body, &r); err != nil {
+			return fmt.Errorf("error decodificando JSON")
+		}
+
+		return receiptsMsg(r)
+	}
+}
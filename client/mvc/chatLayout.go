@@ -0,0 +1,68 @@
+package mvc
+
+import (
+	"github.com/charmbracelet/bubbles/textarea"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// chatLayout es la pantalla común de los chats: los mensajes en un viewport y debajo el textarea para escribir
+type chatLayout struct {
+	viewport viewport.Model
+	textbox  textarea.Model
+
+	meStyle    lipgloss.Style
+	otherStyle lipgloss.Style
+}
+
+func newChatLayout() chatLayout {
+	l := chatLayout{}
+	l.viewport = viewport.New(80, 12)
+
+	l.textbox = textarea.New()
+	l.textbox.Focus()
+	l.textbox.Placeholder = "Send a message..."
+	l.textbox.Prompt = "┃ "
+	l.textbox.CharLimit = 280
+	l.textbox.ShowLineNumbers = false
+	l.textbox.SetHeight(5)
+	l.textbox.SetWidth(80)
+	l.textbox.FocusedStyle.CursorLine = lipgloss.NewStyle()
+
+	l.meStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#ff8"))
+	l.otherStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#45f"))
+
+	return l
+}
+
+// update pasa msg al viewport y al textarea
+func (l *chatLayout) update(msg tea.Msg) []tea.Cmd {
+	cmds := make([]tea.Cmd, 2)
+
+	l.viewport, cmds[0] = l.viewport.Update(msg)
+	l.textbox, cmds[1] = l.textbox.Update(msg)
+
+	return cmds
+}
+
+// setMessages sustituye los mensajes mostrados y baja hasta el último
+func (l *chatLayout) setMessages(s string) {
+	l.viewport.SetContent(s)
+	l.viewport.GotoBottom()
+}
+
+// view pinta la cabecera, los mensajes, los avisos de status y el textarea
+func (l chatLayout) view(header string, status string) string {
+	s := header
+
+	s += "_________________________\n"
+	s += l.viewport.View() + "\n"
+	s += "‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾\n"
+
+	s += status
+	s += "\n"
+	s += l.textbox.View() + "\n"
+
+	return s
+}
@@ -0,0 +1,274 @@
+package mvc
+
+import (
+	"client/message"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+	"util"
+	"util/model"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	socketDialTimeout = 5 * time.Second
+	socketSendTimeout = 10 * time.Second
+
+	// mensajes que se guardan para un chat que no los está leyendo; el resto se recupera con el siguiente sync
+	socketBufferSize = 64
+)
+
+var errSocketClosed = fmt.Errorf("websocket cerrado")
+
+/*
+ChatSocket es el websocket de chat del usuario, compartido por todas las conversaciones. Cada ChatPage se apunta con
+Open a los mensajes y confirmaciones de su conversación y los recibe como tea.Msg. Si el servidor no acepta el websocket se usan el
+stream SSE y la API REST.
+*/
+type ChatSocket struct {
+	conn     *websocket.Conn
+	username string
+	token    []byte
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	subs    map[string]chan tea.Msg
+	replies map[int64]chan model.SocketFrame
+	nextRef int64
+
+	done chan struct{}
+}
+
+var (
+	chatSocketMu sync.Mutex
+	chatSocket   *ChatSocket
+)
+
+// getChatSocket devuelve el websocket abierto para el usuario o intenta abrir uno. Devuelve nil si no se puede
+func getChatSocket(user model.User, client *http.Client) *ChatSocket {
+	chatSocketMu.Lock()
+	defer chatSocketMu.Unlock()
+
+	if chatSocket != nil && chatSocket.alive() && chatSocket.username == user.Name && string(chatSocket.token) == string(currentToken(user)) {
+		return chatSocket
+	}
+
+	if chatSocket != nil {
+		chatSocket.Close()
+		chatSocket = nil
+	}
+
+	s, err := DialChatSocket(user, client)
+	if err != nil {
+		return nil
+	}
+
+	chatSocket = s
+	return s
+}
+
+func DialChatSocket(user model.User, client *http.Client) (*ChatSocket, error) {
+	dialer := websocket.Dialer{HandshakeTimeout: socketDialTimeout}
+	if tr := transport(client); tr != nil {
+		dialer.TLSClientConfig = tr.TLSClientConfig
+	}
+
+	// el websocket no pasa por SessionTransport, va con el token vigente
+	token := currentToken(user)
+
+	header := http.Header{}
+	header.Add("Authorization", util.Encode64(token))
+	header.Add("Username", user.Name)
+
+	conn, _, err := dialer.Dial("wss://localhost:10443/ws", header)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ChatSocket{
+		conn:     conn,
+		username: user.Name,
+		token:    token,
+		subs:     make(map[string]chan tea.Msg),
+		replies:  make(map[int64]chan model.SocketFrame),
+		done:     make(chan struct{}),
+	}
+
+	go s.readLoop()
+	return s, nil
+}
+
+func (s *ChatSocket) alive() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (s *ChatSocket) readLoop() {
+	defer s.shutdown()
+
+	for {
+		var frame model.SocketFrame
+		if err := s.conn.ReadJSON(&frame); err != nil {
+			return
+		}
+
+		switch frame.Type {
+		case model.FrameMessage:
+			if frame.Message != nil {
+				s.dispatch(frame.User, message.ReceiveMessageMsg(*frame.Message))
+			}
+		case model.FrameTyping:
+			s.dispatch(frame.User, message.TypingMsg(frame.User))
+		case model.FrameReceipt:
+			if frame.Receipt != nil {
+				s.dispatch(frame.User, message.ReceiptMsg(*frame.Receipt))
+			}
+		case model.FrameExpiry:
+			if frame.Expiry != nil {
+				s.dispatch(frame.User, message.ExpiryMsg(*frame.Expiry))
+			}
+		case model.FrameSent, model.FrameError:
+			s.mu.Lock()
+			if reply, ok := s.replies[frame.Ref]; ok {
+				reply <- frame
+				delete(s.replies, frame.Ref)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// dispatch nunca bloquea la lectura: si el chat no consume, lo que no quepa se queda pendiente en el servidor
+func (s *ChatSocket) dispatch(user string, msg tea.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if events, ok := s.subs[user]; ok {
+		select {
+		case events <- msg:
+		default:
+		}
+	}
+}
+
+// shutdown cierra los canales de todos los chats para que vuelvan a conectar, por websocket o por SSE
+func (s *ChatSocket) shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	close(s.done)
+	for user, events := range s.subs {
+		close(events)
+		delete(s.subs, user)
+	}
+}
+
+func (s *ChatSocket) write(frame model.SocketFrame) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if !s.alive() {
+		return errSocketClosed
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(socketSendTimeout))
+	if err := s.conn.WriteJSON(frame); err != nil {
+		s.conn.Close()
+		return errSocketClosed
+	}
+
+	return nil
+}
+
+// Open apunta al chat a los mensajes de usernameOther y pide los pendientes posteriores a lastId
+func (s *ChatSocket) Open(usernameOther string, lastId int64) (<-chan tea.Msg, error) {
+	events := make(chan tea.Msg, socketBufferSize)
+
+	s.mu.Lock()
+	if !s.alive() {
+		s.mu.Unlock()
+		close(events)
+		return events, errSocketClosed
+	}
+
+	if old, ok := s.subs[usernameOther]; ok {
+		close(old)
+	}
+	s.subs[usernameOther] = events
+	s.mu.Unlock()
+
+	return events, s.write(model.SocketFrame{Type: model.FrameSync, User: usernameOther, Id: lastId})
+}
+
+// Leave deja de recibir los mensajes de usernameOther si events sigue siendo la suscripción actual
+func (s *ChatSocket) Leave(usernameOther string, events <-chan tea.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok := s.subs[usernameOther]; ok && (<-chan tea.Msg)(current) == events {
+		close(current)
+		delete(s.subs, usernameOther)
+	}
+}
+
+// Send envía un mensaje ya cifrado y firmado y espera a que el servidor devuelva su id
+func (s *ChatSocket) Send(usernameOther string, msg model.Message) (int64, error) {
+	reply := make(chan model.SocketFrame, 1)
+
+	s.mu.Lock()
+	s.nextRef++
+	ref := s.nextRef
+	s.replies[ref] = reply
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.replies, ref)
+		s.mu.Unlock()
+	}()
+
+	err := s.write(model.SocketFrame{Type: model.FrameSend, User: usernameOther, Ref: ref, Message: &msg})
+	if err != nil {
+		return 0, err
+	}
+
+	var frame model.SocketFrame
+	select {
+	case frame = <-reply:
+	case <-s.done:
+		// la respuesta puede haber llegado justo antes de cerrarse, no hay que reenviar el mensaje por REST
+		select {
+		case frame = <-reply:
+		default:
+			return 0, errSocketClosed
+		}
+	case <-time.After(socketSendTimeout):
+		return 0, fmt.Errorf("el servidor no ha confirmado el mensaje")
+	}
+
+	if frame.Type == model.FrameError {
+		return 0, fmt.Errorf("error enviando mensaje: %s", frame.Error)
+	}
+	return frame.Id, nil
+}
+
+// Read marca como leídos los mensajes de usernameOther hasta id
+func (s *ChatSocket) Read(usernameOther string, id int64) error {
+	return s.write(model.SocketFrame{Type: model.FrameRead, User: usernameOther, Id: id})
+}
+
+func (s *ChatSocket) Typing(usernameOther string) error {
+	return s.write(model.SocketFrame{Type: model.FrameTyping, User: usernameOther})
+}
+
+func (s *ChatSocket) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,135 @@
+package mvc
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"util/model"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+/*
+Mensajes temporales. Cada parte propone un TTL con /expiry y se aplica cuando la otra propone el mismo. El servidor
+pone la caducidad a cada mensaje y borra los pendientes caducados; el cliente los quita del chat y nunca los guarda en
+el archivo ni en el historial del servidor.
+*/
+
+// cada cuánto se quitan del chat abierto los mensajes caducados
+const expiryTick = 10 * time.Second
+
+// expiryMsg trae la configuración de la conversación con username tras pedirla o cambiarla
+type expiryMsg struct {
+	username string
+	expiry   model.Expiry
+}
+
+// expiryTickMsg revisa la caducidad en el chat abierto en page
+type expiryTickMsg struct {
+	page int64
+}
+
+func GetExpiry(user model.User, username string, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		var e model.Expiry
+		if err := doJSON("GET", fmt.Sprintf("https://localhost:10443/chat/%s/expiry", username), user.Name, user.Token, nil, &e, client); err != nil {
+			return fmt.Errorf("error pidiendo los mensajes temporales. %s", err.Error())
+		}
+		return expiryMsg{username, e}
+	}
+}
+
+// SetExpiry propone ttl para la conversación con username, o lo acepta si el otro ya lo había propuesto
+func SetExpiry(user model.User, username string, ttl time.Duration, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		var e model.Expiry
+		if err := doJSON("POST", fmt.Sprintf("https://localhost:10443/chat/%s/expiry", username), user.Name, user.Token, model.Expiry{TTL: ttl}, &e, client); err != nil {
+			return fmt.Errorf("error cambiando los mensajes temporales. %s", err.Error())
+		}
+		return expiryMsg{username, e}
+	}
+}
+
+// pruneExpired quita del chat los mensajes caducados en now y dice si ha quitado alguno
+func pruneExpired(chat *model.Chat, now time.Time) bool {
+	n := len(chat.Messages)
+	chat.Messages = slices.DeleteFunc(chat.Messages, func(m model.Message) bool {
+		return !m.Expires.IsZero() && !m.Expires.After(now)
+	})
+	return len(chat.Messages) != n
+}
+
+// parseTTL admite "off", duraciones de Go (30s, 5m, 1h) y días (7d)
+func parseTTL(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "off" || s == "0" {
+		return 0, nil
+	}
+
+	var ttl time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("duración no válida: %s", s)
+		}
+		ttl = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if ttl, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("duración no válida: %s", s)
+		}
+	}
+
+	if ttl < model.MinExpiryTTL || ttl > model.MaxExpiryTTL {
+		return 0, fmt.Errorf("la duración tiene que estar entre %s y %s", formatTTL(model.MinExpiryTTL), formatTTL(model.MaxExpiryTTL))
+	}
+
+	return ttl, nil
+}
+
+// formatTTL escribe ttl con la unidad más grande que lo divide
+func formatTTL(ttl time.Duration) string {
+	units := []struct {
+		d    time.Duration
+		name string
+	}{{24 * time.Hour, "d"}, {time.Hour, "h"}, {time.Minute, "m"}, {time.Second, "s"}}
+
+	for _, u := range units {
+		if ttl >= u.d && ttl%u.d == 0 {
+			return fmt.Sprintf("%d%s", ttl/u.d, u.name)
+		}
+	}
+	return ttl.String()
+}
+
+// expiryStatus describe para la cabecera del chat los mensajes temporales y la propuesta pendiente
+func expiryStatus(e model.Expiry, username string) string {
+	var s string
+	if e.TTL > 0 {
+		s = fmt.Sprintf("Mensajes temporales: %s\n", formatTTL(e.TTL))
+	}
+
+	if e.ProposedBy == "" {
+		return s
+	}
+
+	proposal := "desactivarlos"
+	if e.Proposed > 0 {
+		proposal = formatTTL(e.Proposed)
+	}
+
+	if e.ProposedBy == username {
+		return s + fmt.Sprintf("@%s propone mensajes temporales: %s. Escribe /expiry %s para aceptar\n", username, proposal, ttlArg(e.Proposed))
+	}
+	return s + fmt.Sprintf("Has propuesto mensajes temporales: %s. Esperando a @%s\n", proposal, username)
+}
+
+func ttlArg(ttl time.Duration) string {
+	if ttl == 0 {
+		return "off"
+	}
+	return formatTTL(ttl)
+}
@@ -0,0 +1,355 @@
+package mvc
+
+import (
+	"client/global"
+	"client/message"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"util"
+	"util/model"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+/*
+Chat cifrado de un grupo. Cada miembro cifra sus mensajes con una sender key AES propia que reparte a los demás
+cifrada con la clave RSA de cada uno. Cuando alguien entra o sale el epoch del grupo cambia, el servidor deja de
+aceptar mensajes con las claves anteriores y al enviar se reparte una nueva solo a los miembros actuales.
+
+Las claves y los mensajes se quedan en el servidor, así que no se guarda nada en local: al abrir el chat se baja todo.
+*/
+
+// cada cuánto se piden los mensajes nuevos mientras el chat está abierto
+const groupPollInterval = 2 * time.Second
+
+func senderKeyId(sender string, epoch int64) string {
+	return fmt.Sprintf("%s/%d", sender, epoch)
+}
+
+// datos adicionales del cifrado: cada mensaje queda ligado a su grupo, emisor y epoch
+func groupAD(group string, sender string, epoch int64) []byte {
+	return []byte(fmt.Sprintf("group:%s/%s/%d", group, sender, epoch))
+}
+
+type GroupChatPage struct {
+	chatLayout
+
+	group    string
+	info     model.GroupInfo
+	keys     map[string][]byte // emisor/epoch -> sender key
+	messages []model.GroupMessage
+	msg      string
+
+	user   model.User
+	client *http.Client
+}
+
+// groupChatMsg trae los mensajes nuevos ya descifrados y, si se han vuelto a pedir, los miembros y las claves
+type groupChatMsg struct {
+	group    string
+	info     *model.GroupInfo
+	keys     map[string][]byte
+	messages []model.GroupMessage
+}
+
+type groupPollMsg struct {
+	group string
+}
+
+func InitialGroupChatPageModel(user model.User, client *http.Client, group string) GroupChatPage {
+	m := GroupChatPage{}
+	m.chatLayout = newChatLayout()
+	m.group = group
+	m.keys = make(map[string][]byte)
+	m.user = user
+	m.client = client
+	return m
+}
+
+// LoadGroupChat baja los miembros, las claves y todos los mensajes del chat del grupo
+func LoadGroupChat(user model.User, group string, client *http.Client) tea.Cmd {
+	return pollGroupChat(user, group, 0, nil, client)
+}
+
+/*
+pollGroupChat baja los mensajes posteriores a after. Con keys a nil, o si alguno es de una clave que aún no se tiene,
+vuelve a pedir los miembros y las sender keys.
+*/
+func pollGroupChat(user model.User, group string, after int64, keys map[string][]byte, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		var msgs []model.GroupMessage
+		url := fmt.Sprintf("https://localhost:10443/groups/%s/messages?after=%d", group, after)
+		if err := doJSON("GET", url, user.Name, user.Token, nil, &msgs, client); err != nil {
+			return fmt.Errorf("error bajando los mensajes del grupo. %s", err.Error())
+		}
+
+		loaded := groupChatMsg{group: group, keys: keys}
+
+		missing := slices.ContainsFunc(msgs, func(m model.GroupMessage) bool {
+			_, ok := keys[senderKeyId(m.Sender, m.Epoch)]
+			return !ok
+		})
+		if keys == nil || missing {
+			info, fetched, err := fetchGroupKeys(user, group, client)
+			if err != nil {
+				return err
+			}
+			loaded.info, loaded.keys = &info, fetched
+		}
+
+		for _, m := range msgs {
+			loaded.messages = append(loaded.messages, openGroupMessage(m, loaded.keys, client))
+		}
+
+		return loaded
+	}
+}
+
+// openGroupMessage comprueba la firma y descifra un mensaje del grupo. Si no se puede descifrar queda constancia
+func openGroupMessage(m model.GroupMessage, keys map[string][]byte, client *http.Client) model.GroupMessage {
+	m.Unverified = !verify(m.Sender, m.SignedData(), m.Signature, client)
+	m.Signature = nil
+
+	key, ok := keys[senderKeyId(m.Sender, m.Epoch)]
+	if !ok {
+		m.Message = "[mensaje no descifrable: sin la clave del emisor]"
+		return m
+	}
+
+	ciphertext, err := util.Decode64(m.Message)
+	if err == nil {
+		var plaintext []byte
+		if plaintext, err = util.DecryptAD(ciphertext, key, groupAD(m.Group, m.Sender, m.Epoch)); err == nil {
+			m.Message = string(plaintext)
+			return m
+		}
+	}
+
+	m.Message = "[mensaje no descifrable: " + err.Error() + "]"
+	return m
+}
+
+/*
+fetchGroupKeys baja los miembros y las sender keys del grupo que se han repartido al usuario, comprobando que las ha
+firmado su emisor. Si el usuario aún no tiene la suya para el epoch actual la reparte.
+*/
+func fetchGroupKeys(user model.User, group string, client *http.Client) (model.GroupInfo, map[string][]byte, error) {
+	privKey := global.GetPrivateKey()
+	if privKey == nil {
+		return model.GroupInfo{}, nil, fmt.Errorf("no hay claves RSA cargadas, no se puede usar el chat del grupo")
+	}
+
+	var info model.GroupInfo
+	if err := doJSON("GET", fmt.Sprintf("https://localhost:10443/groups/%s/members", group), user.Name, user.Token, nil, &info, client); err != nil {
+		return info, nil, fmt.Errorf("error pidiendo los miembros del grupo. %s", err.Error())
+	}
+
+	var senderKeys []model.SenderKey
+	if err := doJSON("GET", fmt.Sprintf("https://localhost:10443/groups/%s/keys", group), user.Name, user.Token, nil, &senderKeys, client); err != nil {
+		return info, nil, fmt.Errorf("error pidiendo las claves del grupo. %s", err.Error())
+	}
+
+	keys := make(map[string][]byte)
+	for _, k := range senderKeys {
+		sealed := k.Keys[user.Name]
+		if !verify(k.Sender, k.SignedData(user.Name), sealed.Signature, client) {
+			// sin firma válida podría ser una clave del servidor para leer lo que se envíe
+			continue
+		}
+
+		key, err := util.DecryptWithRSA(sealed.Key, privKey)
+		if err == nil {
+			keys[senderKeyId(k.Sender, k.Epoch)] = key
+		}
+	}
+
+	if _, ok := keys[senderKeyId(user.Name, info.Epoch)]; !ok {
+		key, err := distributeSenderKey(user, info, client)
+		if err != nil {
+			return info, nil, err
+		}
+		keys[senderKeyId(user.Name, info.Epoch)] = key
+	}
+
+	return info, keys, nil
+}
+
+// distributeSenderKey crea una sender key para el epoch de info y la reparte a sus miembros
+func distributeSenderKey(user model.User, info model.GroupInfo, client *http.Client) ([]byte, error) {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	sk := model.SenderKey{Group: info.Name, Sender: user.Name, Epoch: info.Epoch, Keys: make(map[string]model.SealedKey)}
+
+	for _, member := range info.Members {
+		// con la clave fijada: si el servidor ha cambiado la de algún miembro no se le reparte nada a nadie
+		pubKey, err := getPubKey(member, client)
+		if err != nil {
+			return nil, err
+		}
+
+		sealed, err := util.EncryptWithRSA(key, pubKey)
+		if err != nil {
+			return nil, err
+		}
+		sk.Keys[member] = model.SealedKey{Key: sealed}
+	}
+
+	for member, sealed := range sk.Keys {
+		signature, err := sign(sk.SignedData(member))
+		if err != nil {
+			return nil, err
+		}
+		sealed.Signature = signature
+		sk.Keys[member] = sealed
+	}
+
+	url := fmt.Sprintf("https://localhost:10443/groups/%s/keys", info.Name)
+	if err := doJSON("POST", url, user.Name, user.Token, sk, nil, client); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (m GroupChatPage) Init() tea.Cmd {
+	return nil
+}
+
+func (m GroupChatPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	cmds := m.chatLayout.update(msg)
+
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "left":
+			return InitialHomeModel(m.user, m.client), nil
+		case "ctrl+c":
+			return m, tea.Quit
+		case "enter":
+			text := strings.TrimSpace(m.textbox.Value())
+			if text == "" {
+				break
+			}
+
+			sent, err := m.Send(text)
+			if err != nil {
+				m.msg = err.Error()
+				break
+			}
+
+			m.add([]model.GroupMessage{sent})
+			m.textbox.Reset()
+		}
+	case groupChatMsg:
+		if msg.group != m.group {
+			break
+		}
+
+		if msg.info != nil {
+			m.info = *msg.info
+		}
+		m.keys = msg.keys
+		m.add(msg.messages)
+
+		cmds = append(cmds, message.SendTimedMessage(groupPollMsg{m.group}, groupPollInterval))
+	case groupPollMsg:
+		if msg.group == m.group {
+			cmds = append(cmds, pollGroupChat(m.user, m.group, m.lastId(), m.keys, m.client))
+		}
+	case error:
+		m.msg = fmt.Sprintf("error. %v", msg)
+	}
+
+	return m, tea.Batch(cmds...)
+}
+
+func (m *GroupChatPage) lastId() int64 {
+	var lastId int64
+	for _, msg := range m.messages {
+		lastId = max(lastId, msg.Id)
+	}
+	return lastId
+}
+
+// add añade los mensajes que no estén ya y vuelve a pintar
+func (m *GroupChatPage) add(msgs []model.GroupMessage) {
+	for _, msg := range msgs {
+		if !slices.ContainsFunc(m.messages, func(c model.GroupMessage) bool { return c.Id == msg.Id }) {
+			m.messages = append(m.messages, msg)
+		}
+	}
+
+	var s string
+	for _, msg := range m.messages {
+		style := m.otherStyle
+		if msg.Sender == m.user.Name {
+			style = m.meStyle
+		}
+
+		s += MessageToString(model.Message{Sender: msg.Sender, Message: msg.Message, Timestamp: msg.Timestamp, Unverified: msg.Unverified}, style) + "\n"
+	}
+
+	m.setMessages(s)
+}
+
+/*
+Send cifra text con la sender key del epoch actual y lo envía. Si el servidor responde que el grupo ha cambiado,
+se reparte una clave nueva a los miembros actuales y se vuelve a intentar.
+*/
+func (m *GroupChatPage) Send(text string) (model.GroupMessage, error) {
+	url := fmt.Sprintf("https://localhost:10443/groups/%s/messages", m.group)
+
+	for attempt := 0; ; attempt++ {
+		if key, ok := m.keys[senderKeyId(m.user.Name, m.info.Epoch)]; ok && m.info.Name != "" {
+			body := model.GroupMessage{Group: m.group, Sender: m.user.Name, Epoch: m.info.Epoch}
+			body.Message = util.Encode64(util.EncryptAD([]byte(text), key, groupAD(m.group, m.user.Name, m.info.Epoch)))
+
+			var err error
+			if body.Signature, err = sign(body.SignedData()); err != nil {
+				return body, err
+			}
+
+			var sent model.GroupMessage
+			err = doJSON("POST", url, m.user.Name, m.user.Token, body, &sent, m.client)
+			if err == nil {
+				sent.Message, sent.Signature = text, nil
+				return sent, nil
+			}
+
+			if !errors.Is(err, statusError(http.StatusConflict)) || attempt > 1 {
+				return sent, fmt.Errorf("error enviando el mensaje. %s", err.Error())
+			}
+		}
+
+		info, keys, err := fetchGroupKeys(m.user, m.group, m.client)
+		if err != nil {
+			return model.GroupMessage{}, err
+		}
+		m.info = info
+		for id, key := range keys {
+			m.keys[id] = key
+		}
+	}
+}
+
+func (m GroupChatPage) View() string {
+	header := fmt.Sprintf("Grupo '%s'", m.group)
+	if len(m.info.Members) > 0 {
+		header += fmt.Sprintf(" (%s)", strings.Join(m.info.Members, ", "))
+	}
+
+	s := m.chatLayout.view(header+"\n", "")
+	s += "enter to send, left to go back\n"
+
+	if m.msg != "" {
+		s += fmt.Sprintf("Info: %s\n\n", m.msg)
+	}
+
+	return s
+}
@@ -0,0 +1,190 @@
+package mvc
+
+import (
+	"client/global"
+	"cmp"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"util"
+	"util/model"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+/*
+Historial de los chats en el servidor, para quien lo activa. Cada mensaje ya descifrado se vuelve a cifrar con una
+clave que sale de la clave RSA del usuario, así que cualquier dispositivo con sus claves puede leerlo y el servidor no.
+Al abrir un chat se baja lo que haya a partir del cursor guardado y se suben los mensajes locales que aún no estén.
+*/
+
+// entradas que se piden por página
+const historyPage = 100
+
+// historyKey deriva la clave del historial de la clave RSA, que es lo que comparten los dispositivos del usuario
+func historyKey() ([]byte, error) {
+	privKey := global.GetPrivateKey()
+	if privKey == nil {
+		return nil, fmt.Errorf("no hay claves RSA cargadas, no se puede usar el historial")
+	}
+
+	return util.Hash(append([]byte("historial\n"), x509.MarshalPKCS1PrivateKey(privKey)...)), nil
+}
+
+// cada entrada queda ligada a su conversación y a su mensaje
+func historyAD(username, usernameOther string, id int64) []byte {
+	return []byte(fmt.Sprintf("history:%s/%s/%d", username, usernameOther, id))
+}
+
+// historyMsg trae lo bajado del historial de un chat y los ids de los mensajes locales ya subidos
+type historyMsg struct {
+	username string
+	messages []model.Message
+	seq      int64
+	epoch    int64
+	archived []int64
+}
+
+// historySetMsg confirma que se ha activado o desactivado el historial
+type historySetMsg bool
+
+// SetHistory activa o desactiva el historial en el servidor. Al desactivarlo el servidor lo borra
+func SetHistory(user model.User, enabled bool, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		err := doJSON("POST", "https://localhost:10443/history", user.Name, user.Token, model.HistorySettings{Enabled: enabled}, nil, client)
+		if err != nil {
+			return err
+		}
+		return historySetMsg(enabled)
+	}
+}
+
+/*
+SyncHistory baja las entradas del historial posteriores al cursor del chat y sube los mensajes locales que no estén
+archivados. Si el historial se ha vuelto a activar desde la última vez, se baja y se sube todo de nuevo.
+*/
+func SyncHistory(user model.User, chat model.Chat, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		key, err := historyKey()
+		if err != nil {
+			return err
+		}
+
+		usernameOther := chat.UserB
+		url := fmt.Sprintf("https://localhost:10443/chat/%s/history", usernameOther)
+		synced := historyMsg{username: usernameOther, seq: chat.HistorySeq, epoch: chat.HistoryEpoch}
+
+		for more := true; more; {
+			var page model.HistoryPage
+			if err := doJSON("GET", fmt.Sprintf("%s?after=%d&limit=%d", url, synced.seq, historyPage), user.Name, user.Token, nil, &page, client); err != nil {
+				return fmt.Errorf("error bajando el historial. %s", err.Error())
+			}
+
+			if page.Epoch != synced.epoch {
+				synced = historyMsg{username: usernameOther, epoch: page.Epoch}
+				continue
+			}
+
+			for _, e := range page.Entries {
+				data, err := util.DecryptAD(e.Ciphertext, key, historyAD(user.Name, usernameOther, e.MessageId))
+				if err != nil {
+					// de otra clave RSA o manipulada, no se puede hacer nada con ella
+					continue
+				}
+
+				var m model.Message
+				if err := json.Unmarshal(data, &m); err == nil && m.Id == e.MessageId {
+					m.Archived = true
+					synced.messages = append(synced.messages, m)
+				}
+			}
+
+			synced.seq, more = page.Next, page.More
+		}
+
+		reset := synced.epoch != chat.HistoryEpoch
+		pending := slices.DeleteFunc(slices.Clone(chat.Messages), func(m model.Message) bool {
+			return (m.Archived && !reset) || m.Id <= 0 || !m.Expires.IsZero() || slices.ContainsFunc(synced.messages, func(r model.Message) bool { return r.Id == m.Id })
+		})
+
+		synced.archived, err = uploadHistory(user, usernameOther, key, pending, client)
+		if err != nil {
+			return err
+		}
+
+		return synced
+	}
+}
+
+// PushHistory sube al historial mensajes nuevos del chat
+func PushHistory(user model.User, usernameOther string, msgs []model.Message, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		key, err := historyKey()
+		if err != nil {
+			return err
+		}
+
+		archived, err := uploadHistory(user, usernameOther, key, msgs, client)
+		if err != nil {
+			return err
+		}
+
+		return historyMsg{username: usernameOther, archived: archived}
+	}
+}
+
+func uploadHistory(user model.User, usernameOther string, key []byte, msgs []model.Message, client *http.Client) ([]int64, error) {
+	url := fmt.Sprintf("https://localhost:10443/chat/%s/history", usernameOther)
+	archived := make([]int64, 0, len(msgs))
+
+	for _, m := range msgs {
+		m.Archived = false
+		entry := model.HistoryEntry{
+			MessageId:  m.Id,
+			Ciphertext: util.EncryptAD(util.EncodeJSON(m), key, historyAD(user.Name, usernameOther, m.Id)),
+		}
+
+		if err := doJSON("POST", url, user.Name, user.Token, entry, nil, client); err != nil {
+			return archived, fmt.Errorf("error subiendo el historial. %s", err.Error())
+		}
+		archived = append(archived, m.Id)
+	}
+
+	return archived, nil
+}
+
+// mergeHistory añade al chat los mensajes del historial que no tenga y marca los subidos
+func mergeHistory(chat *model.Chat, h historyMsg) {
+	// lo de un historial anterior ya no está en el servidor
+	if h.epoch != 0 && h.epoch != chat.HistoryEpoch {
+		for i := range chat.Messages {
+			chat.Messages[i].Archived = false
+		}
+		chat.HistoryEpoch, chat.HistorySeq = h.epoch, 0
+	}
+
+	for i, m := range chat.Messages {
+		if slices.Contains(h.archived, m.Id) {
+			chat.Messages[i].Archived = true
+		}
+	}
+
+	added := false
+	for _, m := range h.messages {
+		if !slices.ContainsFunc(chat.Messages, func(c model.Message) bool { return c.Id == m.Id }) {
+			chat.Messages = append(chat.Messages, m)
+			added = true
+		}
+	}
+
+	// el servidor asigna los ids en orden de llegada
+	if added {
+		slices.SortStableFunc(chat.Messages, func(a, b model.Message) int {
+			return cmp.Compare(a.Id, b.Id)
+		})
+	}
+
+	chat.HistorySeq = max(chat.HistorySeq, h.seq)
+}
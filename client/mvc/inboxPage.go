@@ -0,0 +1,136 @@
+package mvc
+
+import (
+	"fmt"
+	"net/http"
+	"util"
+	"util/model"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+type ChatsMsg []model.ChatSummary
+
+// InboxPage lista las conversaciones del usuario con los mensajes sin leer de cada una
+type InboxPage struct {
+	chats    []model.ChatSummary
+	selected int
+	msg      string
+
+	cursorStyle  lipgloss.Style
+	pendingStyle lipgloss.Style
+
+	user   model.User
+	client *http.Client
+}
+
+func InitialInboxPageModel(user model.User, client *http.Client) InboxPage {
+	m := InboxPage{}
+	m.user = user
+	m.client = client
+	m.chats = make([]model.ChatSummary, 0)
+
+	m.cursorStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#000")).Background(lipgloss.Color("#FFF"))
+	m.pendingStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#ff8"))
+
+	return m
+}
+
+func (m InboxPage) Init() tea.Cmd {
+	return nil
+}
+
+func (m InboxPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "left":
+			return InitialHomeModel(m.user, m.client), nil
+		case "ctrl+c":
+			return m, tea.Quit
+		case "down":
+			if m.selected < len(m.chats)-1 {
+				m.selected++
+			}
+		case "up":
+			if m.selected > 0 {
+				m.selected--
+			}
+		case "enter", "right":
+			if len(m.chats) > 0 {
+				other := m.chats[m.selected].User
+				return InitialChatPageModel(m.user, m.client, other),
+					LoadChat(m.user.Name, m.user.Token, other, m.client)
+			}
+		case "ctrl+r":
+			return m, GetChatsMsg(m.user.Name, m.user.Token, m.client)
+		}
+	case ChatsMsg:
+		m.chats = msg
+		m.selected = min(m.selected, max(len(m.chats)-1, 0))
+		m.msg = ""
+	case error:
+		m.msg = fmt.Sprintf("error. %v", msg)
+	}
+
+	return m, nil
+}
+
+func (m InboxPage) View() string {
+	s := "Conversaciones\n\n"
+
+	if len(m.chats) == 0 {
+		s += "Todavía no tienes conversaciones\n"
+	}
+
+	for i, chat := range m.chats {
+		line := fmt.Sprintf("@%s - %s", chat.User, chat.LastActivity.Format("2 Jan 2006 15:04"))
+		if chat.Pending > 0 {
+			line += m.pendingStyle.Render(fmt.Sprintf(" (%d sin leer)", chat.Pending))
+		}
+
+		if i == m.selected {
+			s += m.cursorStyle.Render(line) + "\n"
+		} else {
+			s += line + "\n"
+		}
+	}
+
+	s += "\nenter para abrir el chat, ctrl+r para actualizar\n"
+
+	if m.msg != "" {
+		s += fmt.Sprintf("Info: %s\n\n", m.msg)
+	}
+
+	return s
+}
+
+func GetChatsMsg(username string, token []byte, client *http.Client) func() tea.Msg {
+	return func() tea.Msg {
+		req, err := http.NewRequest("GET", "https://localhost:10443/chats", nil)
+		if err != nil {
+			return err
+		}
+
+		req.Header.Add("Authorization", util.Encode64(token))
+		req.Header.Add("Username", username)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("error conectando con el servidor")
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("status: %v", resp.StatusCode)
+		}
+
+		chats := make([]model.ChatSummary, 0)
+		if err := util.DecodeJSON(resp.Body, &chats); err != nil {
+			return fmt.Errorf("error decodificando JSON")
+		}
+
+		return ChatsMsg(chats)
+	}
+}
@@ -3,10 +3,15 @@ package mvc
 import (
 	"bytes"
 	"client/global"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 	"util"
 	"util/model"
 
@@ -19,6 +24,13 @@ type LoginPage struct {
 	password textinput.Model
 	msg      string
 
+	// segundo paso, si el usuario tiene la verificación en dos pasos
+	code   textinput.Model
+	ticket string
+
+	// el servidor ha pedido esperar hasta entonces por demasiados intentos
+	retryAt time.Time
+
 	client *http.Client
 	cert   bool
 }
@@ -33,6 +45,10 @@ func InitialLoginModel(client *http.Client, cert bool) LoginPage {
 	model.password = textinput.New()
 	model.password.Placeholder = "Password"
 
+	model.code = textinput.New()
+	model.code.Placeholder = "Código de verificación o de recuperación"
+	model.code.CharLimit = 16
+
 	model.client = client
 	model.cert = cert
 
@@ -47,20 +63,22 @@ func (m LoginPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var (
 		passCmd tea.Cmd
 		userCmd tea.Cmd
+		codeCmd tea.Cmd
 	)
 	m.password, passCmd = m.password.Update(msg)
 	m.username, userCmd = m.username.Update(msg)
+	m.code, codeCmd = m.code.Update(msg)
 
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
 		switch msg.String() {
 		case "down":
-			if !m.cert {
+			if !m.cert && m.ticket == "" {
 				m.password.Focus()
 				m.username.Blur()
 			}
 		case "up":
-			if !m.cert {
+			if !m.cert && m.ticket == "" {
 				m.username.Focus()
 				m.password.Blur()
 			}
@@ -69,26 +87,57 @@ func (m LoginPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case "ctrl+c":
 			return m, tea.Quit
 		case "enter":
+			if time.Now().Before(m.retryAt) {
+				return m, nil
+			}
+
 			var (
 				user model.User
 				err  error
 			)
 
-			if !m.cert {
+			switch {
+			case m.ticket != "":
+				user, err = m.LoginTOTP()
+			case !m.cert:
 				user, err = m.Login()
-			} else {
+			default:
 				user, err = m.LoginCert()
 			}
 
-			if err != nil {
+			var pending ticketError
+			var wait waitError
+			if errors.As(err, &wait) {
+				m.retryAt = time.Now().Add(wait.wait)
+				m.msg = err.Error()
+				return m, loginTick()
+			} else if errors.As(err, &pending) {
+				m.ticket = string(pending)
+				m.msg = err.Error()
+				m.username.Blur()
+				m.password.Blur()
+				m.code.Focus()
+				return m, nil
+			} else if err != nil {
+				m.msg = err.Error()
+				m.code.Reset()
+				return m, nil
+			}
+
+			if err := global.LoadContacts(user.Name); err != nil {
 				m.msg = err.Error()
 				return m, nil
 			}
 
-			return InitialHomeModel(user, m.client), nil
+			return InitialHomeModel(user, m.client), PublishPreKeys(user, m.client)
+		}
+	case loginTickMsg:
+		if time.Now().Before(m.retryAt) {
+			return m, loginTick()
 		}
+		m.msg = ""
 	}
-	return m, tea.Batch(passCmd, userCmd)
+	return m, tea.Batch(passCmd, userCmd, codeCmd)
 }
 
 func (m LoginPage) View() string {
@@ -96,14 +145,20 @@ func (m LoginPage) View() string {
 
 	s = "Login\n\n"
 
-	s += m.username.View() + "\n"
-	if !m.cert {
-		s += m.password.View() + "\n"
+	if m.ticket != "" {
+		s += m.code.View() + "\n"
+	} else {
+		s += m.username.View() + "\n"
+		if !m.cert {
+			s += m.password.View() + "\n"
+		}
 	}
 
 	s += "\n"
 
-	if m.msg != "" {
+	if wait := time.Until(m.retryAt); wait > 0 {
+		s += fmt.Sprintf("Info: %s. Puedes volver a intentarlo en %s\n\n", m.msg, wait.Round(time.Second))
+	} else if m.msg != "" {
 		s += "Info: "
 		s += m.msg
 		// charLimit := 100
@@ -123,22 +178,37 @@ func (m LoginPage) Login() (model.User, error) {
 	username := m.username.Value()
 	password := m.password.Value()
 
-	register := model.Credentials{User: strings.TrimSpace(username), Pass: strings.TrimSpace(password)}
+	register := model.Credentials{User: strings.TrimSpace(username), Pass: strings.TrimSpace(password), Device: deviceName()}
 	jsonBody := util.EncodeJSON(register)
 
 	resp, err := m.client.Post("https://localhost:10443/login", "application/json", bytes.NewReader(jsonBody))
 	if err != nil {
 		return model.User{}, fmt.Errorf("error al hacer la peticion")
 	}
+	if err := throttled(resp); err != nil {
+		resp.Body.Close()
+		return model.User{}, err
+	}
 
 	var r = model.RespAuth{}
 	util.DecodeJSON(resp.Body, &r)
 	defer resp.Body.Close()
 
+	if r.Ticket != "" {
+		return model.User{}, ticketError(r.Ticket)
+	}
+
 	if !r.Ok {
 		return model.User{}, fmt.Errorf(r.Msg)
 	}
 
+	global.SetSession(r.User.Name, r.User.Token, r.Refresh)
+
+	// las claves RSA hacen falta para los chats cifrados; si este equipo no las tiene se podrá usar el resto
+	if _, err := os.Stat(fmt.Sprintf("keys/%s.key", r.User.Name)); err == nil {
+		global.LoadKeys(r.User.Name)
+	}
+
 	return r.User, nil
 }
 
@@ -149,6 +219,11 @@ func (m LoginPage) LoginCert() (model.User, error) {
 		return model.User{}, fmt.Errorf("error conectando con el servidor. %s", err.Error())
 	}
 
+	if err := throttled(resp); err != nil {
+		resp.Body.Close()
+		return model.User{}, err
+	}
+
 	if resp.StatusCode == http.StatusNotFound {
 		return model.User{}, fmt.Errorf("usuario no encontrado")
 	}
@@ -171,7 +246,7 @@ func (m LoginPage) LoginCert() (model.User, error) {
 		return model.User{}, fmt.Errorf("error firmando token para el servidor. %s", err.Error())
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://localhost:10443/login/cert?user=%s", m.username.Value()), bytes.NewReader(signature))
+	req, err := http.NewRequest("POST", fmt.Sprintf("https://localhost:10443/login/cert?user=%s&device=%s", m.username.Value(), url.QueryEscape(deviceName())), bytes.NewReader(signature))
 
 	if err != nil {
 		global.ClearKeys()
@@ -192,6 +267,12 @@ func (m LoginPage) LoginCert() (model.User, error) {
 		return model.User{}, fmt.Errorf("error conectando con el servidor. %s", err.Error())
 	}
 
+	if err := throttled(resp); err != nil {
+		resp.Body.Close()
+		global.ClearKeys()
+		return model.User{}, err
+	}
+
 	r := model.RespAuth{}
 	err = util.DecodeJSON(resp.Body, &r)
 
@@ -200,10 +281,91 @@ func (m LoginPage) LoginCert() (model.User, error) {
 		return model.User{}, fmt.Errorf("error decodificando JSON. %s", err.Error())
 	}
 
+	// las claves ya están cargadas para cuando llegue el código
+	if r.Ticket != "" {
+		return model.User{}, ticketError(r.Ticket)
+	}
+
 	if !r.Ok {
 		global.ClearKeys()
 		return model.User{}, fmt.Errorf("%v", r.Msg)
 	}
 
+	global.SetSession(r.User.Name, r.User.Token, r.Refresh)
+	return r.User, nil
+}
+
+// ticketError es la respuesta a un login correcto de un usuario con verificación en dos pasos, que aún no da token
+type ticketError string
+
+func (e ticketError) Error() string {
+	return "introduce el código de la aplicación de autenticación o uno de recuperación"
+}
+
+// LoginTOTP es el segundo paso del login, con el código y el ticket que dio el primero
+func (m LoginPage) LoginTOTP() (model.User, error) {
+	username := strings.TrimSpace(m.username.Value())
+	login := model.TOTPLogin{User: username, Ticket: m.ticket, Code: strings.TrimSpace(m.code.Value())}
+
+	resp, err := m.client.Post("https://localhost:10443/login/totp", "application/json", bytes.NewReader(util.EncodeJSON(login)))
+	if err != nil {
+		return model.User{}, fmt.Errorf("error al hacer la peticion")
+	}
+	if err := throttled(resp); err != nil {
+		resp.Body.Close()
+		return model.User{}, err
+	}
+	defer resp.Body.Close()
+
+	var r = model.RespAuth{}
+	util.DecodeJSON(resp.Body, &r)
+
+	if !r.Ok {
+		return model.User{}, fmt.Errorf(r.Msg)
+	}
+
+	global.SetSession(r.User.Name, r.User.Token, r.Refresh)
+
+	// con certificado las claves ya se cargaron en el primer paso
+	if global.GetPrivateKey() == nil {
+		if _, err := os.Stat(fmt.Sprintf("keys/%s.key", r.User.Name)); err == nil {
+			global.LoadKeys(r.User.Name)
+		}
+	}
+
 	return r.User, nil
 }
+
+// waitError es un 429 o 503 del servidor, que pide esperar antes de volver a intentarlo
+type waitError struct {
+	wait time.Duration
+	busy bool
+}
+
+func (e waitError) Error() string {
+	if e.busy {
+		return "el servidor está ocupado"
+	}
+	return "demasiados intentos"
+}
+
+// throttled devuelve un waitError si resp pide esperar, con lo que diga Retry-After
+func throttled(resp *http.Response) error {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil
+	}
+
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		seconds = 1
+	}
+
+	return waitError{wait: time.Duration(seconds) * time.Second, busy: resp.StatusCode == http.StatusServiceUnavailable}
+}
+
+// loginTickMsg refresca la cuenta atrás mientras toca esperar
+type loginTickMsg struct{}
+
+func loginTick() tea.Cmd {
+	return tea.Tick(time.Second, func(time.Time) tea.Msg { return loginTickMsg{} })
+}
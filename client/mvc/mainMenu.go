@@ -1,6 +1,7 @@
 package mvc
 
 import (
+	"client/global"
 	"fmt"
 	"net/http"
 	"util/model"
@@ -13,6 +14,7 @@ type HomePage struct {
 	options     []string
 	cursor      int
 	cursorStyle lipgloss.Style
+	msg         string
 
 	client *http.Client
 	user   model.User
@@ -35,10 +37,17 @@ func InitialHomeModel(user model.User, client *http.Client) HomePage {
 		m.options = []string{
 			"Posts",
 			"Search user",
+			"Inbox",
 			"Create group",
 			"Join group",
 			"See group posts",
+			"Group chat",
+			"Leave group",
 			"Logout",
+			historyOption(m.user.History),
+			presenceOption(m.user.HidePresence),
+			"Sesiones",
+			twoFactorOption(m.user.TwoFactor),
 		}
 
 		if m.user.Role == model.Admin {
@@ -95,22 +104,71 @@ func (m HomePage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					cmd := GetUserMsg(0, "", m.client)
 					return InitialUserSearchPageModel(m.user, "", m.client), cmd
 				case 2:
-					return InitialAccessGroupModel(m.client, m.user, 1), nil
+					return InitialInboxPageModel(m.user, m.client), GetChatsMsg(m.user.Name, m.user.Token, m.client)
 				case 3:
-					return InitialAccessGroupModel(m.client, m.user, 2), nil
+					return InitialAccessGroupModel(m.client, m.user, 1), nil
 				case 4:
-					return InitialAccessGroupModel(m.client, m.user, 3), nil
+					return InitialAccessGroupModel(m.client, m.user, 2), nil
 				case 5:
-					return InitialHomeModel(model.User{}, m.client), nil
+					return InitialAccessGroupModel(m.client, m.user, 3), nil
 				case 6:
+					return InitialAccessGroupModel(m.client, m.user, 4), nil
+				case 7:
+					return InitialAccessGroupModel(m.client, m.user, 5), nil
+				case 8:
+					// con el token vigente, la sesión se olvida antes de que se envíe
+					user := m.user
+					user.Token = currentToken(user)
+					cmd := Logout(user, m.client)
+					global.ClearKeys()
+					global.ClearSession()
+					return InitialHomeModel(model.User{}, m.client), cmd
+				case 9:
+					return m, SetHistory(m.user, !m.user.History, m.client)
+				case 10:
+					return m, SetPresenceHidden(m.user, !m.user.HidePresence, m.client)
+				case 11:
+					return InitialSessionsPageModel(m.user, m.client), GetSessions(m.user, m.client)
+				case 12:
+					page := InitialTwoFactorModel(m.user, m.client)
+					if m.user.TwoFactor {
+						return page, nil
+					}
+					return page, StartTOTP(m.user, m.client)
+				case 13:
 					return InitialBlockUserModel(m.user, m.client), nil
 				}
 			}
 		}
+	case historySetMsg:
+		m.user.History = bool(msg)
+		m.options[9] = historyOption(m.user.History)
+		if m.user.History {
+			m.msg = "Historial activado: los chats se guardan cifrados en el servidor al abrirlos"
+		} else {
+			m.msg = "Historial desactivado y borrado del servidor"
+		}
+	case presenceSetMsg:
+		m.user.HidePresence = bool(msg)
+		m.options[10] = presenceOption(m.user.HidePresence)
+		if m.user.HidePresence {
+			m.msg = "Presencia oculta: los demás no ven si estás conectado ni cuándo lo estuviste"
+		} else {
+			m.msg = "Presencia visible para los demás"
+		}
+	case error:
+		m.msg = fmt.Sprintf("error. %v", msg)
 	}
 	return m, nil
 }
 
+func historyOption(enabled bool) string {
+	if enabled {
+		return "Desactivar historial en el servidor"
+	}
+	return "Activar historial en el servidor"
+}
+
 func (m HomePage) View() string {
 	var s string
 	if m.user.Name != "" {
@@ -128,5 +186,9 @@ func (m HomePage) View() string {
 
 	s += "\nPresione 'q' o 'ctrl-c' para salir\n\n"
 
+	if m.msg != "" {
+		s += fmt.Sprintf("Info: %s\n\n", m.msg)
+	}
+
 	return s
 }
@@ -0,0 +1,83 @@
+package mvc
+
+import (
+	"encoding/json"
+	"strings"
+	"util"
+	"util/model"
+)
+
+/*
+Edición y borrado de mensajes enviados. Se manda un mensaje cifrado más con el control y cada parte lo aplica a su
+copia del chat. El control se queda en el chat sin mostrarse, así se sabe que ya ha llegado y se puede volver a
+aplicar sobre lo que venga del historial.
+*/
+
+// marca el texto de un mensaje que lleva un control en vez de texto
+const controlPrefix = "\x00control\n"
+
+func encodeControl(c model.MessageControl) string {
+	return controlPrefix + string(util.EncodeJSON(c))
+}
+
+// parseContent interpreta el texto ya descifrado de un mensaje: texto normal, adjunto o control
+func parseContent(m model.Message) model.Message {
+	data, ok := strings.CutPrefix(m.Message, controlPrefix)
+	if !ok {
+		return parseAttachment(m)
+	}
+
+	var c model.MessageControl
+	if err := json.Unmarshal([]byte(data), &c); err != nil || (c.Type != model.ControlEdit && c.Type != model.ControlDelete) {
+		m.Message = "[control no válido]"
+		return m
+	}
+
+	m.Control = &c
+	m.Message = ""
+	return m
+}
+
+/*
+applyControl aplica al chat un control de sender. Solo cambia mensajes del mismo emisor que no estén borrados y los
+adjuntos no se pueden editar. Aplicarlo dos veces no cambia nada.
+*/
+func applyControl(chat *model.Chat, c model.MessageControl, sender string) bool {
+	for i, m := range chat.Messages {
+		if m.Id != c.Ref || m.Sender != sender || m.Control != nil || m.Deleted {
+			continue
+		}
+
+		switch c.Type {
+		case model.ControlEdit:
+			if m.Attachment != nil {
+				return false
+			}
+			chat.Messages[i].Message, chat.Messages[i].Edited = c.Text, true
+		case model.ControlDelete:
+			chat.Messages[i] = model.Message{Id: m.Id, Sender: m.Sender, Timestamp: m.Timestamp, Status: m.Status, Expires: m.Expires, Archived: m.Archived, Deleted: true}
+		}
+		return true
+	}
+
+	return false
+}
+
+// applyControls vuelve a aplicar en orden todos los controles del chat, por ejemplo tras juntarlo con el historial
+func applyControls(chat *model.Chat) {
+	for _, m := range chat.Messages {
+		if m.Control != nil {
+			applyControl(chat, *m.Control, m.Sender)
+		}
+	}
+}
+
+// lastOwnMessage devuelve el último mensaje del usuario que se puede editar o borrar
+func lastOwnMessage(chat model.Chat, username string) (model.Message, bool) {
+	for i := len(chat.Messages) - 1; i >= 0; i-- {
+		if m := chat.Messages[i]; m.Sender == username && m.Control == nil && !m.Deleted && m.Id > 0 {
+			return m, true
+		}
+	}
+	return model.Message{}, false
+}
@@ -10,16 +10,21 @@ import (
 )
 
 type PostModel struct {
-	post       model.Post
-	userStyle  lipgloss.Style
-	groupStyle lipgloss.Style
+	post         model.Post
+	userStyle    lipgloss.Style
+	groupStyle   lipgloss.Style
+	warningStyle lipgloss.Style
 }
 
+// aviso junto a los posts y mensajes cuya firma no se ha podido comprobar
+const unverifiedMark = "⚠ sin verificar"
+
 func InitialPost(post model.Post) PostModel {
 	return PostModel{
-		post:       post,
-		userStyle:  lipgloss.NewStyle().Foreground(lipgloss.Color("#ff8")),
-		groupStyle: lipgloss.NewStyle().Foreground(lipgloss.Color("#45f")),
+		post:         post,
+		userStyle:    lipgloss.NewStyle().Foreground(lipgloss.Color("#ff8")),
+		groupStyle:   lipgloss.NewStyle().Foreground(lipgloss.Color("#45f")),
+		warningStyle: lipgloss.NewStyle().Foreground(lipgloss.Color("#f55")),
 	}
 }
 
@@ -36,6 +41,9 @@ func (m PostModel) View() string {
 	if m.post.Group != "" {
 		s += fmt.Sprintf(" [%s]", m.groupStyle.Render(m.post.Group))
 	}
+	if m.post.Unverified {
+		s += " " + m.warningStyle.Render(unverifiedMark)
+	}
 	s += "\n"
 
 	contentWords := strings.Split(m.post.Content, " ")
@@ -136,6 +136,10 @@ func GetPostsMsg(page int, group, username string, token []byte, client *http.Cl
 
 		json.NewDecoder(res.Body).Decode(&posts)
 
+		for i, post := range posts {
+			posts[i].Unverified = !verify(post.Author, post.SignedData(), post.Signature, client)
+		}
+
 		return posts
 	}
 }
@@ -261,8 +265,15 @@ func (m PostListModel) View() string {
 }
 
 func (m PostListModel) PublishPost() (int, error) {
-	post := model.Post{Content: m.textbox.Value()}
-	postBytes := util.EncodeJSON(post)
+	// el servidor guarda el contenido sin espacios alrededor, la firma tiene que cubrir eso mismo
+	content := strings.TrimSpace(m.textbox.Value())
+
+	signature, err := sign(model.Post{Content: content, Author: m.user.Name, Group: m.group}.SignedData())
+	if err != nil {
+		return -1, err
+	}
+
+	postBytes := util.EncodeJSON(model.PostContent{Content: content, Signature: signature})
 	var url string
 
 	if m.group == "" {
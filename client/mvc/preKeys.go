@@ -0,0 +1,152 @@
+package mvc
+
+import (
+	"bytes"
+	"client/global"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+	"util"
+	"util/model"
+	"util/ratchet"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const (
+	// por debajo de minPreKeys publicadas se suben preKeyBatch nuevas
+	minPreKeys  = 20
+	preKeyBatch = 50
+)
+
+/*
+PublishPreKeys se asegura de que el servidor tenga las prekeys del usuario para que otros puedan empezar chats con él:
+la primera vez publica la identidad y después repone las de un solo uso cuando quedan pocas y sube la prekey firmada
+cuando toca cambiarla. Necesita las claves RSA cargadas para firmar.
+*/
+func PublishPreKeys(user model.User, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		privKey := global.GetPrivateKey()
+		if privKey == nil {
+			return fmt.Errorf("no hay claves RSA cargadas, no se pueden publicar las prekeys")
+		}
+
+		if err := global.LoadIdentity(user.Name); err != nil {
+			return err
+		}
+
+		var status model.PreKeyStatus
+		if err := doJSON("GET", "https://localhost:10443/prekeys", user.Name, user.Token, nil, &status, client); err != nil {
+			return err
+		}
+
+		var bundle model.PreKeyBundle
+		err := global.UpdateIdentity(func(id *ratchet.Identity) (bool, error) {
+			rotated, err := id.RotateSignedPreKey(time.Now())
+			if err != nil {
+				return rotated, err
+			}
+
+			// si solo ha cambiado la prekey firmada el servidor conserva las de un solo uso que tenía
+			n := 0
+			if !bytes.Equal(status.IdentityKey, id.IdentityKey.Public) || status.OneTimePreKeys < minPreKeys {
+				n = preKeyBatch
+			}
+			if n == 0 && status.SignedPreKeyId == id.SignedPreKeyId {
+				return rotated, nil
+			}
+
+			bundle, err = id.Bundle(n)
+			return true, err
+		})
+		if err != nil || bundle.IdentityKey == nil {
+			return err
+		}
+
+		bundle.Signature, err = util.SignRSA(bundle.SignedData(), privKey)
+		if err != nil {
+			return err
+		}
+
+		return doJSON("POST", "https://localhost:10443/prekeys", user.Name, user.Token, bundle, nil, client)
+	}
+}
+
+// fetchPreKeyBundle pide las prekeys de usernameOther y comprueba que las ha firmado su clave RSA
+func fetchPreKeyBundle(username string, token []byte, usernameOther string, client *http.Client) (model.PreKeyBundle, error) {
+	var bundle model.PreKeyBundle
+
+	url := fmt.Sprintf("https://localhost:10443/chat/%s/prekeys", usernameOther)
+	if err := doJSON("GET", url, username, token, nil, &bundle, client); err != nil {
+		return bundle, fmt.Errorf("@%s aún no puede recibir mensajes cifrados. %s", usernameOther, err.Error())
+	}
+
+	if !verify(usernameOther, bundle.SignedData(), bundle.Signature, client) {
+		return bundle, fmt.Errorf("las prekeys de @%s no están firmadas por su clave", usernameOther)
+	}
+
+	return bundle, nil
+}
+
+func fetchPubKey(usernameOther string, client *http.Client) ([]byte, error) {
+	resp, err := client.Get(fmt.Sprintf("https://localhost:10443/chat/%s/pubkey", usernameOther))
+	if err != nil {
+		return nil, fmt.Errorf("error conectando con servidor para conseguir clave publica de %s", usernameOther)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error leyendo body")
+	}
+
+	pubKey, err := util.Decode64(string(body))
+	if err != nil || len(pubKey) == 0 {
+		return nil, fmt.Errorf("error decodificando la clave publica de %s", usernameOther)
+	}
+
+	return pubKey, nil
+}
+
+// statusError es una respuesta del servidor con un status distinto de 200
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("status: %v", int(e))
+}
+
+// doJSON hace una petición autenticada con body en JSON (si no es nil) y decodifica la respuesta en out (si no es nil)
+func doJSON(method string, url string, username string, token []byte, body any, out any, client *http.Client) error {
+	var reader io.Reader = http.NoBody
+	if body != nil {
+		reader = bytes.NewReader(util.EncodeJSON(body))
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Authorization", util.Encode64(token))
+	req.Header.Add("Username", username)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error conectando con el servidor")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp.StatusCode)
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("error decodificando JSON")
+		}
+	}
+
+	return nil
+}
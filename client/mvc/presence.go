@@ -0,0 +1,82 @@
+package mvc
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+	"util/model"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// cada cuánto se vuelve a pedir la presencia del otro en el chat abierto
+const presenceTick = 30 * time.Second
+
+// presenceMsg trae la presencia de un usuario
+type presenceMsg model.Presence
+
+// presenceTickMsg vuelve a pedir la presencia en el chat abierto en page
+type presenceTickMsg struct {
+	page int64
+}
+
+// presenceSetMsg confirma que se ha ocultado o vuelto a mostrar la presencia
+type presenceSetMsg bool
+
+func GetPresence(user model.User, username string, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		var p model.Presence
+		if err := doJSON("GET", fmt.Sprintf("https://localhost:10443/users/%s/presence", username), user.Name, user.Token, nil, &p, client); err != nil {
+			return fmt.Errorf("error pidiendo la presencia de %s. %s", username, err.Error())
+		}
+		return presenceMsg(p)
+	}
+}
+
+// SetPresenceHidden oculta o vuelve a mostrar a los demás si el usuario está conectado y cuándo lo estuvo
+func SetPresenceHidden(user model.User, hidden bool, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		if err := doJSON("POST", "https://localhost:10443/presence", user.Name, user.Token, model.PresenceSettings{Hidden: hidden}, nil, client); err != nil {
+			return err
+		}
+		return presenceSetMsg(hidden)
+	}
+}
+
+// SendTyping avisa por REST de que se está escribiendo a username, cuando no hay websocket. Si falla no pasa nada
+func SendTyping(user model.User, username string, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		doJSON("POST", fmt.Sprintf("https://localhost:10443/chat/%s/typing", username), user.Name, user.Token, nil, nil, client)
+		return nil
+	}
+}
+
+// presenceStatus describe la presencia para la cabecera del chat, vacío si no se sabe o está oculta
+func presenceStatus(p model.Presence, now time.Time) string {
+	switch p.Status {
+	case model.PresenceOnline:
+		return "en línea"
+	case model.PresenceAway:
+		return "ausente"
+	case model.PresenceOffline:
+		return "últ. vez " + formatLastSeen(p.LastSeen, now)
+	}
+	return ""
+}
+
+func formatLastSeen(t time.Time, now time.Time) string {
+	switch d := now.Sub(t); {
+	case d < time.Hour:
+		return fmt.Sprintf("hace %d min", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("hace %d h", int(d.Hours()))
+	}
+	return t.Local().Format("02/01/2006 15:04")
+}
+
+func presenceOption(hidden bool) string {
+	if hidden {
+		return "Mostrar mi presencia"
+	}
+	return "Ocultar mi presencia"
+}
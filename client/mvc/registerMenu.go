@@ -70,8 +70,13 @@ func (m RegisterPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return m, nil
 			}
 
-			// token := []byte("token")
-			return InitialHomeModel(user, m.client), nil
+			if err := global.LoadContacts(user.Name); err != nil {
+				m.msg = err.Error()
+				return m, nil
+			}
+
+			// se ofrece activar la verificación en dos pasos nada más registrarse, con ← se sigue sin ella
+			return InitialTwoFactorModel(user, m.client), tea.Batch(PublishPreKeys(user, m.client), StartTOTP(user, m.client))
 		}
 	}
 	return m, tea.Batch(passCmd, userCmd)
@@ -125,7 +130,7 @@ func (m RegisterPage) Register() (model.User, error) {
 		global.LoadKeys(username)
 	}
 
-	register := model.RegisterCredentials{User: username, Pass: password, PubKey: publicKeyBytes}
+	register := model.RegisterCredentials{User: username, Pass: password, PubKey: publicKeyBytes, Device: deviceName()}
 	jsonBody := util.EncodeJSON(register)
 
 	resp, err := m.client.Post("https://localhost:10443/register", "application/json", bytes.NewReader(jsonBody))
@@ -135,6 +140,12 @@ func (m RegisterPage) Register() (model.User, error) {
 		return model.User{}, fmt.Errorf("error al hacer la peticion. Servidor caído")
 	}
 
+	if err := throttled(resp); err != nil {
+		resp.Body.Close()
+		global.ClearKeys()
+		return model.User{}, fmt.Errorf("%s, vuelve a intentarlo en %s", err.Error(), err.(waitError).wait)
+	}
+
 	var r = model.RespAuth{}
 	util.DecodeJSON(resp.Body, &r)
 	if !r.Ok {
@@ -143,5 +154,6 @@ func (m RegisterPage) Register() (model.User, error) {
 	}
 
 	resp.Body.Close()
+	global.SetSession(r.User.Name, r.User.Token, r.Refresh)
 	return r.User, nil
 }
@@ -0,0 +1,189 @@
+package mvc
+
+import (
+	"bytes"
+	"client/global"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"util"
+	"util/model"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+/*
+SessionTransport pone en cada petición autenticada el token de acceso vigente de la sesión y guarda el que manda el
+servidor en Access-Token cuando está a punto de caducar. Si el servidor responde 401
+porque ha caducado, renueva la sesión con el refresh token y repite la petición una vez; si la sesión se ha cerrado
+desde otro dispositivo el 401 llega tal cual.
+*/
+type SessionTransport struct {
+	Base *http.Transport
+
+	// solo se renueva una vez aunque caduque con varias peticiones en marcha
+	mu sync.Mutex
+}
+
+func (t *SessionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	user := req.Header.Get("Username")
+	token := global.SessionToken(user)
+	if req.Header.Get("Authorization") == "" || token == nil {
+		return t.Base.RoundTrip(req)
+	}
+
+	resp, err := t.Base.RoundTrip(withToken(req, token))
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		renewed(user, resp)
+		return resp, nil
+	}
+
+	// sin GetBody no se puede volver a mandar el cuerpo
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+
+	token, err = t.refresh(user, token)
+	if err != nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	retry := withToken(req, token)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err = t.Base.RoundTrip(retry)
+	if err == nil {
+		renewed(user, resp)
+	}
+	return resp, err
+}
+
+// renewed guarda el token de acceso que el servidor manda renovado en la respuesta
+func renewed(user string, resp *http.Response) {
+	if h := resp.Header.Get("Access-Token"); h != "" {
+		if token, err := util.Decode64(h); err == nil {
+			global.SetSessionToken(user, token)
+		}
+	}
+}
+
+// la petición original no se puede modificar
+func withToken(req *http.Request, token []byte) *http.Request {
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", util.Encode64(token))
+	return r
+}
+
+// refresh renueva la sesión de user tras fallar con used y devuelve el token nuevo
+func (t *SessionTransport) refresh(user string, used []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// otra petición la ha renovado mientras tanto
+	if token := global.SessionToken(user); token != nil && !bytes.Equal(token, used) {
+		return token, nil
+	}
+
+	refresh := global.SessionRefresh(user)
+	if refresh == nil {
+		return nil, fmt.Errorf("no hay sesión abierta")
+	}
+
+	req, err := http.NewRequest("POST", "https://localhost:10443/sessions/refresh", bytes.NewReader(util.EncodeJSON(model.RefreshRequest{User: user, Refresh: refresh})))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp.StatusCode)
+	}
+
+	var tokens model.SessionTokens
+	if err := util.DecodeJSON(resp.Body, &tokens); err != nil {
+		return nil, err
+	}
+
+	global.SetSession(user, tokens.Token, tokens.Refresh)
+	return tokens.Token, nil
+}
+
+// transport devuelve el transporte de client por debajo de SessionTransport
+func transport(client *http.Client) *http.Transport {
+	switch tr := client.Transport.(type) {
+	case *SessionTransport:
+		return tr.Base
+	case *http.Transport:
+		return tr
+	}
+	return nil
+}
+
+// currentToken es el token de acceso vigente de user, que puede haber cambiado desde el login
+func currentToken(user model.User) []byte {
+	if token := global.SessionToken(user.Name); token != nil {
+		return token
+	}
+	return user.Token
+}
+
+// deviceName es el nombre con el que sale esta sesión en la lista de sesiones
+func deviceName() string {
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return "cliente"
+}
+
+// sessionsMsg trae las sesiones abiertas del usuario
+type sessionsMsg []model.SessionInfo
+
+// sessionsRevokedMsg confirma que se han cerrado sesiones
+type sessionsRevokedMsg string
+
+// Logout cierra la sesión en el servidor. Aunque falle, el cliente ya ha olvidado los tokens
+func Logout(user model.User, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		doJSON("POST", "https://localhost:10443/logout", user.Name, user.Token, nil, nil, client)
+		return nil
+	}
+}
+
+func GetSessions(user model.User, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		var sessions []model.SessionInfo
+		if err := doJSON("GET", "https://localhost:10443/sessions", user.Name, user.Token, nil, &sessions, client); err != nil {
+			return fmt.Errorf("error pidiendo las sesiones. %s", err.Error())
+		}
+		return sessionsMsg(sessions)
+	}
+}
+
+// RevokeSession cierra la sesión id. Si id está vacío cierra todas menos la actual
+func RevokeSession(user model.User, id string, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		url, msg := "https://localhost:10443/sessions", "Cerradas las demás sesiones"
+		if id != "" {
+			url, msg = url+"/"+id, "Sesión cerrada"
+		}
+
+		if err := doJSON("DELETE", url, user.Name, user.Token, nil, nil, client); err != nil {
+			return fmt.Errorf("error cerrando sesiones. %s", err.Error())
+		}
+		return sessionsRevokedMsg(msg)
+	}
+}
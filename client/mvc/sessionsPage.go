@@ -0,0 +1,108 @@
+package mvc
+
+import (
+	"fmt"
+	"net/http"
+	"util/model"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// SessionsPage lista los dispositivos con sesión abierta y deja cerrarlas
+type SessionsPage struct {
+	sessions []model.SessionInfo
+	selected int
+	msg      string
+
+	cursorStyle  lipgloss.Style
+	currentStyle lipgloss.Style
+
+	user   model.User
+	client *http.Client
+}
+
+func InitialSessionsPageModel(user model.User, client *http.Client) SessionsPage {
+	m := SessionsPage{}
+	m.user = user
+	m.client = client
+	m.sessions = make([]model.SessionInfo, 0)
+
+	m.cursorStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#000")).Background(lipgloss.Color("#FFF"))
+	m.currentStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#8f8"))
+
+	return m
+}
+
+func (m SessionsPage) Init() tea.Cmd {
+	return nil
+}
+
+func (m SessionsPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "left":
+			return InitialHomeModel(m.user, m.client), nil
+		case "ctrl+c":
+			return m, tea.Quit
+		case "down":
+			if m.selected < len(m.sessions)-1 {
+				m.selected++
+			}
+		case "up":
+			if m.selected > 0 {
+				m.selected--
+			}
+		case "enter":
+			if len(m.sessions) == 0 {
+				break
+			}
+
+			if s := m.sessions[m.selected]; s.Current {
+				m.msg = "Esta es la sesión actual, ciérrala con Logout"
+			} else {
+				return m, RevokeSession(m.user, s.Id, m.client)
+			}
+		case "ctrl+d":
+			return m, RevokeSession(m.user, "", m.client)
+		case "ctrl+r":
+			return m, GetSessions(m.user, m.client)
+		}
+	case sessionsMsg:
+		m.sessions = msg
+		m.selected = min(m.selected, max(len(m.sessions)-1, 0))
+	case sessionsRevokedMsg:
+		m.msg = string(msg)
+		return m, GetSessions(m.user, m.client)
+	case error:
+		m.msg = fmt.Sprintf("error. %v", msg)
+	}
+
+	return m, nil
+}
+
+func (m SessionsPage) View() string {
+	s := "Sesiones abiertas\n\n"
+
+	for i, session := range m.sessions {
+		line := fmt.Sprintf("%s - desde %s, usada %s", session.Device, session.Created.Local().Format("2 Jan 2006 15:04"), session.Seen.Local().Format("2 Jan 2006 15:04"))
+		if session.Current {
+			line += m.currentStyle.Render(" (esta)")
+		}
+
+		if i == m.selected {
+			s += m.cursorStyle.Render(line) + "\n"
+		} else {
+			s += line + "\n"
+		}
+	}
+
+	s += "\nenter cierra la sesión, ctrl+d cierra todas menos esta, ctrl+r para actualizar\n"
+
+	if m.msg != "" {
+		s += fmt.Sprintf("Info: %s\n\n", m.msg)
+	}
+
+	return s
+}
@@ -0,0 +1,123 @@
+package mvc
+
+import (
+	"client/global"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"sync"
+	"util"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// claves públicas RSA ya descargadas y comprobadas contra las fijadas, por usuario
+var pubKeys = struct {
+	sync.Mutex
+	keys map[string]*rsa.PublicKey
+}{keys: make(map[string]*rsa.PublicKey)}
+
+func getPubKey(username string, client *http.Client) (*rsa.PublicKey, error) {
+	pubKeys.Lock()
+	key, ok := pubKeys.keys[username]
+	pubKeys.Unlock()
+
+	if ok {
+		return key, nil
+	}
+
+	return checkPubKey(username, client)
+}
+
+/*
+checkPubKey descarga de nuevo la clave pública de username y la compara con la fijada. Si el servidor devuelve otra se
+saca de la caché, para que no se verifique nada con ninguna de las dos hasta que el usuario la acepte.
+*/
+func checkPubKey(username string, client *http.Client) (*rsa.PublicKey, error) {
+	pubKeyBytes, err := fetchPubKey(username, client)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := global.CheckContactKey(username, pubKeyBytes); err != nil {
+		forgetPubKey(username)
+		if err == global.ErrKeyChanged {
+			return nil, keyChangedError(username)
+		}
+		return nil, err
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(pubKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("la clave publica de %s no es valida", username)
+	}
+
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("la clave publica de %s no es RSA", username)
+	}
+
+	pubKeys.Lock()
+	pubKeys.keys[username] = key
+	pubKeys.Unlock()
+
+	return key, nil
+}
+
+func forgetPubKey(username string) {
+	pubKeys.Lock()
+	delete(pubKeys.keys, username)
+	pubKeys.Unlock()
+}
+
+// keyChangedError avisa de que el servidor ha devuelto otra clave para username
+type keyChangedError string
+
+func (e keyChangedError) Error() string {
+	return fmt.Sprintf("⚠ LA CLAVE DE @%s HA CAMBIADO. No se le enviará nada hasta que compruebes el número de seguridad (ctrl+k)", string(e))
+}
+
+func (e keyChangedError) Unwrap() error {
+	return global.ErrKeyChanged
+}
+
+var keyWarningStyle = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("#f55"))
+
+// contactKeyMsg es el resultado de comprobar la clave de un contacto
+type contactKeyMsg struct {
+	username string
+	err      error
+}
+
+func checkContactKey(username string, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		_, err := checkPubKey(username, client)
+		return contactKeyMsg{username, err}
+	}
+}
+
+// sign firma data con la clave RSA del usuario
+func sign(data []byte) ([]byte, error) {
+	privKey := global.GetPrivateKey()
+	if privKey == nil {
+		return nil, fmt.Errorf("no hay claves RSA cargadas, no se puede firmar")
+	}
+
+	return util.SignRSA(data, privKey)
+}
+
+// verify comprueba que signature es de username. Sin firma, sin clave o con firma incorrecta no se puede verificar
+func verify(username string, data []byte, signature []byte, client *http.Client) bool {
+	if len(signature) == 0 {
+		return false
+	}
+
+	key, err := getPubKey(username, client)
+	if err != nil {
+		return false
+	}
+
+	return util.CheckSignatureRSA(data, signature, key) == nil
+}
@@ -0,0 +1,72 @@
+package mvc
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"util/model"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+/*
+Verificación en dos pasos. Al activarla el servidor da un secreto que se enseña como QR y como URI para la aplicación
+de autenticación, y no se activa hasta confirmarlo con un primer código. Después el login pide un código además de la
+contraseña o el certificado; los códigos de recuperación sirven en su lugar, una vez cada uno.
+*/
+
+// totpEnrollMsg trae el secreto pendiente de confirmar
+type totpEnrollMsg model.TOTPEnrollment
+
+// recoveryCodesMsg confirma que se ha activado y trae los códigos de recuperación
+type recoveryCodesMsg []string
+
+// twoFactorDisabledMsg confirma que se ha desactivado
+type twoFactorDisabledMsg struct{}
+
+func StartTOTP(user model.User, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		var e model.TOTPEnrollment
+		if err := doJSON("POST", "https://localhost:10443/totp", user.Name, user.Token, nil, &e, client); err != nil {
+			return twoFactorError(err)
+		}
+		return totpEnrollMsg(e)
+	}
+}
+
+func ConfirmTOTP(user model.User, code string, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		var r model.RecoveryCodes
+		if err := doJSON("POST", "https://localhost:10443/totp/confirm", user.Name, user.Token, model.TOTPCode{Code: code}, &r, client); err != nil {
+			return twoFactorError(err)
+		}
+		return recoveryCodesMsg(r.Codes)
+	}
+}
+
+// DisableTOTP desactiva la verificación con un código de la aplicación o de recuperación
+func DisableTOTP(user model.User, code string, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		if err := doJSON("DELETE", "https://localhost:10443/totp", user.Name, user.Token, model.TOTPCode{Code: code}, nil, client); err != nil {
+			return twoFactorError(err)
+		}
+		return twoFactorDisabledMsg{}
+	}
+}
+
+func twoFactorError(err error) error {
+	switch {
+	case errors.Is(err, statusError(http.StatusForbidden)):
+		return fmt.Errorf("código incorrecto")
+	case errors.Is(err, statusError(http.StatusConflict)):
+		return fmt.Errorf("la verificación en dos pasos ya estaba activada o desactivada")
+	}
+	return fmt.Errorf("error con la verificación en dos pasos. %s", err.Error())
+}
+
+func twoFactorOption(enabled bool) string {
+	if enabled {
+		return "Desactivar verificación en dos pasos"
+	}
+	return "Activar verificación en dos pasos"
+}
@@ -0,0 +1,127 @@
+package mvc
+
+import (
+	"client/qr"
+	"fmt"
+	"net/http"
+	"strings"
+	"util/model"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// TwoFactorPage activa la verificación en dos pasos enseñando el QR, o la desactiva si ya lo está
+type TwoFactorPage struct {
+	code     textinput.Model
+	enroll   model.TOTPEnrollment
+	qr       string
+	recovery []string
+	msg      string
+
+	user   model.User
+	client *http.Client
+}
+
+// InitialTwoFactorModel abre la página; para activarla hay que mandar también StartTOTP
+func InitialTwoFactorModel(user model.User, client *http.Client) TwoFactorPage {
+	m := TwoFactorPage{}
+	m.user = user
+	m.client = client
+
+	m.code = textinput.New()
+	m.code.Placeholder = "Código"
+	m.code.CharLimit = 16
+	m.code.Focus()
+
+	return m
+}
+
+func (m TwoFactorPage) Init() tea.Cmd {
+	return nil
+}
+
+func (m TwoFactorPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	var cmd tea.Cmd
+	m.code, cmd = m.code.Update(msg)
+
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "left":
+			return InitialHomeModel(m.user, m.client), nil
+		case "ctrl+c":
+			return m, tea.Quit
+		case "enter":
+			if m.recovery != nil {
+				return InitialHomeModel(m.user, m.client), nil
+			}
+
+			code := strings.TrimSpace(m.code.Value())
+			if code == "" {
+				return m, nil
+			}
+			m.code.Reset()
+
+			if m.user.TwoFactor {
+				return m, DisableTOTP(m.user, code, m.client)
+			}
+			if m.enroll.Secret == "" {
+				m.msg = "esperando al servidor"
+				return m, nil
+			}
+			return m, ConfirmTOTP(m.user, code, m.client)
+		}
+	case totpEnrollMsg:
+		m.enroll = model.TOTPEnrollment(msg)
+		if modules, err := qr.Encode(m.enroll.URI); err == nil {
+			m.qr = qr.ASCII(modules)
+		}
+	case recoveryCodesMsg:
+		m.recovery = msg
+		m.user.TwoFactor = true
+		m.msg = ""
+	case twoFactorDisabledMsg:
+		m.user.TwoFactor = false
+		home := InitialHomeModel(m.user, m.client)
+		home.msg = "Verificación en dos pasos desactivada"
+		return home, nil
+	case error:
+		m.msg = msg.Error()
+	}
+
+	return m, cmd
+}
+
+func (m TwoFactorPage) View() string {
+	s := "Verificación en dos pasos\n\n"
+
+	switch {
+	case m.recovery != nil:
+		s += "Activada. Guarda estos códigos de recuperación, cada uno sirve una vez en lugar del código de la aplicación:\n\n"
+		for _, c := range m.recovery {
+			s += "\t" + c + "\n"
+		}
+		s += "\nNo se volverán a enseñar. Enter para continuar\n\n"
+		return s
+	case m.user.TwoFactor:
+		s += "Para desactivarla escribe un código de la aplicación o uno de recuperación\n\n"
+	case m.enroll.Secret == "":
+		s += "Generando el secreto...\n\n"
+	default:
+		s += "Escanea el QR con la aplicación de autenticación o añade la URI a mano:\n\n"
+		s += m.qr + "\n"
+		s += m.enroll.URI + "\n\n"
+		s += fmt.Sprintf("Secreto: %s\n\n", m.enroll.Secret)
+		s += "Escribe el código que da la aplicación para activarla\n\n"
+	}
+
+	s += m.code.View() + "\n\n"
+	s += "Pulsa ← para volver sin cambiar nada\n\n"
+
+	if m.msg != "" {
+		s += "Info: " + m.msg + "\n\n"
+	}
+
+	return s
+}
@@ -4,11 +4,11 @@ import (
 	"bytes"
 	"client/global"
 	"client/message"
+	"context"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"io/fs"
 	"net/http"
 	"os"
 	"slices"
@@ -16,32 +16,181 @@ import (
 	"time"
 	"util"
 	"util/model"
+	"util/ratchet"
 
-	"github.com/charmbracelet/bubbles/textarea"
-	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 )
 
+// datos adicionales del cifrado: los mensajes quedan ligados a emisor y receptor y los chats guardados a su dueño
+func messageAD(sender, receiver string) []byte {
+	return []byte(fmt.Sprintf("%s->%s", sender, receiver))
+}
+
+func chatArchiveAD(username, usernameOther string) []byte {
+	return []byte(fmt.Sprintf("chat:%s/%s", username, usernameOther))
+}
+
+/*
+decryptMessage descifra un mensaje que sender ha enviado a receiver y avanza la sesión del chat. Si el mensaje empieza
+una sesión nueva (el otro ha iniciado el chat o ha perdido la suya) pasa a ser la del chat.
+*/
+func decryptMessage(chat *model.Chat, m model.Message, sender, receiver string) (model.Message, error) {
+	decoded, err := util.Decode64(m.Message)
+	if err != nil {
+		return m, fmt.Errorf("error decodificando")
+	}
+
+	session, err := ratchet.UnmarshalSession(chat.Session)
+	if err != nil {
+		return m, err
+	}
+
+	var plaintext []byte
+	err = global.UpdateIdentity(func(id *ratchet.Identity) (bool, error) {
+		next, out, err := id.Receive(session, decoded, messageAD(sender, receiver))
+		if err != nil {
+			return false, err
+		}
+
+		// una sesión nueva gasta una prekey de un solo uso
+		accepted := next != session
+		session, plaintext = next, out
+		return accepted, nil
+	})
+	if err != nil {
+		return m, fmt.Errorf("error descifrando mensaje de @%s. %s", sender, err.Error())
+	}
+
+	chat.Session = session.Marshal()
+	m.Message = string(plaintext)
+	return parseContent(m), nil
+}
+
+// openMessage comprueba la firma de un mensaje recibido y lo descifra. Un mensaje sin firma válida del emisor se
+// muestra igual, marcado como sin verificar
+func openMessage(chat *model.Chat, m model.Message, sender, receiver string, client *http.Client) (model.Message, error) {
+	unverified := m.Sender != sender || !verify(sender, m.SignedData(receiver), m.Signature, client)
+
+	m, err := decryptMessage(chat, m, sender, receiver)
+
+	// la firma cubre el texto cifrado, con el mensaje ya descifrado no sirve para nada
+	m.Signature = nil
+	m.Unverified = unverified
+	return m, err
+}
+
+// encryptMessage cifra text con la siguiente clave de la sesión. Si aún no hay sesión la empieza con las prekeys
+// que devuelve bundle
+func encryptMessage(chat *model.Chat, text string, sender, receiver string, bundle func() (model.PreKeyBundle, error)) (string, error) {
+	session, err := ratchet.UnmarshalSession(chat.Session)
+	if err != nil {
+		return "", err
+	}
+
+	if session == nil {
+		b, err := bundle()
+		if err != nil {
+			return "", err
+		}
+
+		err = global.UpdateIdentity(func(id *ratchet.Identity) (bool, error) {
+			session, err = ratchet.Initiate(id, b)
+			return false, err
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	ciphertext, err := session.Encrypt([]byte(text), messageAD(sender, receiver))
+	if err != nil {
+		return "", err
+	}
+
+	chat.Session = session.Marshal()
+	return util.Encode64(ciphertext), nil
+}
+
+// undecryptable sustituye el texto de un mensaje que no se ha podido descifrar, para que quede constancia en el chat
+func undecryptable(m model.Message, err error) model.Message {
+	m.Message = fmt.Sprintf("[mensaje no descifrable: %s]", err.Error())
+	return m
+}
+
+// indicadores de entrega de los mensajes propios
+var statusMarks = map[model.DeliveryStatus]string{
+	model.StatusSent:      "✓",
+	model.StatusDelivered: "✓✓",
+	model.StatusRead:      "✓✓ leído",
+}
+
 func MessageToString(m model.Message, senderStyle lipgloss.Style) string {
-	return fmt.Sprintf("%s - %s\n%s\n", senderStyle.Render("@"+m.Sender), m.Timestamp.Format("2 Jan 2006 15:04:05"), m.Message)
+	s := fmt.Sprintf("%s - %s", senderStyle.Render("@"+m.Sender), m.Timestamp.Format("2 Jan 2006 15:04:05"))
+	if mark, ok := statusMarks[m.Status]; ok {
+		s += " " + mark
+	}
+	if m.Unverified {
+		s += " " + unverifiedMark
+	}
+	if m.Edited {
+		s += " (editado)"
+	}
+
+	text := m.Message
+	if m.Deleted {
+		text = "🗑 Mensaje eliminado"
+	}
+
+	return fmt.Sprintf("%s\n%s\n", s, text)
 }
 
 type ChatPage struct {
+	chatLayout
+
 	username    string
 	chat        model.Chat
 	messagesStr string
-	viewport    viewport.Model
-	textbox     textarea.Model
 	msg         string
 
-	meStyle    lipgloss.Style
-	otherStyle lipgloss.Style
-
 	user   model.User
 	client *http.Client
+
+	// mensajes nuevos y avisos de escritura, por websocket si se puede y si no por SSE. Se abre al cargar el chat
+	socket     *ChatSocket
+	events     <-chan tea.Msg
+	stopEvents func()
+
+	typingUntil time.Time
+	lastTyping  time.Time
+
+	// hasta dónde ha recibido y leído el otro lo que le hemos enviado
+	receipt model.Receipt
+
+	// el servidor ha devuelto para el otro una clave distinta de la fijada
+	keyWarning string
+
+	// mensajes temporales de la conversación. page distingue esta página de otras del mismo chat para el tick
+	expiry model.Expiry
+	page   int64
+
+	presence model.Presence
 }
 
+const (
+	// cada cuánto se avisa como mucho de que se está escribiendo y cuánto dura el aviso en pantalla
+	typingInterval = 3 * time.Second
+	typingTimeout  = 5 * time.Second
+)
+
+// vuelve a abrir el stream de events tras cerrarse
+type chatRelistenMsg struct {
+	events <-chan tea.Msg
+}
+
+// fuerza a repintar cuando caduca el aviso de escritura
+type typingExpiredMsg struct{}
+
 var saveKey = make([]byte, 32)
 
 func InitialChatPageModel(user model.User, client *http.Client, username string) ChatPage {
@@ -50,26 +199,14 @@ func InitialChatPageModel(user model.User, client *http.Client, username string)
 	m.user = user
 
 	m.username = username
-	m.viewport = viewport.New(80, 12)
+	m.page = time.Now().UnixNano()
+	m.chatLayout = newChatLayout()
 	m.chat = model.Chat{
 		UserA:    user.Name,
 		UserB:    username,
 		Messages: make([]model.Message, 0),
 	}
 
-	m.textbox = textarea.New()
-	m.textbox.Focus()
-	m.textbox.Placeholder = "Send a message..."
-	m.textbox.Prompt = "┃ "
-	m.textbox.CharLimit = 280
-	m.textbox.ShowLineNumbers = false
-	m.textbox.SetHeight(5)
-	m.textbox.SetWidth(80)
-	m.textbox.FocusedStyle.CursorLine = lipgloss.NewStyle()
-
-	m.meStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#ff8"))
-	m.otherStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#45f"))
-
 	return m
 }
 
@@ -78,19 +215,18 @@ func (m ChatPage) Init() tea.Cmd {
 }
 
 func (m ChatPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
-	cmds := make([]tea.Cmd, 2)
-
-	m.viewport, cmds[0] = m.viewport.Update(msg)
-	m.textbox, cmds[1] = m.textbox.Update(msg)
+	cmds := m.chatLayout.update(msg)
 
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
 		switch msg.String() {
 		case "left":
 			m.SaveChat()
+			m.stopListening()
 			return InitialUserSearchPageModel(m.user, "", m.client), GetUserMsg(0, "", m.client)
 		case "ctrl+c":
 			m.SaveChat()
+			m.stopListening()
 			return m, tea.Quit
 		case "enter":
 			if m.user.Token == nil {
@@ -98,25 +234,82 @@ func (m ChatPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				break
 			}
 
-			if strings.TrimSpace(m.textbox.Value()) == "" {
+			text := strings.TrimSpace(m.textbox.Value())
+			if text == "" {
 				break
 			}
 
-			err := m.Send()
-			if err != nil {
-				m.msg = err.Error()
-			} else {
+			if text == "/attach" || text == "/expiry" || text == "/edit" {
+				m.msg = fmt.Sprintf("Falta el argumento de %s", text)
+				break
+			}
 
-				message := model.Message{Sender: m.user.Name, Message: strings.TrimSpace(m.textbox.Value()), Timestamp: time.Now()}
+			if path, ok := strings.CutPrefix(text, "/attach "); ok {
+				m.msg = "Subiendo adjunto..."
+				m.textbox.Reset()
+				cmds = append(cmds, UploadAttachment(m.user, m.username, strings.TrimSpace(path), m.client))
+				break
+			}
 
-				m.chat.Messages = append(m.chat.Messages, message)
-				m.messagesStr += MessageToString(message, m.meStyle) + "\n"
+			if arg, ok := strings.CutPrefix(text, "/expiry "); ok {
+				ttl, err := parseTTL(arg)
+				if err != nil {
+					m.msg = err.Error()
+					break
+				}
 
-				m.viewport.SetContent(m.messagesStr)
-				m.viewport.GotoBottom()
+				m.textbox.Reset()
+				cmds = append(cmds, SetExpiry(m.user, m.username, ttl, m.client))
+				break
+			}
+
+			if text == "/delete" || strings.HasPrefix(text, "/edit ") {
+				last, ok := lastOwnMessage(m.chat, m.user.Name)
+				if !ok {
+					m.msg = "No hay ningún mensaje tuyo que cambiar"
+					break
+				}
+
+				c := model.MessageControl{Type: model.ControlDelete, Ref: last.Id}
+				if edited, ok := strings.CutPrefix(text, "/edit "); ok {
+					c = model.MessageControl{Type: model.ControlEdit, Ref: last.Id, Text: strings.TrimSpace(edited)}
+				}
+
+				cmd, err := m.send(encodeControl(c))
+				if err != nil {
+					m.msg = err.Error()
+					break
+				}
 
 				m.textbox.Reset()
+				cmds = append(cmds, cmd)
+				if c.Type == model.ControlDelete && last.Attachment != nil {
+					cmds = append(cmds, DeleteAttachment(m.user, last.Attachment.Id, m.client))
+				}
+				break
 			}
+
+			if text == "/save" || strings.HasPrefix(text, "/save ") {
+				a, ok := m.findAttachment(strings.TrimSpace(strings.TrimPrefix(text, "/save")))
+				if !ok {
+					m.msg = "No hay ningún adjunto con ese nombre en el chat"
+					break
+				}
+
+				m.msg = "Bajando adjunto..."
+				m.textbox.Reset()
+				cmds = append(cmds, SaveAttachment(m.user, a, m.client))
+				break
+			}
+
+			cmd, err := m.send(text)
+			if err != nil {
+				m.msg = err.Error()
+				break
+			}
+
+			m.textbox.Reset()
+			cmds = append(cmds, cmd)
 		case "ctrl+s":
 			err := m.SaveChat()
 
@@ -125,317 +318,487 @@ func (m ChatPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			} else {
 				m.msg = "Chat guardado"
 			}
+		case "ctrl+k":
+			m.SaveChat()
+			m.stopListening()
+			return InitialUserPageModel(m.user, m.client, m.username), LoadSafetyNumber(m.username, m.client)
 		case "ctrl+r":
+			m.stopListening()
 			return InitialChatPageModel(m.user, m.client, m.username),
 				LoadChat(m.user.Name, m.user.Token, m.username, m.client)
+		default:
+			if (msg.Type == tea.KeyRunes || msg.Type == tea.KeySpace) && m.stopEvents != nil && time.Since(m.lastTyping) > typingInterval {
+				m.lastTyping = time.Now()
+				if m.socket == nil {
+					cmds = append(cmds, SendTyping(m.user, m.username, m.client))
+					break
+				}
+
+				socket, username := m.socket, m.username
+				cmds = append(cmds, func() tea.Msg {
+					socket.Typing(username)
+					return nil
+				})
+			}
 		}
 	case message.ReceiveMessageMsg:
-		message := model.Message(msg)
+		cmds = append(cmds, WaitChatEvent(m.events))
 
-		m.chat.Messages = append(m.chat.Messages, message)
-		m.messagesStr += MessageToString(message, m.otherStyle) + "\n"
+		// puede llegar repetido si se reconecta antes de que el servidor reciba el ack
+		if slices.ContainsFunc(m.chat.Messages, func(c model.Message) bool { return c.Id == msg.Id }) {
+			break
+		}
 
-		m.viewport.SetContent(m.messagesStr)
+		message, err := openMessage(&m.chat, model.Message(msg), m.username, m.user.Name, m.client)
+		if err != nil {
+			message = undecryptable(message, err)
+		}
+
+		m.chat.Messages = append(m.chat.Messages, message)
+		if message.Control != nil {
+			applyControl(&m.chat, *message.Control, m.username)
+		}
+		m.render()
+		m.persist()
 
 		m.msg = "Recibido mensaje"
+		m.typingUntil = time.Time{}
+		cmds = append(cmds, m.read(message.Id))
+		if m.user.History && message.Expires.IsZero() {
+			cmds = append(cmds, PushHistory(m.user, m.username, []model.Message{message}, m.client))
+		}
+	case message.ExpiryMsg:
+		cmds = append(cmds, WaitChatEvent(m.events))
+		m.expiry = model.Expiry(msg)
+	case expiryMsg:
+		if msg.username == m.username {
+			m.expiry = msg.expiry
+		}
+	case expiryTickMsg:
+		if msg.page != m.page {
+			break
+		}
+
+		if pruneExpired(&m.chat, time.Now()) {
+			m.render()
+			m.persist()
+		}
+		cmds = append(cmds, message.SendTimedMessage(expiryTickMsg{m.page}, expiryTick))
+	case presenceMsg:
+		if msg.User == m.username {
+			m.presence = model.Presence(msg)
+		}
+	case presenceTickMsg:
+		if msg.page == m.page {
+			cmds = append(cmds, GetPresence(m.user, m.username, m.client), message.SendTimedMessage(presenceTickMsg{m.page}, presenceTick))
+		}
+	case message.ReceiptMsg:
+		cmds = append(cmds, WaitChatEvent(m.events))
+		m.applyReceipt(model.Receipt(msg))
+	case receiptsMsg:
+		m.applyReceipt(model.Receipt(msg))
+	case message.TypingMsg:
+		cmds = append(cmds, WaitChatEvent(m.events))
+
+		if string(msg) == m.username {
+			m.typingUntil = time.Now().Add(typingTimeout)
+			cmds = append(cmds, message.SendTimedMessage(typingExpiredMsg{}, typingTimeout))
+		}
+	case chatStreamClosedMsg:
+		// solo si es el stream actual y el chat sigue abierto
+		if msg.events == m.events && m.stopEvents != nil {
+			cmds = append(cmds, message.SendTimedMessage(chatRelistenMsg{msg.events}, time.Second))
+		}
+	case chatRelistenMsg:
+		if msg.events == m.events && m.stopEvents != nil {
+			cmds = append(cmds, m.listen())
+		}
+	case contactKeyMsg:
+		// sin conexión no se sabe, ya se comprobará al enviar
+		if msg.username == m.username && errors.Is(msg.err, global.ErrKeyChanged) {
+			m.keyWarning = msg.err.Error()
+		}
 	case message.ChatMsg:
 		m.chat = model.Chat(msg)
+		m.render()
+		m.persist()
 
-		for _, message := range m.chat.Messages {
-			if message.Sender == m.user.Name {
-				m.messagesStr += MessageToString(message, m.meStyle) + "\n"
-			} else if message.Sender == m.username {
-				m.messagesStr += MessageToString(message, m.otherStyle) + "\n"
-			} else {
-				panic(message)
-			}
+		// m.msg = "Cargado chat"
+
+		cmds = append(cmds, m.listen(), GetReceipts(m.user.Name, m.user.Token, m.username, m.client), checkContactKey(m.username, m.client),
+			GetExpiry(m.user, m.username, m.client), message.SendTimedMessage(expiryTickMsg{m.page}, expiryTick),
+			GetPresence(m.user, m.username, m.client), message.SendTimedMessage(presenceTickMsg{m.page}, presenceTick))
+		if lastId := m.lastReceivedId(); lastId > 0 {
+			cmds = append(cmds, m.read(lastId))
+		}
+		if m.user.History {
+			cmds = append(cmds, SyncHistory(m.user, m.chat, m.client))
+		}
+	case attachmentMsg:
+		if msg.username != m.username {
+			break
 		}
 
-		m.viewport.SetContent(m.messagesStr)
-		m.viewport.GotoBottom()
+		cmd, err := m.send(encodeAttachment(msg.attachment))
+		if err != nil {
+			m.msg = fmt.Sprintf("adjunto subido pero no enviado. %s", err.Error())
+			break
+		}
 
-		// m.msg = "Cargado chat"
+		m.msg = "Adjunto enviado"
+		cmds = append(cmds, cmd)
+	case attachmentSavedMsg:
+		m.msg = fmt.Sprintf("Adjunto guardado en %s", string(msg))
+	case historyMsg:
+		if msg.username == m.username {
+			mergeHistory(&m.chat, msg)
+			applyControls(&m.chat)
+			m.render()
+			m.persist()
+		}
 	case error:
 		m.msg = fmt.Sprintf("error. %v", msg)
 	}
 	return m, tea.Batch(cmds...)
 }
 
-func (m ChatPage) View() string {
-	var s string
+// send envía text y lo añade al chat. Devuelve lo que hay que hacer después, como subirlo al historial
+func (m *ChatPage) send(text string) (tea.Cmd, error) {
+	// la sesión avanza aunque el envío falle
+	defer m.persist()
 
-	s = fmt.Sprintf("Chat with '%s'\n", m.username)
+	id, err := m.Send(text)
+	if errors.Is(err, global.ErrKeyChanged) {
+		m.keyWarning = err.Error()
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	s += "_________________________\n"
-	s += m.viewport.View() + "\n"
-	s += "‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾\n\n"
-	s += m.textbox.View() + "\n"
-	s += "ctrl+s to post\n"
+	message := parseContent(model.Message{Id: id, Sender: m.user.Name, Message: text, Timestamp: time.Now()})
+	message.Status = m.receipt.Status(id)
+	if m.expiry.TTL > 0 {
+		message.Expires = message.Timestamp.Add(m.expiry.TTL)
+	}
 
-	if m.msg != "" {
-		s += fmt.Sprintf("Info: %s\n\n", m.msg)
+	m.chat.Messages = append(m.chat.Messages, message)
+	if message.Control != nil {
+		applyControl(&m.chat, *message.Control, m.user.Name)
 	}
+	m.render()
 
-	return s
+	// los temporales no se guardan en el historial
+	if m.user.History && message.Expires.IsZero() {
+		return PushHistory(m.user, m.username, []model.Message{message}, m.client), nil
+	}
+	return nil, nil
 }
 
-func (m *ChatPage) Send() error {
-	url := fmt.Sprintf("https://localhost:10443/chat/%s/message", m.username)
+// findAttachment devuelve el último adjunto del chat llamado name, o el último si name está vacío
+func (m *ChatPage) findAttachment(name string) (model.Attachment, bool) {
+	for i := len(m.chat.Messages) - 1; i >= 0; i-- {
+		if a := m.chat.Messages[i].Attachment; a != nil && (name == "" || a.Name == name) {
+			return *a, true
+		}
+	}
+	return model.Attachment{}, false
+}
 
-	body := model.Message{Message: util.Encode64(util.Encrypt([]byte(m.textbox.Value()), m.chat.Key)), Sender: m.user.Name}
+// render vuelve a pintar todos los mensajes, con el estado de entrega de los propios
+func (m *ChatPage) render() {
+	m.messagesStr = ""
+	for _, message := range m.chat.Messages {
+		if message.Control != nil {
+			continue
+		}
 
-	bodyBytes := util.EncodeJSON(body)
+		if message.Sender == m.user.Name {
+			m.messagesStr += MessageToString(message, m.meStyle) + "\n"
+		} else if message.Sender == m.username {
+			m.messagesStr += MessageToString(message, m.otherStyle) + "\n"
+		} else {
+			panic(message)
+		}
+	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(bodyBytes))
+	m.setMessages(m.messagesStr)
+}
 
-	if err != nil {
-		return fmt.Errorf("error creando request")
+// applyReceipt actualiza el estado de los mensajes enviados, que nunca retrocede
+func (m *ChatPage) applyReceipt(r model.Receipt) {
+	if r.User != m.username {
+		return
 	}
 
-	req.Header.Add("Authorization", util.Encode64(m.user.Token))
-	req.Header.Add("Username", m.user.Name)
-
-	resp, err := m.client.Do(req)
+	m.receipt.User = r.User
+	m.receipt.Delivered = max(m.receipt.Delivered, r.Delivered)
+	m.receipt.Read = max(m.receipt.Read, r.Read)
 
-	if err != nil {
-		return fmt.Errorf("error conectando con el servidor")
+	for i, message := range m.chat.Messages {
+		if message.Sender == m.user.Name && message.Id > 0 {
+			m.chat.Messages[i].Status = max(message.Status, m.receipt.Status(message.Id))
+		}
 	}
+	m.render()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("error en la peticion %v", resp.StatusCode)
+func (m *ChatPage) lastReceivedId() int64 {
+	var lastId int64
+	for _, message := range m.chat.Messages {
+		if message.Sender == m.username {
+			lastId = max(lastId, message.Id)
+		}
 	}
+	return lastId
+}
 
-	return nil
+// persist guarda el chat cada vez que avanza la sesión: si al reabrirlo se carga una anterior, los mensajes nuevos no
+// se pueden descifrar
+func (m *ChatPage) persist() {
+	if err := m.SaveChat(); err != nil {
+		m.msg = err.Error()
+	}
 }
 
-func writeSaveKey(keyPath string) error {
-	pubKey := global.GetPublicKey()
+// listen abre el stream a partir del último mensaje recibido del otro usuario
+func (m *ChatPage) listen() tea.Cmd {
+	m.stopListening()
 
-	if pubKey == nil {
-		return fmt.Errorf("error. no hay clave publica guardada")
-	}
+	lastId := m.lastReceivedId()
 
-	rand.Read(saveKey)
+	if socket := getChatSocket(m.user, m.client); socket != nil {
+		if events, err := socket.Open(m.username, lastId); err == nil {
+			username := m.username
+			m.socket = socket
+			m.events = events
+			m.stopEvents = func() { socket.Leave(username, events) }
 
-	encKey, err := util.EncryptWithRSA(saveKey, pubKey)
-	if err != nil {
-		return err
+			return WaitChatEvent(m.events)
+		}
 	}
 
-	file, err := os.Create(keyPath)
-	if err != nil {
-		return err
-	}
+	// sin websocket: mensajes por SSE y envíos por REST
+	ctx, cancel := context.WithCancel(context.Background())
+	m.socket = nil
+	m.stopEvents = cancel
+	m.events = ListenChat(ctx, m.user.Name, m.user.Token, m.username, lastId, m.client)
 
-	defer file.Close()
-	file.Write(encKey)
+	return WaitChatEvent(m.events)
+}
 
-	file2, err := os.Create(keyPath + ".pub")
-	if err != nil {
-		return err
+// read marca como leídos los mensajes recibidos hasta id una vez están en pantalla, por el websocket o si no por REST
+func (m *ChatPage) read(id int64) tea.Cmd {
+	if m.socket != nil && m.socket.Read(m.username, id) == nil {
+		return nil
 	}
 
-	defer file2.Close()
-	file2.Write([]byte(fmt.Sprintf("%v", saveKey)))
+	return ReadMessages(m.user.Name, m.user.Token, m.username, id, m.client)
+}
 
-	return nil
+func (m *ChatPage) stopListening() {
+	if m.stopEvents != nil {
+		m.stopEvents()
+		m.stopEvents = nil
+	}
 }
 
-func getSaveKey(keyPath string) error {
-	privKey := global.GetPrivateKey()
-	var err error
+func (m ChatPage) View() string {
+	header := fmt.Sprintf("Chat with '%s'", m.username)
+	if p := presenceStatus(m.presence, time.Now()); p != "" {
+		header += " · " + p
+	}
+	header += "\n" + expiryStatus(m.expiry, m.username)
+	if m.keyWarning != "" {
+		header += keyWarningStyle.Render(m.keyWarning) + "\n"
+	}
 
-	if privKey == nil {
-		return fmt.Errorf("no hay saveKey")
+	var status string
+	if time.Now().Before(m.typingUntil) {
+		status = fmt.Sprintf("@%s está escribiendo...\n", m.username)
 	}
 
-	info, err := os.Stat(keyPath)
-	if err != nil {
-		return err
+	s := m.chatLayout.view(header, status)
+	s += "ctrl+s to post, ctrl+k número de seguridad\n"
+	s += "/attach <ruta> adjunta un archivo, /save [nombre] guarda un adjunto, /expiry <1h|7d|off> mensajes temporales\n"
+	s += "/edit <texto> cambia tu último mensaje, /delete lo borra para los dos\n"
+
+	if m.msg != "" {
+		s += fmt.Sprintf("Info: %s\n\n", m.msg)
 	}
 
-	var encKey []byte = make([]byte, info.Size())
+	return s
+}
 
-	file, err := os.Open(keyPath)
+// Send cifra y envía text y devuelve el id que le ha dado el servidor. Antes comprueba que el servidor
+// siga dando la clave fijada del otro, si no podría haber cambiado también sus prekeys
+func (m *ChatPage) Send(text string) (int64, error) {
+	if _, err := checkPubKey(m.username, m.client); err != nil {
+		return 0, err
+	}
 
+	ciphertext, err := encryptMessage(&m.chat, text, m.user.Name, m.username, func() (model.PreKeyBundle, error) {
+		return fetchPreKeyBundle(m.user.Name, m.user.Token, m.username, m.client)
+	})
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	defer file.Close()
-	file.Read(encKey)
+	body := model.Message{Message: ciphertext, Sender: m.user.Name}
+	if a := parseAttachment(model.Message{Message: text}).Attachment; a != nil {
+		// el servidor no ve el mensaje, el id va aparte para que borre el adjunto si el mensaje caduca
+		body.Blobs = []string{a.Id}
+	}
+	if body.Signature, err = sign(body.SignedData(m.username)); err != nil {
+		return 0, err
+	}
 
-	saveKey, err = util.DecryptWithRSA(encKey, privKey)
-	if err != nil {
-		return fmt.Errorf("clave aes %v\n clave privada %v\n clave encriptada %v", saveKey, privKey, encKey)
+	if m.socket != nil {
+		id, err := m.socket.Send(m.username, body)
+		if err != errSocketClosed {
+			return id, err
+		}
+		// el websocket se ha caído, el mensaje se manda por REST
 	}
 
-	return nil
-}
+	url := fmt.Sprintf("https://localhost:10443/chat/%s/message", m.username)
 
-func SendKey(username string, token []byte, usernameOther string, client *http.Client) ([]byte, error) {
-	resp, err := client.Get(fmt.Sprintf("https://localhost:10443/chat/%s/pubkey", usernameOther))
+	bodyBytes := util.EncodeJSON(body)
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(bodyBytes))
 
 	if err != nil {
-		return nil, fmt.Errorf("error conectando con servidor para conseguir clave publica de %s", usernameOther)
+		return 0, fmt.Errorf("error creando request")
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	req.Header.Add("Authorization", util.Encode64(m.user.Token))
+	req.Header.Add("Username", m.user.Name)
+
+	resp, err := m.client.Do(req)
 
 	if err != nil {
-		return nil, fmt.Errorf("error leyendo body")
+		return 0, fmt.Errorf("error conectando con el servidor")
 	}
+	defer resp.Body.Close()
 
-	pubkeybytes, err := util.Decode64(string(body))
-
-	if err != nil {
-		return nil, fmt.Errorf("error decodificando de base 64")
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("error en la peticion %v", resp.StatusCode)
 	}
 
-	var aeskey = make([]byte, 32)
-	rand.Read(aeskey)
+	var sent model.Message
+	if err := util.DecodeJSON(resp.Body, &sent); err != nil {
+		return 0, fmt.Errorf("error decodificando JSON")
+	}
 
-	pubkey := util.ParsePublicKey(pubkeybytes)
+	return sent.Id, nil
+}
 
-	encryptedKey, err := util.EncryptWithRSA(aeskey, pubkey)
+/*
+writeSaveKey genera una clave nueva para el chat guardado y la escribe en keyPath cifrada con la clave RSA del usuario.
+La clave no se guarda en claro en ningún sitio: el chat lleva el estado del ratchet y con ella se podrían descifrar los
+mensajes que vengan.
+*/
+func writeSaveKey(keyPath string) error {
+	pubKey := global.GetPublicKey()
 
-	if err != nil {
-		return nil, fmt.Errorf("error encriptando la clave aes")
+	if pubKey == nil {
+		return fmt.Errorf("error. no hay clave publica guardada")
 	}
 
-	url := fmt.Sprintf("https://localhost:10443/chat/%s/message", usernameOther)
-
-	bodyReq := make(map[string]string)
-	bodyReq["Message"] = util.Encode64(encryptedKey)
-	_, err = util.Decode64(bodyReq["Message"])
+	rand.Read(saveKey)
 
+	encKey, err := util.EncryptWithRSA(saveKey, pubKey)
 	if err != nil {
-		return nil, fmt.Errorf("decodificando lo que acabas de codificar")
+		return err
 	}
-	bodyBytes := util.EncodeJSON(bodyReq)
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(bodyBytes))
+	if err := writePrivateFile(keyPath, encKey); err != nil {
+		return err
+	}
 
-	if err != nil {
-		return nil, fmt.Errorf("error creando request")
+	// la que dejaban en claro las versiones anteriores ya no sirve
+	if err := os.Remove(keyPath + ".pub"); err != nil && !os.IsNotExist(err) {
+		return err
 	}
+	return nil
+}
 
-	req.Header.Add("Authorization", util.Encode64(token))
-	req.Header.Add("Username", username)
+func getSaveKey(keyPath string) error {
+	privKey := global.GetPrivateKey()
 
-	resp, err = client.Do(req)
+	if privKey == nil {
+		return fmt.Errorf("no hay clave privada cargada")
+	}
 
+	encKey, err := os.ReadFile(keyPath)
 	if err != nil {
-		return nil, fmt.Errorf("error conectando con servidor para enviar clave simetrica a %s", usernameOther)
+		return err
 	}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("status %v", resp.StatusCode)
+	saveKey, err = util.DecryptWithRSA(encKey, privKey)
+	if err != nil {
+		return fmt.Errorf("no se ha podido descifrar la clave del chat guardado")
 	}
 
-	return aeskey, nil
+	return nil
 }
 
+// writePrivateFile escribe data en path solo legible por el usuario, también si el archivo ya existía con otros permisos
+func writePrivateFile(path string, data []byte) error {
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0600)
+}
+
+// LoadChat junta el chat guardado con los mensajes que han llegado mientras no estaba abierto, ya descifrados
 func LoadChat(username string, token []byte, usernameOther string, client *http.Client) func() tea.Msg {
 	return func() tea.Msg {
 		chat := model.Chat{UserA: username, UserB: usernameOther, Messages: make([]model.Message, 0)}
-		unread := make([]model.Message, 0)
-		loadMsg := LoadSavedChat(username, usernameOther)
-		downloadMsg := DownloadUnread(username, token, usernameOther, client)
-
-		// opciones: ambos vacios -> primera vez que nos contactamos username y yo, hay que enviar clave aes con rsa
-		// hay nuevos mensajes pero no chat guardado, primer mensaje debe contener clave aes porque el otro ha iniciado chat
-		// 		habria que ver que hacer si se borra chat manualmente, porque el nuevo mensaje no sera una clave aes
-		// chat cargado pero sin mensajes nuevos -> todo gucci
-		// chat cargado Y nuevos mensajes -> unir mensajes y devolver como message.ChatMsg
-
-		var (
-			prevChat    = false
-			newMessages = false
-		)
-
-		switch loadMsg := loadMsg.(type) {
+
+		if err := global.LoadIdentity(username); err != nil {
+			return err
+		}
+
+		switch loadMsg := LoadSavedChat(username, usernameOther).(type) {
 		case error:
 			return loadMsg
-		case message.FirstChatMsg:
-			prevChat = false
 		case message.ChatMsg:
 			chat = model.Chat(loadMsg)
-			prevChat = true
 		}
 
-		switch downloadMsg := downloadMsg.(type) {
+		var unread []model.Message
+		switch downloadMsg := DownloadUnread(username, token, usernameOther, client).(type) {
 		case error:
-			return loadMsg
+			return downloadMsg
 		case message.UnreadMsg:
 			unread = downloadMsg
 		}
 
-		newMessages = len(unread) != 0
-
-		if !prevChat && !newMessages {
-			aeskey, err := SendKey(username, token, usernameOther, client)
-			if err != nil {
-				return err
-			}
-
-			chat.Key = aeskey
-		} else if prevChat && newMessages {
-			for i, message := range unread {
-				decoded, err := util.Decode64(message.Message)
-
-				if err != nil {
-					return fmt.Errorf("error decodificando")
-				}
-
-				msgBytes, err := util.Decrypt(decoded, chat.Key)
-				if err != nil {
-					return fmt.Errorf("error descifrando con la clave simetrica")
-				}
-				unread[i].Message = string(msgBytes)
-			}
-			chat.Messages = slices.Concat(chat.Messages, unread)
-		} else if newMessages { // chat nuevo iniciado por otro usuario
-			privKey := global.GetPrivateKey()
-			if privKey == nil {
-				return fmt.Errorf("error obteniendo clave privada")
-			}
-
-			decoded, err := util.Decode64(unread[0].Message)
+		// el servidor ya los ha borrado: los que no se puedan descifrar se quedan en el chat con el error
+		for _, msg := range unread {
+			decrypted, err := openMessage(&chat, msg, usernameOther, username, client)
 			if err != nil {
-				return fmt.Errorf("error decodificando mensaje")
+				decrypted = undecryptable(decrypted, err)
 			}
-
-			chat.Key, err = util.DecryptWithRSA(decoded, privKey)
-			if err != nil {
-				return fmt.Errorf("error decodificando mensaje")
+			chat.Messages = append(chat.Messages, decrypted)
+			if decrypted.Control != nil {
+				applyControl(&chat, *decrypted.Control, usernameOther)
 			}
-
-			unread = unread[1:]
-
-			for i, message := range unread {
-				decoded, err := util.Decode64(message.Message)
-
-				if err != nil {
-					return fmt.Errorf("error decodificando")
-				}
-
-				msgBytes, err := util.Decrypt(decoded, chat.Key)
-				if err != nil {
-					return fmt.Errorf("error descifrando con la clave simetrica")
-				}
-				unread[i].Message = string(msgBytes)
-			}
-
-			chat.Messages = unread
 		}
 
+		pruneExpired(&chat, time.Now())
 		return message.ChatMsg(chat)
 	}
 }
 
 func LoadSavedChat(username string, usernameOther string) tea.Msg {
 	chat := model.Chat{}
+
+	// versiones anteriores dejaban la clave del chat en claro al lado
+	if err := os.Remove(fmt.Sprintf("./chats/%s/%s.key.pub", username, usernameOther)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
 	err := getSaveKey(fmt.Sprintf("./chats/%s/%s.key", username, usernameOther))
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -454,7 +817,13 @@ func LoadSavedChat(username string, usernameOther string) tea.Msg {
 		return err
 	}
 
-	chatJson, err := util.Decrypt(chatEnc, saveKey)
+	var chatJson []byte
+	if util.IsEnvelope(chatEnc) {
+		chatJson, err = util.DecryptAD(chatEnc, saveKey, chatArchiveAD(username, usernameOther))
+	} else {
+		// chat guardado antes del cifrado autenticado, al volver a guardarlo queda ya en el formato nuevo
+		chatJson, err = util.DecryptLegacy(chatEnc, saveKey)
+	}
 
 	if err != nil {
 		return err
@@ -496,7 +865,10 @@ func DownloadUnread(username string, token []byte, usernameOther string, client
 	return message.UnreadMsg(body)
 }
 
+// SaveChat guarda el chat cifrado, sin los mensajes que ya han caducado
 func (m *ChatPage) SaveChat() error {
+	pruneExpired(&m.chat, time.Now())
+
 	chatJson, err := json.Marshal(m.chat)
 
 	if err != nil {
@@ -504,39 +876,17 @@ func (m *ChatPage) SaveChat() error {
 	}
 
 	chatsPath := fmt.Sprintf("./chats/%s", m.user.Name)
-	if _, err := os.Stat(chatsPath); os.IsNotExist(err) {
-		err = os.Mkdir(chatsPath, fs.ModePerm)
-
-		if err != nil {
-			dir, _ := os.Getwd()
-			return fmt.Errorf("error creando carpeta %s desde %s", chatsPath, dir)
-		}
-	}
-
-	err = writeSaveKey(fmt.Sprintf("./chats/%s/%s.key", m.user.Name, m.username))
-	if err != nil {
-		return err
+	if err := os.MkdirAll(chatsPath, 0700); err != nil {
+		dir, _ := os.Getwd()
+		return fmt.Errorf("error creando carpeta %s desde %s", chatsPath, dir)
 	}
 
-	chatEnc := util.Encrypt(chatJson, saveKey)
-
-	file, err := os.Create(fmt.Sprintf("%s/%s.enc", chatsPath, m.username))
-
+	err = writeSaveKey(fmt.Sprintf("%s/%s.key", chatsPath, m.username))
 	if err != nil {
 		return err
 	}
 
-	defer file.Close()
-
-	_, err = file.Write(chatEnc)
+	chatEnc := util.EncryptAD(chatJson, saveKey, chatArchiveAD(m.user.Name, m.username))
 
-	if err != nil {
-		return err
-	}
-
-	file, _ = os.Create(fmt.Sprintf("%s/%s.json", chatsPath, m.username))
-	defer file.Close()
-	file.Write(chatJson)
-
-	return nil
+	return writePrivateFile(fmt.Sprintf("%s/%s.enc", chatsPath, m.username), chatEnc)
 }
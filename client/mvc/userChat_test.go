@@ -0,0 +1,80 @@
+package mvc
+
+import (
+	"bytes"
+	"client/global"
+	"client/message"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"util/model"
+)
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// el chat guardado lleva el estado del ratchet: sin la clave privada RSA no se puede leer nada de lo que queda en disco
+func TestSavedChatNeedsPrivateKey(t *testing.T) {
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		global.ClearKeys()
+	})
+
+	key := newRSAKey(t)
+	global.SetPriv(key)
+	global.SetPub(&key.PublicKey)
+
+	// de una versión anterior, con la clave en claro
+	os.MkdirAll("chats/alice", 0700)
+	os.WriteFile("chats/alice/bob.key.pub", []byte("clave"), 0644)
+
+	m := InitialChatPageModel(model.User{Name: "alice"}, nil, "bob")
+	m.chat.Session = []byte("estado del ratchet")
+	m.chat.Messages = append(m.chat.Messages, model.Message{Sender: "alice", Message: "hola", Timestamp: time.Now()})
+	if err := m.SaveChat(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := os.ReadDir("chats/alice")
+	for _, e := range entries {
+		path := filepath.Join("chats/alice", e.Name())
+		if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+			t.Errorf("%s con permisos %v", path, info.Mode().Perm())
+		}
+		if data, _ := os.ReadFile(path); bytes.Contains(data, saveKey) || bytes.Contains(data, []byte("ratchet")) {
+			t.Errorf("%s tiene la clave o el chat en claro", path)
+		}
+	}
+
+	if _, err := os.Stat("chats/alice/bob.key.pub"); !os.IsNotExist(err) {
+		t.Error("la clave en claro no se ha borrado al guardar el chat")
+	}
+
+	// y al cargarlo
+	os.WriteFile("chats/alice/bob.key.pub", []byte("clave"), 0644)
+	chat, ok := LoadSavedChat("alice", "bob").(message.ChatMsg)
+	if !ok || len(chat.Messages) != 1 || string(chat.Session) != "estado del ratchet" {
+		t.Fatalf("chat cargado %+v", chat)
+	}
+	if _, err := os.Stat("chats/alice/bob.key.pub"); !os.IsNotExist(err) {
+		t.Error("la clave en claro no se ha borrado al cargar el chat")
+	}
+
+	// con otra clave privada no se descifra la del chat
+	global.SetPriv(newRSAKey(t))
+	if _, ok := LoadSavedChat("alice", "bob").(error); !ok {
+		t.Fatal("chat cargado con otra clave privada")
+	}
+}
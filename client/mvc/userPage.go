@@ -1,19 +1,43 @@
 package mvc
 
 import (
+	"client/global"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"util"
 	"util/model"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
 
+/*
+UserPage muestra la huella de la clave de un usuario y el número de seguridad de la conversación con él. Si los dos
+lo comparan por otro canal y coincide, el servidor no les ha cambiado las claves; entonces se puede marcar como
+verificada, o aceptar la nueva si ha cambiado.
+*/
 type UserPage struct {
 	username string
 
+	// clave que da ahora el servidor y la fijada, que solo son distintas si ha cambiado
+	pubKey  []byte
+	contact global.Contact
+	loaded  bool
+	msg     string
+
 	user   model.User
 	client *http.Client
 }
 
+// safetyMsg trae la clave actual de un usuario y la fijada para él
+type safetyMsg struct {
+	username string
+	pubKey   []byte
+	contact  global.Contact
+}
+
 func InitialUserPageModel(user model.User, client *http.Client, username string) UserPage {
 	model := UserPage{}
 	model.client = client
@@ -22,6 +46,23 @@ func InitialUserPageModel(user model.User, client *http.Client, username string)
 	return model
 }
 
+// LoadSafetyNumber descarga la clave de username, fijándola si aún no lo estaba
+func LoadSafetyNumber(username string, client *http.Client) tea.Cmd {
+	return func() tea.Msg {
+		pubKey, err := fetchPubKey(username, client)
+		if err != nil {
+			return err
+		}
+
+		if err := global.CheckContactKey(username, pubKey); err != nil && !errors.Is(err, global.ErrKeyChanged) {
+			return err
+		}
+
+		contact, _ := global.GetContact(username)
+		return safetyMsg{username, pubKey, contact}
+	}
+}
+
 func (m UserPage) Init() tea.Cmd {
 	return nil
 }
@@ -31,15 +72,88 @@ func (m UserPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case tea.KeyMsg:
 		switch msg.String() {
 		case "left":
-			return InitialHomeModel(m.user, m.client), nil
+			return InitialUserSearchPageModel(m.user, "", m.client), GetUserMsg(0, "", m.client)
 		case "ctrl+c":
 			return m, tea.Quit
+		case "m":
+			if m.user.Token != nil {
+				return InitialChatPageModel(m.user, m.client, m.username),
+					LoadChat(m.user.Name, m.user.Token, m.username, m.client)
+			}
+		case "v":
+			if !m.loaded {
+				break
+			}
+
+			if err := global.TrustContactKey(m.username, m.pubKey); err != nil {
+				m.msg = err.Error()
+				break
+			}
+
+			// lo que se verificó con la clave anterior ya no vale
+			forgetPubKey(m.username)
+			m.contact = global.Contact{PubKey: m.pubKey, Verified: true}
+			m.msg = "Clave marcada como verificada"
+		}
+	case safetyMsg:
+		if msg.username == m.username {
+			m.pubKey, m.contact, m.loaded = msg.pubKey, msg.contact, true
 		}
+	case error:
+		m.msg = fmt.Sprintf("error. %v", msg)
 	}
 	return m, nil
 }
 
+func (m UserPage) changed() bool {
+	return m.contact.PubKey != nil && string(m.contact.PubKey) != string(m.pubKey)
+}
+
 func (m UserPage) View() string {
-	var s string
+	s := fmt.Sprintf("Usuario @%s\n\n", m.username)
+
+	if !m.loaded {
+		s += "Cargando clave...\n\n"
+	} else {
+		if m.changed() {
+			s += keyWarningStyle.Render(fmt.Sprintf("⚠ LA CLAVE DE @%s HA CAMBIADO", m.username)) + "\n"
+			s += fmt.Sprintf("Puede que haya cambiado de dispositivo, o que alguien se esté haciendo pasar por @%s.\n", m.username)
+			s += "No se le enviará nada hasta que aceptes la nueva.\n\n"
+			s += fmt.Sprintf("Clave anterior:  %s\n", util.Fingerprint(m.contact.PubKey))
+		}
+		s += fmt.Sprintf("Clave de @%s: %s\n", m.username, util.Fingerprint(m.pubKey))
+
+		myKey, err := x509.MarshalPKIXPublicKey(global.GetPublicKey())
+		if global.GetPublicKey() == nil || err != nil {
+			s += "\nSin tus claves cargadas no se puede calcular el número de seguridad\n\n"
+		} else {
+			s += fmt.Sprintf("Tu clave:        %s\n\n", util.Fingerprint(myKey))
+
+			s += "Número de seguridad:\n"
+			groups := strings.Fields(util.SafetyNumber(m.user.Name, myKey, m.username, m.pubKey))
+			for i := 0; i < len(groups); i += 4 {
+				s += "    " + strings.Join(groups[i:min(i+4, len(groups))], " ") + "\n"
+			}
+			s += fmt.Sprintf("Compáralo con @%s en persona o por otro canal. Si coincide, nadie ha cambiado vuestras claves.\n\n", m.username)
+		}
+
+		switch {
+		case m.changed():
+			s += "Estado: " + keyWarningStyle.Render("cambiada") + "\n\n"
+			s += "'v' to accept the new key, "
+		case m.contact.Verified:
+			s += "Estado: verificada\n\n"
+		default:
+			s += "Estado: sin verificar\n\n"
+			s += "'v' to mark as verified, "
+		}
+	}
+
+	s += "'m' to message user\n\n"
+
+	if m.msg != "" {
+		s += fmt.Sprintf("Info: %s\n\n", m.msg)
+	}
+
 	return s
 }
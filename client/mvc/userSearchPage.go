@@ -114,9 +114,11 @@ func (m UserSearchPage) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			if m.onSearchBtn {
 				return InitialUserSearchPageModel(m.user, m.searchBar.Value(), m.client), GetUserMsg(0, m.searchBar.Value(), m.client)
 			}
-		// else {
-		// // Entrar pagina usu
-		// }
+
+			if m.user.Token != nil && m.selectedUser >= 0 && m.usernames[m.selectedUser] != m.user.Name {
+				return InitialUserPageModel(m.user, m.client, m.usernames[m.selectedUser]),
+					LoadSafetyNumber(m.usernames[m.selectedUser], m.client)
+			}
 		case "ctrl+r":
 			cmd := GetUserMsg(0, "", m.client)
 			return InitialUserSearchPageModel(m.user, "", m.client), cmd
@@ -202,7 +204,7 @@ func (m UserSearchPage) View() string {
 
 	s += "‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾‾\n\n"
 	s += "ctrl+r to refresh\n"
-	s += "'m' to message user\n\n"
+	s += "'m' to message user, enter to check their key\n\n"
 
 	if m.msg != "" {
 		s += fmt.Sprintf("Info: %v\n\n", m.msg)
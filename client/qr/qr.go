@@ -0,0 +1,455 @@
+/*
+Códigos QR para enseñar en el terminal la URI de la verificación en dos pasos. Solo lo necesario para eso: modo byte,
+corrección de errores L y versiones de la 1 a la 9, que caben hasta 230 bytes.
+*/
+package qr
+
+import (
+	"fmt"
+	"strings"
+)
+
+type version struct {
+	blocks []int // codewords de datos de cada bloque
+	ec     int   // codewords de corrección por bloque
+	align  []int // centros de los patrones de alineamiento
+}
+
+// nivel L
+var versions = []version{
+	{[]int{19}, 7, nil},
+	{[]int{34}, 10, []int{6, 18}},
+	{[]int{55}, 15, []int{6, 22}},
+	{[]int{80}, 20, []int{6, 26}},
+	{[]int{108}, 26, []int{6, 30}},
+	{[]int{68, 68}, 18, []int{6, 34}},
+	{[]int{78, 78}, 20, []int{6, 22, 38}},
+	{[]int{97, 97}, 24, []int{6, 24, 42}},
+	{[]int{116, 116}, 30, []int{6, 26, 46}},
+}
+
+// Encode devuelve los módulos del QR de data, true los oscuros
+func Encode(data string) ([][]bool, error) {
+	for i, v := range versions {
+		capacity := 0
+		for _, n := range v.blocks {
+			capacity += n
+		}
+
+		// modo (4 bits) y longitud (8 bits)
+		if 12+8*len(data) <= 8*capacity {
+			return build(i+1, v, codewords(v, encodeData(data, capacity)))
+		}
+	}
+
+	return nil, fmt.Errorf("demasiado largo para un QR: %d bytes", len(data))
+}
+
+func encodeData(data string, capacity int) []byte {
+	var bits bitBuffer
+	bits.append(0b0100, 4)
+	bits.append(len(data), 8)
+	for i := 0; i < len(data); i++ {
+		bits.append(int(data[i]), 8)
+	}
+
+	bits.append(0, min(4, 8*capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+
+	out := bits.bytes()
+	for pad := byte(0xec); len(out) < capacity; pad ^= 0xec ^ 0x11 {
+		out = append(out, pad)
+	}
+	return out
+}
+
+// codewords parte data en bloques, calcula su corrección y los intercala
+func codewords(v version, data []byte) []byte {
+	gen := generator(v.ec)
+
+	blocks := make([][]byte, len(v.blocks))
+	ecs := make([][]byte, len(v.blocks))
+	for i, n := range v.blocks {
+		blocks[i], data = data[:n], data[n:]
+		ecs[i] = remainder(blocks[i], gen)
+	}
+
+	var out []byte
+	for i := 0; i < v.blocks[len(v.blocks)-1]; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < v.ec; i++ {
+		for _, ec := range ecs {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+type matrix struct {
+	size     int
+	modules  [][]bool
+	function [][]bool // patrones fijos, que no llevan datos ni máscara
+}
+
+func build(n int, v version, data []byte) ([][]bool, error) {
+	m := newMatrix(17 + 4*n)
+	m.drawFunctions(n, v)
+	m.drawData(data)
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c := m.clone()
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+	}
+
+	m.applyMask(best)
+	m.drawFormat(best)
+	return m.modules, nil
+}
+
+func newMatrix(size int) *matrix {
+	m := &matrix{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for i := range m.modules {
+		m.modules[i] = make([]bool, size)
+		m.function[i] = make([]bool, size)
+	}
+	return m
+}
+
+func (m *matrix) clone() *matrix {
+	c := newMatrix(m.size)
+	for i := range m.modules {
+		copy(c.modules[i], m.modules[i])
+		copy(c.function[i], m.function[i])
+	}
+	return c
+}
+
+func (m *matrix) set(row, col int, dark bool) {
+	m.modules[row][col] = dark
+	m.function[row][col] = true
+}
+
+func (m *matrix) drawFunctions(n int, v version) {
+	for i := 0; i < m.size; i++ {
+		m.set(6, i, i%2 == 0)
+		m.set(i, 6, i%2 == 0)
+	}
+
+	// buscadores con su separador
+	for _, c := range [][2]int{{3, 3}, {m.size - 4, 3}, {3, m.size - 4}} {
+		for dr := -4; dr <= 4; dr++ {
+			for dc := -4; dc <= 4; dc++ {
+				r, col := c[0]+dr, c[1]+dc
+				if r < 0 || r >= m.size || col < 0 || col >= m.size {
+					continue
+				}
+				d := max(abs(dr), abs(dc))
+				m.set(r, col, d != 2 && d != 4)
+			}
+		}
+	}
+
+	// los alineamientos que caerían sobre un buscador no se ponen
+	last := len(v.align) - 1
+	for i, r := range v.align {
+		for j, c := range v.align {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dr := -2; dr <= 2; dr++ {
+				for dc := -2; dc <= 2; dc++ {
+					m.set(r+dr, c+dc, max(abs(dr), abs(dc)) != 1)
+				}
+			}
+		}
+	}
+
+	// se reserva el sitio del formato, que depende de la máscara
+	m.drawFormat(0)
+
+	if n >= 7 {
+		rem := n
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+		}
+		bits := n<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>i)&1 == 1
+			a, b := m.size-11+i%3, i/3
+			m.set(b, a, dark)
+			m.set(a, b, dark)
+		}
+	}
+}
+
+// drawFormat pone el nivel de corrección (L) y la máscara, con su BCH, en sus dos copias
+func (m *matrix) drawFormat(mask int) {
+	data := 0b01<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		m.set(i, 8, bit(i))
+	}
+	m.set(7, 8, bit(6))
+	m.set(8, 8, bit(7))
+	m.set(8, 7, bit(8))
+	for i := 9; i < 15; i++ {
+		m.set(8, 14-i, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		m.set(8, m.size-1-i, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		m.set(m.size-15+i, 8, bit(i))
+	}
+	m.set(m.size-8, 8, true)
+}
+
+// drawData coloca los codewords en zigzag por parejas de columnas, de abajo a la derecha hacia arriba
+func (m *matrix) drawData(data []byte) {
+	i := 0
+	for right := m.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+
+		for vert := 0; vert < m.size; vert++ {
+			row := vert
+			if upward {
+				row = m.size - 1 - vert
+			}
+
+			for j := 0; j < 2; j++ {
+				col := right - j
+				if m.function[row][col] || i >= 8*len(data) {
+					continue
+				}
+				m.modules[row][col] = (data[i/8]>>(7-i%8))&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+func (m *matrix) applyMask(mask int) {
+	for r := 0; r < m.size; r++ {
+		for c := 0; c < m.size; c++ {
+			if m.function[r][c] {
+				continue
+			}
+
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (r+c)%2 == 0
+			case 1:
+				invert = r%2 == 0
+			case 2:
+				invert = c%3 == 0
+			case 3:
+				invert = (r+c)%3 == 0
+			case 4:
+				invert = (r/2+c/3)%2 == 0
+			case 5:
+				invert = r*c%2+r*c%3 == 0
+			case 6:
+				invert = (r*c%2+r*c%3)%2 == 0
+			case 7:
+				invert = ((r+c)%2+r*c%3)%2 == 0
+			}
+			m.modules[r][c] = m.modules[r][c] != invert
+		}
+	}
+}
+
+// penalty puntúa el resultado de una máscara según las cuatro reglas del estándar, gana la más baja
+func (m *matrix) penalty() int {
+	p := 0
+	at := func(r, c int, transposed bool) bool {
+		if transposed {
+			return m.modules[c][r]
+		}
+		return m.modules[r][c]
+	}
+
+	finder := []bool{true, false, true, true, true, false, true}
+	for _, t := range []bool{false, true} {
+		for r := 0; r < m.size; r++ {
+			run := 1
+			for c := 1; c <= m.size; c++ {
+				if c < m.size && at(r, c, t) == at(r, c-1, t) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					p += 3 + run - 5
+				}
+				run = 1
+			}
+
+			// 1:1:3:1:1 con cuatro claros a un lado
+			for c := 0; c+7 <= m.size; c++ {
+				match := true
+				for k, dark := range finder {
+					if at(r, c+k, t) != dark {
+						match = false
+						break
+					}
+				}
+				if match && (m.light(r, c-4, c, t) || m.light(r, c+7, c+11, t)) {
+					p += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for r := 0; r < m.size; r++ {
+		for c := 0; c < m.size; c++ {
+			if m.modules[r][c] {
+				dark++
+			}
+			if r+1 < m.size && c+1 < m.size {
+				v := m.modules[r][c]
+				if m.modules[r+1][c] == v && m.modules[r][c+1] == v && m.modules[r+1][c+1] == v {
+					p += 3
+				}
+			}
+		}
+	}
+
+	percent := dark * 100 / (m.size * m.size)
+	p += abs(percent-50) / 5 * 10
+
+	return p
+}
+
+// light dice si los módulos de from a to (sin incluir) de la fila r son claros; fuera del código cuentan como claros
+func (m *matrix) light(r, from, to int, transposed bool) bool {
+	for c := from; c < to; c++ {
+		if c < 0 || c >= m.size {
+			continue
+		}
+		if (transposed && m.modules[c][r]) || (!transposed && m.modules[r][c]) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ASCII dibuja el QR con medios bloques, dos filas de módulos por línea y un margen de dos módulos. Los módulos claros
+son los que se pintan, así se lee bien en un terminal con fondo oscuro.
+*/
+func ASCII(modules [][]bool) string {
+	const quiet = 2
+	size := len(modules)
+
+	light := func(r, c int) bool {
+		r, c = r-quiet, c-quiet
+		return r < 0 || c < 0 || r >= size || c >= size || !modules[r][c]
+	}
+
+	var sb strings.Builder
+	for r := 0; r < size+2*quiet; r += 2 {
+		for c := 0; c < size+2*quiet; c++ {
+			top, bottom := light(r, c), r+1 < size+2*quiet && light(r+1, c)
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+type bitBuffer []bool
+
+func (b *bitBuffer) append(v int, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (v>>i)&1 == 1)
+	}
+}
+
+func (b bitBuffer) bytes() []byte {
+	out := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			out[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	return out
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// generator devuelve los coeficientes del polinomio generador de Reed-Solomon de grado degree, sin el de mayor grado
+func generator(degree int) []byte {
+	gen := make([]byte, degree)
+	gen[degree-1] = 1
+
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range gen {
+			gen[j] = multiply(gen[j], root)
+			if j+1 < len(gen) {
+				gen[j] ^= gen[j+1]
+			}
+		}
+		root = multiply(root, 0x02)
+	}
+	return gen
+}
+
+// remainder calcula los codewords de corrección de data
+func remainder(data []byte, gen []byte) []byte {
+	rem := make([]byte, len(gen))
+	for _, b := range data {
+		factor := b ^ rem[0]
+		copy(rem, rem[1:])
+		rem[len(rem)-1] = 0
+		for i, g := range gen {
+			rem[i] ^= multiply(g, factor)
+		}
+	}
+	return rem
+}
+
+// multiply multiplica en GF(2^8) módulo x^8 + x^4 + x^3 + x^2 + 1
+func multiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11d)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
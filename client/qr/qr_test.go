@@ -0,0 +1,151 @@
+package qr
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// ejemplo del estándar: "HELLO WORLD" en 1-M, con 10 codewords de corrección
+func TestReedSolomon(t *testing.T) {
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	if ec := remainder(data, generator(10)); !bytes.Equal(ec, want) {
+		t.Fatalf("corrección %v, esperaba %v", ec, want)
+	}
+}
+
+func TestFormatBits(t *testing.T) {
+	m := newMatrix(21)
+	m.drawFormat(0)
+
+	// L con máscara 0
+	if bits := formatBits(m); bits != 0b111011111000100 {
+		t.Fatalf("formato %015b", bits)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		data    string
+		version int
+	}{
+		{"HELLO WORLD", 1},
+		{"otpauth://totp/chat:alice?secret=JBSWY3DPEHPK3PXP&issuer=chat", 4},
+		{strings.Repeat("a", 140), 7},
+		{strings.Repeat("a", 230), 9},
+	}
+
+	for _, tt := range tests {
+		modules, err := Encode(tt.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := 17 + 4*tt.version; len(modules) != size {
+			t.Errorf("%d bytes: tamaño %d, esperaba %d", len(tt.data), len(modules), size)
+			continue
+		}
+
+		v := versions[tt.version-1]
+		capacity := 0
+		for _, n := range v.blocks {
+			capacity += n
+		}
+		if got, want := decode(t, tt.version, modules), codewords(v, encodeData(tt.data, capacity)); !bytes.Equal(got, want) {
+			t.Errorf("%d bytes: codewords leídos distintos de los escritos", len(tt.data))
+		}
+	}
+
+	if _, err := Encode(strings.Repeat("a", 231)); err == nil {
+		t.Error("231 bytes caben en un QR de hasta la versión 9")
+	}
+}
+
+// a partir de la 7 va la versión, con su BCH, en las dos esquinas
+func TestVersionInfo(t *testing.T) {
+	modules, err := Encode(strings.Repeat("a", 140))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const want = 0b000111110010010100
+	size := len(modules)
+	for i := 0; i < 18; i++ {
+		a, b := size-11+i%3, i/3
+		bit := (want>>i)&1 == 1
+		if modules[b][a] != bit || modules[a][b] != bit {
+			t.Fatalf("bit %d de la versión", i)
+		}
+	}
+}
+
+// formatBits lee el formato de la copia junto al buscador de arriba a la izquierda
+func formatBits(m *matrix) int {
+	var bits int
+	put := func(i int, dark bool) {
+		if dark {
+			bits |= 1 << i
+		}
+	}
+
+	for i := 0; i <= 5; i++ {
+		put(i, m.modules[i][8])
+	}
+	put(6, m.modules[7][8])
+	put(7, m.modules[8][8])
+	put(8, m.modules[8][7])
+	for i := 9; i < 15; i++ {
+		put(i, m.modules[8][14-i])
+	}
+	return bits
+}
+
+// decode quita la máscara que dice el formato y lee los codewords
+func decode(t *testing.T, n int, modules [][]bool) []byte {
+	m := newMatrix(len(modules))
+	m.drawFunctions(n, versions[n-1])
+	for r := range modules {
+		copy(m.modules[r], modules[r])
+	}
+
+	mask := -1
+	for k := 0; k < 8; k++ {
+		f := newMatrix(m.size)
+		f.drawFormat(k)
+		if formatBits(f) == formatBits(m) {
+			mask = k
+		}
+	}
+	if mask < 0 {
+		t.Fatalf("formato %015b desconocido", formatBits(m))
+	}
+	m.applyMask(mask)
+
+	var bits bitBuffer
+	for right := m.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+
+		for vert := 0; vert < m.size; vert++ {
+			row := vert
+			if upward {
+				row = m.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				if col := right - j; !m.function[row][col] {
+					bits = append(bits, m.modules[row][col])
+				}
+			}
+		}
+	}
+
+	v := versions[n-1]
+	total := v.ec * len(v.blocks)
+	for _, b := range v.blocks {
+		total += b
+	}
+	return bits[:8*total].bytes()
+}
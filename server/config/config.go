@@ -0,0 +1,317 @@
+/*
+Configuración del servidor. Cada opción se puede dar, de menor a mayor prioridad, con su valor por defecto, en el archivo
+JSON (server.json o el indicado con -config), con una variable de entorno SOCIAL_* o con un flag.
+
+La clave de la base de datos y la del servidor de logs se leen según DBKeySource/LogKeySource: "prompt" la pide por
+la terminal, "env" la lee de SOCIAL_DB_KEY/SOCIAL_LOG_KEY y "file" de DBKeyFile/LogKeyFile.
+*/
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	d.Duration = parsed
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+type Config struct {
+	Addr     string
+	CertFile string
+	KeyFile  string
+
+	// servidor de logs y backups
+	LogURL       string
+	LogKeySource string
+	LogKeyFile   string
+
+	Store        string
+	SaveInterval Duration
+	DBKeySource  string
+	DBKeyFile    string
+
+	TokenLifetime   Duration
+	RefreshLifetime Duration // lo que dura una sesión sin usarse
+	KeyRotation     Duration // cada cuánto cambia la clave que firma los tokens de acceso
+
+	// login y registro: peticiones por minuto de cada IP, bloqueo tras muchos fallos seguidos, y contraseñas que se
+	// comprueban a la vez (0 = una por CPU) y en cola antes de responder 503
+	AuthRate    int
+	AuthLockout Duration
+	HashWorkers int
+	HashQueue   int
+
+	// bytes de adjuntos que puede tener cada usuario (0 = sin límite) y tiempo para terminar de subir uno antes de que
+	// se borre
+	BlobQuota     int
+	BlobUploadTTL Duration
+
+	// tiempo máximo para que terminen las peticiones en curso y se envíen los logs al apagar
+	ShutdownTimeout Duration
+
+	// tamaño de página cuando no se pide ninguno (0 = todo) y máximo permitido (0 = sin límite)
+	PageSize    int
+	MaxPageSize int
+
+	// vuelca la base de datos en claro, sin secretos, a db.json en cada guardado. Solo para depurar
+	DebugDump bool
+}
+
+const (
+	KeySourcePrompt = "prompt"
+	KeySourceEnv    = "env"
+	KeySourceFile   = "file"
+
+	EnvDBKey  = "SOCIAL_DB_KEY"
+	EnvLogKey = "SOCIAL_LOG_KEY"
+)
+
+func Default() Config {
+	return Config{
+		Addr:            ":10443",
+		CertFile:        "localhost.crt",
+		KeyFile:         "localhost.key",
+		LogURL:          "https://localhost:10444",
+		LogKeySource:    KeySourcePrompt,
+		Store:           "memory",
+		SaveInterval:    Duration{30 * time.Second},
+		DBKeySource:     KeySourcePrompt,
+		TokenLifetime:   Duration{15 * time.Minute},
+		RefreshLifetime: Duration{30 * 24 * time.Hour},
+		KeyRotation:     Duration{24 * time.Hour},
+		AuthRate:        30,
+		AuthLockout:     Duration{15 * time.Minute},
+		HashWorkers:     0,
+		HashQueue:       32,
+		BlobQuota:       256 * 1024 * 1024,
+		BlobUploadTTL:   Duration{24 * time.Hour},
+		ShutdownTimeout: Duration{10 * time.Second},
+		PageSize:        0,
+		MaxPageSize:     100,
+	}
+}
+
+type option struct {
+	name  string
+	env   string
+	usage string
+	value any
+}
+
+func (c *Config) options() []option {
+	return []option{
+		{"addr", "SOCIAL_ADDR", "dirección de escucha", &c.Addr},
+		{"cert", "SOCIAL_CERT", "certificado TLS", &c.CertFile},
+		{"key", "SOCIAL_KEY", "clave privada TLS", &c.KeyFile},
+		{"log-url", "SOCIAL_LOG_URL", "URL del servidor de logs y backups", &c.LogURL},
+		{"log-key-source", "SOCIAL_LOG_KEY_SOURCE", "origen de la clave de logs: prompt, env o file", &c.LogKeySource},
+		{"log-key-file", "SOCIAL_LOG_KEY_FILE", "archivo con la clave de logs", &c.LogKeyFile},
+		{"store", "SOCIAL_STORE", "backend de almacenamiento: memory (db.enc) o bolt (db.bolt)", &c.Store},
+		{"interval", "SOCIAL_SAVE_INTERVAL", "intervalo de guardado (30s, 5m...)", &c.SaveInterval},
+		{"db-key-source", "SOCIAL_DB_KEY_SOURCE", "origen de la clave de la base de datos: prompt, env o file", &c.DBKeySource},
+		{"db-key-file", "SOCIAL_DB_KEY_FILE", "archivo con la clave de la base de datos", &c.DBKeyFile},
+		{"token-lifetime", "SOCIAL_TOKEN_LIFETIME", "duración de los tokens de acceso", &c.TokenLifetime},
+		{"refresh-lifetime", "SOCIAL_REFRESH_LIFETIME", "duración de las sesiones sin renovarse (720h...)", &c.RefreshLifetime},
+		{"key-rotation", "SOCIAL_KEY_ROTATION", "intervalo de cambio de la clave de firma de los tokens", &c.KeyRotation},
+		{"auth-rate", "SOCIAL_AUTH_RATE", "peticiones de login y registro por minuto de cada IP", &c.AuthRate},
+		{"auth-lockout", "SOCIAL_AUTH_LOCKOUT", "bloqueo de una cuenta o IP tras muchos fallos de login", &c.AuthLockout},
+		{"hash-workers", "SOCIAL_HASH_WORKERS", "contraseñas que se comprueban a la vez (0 = una por CPU)", &c.HashWorkers},
+		{"hash-queue", "SOCIAL_HASH_QUEUE", "contraseñas en cola antes de responder 503", &c.HashQueue},
+		{"blob-quota", "SOCIAL_BLOB_QUOTA", "bytes de adjuntos de cada usuario (0 = sin límite)", &c.BlobQuota},
+		{"blob-upload-ttl", "SOCIAL_BLOB_UPLOAD_TTL", "tiempo para terminar de subir un adjunto antes de borrarlo", &c.BlobUploadTTL},
+		{"shutdown-timeout", "SOCIAL_SHUTDOWN_TIMEOUT", "tiempo máximo de espera al apagar", &c.ShutdownTimeout},
+		{"page-size", "SOCIAL_PAGE_SIZE", "tamaño de página por defecto (0 = todo)", &c.PageSize},
+		{"max-page-size", "SOCIAL_MAX_PAGE_SIZE", "tamaño de página máximo (0 = sin límite)", &c.MaxPageSize},
+		{"debug-dump", "SOCIAL_DEBUG_DUMP", "vuelca la base de datos en claro a db.json, sin secretos (solo para depurar)", &c.DebugDump},
+	}
+}
+
+func set(value any, s string) error {
+	switch v := value.(type) {
+	case *string:
+		*v = s
+	case *int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		*v = n
+	case *bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		*v = b
+	case *Duration:
+		// se acepta un número suelto como segundos, como el antiguo argumento del intervalo
+		if n, err := strconv.Atoi(s); err == nil {
+			v.Duration = time.Duration(n) * time.Second
+			return nil
+		}
+
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.Duration = d
+	}
+
+	return nil
+}
+
+// Load lee la configuración de args (sin el nombre del programa) y devuelve los argumentos que no son flags
+func Load(args []string) (Config, []string, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configPath := fs.String("config", "", "archivo de configuración JSON (por defecto server.json si existe)")
+
+	// los flags se aplican al final para que tengan prioridad sobre el archivo y el entorno
+	flags := make(map[string]string)
+	for _, o := range cfg.options() {
+		name := o.name
+		parse := func(s string) error {
+			flags[name] = s
+			return nil
+		}
+
+		// los booleanos se pueden dar sin valor, -debug-dump es -debug-dump=true
+		if _, ok := o.value.(*bool); ok {
+			fs.BoolFunc(name, fmt.Sprintf("%s [%s]", o.usage, o.env), parse)
+		} else {
+			fs.Func(name, fmt.Sprintf("%s [%s]", o.usage, o.env), parse)
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	path := *configPath
+	if path == "" {
+		path = os.Getenv("SOCIAL_CONFIG")
+	}
+	if path == "" {
+		if _, err := os.Stat("server.json"); err == nil {
+			path = "server.json"
+		}
+	}
+
+	if path != "" {
+		file, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, nil, err
+		}
+
+		if err := json.Unmarshal(file, &cfg); err != nil {
+			return cfg, nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	for _, o := range cfg.options() {
+		if s, ok := os.LookupEnv(o.env); ok {
+			if err := set(o.value, s); err != nil {
+				return cfg, nil, fmt.Errorf("%s: %w", o.env, err)
+			}
+		}
+	}
+
+	for _, o := range cfg.options() {
+		if s, ok := flags[o.name]; ok {
+			if err := set(o.value, s); err != nil {
+				return cfg, nil, fmt.Errorf("-%s: %w", o.name, err)
+			}
+		}
+	}
+
+	return cfg, fs.Args(), cfg.validate()
+}
+
+func (c Config) validate() error {
+	for _, source := range []string{c.DBKeySource, c.LogKeySource} {
+		if source != KeySourcePrompt && source != KeySourceEnv && source != KeySourceFile {
+			return fmt.Errorf("origen de clave desconocido: %s", source)
+		}
+	}
+
+	if c.SaveInterval.Duration <= 0 {
+		return fmt.Errorf("el intervalo de guardado debe ser positivo")
+	}
+
+	if c.TokenLifetime.Duration <= 0 || c.RefreshLifetime.Duration <= 0 {
+		return fmt.Errorf("la duración de los tokens debe ser positiva")
+	}
+
+	if c.KeyRotation.Duration <= 0 {
+		return fmt.Errorf("el intervalo de cambio de clave debe ser positivo")
+	}
+
+	if c.AuthRate <= 0 || c.AuthLockout.Duration <= 0 {
+		return fmt.Errorf("el límite de intentos de login y su bloqueo deben ser positivos")
+	}
+
+	if c.HashWorkers < 0 || c.HashQueue < 0 {
+		return fmt.Errorf("los workers y la cola de contraseñas no pueden ser negativos")
+	}
+
+	if c.BlobQuota < 0 || c.BlobUploadTTL.Duration <= 0 {
+		return fmt.Errorf("la cuota de adjuntos no puede ser negativa y su tiempo de subida debe ser positivo")
+	}
+
+	if c.ShutdownTimeout.Duration <= 0 {
+		return fmt.Errorf("el tiempo de apagado debe ser positivo")
+	}
+
+	if c.PageSize < 0 || c.MaxPageSize < 0 {
+		return fmt.Errorf("los tamaños de página no pueden ser negativos")
+	}
+
+	return nil
+}
+
+// ReadKey obtiene una clave según su origen. prompt se usa solo si el origen es "prompt"
+func ReadKey(source string, file string, env string, prompt func() []byte) ([]byte, error) {
+	switch source {
+	case KeySourceEnv:
+		key, ok := os.LookupEnv(env)
+		if !ok {
+			return nil, fmt.Errorf("variable de entorno %s no definida", env)
+		}
+		return trimKey([]byte(key)), nil
+	case KeySourceFile:
+		key, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return trimKey(key), nil
+	}
+
+	return prompt(), nil
+}
+
+func trimKey(key []byte) []byte {
+	for len(key) > 0 && (key[len(key)-1] == '\n' || key[len(key)-1] == '\r') {
+		key = key[:len(key)-1]
+	}
+	return key
+}
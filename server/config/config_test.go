@@ -0,0 +1,85 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// flags > entorno > archivo > valores por defecto
+func TestLoadPriority(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.json")
+	err := os.WriteFile(path, []byte(`{"Addr": ":8443", "Store": "bolt", "SaveInterval": "1m", "MaxPageSize": 10}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SOCIAL_STORE", "memory")
+	t.Setenv("SOCIAL_MAX_PAGE_SIZE", "20")
+
+	cfg, args, err := Load([]string{"-config", path, "-max-page-size", "30", "-debug-dump", "rotate-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Addr != ":8443" || cfg.SaveInterval.Duration != time.Minute {
+		t.Errorf("valores del archivo no aplicados: %+v", cfg)
+	}
+	if cfg.Store != "memory" {
+		t.Errorf("el entorno no tiene prioridad sobre el archivo: %s", cfg.Store)
+	}
+	if cfg.MaxPageSize != 30 {
+		t.Errorf("los flags no tienen prioridad: %d", cfg.MaxPageSize)
+	}
+	if !cfg.DebugDump {
+		t.Error("flag booleano sin valor no aplicado")
+	}
+	if cfg.CertFile != "localhost.crt" {
+		t.Errorf("valor por defecto perdido: %s", cfg.CertFile)
+	}
+	if len(args) != 1 || args[0] != "rotate-key" {
+		t.Errorf("argumentos restantes: %v", args)
+	}
+}
+
+func TestReadKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.key")
+	os.WriteFile(path, []byte("secreto\n"), 0600)
+
+	noPrompt := func() []byte {
+		t.Fatal("no se debe pedir la clave")
+		return nil
+	}
+
+	if key, err := ReadKey(KeySourceFile, path, EnvDBKey, noPrompt); err != nil || string(key) != "secreto" {
+		t.Errorf("clave desde archivo: %q %v", key, err)
+	}
+
+	t.Setenv(EnvDBKey, "otra")
+	if key, err := ReadKey(KeySourceEnv, "", EnvDBKey, noPrompt); err != nil || string(key) != "otra" {
+		t.Errorf("clave desde entorno: %q %v", key, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, env := range map[string][2]string{
+		"cola negativa":          {"SOCIAL_HASH_QUEUE", "-1"},
+		"workers negativos":      {"SOCIAL_HASH_WORKERS", "-2"},
+		"sin límite de intentos": {"SOCIAL_AUTH_RATE", "0"},
+		"cuota negativa":         {"SOCIAL_BLOB_QUOTA", "-1"},
+		"intervalo cero":         {"SOCIAL_SAVE_INTERVAL", "0s"},
+		"origen desconocido":     {"SOCIAL_DB_KEY_SOURCE", "stdin"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(env[0], env[1])
+			if _, _, err := Load(nil); err == nil {
+				t.Errorf("%s=%s aceptado", env[0], env[1])
+			}
+		})
+	}
+
+	if _, _, err := Load([]string{"-hash-queue", "0"}); err != nil {
+		t.Errorf("cola vacía rechazada: %v", err)
+	}
+}
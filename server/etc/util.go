@@ -2,9 +2,13 @@ package etc
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"server/hub"
 	"server/middleware"
+	"server/session"
+	"server/store"
 	"strconv"
 	"util"
 	"util/model"
@@ -22,12 +26,52 @@ func ResponseAuth(w io.Writer, ok bool, msg string, user model.User) {
 	util.FailOnError(err)
 }
 
-func GetDb(req *http.Request) *model.Database {
+// ResponseSession responde a un login correcto con los tokens de la sesión nueva, user.Token es el de acceso
+func ResponseSession(w io.Writer, msg string, user model.User, refresh []byte) {
+	r := model.RespAuth{Ok: true, Msg: msg, User: user, Refresh: refresh}
+	err := json.NewEncoder(w).Encode(&r)
+	util.FailOnError(err)
+}
+
+// ResponseTicket responde a una contraseña correcta de un usuario con verificación en dos pasos, sin token todavía
+func ResponseTicket(w io.Writer, msg string, ticket string) {
+	r := model.RespAuth{Ok: false, Msg: msg, Ticket: ticket}
+	err := json.NewEncoder(w).Encode(&r)
+	util.FailOnError(err)
+}
+
+func GetDb(req *http.Request) store.Store {
 	db := req.Context().Value(middleware.ContextKeyData)
 	if db == nil {
 		return nil
 	}
-	return db.(*model.Database)
+	return db.(store.Store)
+}
+
+// tamaño de página cuando no se indica (0 = todo) y máximo permitido (0 = sin límite)
+var defaultPageSize = 0
+var maxPageSize = 0
+
+func SetPageLimits(defaultSize int, maxSize int) {
+	defaultPageSize = defaultSize
+	maxPageSize = maxSize
+}
+
+func GetHub(req *http.Request) *hub.Hub {
+	h, _ := req.Context().Value(middleware.ContextKeyHub).(*hub.Hub)
+	return h
+}
+
+// GetUsername devuelve el usuario autenticado de la petición, sacado de su token y no de la cabecera Username
+func GetUsername(req *http.Request) string {
+	claims, _ := req.Context().Value(middleware.ContextKeyClaims).(session.Claims)
+	return claims.User
+}
+
+// GetSessionId devuelve el id de la sesión con la que se ha autenticado la petición
+func GetSessionId(req *http.Request) string {
+	claims, _ := req.Context().Value(middleware.ContextKeyClaims).(session.Claims)
+	return claims.Session
 }
 
 func GetPaginationSizes(req *http.Request, dataLength int) (int, int, error) {
@@ -38,6 +82,10 @@ func GetPaginationSizes(req *http.Request, dataLength int) (int, int, error) {
 	page := 0
 	size := dataLength
 
+	if defaultPageSize > 0 {
+		size = defaultPageSize
+	}
+
 	if pageStr != "" {
 		p, err := strconv.Atoi(pageStr)
 		if err != nil {
@@ -54,6 +102,14 @@ func GetPaginationSizes(req *http.Request, dataLength int) (int, int, error) {
 		size = s
 	}
 
+	if page < 0 || size < 0 {
+		return 0, 0, fmt.Errorf("página o tamaño negativos")
+	}
+
+	if maxPageSize > 0 && size > maxPageSize {
+		size = maxPageSize
+	}
+
 	return page, size, nil
 }
 
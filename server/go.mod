@@ -2,6 +2,13 @@ module server
 
 go 1.22.1
 
-require golang.org/x/crypto v0.21.0
+require (
+	github.com/gorilla/websocket v1.5.1
+	go.etcd.io/bbolt v1.3.9
+	golang.org/x/crypto v0.21.0
+)
 
-require golang.org/x/sys v0.18.0 // indirect
+require (
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+)
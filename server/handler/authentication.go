@@ -1,20 +1,40 @@
 package handler
 
 import (
-	"bytes"
 	"crypto/rand"
 	"fmt"
 	"net/http"
 	"server/etc"
 	"server/logging"
+	"server/password"
+	"server/store"
 	"strings"
 	"time"
 	"util"
 	"util/model"
-
-	"golang.org/x/crypto/argon2"
 )
 
+var errBlocked = fmt.Errorf("usuario bloqueado")
+
+// touchLogin apunta el login del usuario, dentro de UpdateUser para que no se pise con un bloqueo. El token que había
+// antes de las sesiones ya no sirve y se borra
+func touchLogin(u *model.User) error {
+	if u.Blocked {
+		return errBlocked
+	}
+
+	u.Seen = time.Now()
+	u.Token = nil
+	return nil
+}
+
+// busy responde cuando no hay sitio para comprobar más contraseñas
+func busy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	etc.ResponseAuth(w, false, "Servidor ocupado, inténtalo en unos segundos", model.User{})
+}
+
 func RegisterHandler(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	w.Header().Set("Content-Type", "application/json")
@@ -27,8 +47,9 @@ func RegisterHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if strings.ContainsAny(register.User, "@&?=/:;") {
-		etc.ResponseAuth(w, false, "Carácteres no válidos '@&?=/:;'", model.User{})
+	// '>' tampoco, las conversaciones se guardan como emisor->receptor y un nombre con "->" se confundiría con otro
+	if strings.ContainsAny(register.User, "@&?=/:;>") {
+		etc.ResponseAuth(w, false, "Carácteres no válidos '@&?=/:;>'", model.User{})
 		return
 	}
 
@@ -39,35 +60,34 @@ func RegisterHandler(w http.ResponseWriter, req *http.Request) {
 
 	data := etc.GetDb(req)
 
-	_, ok := data.Users[register.User]
-	if ok {
-		etc.ResponseAuth(w, false, "Usuario ya registrado", model.User{})
-		return
-	}
-
 	u := model.User{}
 	u.Name = register.User
 	u.Salt = make([]byte, 16)
 	rand.Read(u.Salt)
-	password := register.Pass
-
-	u.Hash = argon2.Key([]byte(password), u.Salt, 3, 32*1024, 4, 32)
+	hash, err := password.Hash(register.Pass, u.Salt)
+	if err == password.ErrBusy {
+		busy(w)
+		return
+	}
+	u.Hash = hash
 
 	u.Seen = time.Now()
-	u.Token = make([]byte, 16)
-	rand.Read(u.Token)
 
 	u.PubKey = register.PubKey
 
 	u.Blocked = false
-	if len(data.UserNames) == 0 {
-		u.Role = model.Admin
-	} else {
-		u.Role = model.NormalUser
-	}
+	u.Role = model.NormalUser
 
-	data.Users[u.Name] = u
-	data.UserNames = append(data.UserNames, u.Name)
+	// el primer usuario registrado pasa a ser admin
+	u, err = data.CreateUser(u)
+	if err == store.ErrExists {
+		etc.ResponseAuth(w, false, "Usuario ya registrado", model.User{})
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		etc.ResponseAuth(w, false, "Error guardando el usuario", model.User{})
+		return
+	}
 
 	encryptedMsg, err := util.EncryptWithRSA([]byte("Bienvenido a la red social"), util.ParsePublicKey(register.PubKey))
 	if err != nil {
@@ -75,7 +95,7 @@ func RegisterHandler(w http.ResponseWriter, req *http.Request) {
 		etc.ResponseAuth(w, false, "Error de clave publica", model.User{})
 		return
 	}
-	etc.ResponseAuth(w, true, util.Encode64(encryptedMsg), model.User{Name: u.Name, Token: u.Token, Role: u.Role})
+	startSession(w, data, u, register.Device, util.Encode64(encryptedMsg))
 }
 
 func LoginHandler(w http.ResponseWriter, req *http.Request) {
@@ -90,35 +110,42 @@ func LoginHandler(w http.ResponseWriter, req *http.Request) {
 
 	data := etc.GetDb(req)
 
-	u, ok := data.Users[login.User]
+	u, ok := data.GetUser(login.User)
 	if !ok {
+		// 401 para que cuente como fallo en el límite de intentos
+		w.WriteHeader(401)
 		etc.ResponseAuth(w, false, "Usuario inexistente", model.User{})
 		return
 	}
 
-	password := login.Pass
-
-	hash := argon2.Key([]byte(password), u.Salt, 3, 32*1024, 4, 32)
-	if !bytes.Equal(u.Hash, hash) {
+	valid, err := password.Check(login.Pass, u.Salt, u.Hash)
+	if err == password.ErrBusy {
+		busy(w)
+		return
+	}
+	if !valid {
 		w.WriteHeader(401)
 		etc.ResponseAuth(w, false, "Credenciales inválidas", model.User{})
 		return
 	}
 
-	if u.Blocked {
+	if secondFactor(w, data, u, login.Device) {
+		return
+	}
+
+	u, err = data.UpdateUser(u.Name, touchLogin)
+	if err == errBlocked {
 		w.WriteHeader(401)
 		etc.ResponseAuth(w, false, "Usuario bloqueado por el administrador", model.User{})
 		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		etc.ResponseAuth(w, false, "Error guardando el usuario", model.User{})
+		return
 	}
 
-	u.Seen = time.Now()
-	u.Token = make([]byte, 16)
-	rand.Read(u.Token)
-	data.Users[u.Name] = u
-
 	// logging.Info(fmt.Sprintf("Último login del usuario '%s': %s", u.Name, u.Seen.Format(time.RFC3339)))
-	etc.ResponseAuth(w, true, "Credenciales válidas", u)
-
+	startSession(w, data, u, login.Device, "Credenciales válidas")
 }
 
 func GetLoginCertHandler(w http.ResponseWriter, req *http.Request) {
@@ -130,7 +157,7 @@ func GetLoginCertHandler(w http.ResponseWriter, req *http.Request) {
 
 	data := etc.GetDb(req)
 
-	_, ok := data.Users[username]
+	_, ok := data.GetUser(username)
 
 	if !ok {
 		logging.SendLogRemote(fmt.Sprintf("Usuario %s no encontrado", username))
@@ -141,7 +168,7 @@ func GetLoginCertHandler(w http.ResponseWriter, req *http.Request) {
 	b := make([]byte, 32)
 	rand.Read(b)
 
-	data.PendingCertLogin[username] = b
+	data.SetCertChallenge(username, b)
 	fmt.Fprintf(w, "%s", b)
 
 	go func() {
@@ -149,9 +176,7 @@ func GetLoginCertHandler(w http.ResponseWriter, req *http.Request) {
 		timer := time.NewTimer(5 * time.Second)
 		<-timer.C
 
-		_, ok = data.PendingCertLogin[username]
-		if ok {
-			delete(data.PendingCertLogin, username)
+		if data.ExpireCertChallenge(username, b) {
 			logging.SendLogRemote(fmt.Sprintf("Timeout login por certificado para usuario, %s", username))
 		}
 	}()
@@ -166,7 +191,7 @@ func PostLoginCertHandler(w http.ResponseWriter, req *http.Request) {
 
 	data := etc.GetDb(req)
 
-	user, ok := data.Users[username]
+	user, ok := data.GetUser(username)
 
 	if !ok {
 		logging.SendLogRemote(fmt.Sprintf("Usuario no encontrado, %s", username))
@@ -175,7 +200,8 @@ func PostLoginCertHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	realToken, ok := data.PendingCertLogin[username]
+	// el reto se consume aunque la firma sea incorrecta, solo hay un intento por reto
+	realToken, ok := data.TakeCertChallenge(username)
 	if !ok {
 		logging.SendLogRemote("ERROR: Token expirado")
 		w.WriteHeader(http.StatusBadRequest)
@@ -194,20 +220,22 @@ func PostLoginCertHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	delete(data.PendingCertLogin, username)
+	if secondFactor(w, data, user, req.URL.Query().Get("device")) {
+		return
+	}
 
-	if user.Blocked {
+	user, err = data.UpdateUser(username, touchLogin)
+	if err == errBlocked {
 		w.WriteHeader(401)
 		etc.ResponseAuth(w, false, "Usuario bloqueado por el administrador", model.User{})
 		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		etc.ResponseAuth(w, false, "Error guardando el usuario", model.User{})
+		return
 	}
 
-	user.Token = make([]byte, 16)
-	rand.Read(user.Token)
-	user.Seen = time.Now()
-	data.Users[username] = user
-
 	logging.SendLogRemote(fmt.Sprintf("Último login del usuario '%s': %s", username, user.Seen.Format(time.RFC3339)))
 
-	etc.ResponseAuth(w, true, "Autenticación exitosa", user)
+	startSession(w, data, user, req.URL.Query().Get("device"), "Autenticación exitosa")
 }
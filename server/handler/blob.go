@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"server/etc"
+	"server/logging"
+	"server/store"
+	"strconv"
+	"time"
+	"util"
+	"util/model"
+)
+
+// lo que puede ocupar de más un trozo por el cifrado
+const blobChunkOverhead = 64
+
+// bytes de adjuntos que puede tener reservados cada usuario (0 = sin límite)
+var blobQuota int64 = 256 * 1024 * 1024
+
+func SetBlobQuota(quota int64) {
+	blobQuota = quota
+}
+
+/*
+CreateBlobHandler reserva un adjunto de Size bytes y devuelve su id, que es aleatorio: quien lo conoce puede bajarlo,
+así que solo se comparte dentro de un mensaje cifrado. El contenido va cifrado por el cliente y el servidor no lo ve.
+*/
+func CreateBlobHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var blob model.Blob
+	if err := util.DecodeJSON(req.Body, &blob); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if blob.Size > model.MaxBlobSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if blob.Size <= 0 || blob.Chunks != model.BlobChunks(blob.Size) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	blob.Id = hex.EncodeToString(id)
+	blob.Owner = etc.GetUsername(req)
+	blob.Uploaded = make([]bool, blob.Chunks)
+	blob.Created = time.Now()
+
+	if err := etc.GetDb(req).CreateBlob(blob, blobQuota); err == store.ErrQuota {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		return
+	} else if err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Creando adjunto. %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(blob); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// blobChunk devuelve el adjunto y el número de trozo de la ruta, si no responde con el error
+func blobChunk(w http.ResponseWriter, req *http.Request) (model.Blob, int, bool) {
+	blob, ok := etc.GetDb(req).GetBlob(req.PathValue("id"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return blob, 0, false
+	}
+
+	n, err := strconv.Atoi(req.PathValue("n"))
+	if err != nil || n < 0 || n >= blob.Chunks {
+		w.WriteHeader(http.StatusBadRequest)
+		return blob, 0, false
+	}
+
+	return blob, n, true
+}
+
+// PutBlobChunkHandler guarda el trozo n de un adjunto del usuario. Repetir un trozo lo sustituye, para poder continuar
+// una subida cortada; una vez completo ya no se puede cambiar
+func PutBlobChunkHandler(w http.ResponseWriter, req *http.Request) {
+	blob, n, ok := blobChunk(w, req)
+	if !ok {
+		return
+	}
+
+	if blob.Owner != etc.GetUsername(req) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// se vuelve a comprobar al guardar, por si otra subida lo completa mientras tanto
+	if blob.Complete() {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	// cada trozo ocupa lo que le toca del tamaño reservado, así la cuota cuenta lo que se guarda de verdad
+	limit := int(min(blob.Size-int64(n)*model.BlobChunkSize, model.BlobChunkSize)) + blobChunkOverhead
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, int64(limit)+1))
+	if err != nil || len(data) == 0 || len(data) > limit {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, err := etc.GetDb(req).PutBlobChunk(blob.Id, n, data); err == store.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err == store.ErrComplete {
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Guardando trozo de adjunto. %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetBlobHandler devuelve el estado de un adjunto, con los trozos que ya se han subido
+func GetBlobHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	blob, ok := etc.GetDb(req).GetBlob(req.PathValue("id"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(blob); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetBlobChunkHandler devuelve el trozo n de un adjunto tal como se subió. Hasta que no está completo responde 409
+func GetBlobChunkHandler(w http.ResponseWriter, req *http.Request) {
+	blob, n, ok := blobChunk(w, req)
+	if !ok {
+		return
+	}
+
+	if !blob.Complete() {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	// caducado con su mensaje, aunque todavía no se haya borrado
+	if !blob.Expires.IsZero() && blob.Expires.Before(time.Now()) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data, ok := etc.GetDb(req).BlobChunk(blob.Id, n)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+// DeleteBlobHandler borra un adjunto del usuario con todos sus trozos, por ejemplo al borrar para todos el mensaje que
+// lo lleva
+func DeleteBlobHandler(w http.ResponseWriter, req *http.Request) {
+	data := etc.GetDb(req)
+
+	blob, ok := data.GetBlob(req.PathValue("id"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if blob.Owner != etc.GetUsername(req) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if err := data.DeleteBlob(blob.Id); err == store.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+	} else if err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Borrando adjunto. %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
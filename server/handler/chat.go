@@ -5,67 +5,224 @@ import (
 	"fmt"
 	"net/http"
 	"server/etc"
+	"server/hub"
 	"server/logging"
+	"server/repository"
+	"server/store"
+	"strconv"
 	"time"
 	"util"
 	"util/model"
 )
 
-var ActiveConnections = make(map[string]chan string)
-var NewConnections = make(chan string)
+// cada cuánto se manda un comentario por los streams para que los proxies no corten la conexión
+const heartbeatInterval = 15 * time.Second
 
-func ChatConnectionHandler(w http.ResponseWriter, req *http.Request) {
-	logging.SendLogRemote("Chat handler")
+// ChatEventsHandler abre un stream SSE con los mensajes que otherUser envía al usuario y, como eventos "receipt", las
+// confirmaciones de otherUser de lo que le ha enviado el usuario, como "expiry", sus cambios en los mensajes
+// temporales y, como "typing", sus avisos de escritura. Al conectar se mandan los pendientes posteriores a
+// Last-Event-ID; los anteriores se dan por recibidos y se borran
+func ChatEventsHandler(w http.ResponseWriter, req *http.Request) {
+	otherUser := req.PathValue("user")
+	reqUser := etc.GetUsername(req)
+
+	data := etc.GetDb(req)
+	chats := etc.GetHub(req)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok || chats == nil {
+		logging.SendLogRemote("ERROR: Streaming no disponible")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if _, ok := data.GetUser(otherUser); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var lastId int64
+	if lastIdStr := req.Header.Get("Last-Event-ID"); lastIdStr != "" {
+		id, err := strconv.ParseInt(lastIdStr, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lastId = id
+
+		if err := data.AckMessages(otherUser, reqUser, lastId); err != nil {
+			logging.SendLogRemote(fmt.Sprintf("ERROR: Confirmando mensajes. %s", err.Error()))
+		}
+		updateReceipt(data, chats, otherUser, reqUser, lastId, 0)
+	}
+
+	// la suscripción va antes de leer los pendientes para no perder los que lleguen entre medias
+	events, cancel := chats.Subscribe(reqUser)
+	defer cancel()
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
 
-	//username := req.Header.Get\("Username")
+	send := func(msg model.Message) error {
+		if msg.Id <= lastId {
+			return nil
+		}
+		lastId = msg.Id
+
+		_, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", msg.Id, util.EncodeJSON(msg))
+		return err
+	}
+
+	for _, msg := range data.PendingMessages(otherUser, reqUser, lastId) {
+		if send(msg) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case e, ok := <-events:
+			// canal cerrado: el servidor se apaga o el cliente va demasiado lento, reconectará
+			if !ok {
+				return
+			}
+
+			if e.From != otherUser {
+				continue
+			}
+
+			switch e.Type {
+			case hub.EventMessage:
+				if send(e.Message) != nil {
+					return
+				}
+			case hub.EventReceipt:
+				// sin id para no mover el Last-Event-ID del cliente
+				if _, err := fmt.Fprintf(w, "event: receipt\ndata: %s\n\n", util.EncodeJSON(e.Receipt)); err != nil {
+					return
+				}
+			case hub.EventExpiry:
+				if _, err := fmt.Fprintf(w, "event: expiry\ndata: %s\n\n", util.EncodeJSON(e.Expiry)); err != nil {
+					return
+				}
+			case hub.EventTyping:
+				if _, err := fmt.Fprintf(w, "event: typing\ndata: %s\n\n", util.EncodeJSON(e.From)); err != nil {
+					return
+				}
+			default:
+				continue
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+
+		flusher.Flush()
+	}
+}
+
+// AckMessagesHandler borra los mensajes pendientes de otherUser que el usuario ya ha recibido por el stream
+func AckMessagesHandler(w http.ResponseWriter, req *http.Request) {
 	otherUser := req.PathValue("user")
-	// reqUser := req.Header.Get("Username")
+	reqUser := etc.GetUsername(req)
+
+	var ack model.MessageAck
+	if err := util.DecodeJSON(req.Body, &ack); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
 	data := etc.GetDb(req)
 
-	if _, ok := data.Users[otherUser]; !ok {
-		w.WriteHeader(http.StatusNotFound)
+	if err := data.AckMessages(otherUser, reqUser, ack.Id); err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Confirmando mensajes. %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := updateReceipt(data, etc.GetHub(req), otherUser, reqUser, ack.Id, 0); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// ReadMessagesHandler marca como leídos los mensajes de otherUser hasta el id indicado. Lo manda el cliente cuando los
+// muestra en pantalla, así que también los da por recibidos
+func ReadMessagesHandler(w http.ResponseWriter, req *http.Request) {
+	otherUser := req.PathValue("user")
+	reqUser := etc.GetUsername(req)
+
+	var ack model.MessageAck
+	if err := util.DecodeJSON(req.Body, &ack); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := readMessages(etc.GetDb(req), etc.GetHub(req), otherUser, reqUser, ack.Id); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// TypingHandler avisa a otherUser de que el usuario le está escribiendo, es lo mismo que el frame typing del websocket
+func TypingHandler(w http.ResponseWriter, req *http.Request) {
+	otherUser := req.PathValue("user")
+	reqUser := etc.GetUsername(req)
+
+	etc.GetHub(req).Publish(hub.Event{Type: hub.EventTyping, From: reqUser, To: otherUser})
+}
+
+// GetReceiptsHandler devuelve hasta qué mensaje ha recibido y leído otherUser lo que le ha enviado el usuario
+func GetReceiptsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	otherUser := req.PathValue("user")
+	reqUser := etc.GetUsername(req)
+
+	data := etc.GetDb(req)
+
+	if err := json.NewEncoder(w).Encode(data.GetReceipt(reqUser, otherUser)); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+}
 
-	// otherConn := fmt.Sprintf("%s->%s", otherUser, reqUser)
-	// chanReceive, ok := ActiveConnections[otherConn]
-
-	// if !ok {
-	// 	closeChan := make(chan bool)
-	// 	defer close(closeChan)
-	// 	defer closeChan<-true
-
-	// 	go func(){
-	// 		select{
-	// 		case <-closeChan:
-	// 			return
-	// 		default:
-	// 		}
-	// 	}
-	// }
-
-	// _, ok := data.Chats[NewTupleAlphabeticOrder(username, otherUser)]
-	// if !ok {
-	// 	data.Chats[NewTupleAlphabeticOrder(username, otherUser)] = make([]model.Message, 0)
-	// }
-
-	// test
-	// for i := 0; i < 10; i++ {
-	// 	msg := fmt.Sprintf("Event %d", i)
-	// 	logging.Info(fmt.Sprintf("Sending: %s", msg))
-	// 	fmt.Fprintf(w, "data: %s\n\n", msg)
-	// 	time.Sleep(1 * time.Second)
-	// 	w.(http.Flusher).Flush()
-	// }
-
-	// <-req.Context().Done()
-	// fmt.Println("Connection closed")
+// readMessages borra los pendientes de sender hasta upTo y le avisa de que receiver los ha leído
+func readMessages(data store.Store, chats *hub.Hub, sender string, receiver string, upTo int64) error {
+	if err := data.AckMessages(sender, receiver, upTo); err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Confirmando mensajes. %s", err.Error()))
+		return err
+	}
+
+	return updateReceipt(data, chats, sender, receiver, upTo, upTo)
+}
+
+// updateReceipt avanza la confirmación de lo que sender ha enviado a receiver y se la publica a sender
+func updateReceipt(data store.Store, chats *hub.Hub, sender string, receiver string, delivered int64, read int64) error {
+	if delivered <= 0 && read <= 0 {
+		return nil
+	}
+
+	r, err := data.UpdateReceipt(sender, receiver, delivered, read)
+	if err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Guardando confirmación. %s", err.Error()))
+		return err
+	}
+
+	if chats != nil {
+		chats.Publish(hub.Event{Type: hub.EventReceipt, From: receiver, To: sender, Receipt: r})
+	}
+
+	return nil
 }
 
 func SendMessageHandler(w http.ResponseWriter, req *http.Request) {
@@ -79,63 +236,121 @@ func SendMessageHandler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	otherUser := req.PathValue("user")
-	reqUser := req.Header.Get("Username")
+	reqUser := etc.GetUsername(req)
 
 	logging.SendLogRemote(fmt.Sprintf("msg received %v from %s to %s", msg.Message, reqUser, otherUser))
 
-	if otherUser == reqUser {
-		logging.SendLogRemote("ERROR: Nombres iguales")
+	msg, err := sendMessage(etc.GetDb(req), etc.GetHub(req), reqUser, otherUser, msg)
+	switch err {
+	case nil:
+		// el emisor necesita el id para casar las confirmaciones
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(msg)
+	case errSameUser, errTooManyBlobs:
 		w.WriteHeader(http.StatusBadRequest)
-		return
+	case errUserNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
 	}
+}
 
-	data := etc.GetDb(req)
+var (
+	errSameUser     = fmt.Errorf("no puedes enviarte mensajes a ti mismo")
+	errUserNotFound = fmt.Errorf("usuario no encontrado")
+	errTooManyBlobs = fmt.Errorf("demasiados adjuntos en un mensaje")
+)
 
-	_, ok := data.Users[otherUser]
+// adjuntos que puede llevar un mensaje
+const maxMessageBlobs = 8
 
-	if !ok {
+// sendMessage guarda el mensaje y lo publica a las conexiones abiertas del receptor. Lo usan la API REST y el websocket
+func sendMessage(data store.Store, chats *hub.Hub, sender string, receiver string, msg model.Message) (model.Message, error) {
+	if sender == receiver {
+		logging.SendLogRemote("ERROR: Nombres iguales")
+		return msg, errSameUser
+	}
+
+	if _, ok := data.GetUser(receiver); !ok {
 		logging.SendLogRemote("ERROR: Usuario no encontrado")
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return msg, errUserNotFound
 	}
 
-	key := fmt.Sprintf("%s->%s", reqUser, otherUser)
-	messages, ok := data.PendingMessages[key]
+	msg.Sender = sender
+	msg.Timestamp = time.Now()
 
-	if !ok {
-		messages = make([]model.Message, 0)
+	// la caducidad la pone el servidor con la configuración de la conversación
+	msg.Expires = time.Time{}
+	if ttl := data.GetExpiry(sender, receiver).TTL; ttl > 0 {
+		msg.Expires = msg.Timestamp.Add(ttl)
 	}
 
-	msg.Sender = reqUser
-	msg.Timestamp = time.Now()
+	// los adjuntos del emisor caducan con el mensaje; los de otros no se tocan
+	if len(msg.Blobs) > maxMessageBlobs {
+		return msg, errTooManyBlobs
+	}
+	if len(msg.Blobs) > 0 && !msg.Expires.IsZero() {
+		if err := data.ExpireBlobs(sender, msg.Blobs, msg.Expires); err != nil {
+			logging.SendLogRemote(fmt.Sprintf("ERROR: Caducidad de adjuntos. %s", err.Error()))
+			return msg, err
+		}
+	}
+
+	// la firma se guarda tal cual; el estado es cosa de cada cliente
+	msg.Status, msg.Unverified = 0, false
 
-	messages = append(messages, msg)
-	data.PendingMessages[key] = messages
+	msg, err := data.AppendMessage(sender, receiver, msg)
+	if err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Guardando mensaje. %s", err.Error()))
+		return msg, err
+	}
+
+	if chats != nil {
+		chats.Publish(hub.Event{Type: hub.EventMessage, From: sender, To: receiver, Message: msg})
+	}
+
+	return msg, nil
 }
 
 func GetPendingMessages(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	otherUser := req.PathValue("user")
-	reqUser := req.Header.Get("Username")
+	reqUser := etc.GetUsername(req)
 
 	data := etc.GetDb(req)
 
-	key := fmt.Sprintf("%s->%s", otherUser, reqUser)
-
-	msgs, ok := data.PendingMessages[key]
+	msgs, err := repository.GetMessages(data, otherUser, reqUser)
+	if err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Leyendo mensajes. %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	if !ok {
-		msgs = make([]model.Message, 0)
+	// al sacarlos de la cola quedan entregados
+	if len(msgs) > 0 {
+		updateReceipt(data, etc.GetHub(req), otherUser, reqUser, msgs[len(msgs)-1].Id, 0)
 	}
 
-	err := json.NewEncoder(w).Encode(msgs)
+	err = json.NewEncoder(w).Encode(msgs)
 	if err != nil {
 		logging.SendLogRemote("ERROR: Error json")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+}
+
+// GetChatsHandler devuelve las conversaciones del usuario con los mensajes pendientes de cada una
+func GetChatsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	reqUser := etc.GetUsername(req)
 
-	delete(data.PendingMessages, key)
+	data := etc.GetDb(req)
+
+	if err := json.NewEncoder(w).Encode(data.Chats(reqUser)); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 }
 
 func GetPubKeyHandler(w http.ResponseWriter, req *http.Request) {
@@ -145,7 +360,7 @@ func GetPubKeyHandler(w http.ResponseWriter, req *http.Request) {
 
 	data := etc.GetDb(req)
 
-	u, ok := data.Users[otherUser]
+	u, ok := data.GetUser(otherUser)
 	if !ok {
 		etc.ResponseSimple(w, false, "Usuario no encontrado")
 		return
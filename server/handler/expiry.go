@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"server/etc"
+	"server/hub"
+	"server/logging"
+	"util"
+	"util/model"
+)
+
+// GetExpiryHandler devuelve la configuración de mensajes temporales de la conversación con otherUser
+func GetExpiryHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	otherUser := req.PathValue("user")
+	reqUser := etc.GetUsername(req)
+
+	if err := json.NewEncoder(w).Encode(etc.GetDb(req).GetExpiry(reqUser, otherUser)); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+SetExpiryHandler propone un TTL para los mensajes temporales de la conversación con otherUser. Si otherUser ya había
+propuesto el mismo pasa a aplicarse; si es el que ya hay, se retira o rechaza la propuesta pendiente.
+*/
+func SetExpiryHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	otherUser := req.PathValue("user")
+	reqUser := etc.GetUsername(req)
+
+	var body model.Expiry
+	if err := util.DecodeJSON(req.Body, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ttl := body.TTL
+	if ttl != 0 && (ttl < model.MinExpiryTTL || ttl > model.MaxExpiryTTL) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data := etc.GetDb(req)
+
+	if otherUser == reqUser {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := data.GetUser(otherUser); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	e, err := data.UpdateExpiry(reqUser, otherUser, func(e *model.Expiry) error {
+		switch {
+		case ttl == e.TTL:
+			e.Proposed, e.ProposedBy = 0, ""
+		case e.ProposedBy == otherUser && e.Proposed == ttl:
+			e.TTL, e.Proposed, e.ProposedBy = ttl, 0, ""
+		default:
+			e.Proposed, e.ProposedBy = ttl, reqUser
+		}
+		return nil
+	})
+	if err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Guardando mensajes temporales. %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if chats := etc.GetHub(req); chats != nil {
+		chats.Publish(hub.Event{Type: hub.EventExpiry, From: reqUser, To: otherUser, Expiry: e})
+	}
+
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -17,7 +17,7 @@ func CreateGroupHandler(w http.ResponseWriter, req *http.Request) {
 	util.DecodeJSON(req.Body, &group)
 	req.Body.Close()
 
-	logging.SendLogRemote(fmt.Sprintf("Crear grupo %s:  %s", group.Name, req.Header.Get("Username")))
+	logging.SendLogRemote(fmt.Sprintf("Crear grupo %s:  %s", group.Name, etc.GetUsername(req)))
 
 	data := etc.GetDb(req)
 
@@ -27,9 +27,9 @@ func CreateGroupHandler(w http.ResponseWriter, req *http.Request) {
 		logging.SendLogRemote(err.Error())
 		etc.ResponseSimple(w, false, fmt.Sprintf("%v", err.Error()))
 	} else {
-		data.GroupUsers[group.Name] = append(data.GroupUsers[group.Name], req.Header.Get("Username"))
+		repository.JoinGroup(data, group.Name, etc.GetUsername(req))
 
-		logging.SendLogRemote(fmt.Sprintf("Grupo creado: %s\n", group))
+		logging.SendLogRemote(fmt.Sprintf("Grupo creado: %s\n", group.Name))
 		etc.ResponseSimple(w, true, fmt.Sprintf("%v", group.Name))
 	}
 
@@ -40,13 +40,13 @@ func JoinGroupHandler(w http.ResponseWriter, req *http.Request) {
 
 	groupName := req.PathValue("group")
 
-	logging.SendLogRemote(fmt.Sprintf("Unirse al grupo %s:  %s", groupName, req.Header.Get("Username")))
+	logging.SendLogRemote(fmt.Sprintf("Unirse al grupo %s:  %s", groupName, etc.GetUsername(req)))
 
 	data := etc.GetDb(req)
 
-	if _, existe := data.Groups[groupName]; existe {
-		if repository.JoinGroup(data, groupName, req.Header.Get("Username")) {
-			logging.SendLogRemote(fmt.Sprintf("Agregado al grupo  %s:  %s", groupName, req.Header.Get("Username")))
+	if _, existe := data.GetGroup(groupName); existe {
+		if repository.JoinGroup(data, groupName, etc.GetUsername(req)) {
+			logging.SendLogRemote(fmt.Sprintf("Agregado al grupo  %s:  %s", groupName, etc.GetUsername(req)))
 			etc.ResponseSimple(w, true, "Agregado al grupo")
 		} else {
 			logging.SendLogRemote("El usuario ya es miembro")
@@ -63,15 +63,15 @@ func UserCanAccessGroupHandler(w http.ResponseWriter, req *http.Request) {
 
 	groupName := req.PathValue("group")
 
-	logging.SendLogRemote(fmt.Sprintf("Comprobando acceso al grupo %s:  %s", groupName, req.Header.Get("Username")))
+	logging.SendLogRemote(fmt.Sprintf("Comprobando acceso al grupo %s:  %s", groupName, etc.GetUsername(req)))
 
 	data := etc.GetDb(req)
 
-	if repository.UserCanAccessGroup(data, groupName, req.Header.Get("Username")) {
-		logging.SendLogRemote(fmt.Sprintf("Usuario %s tiene acceso al grupo %s", groupName, req.Header.Get("Username")))
+	if repository.UserCanAccessGroup(data, groupName, etc.GetUsername(req)) {
+		logging.SendLogRemote(fmt.Sprintf("Usuario %s tiene acceso al grupo %s", groupName, etc.GetUsername(req)))
 		etc.ResponseSimple(w, true, "Acceso permitido")
 	} else {
-		logging.SendLogRemote(fmt.Sprintf("Usuario %s no tiene acceso al grupo %s", groupName, req.Header.Get("Username")))
+		logging.SendLogRemote(fmt.Sprintf("Usuario %s no tiene acceso al grupo %s", groupName, etc.GetUsername(req)))
 		etc.ResponseSimple(w, false, "Acceso denegado")
 	}
 }
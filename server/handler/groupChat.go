@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"server/etc"
+	"server/logging"
+	"server/repository"
+	"server/store"
+	"slices"
+	"strconv"
+	"time"
+	"util"
+	"util/model"
+)
+
+// tamaño máximo de un mensaje cifrado del chat de grupo
+const maxGroupMessage = 4096
+
+// groupMember devuelve el grupo de la ruta si existe y el usuario es miembro, si no responde con el error
+func groupMember(w http.ResponseWriter, req *http.Request) (model.Group, bool) {
+	data := etc.GetDb(req)
+
+	group, ok := data.GetGroup(req.PathValue("group"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return group, false
+	}
+
+	if !repository.UserCanAccessGroup(data, group.Name, etc.GetUsername(req)) {
+		w.WriteHeader(http.StatusForbidden)
+		return group, false
+	}
+
+	return group, true
+}
+
+func LeaveGroupHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	groupName := req.PathValue("group")
+	reqUser := etc.GetUsername(req)
+
+	err := etc.GetDb(req).RemoveGroupUser(groupName, reqUser)
+	if err == store.ErrNotFound {
+		etc.ResponseSimple(w, false, "No eres miembro del grupo")
+		return
+	} else if err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Saliendo del grupo. %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	logging.SendLogRemote(fmt.Sprintf("Eliminado del grupo %s: %s", groupName, reqUser))
+	etc.ResponseSimple(w, true, "Has salido del grupo")
+}
+
+// GetGroupMembersHandler devuelve los miembros y el epoch actual, para repartirles la sender key
+func GetGroupMembersHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	group, ok := groupMember(w, req)
+	if !ok {
+		return
+	}
+
+	info := model.GroupInfo{Name: group.Name, Epoch: group.Epoch, Members: etc.GetDb(req).GroupUsers(group.Name)}
+
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+/*
+PutSenderKeyHandler guarda la sender key del usuario para el epoch actual. Tiene que ir para todos los miembros
+actuales y solo para ellos, con cada copia firmada por su clave RSA. Si el epoch ya no es el actual responde 409.
+*/
+func PutSenderKeyHandler(w http.ResponseWriter, req *http.Request) {
+	reqUser := etc.GetUsername(req)
+
+	group, ok := groupMember(w, req)
+	if !ok {
+		return
+	}
+
+	var key model.SenderKey
+	if err := util.DecodeJSON(req.Body, &key); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if key.Epoch != group.Epoch {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	data := etc.GetDb(req)
+	key.Group, key.Sender = group.Name, reqUser
+
+	members := data.GroupUsers(group.Name)
+	recipients := make([]string, 0, len(key.Keys))
+	for member := range key.Keys {
+		recipients = append(recipients, member)
+	}
+	slices.Sort(members)
+	slices.Sort(recipients)
+	if !slices.Equal(members, recipients) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	u, _ := data.GetUser(reqUser)
+	pubKey := util.ParsePublicKey(u.PubKey)
+	for member, sealed := range key.Keys {
+		if util.CheckSignatureRSA(key.SignedData(member), sealed.Signature, pubKey) != nil {
+			logging.SendLogRemote(fmt.Sprintf("ERROR: Firma de sender key incorrecta de %s", reqUser))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := data.PutSenderKey(key); err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Guardando sender key. %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetSenderKeysHandler devuelve las sender keys del grupo, cada una solo con la copia del usuario
+func GetSenderKeysHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	reqUser := etc.GetUsername(req)
+
+	group, ok := groupMember(w, req)
+	if !ok {
+		return
+	}
+
+	keys := make([]model.SenderKey, 0)
+	for _, k := range etc.GetDb(req).SenderKeys(group.Name) {
+		if sealed, ok := k.Keys[reqUser]; ok {
+			k.Keys = map[string]model.SealedKey{reqUser: sealed}
+			keys = append(keys, k)
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(keys); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// SendGroupMessageHandler guarda un mensaje cifrado con la sender key del epoch actual y lo devuelve con su id
+func SendGroupMessageHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	reqUser := etc.GetUsername(req)
+
+	group, ok := groupMember(w, req)
+	if !ok {
+		return
+	}
+
+	var msg model.GroupMessage
+	if err := util.DecodeJSON(req.Body, &msg); err != nil || msg.Message == "" || len(msg.Message) > maxGroupMessage {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data := etc.GetDb(req)
+
+	// con otro epoch o sin clave repartida los miembros actuales no lo podrían descifrar
+	hasKey := slices.ContainsFunc(data.SenderKeys(group.Name), func(k model.SenderKey) bool {
+		return k.Sender == reqUser && k.Epoch == group.Epoch
+	})
+	if msg.Epoch != group.Epoch || !hasKey {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	msg.Group, msg.Sender, msg.Timestamp, msg.Unverified = group.Name, reqUser, time.Now(), false
+
+	msg, err := data.AppendGroupMessage(msg)
+	if err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Guardando mensaje de grupo. %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetGroupMessagesHandler devuelve los mensajes del grupo posteriores a after que el usuario puede descifrar
+func GetGroupMessagesHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	group, ok := groupMember(w, req)
+	if !ok {
+		return
+	}
+
+	var after int64
+	if s := req.URL.Query().Get("after"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+
+	data := etc.GetDb(req)
+	reqUser := etc.GetUsername(req)
+
+	// solo los que el usuario puede descifrar: los de antes de entrar no llevan clave para él
+	readable := make(map[string]bool)
+	for _, k := range data.SenderKeys(group.Name) {
+		if _, ok := k.Keys[reqUser]; ok {
+			readable[fmt.Sprintf("%s/%d", k.Sender, k.Epoch)] = true
+		}
+	}
+
+	msgs := slices.DeleteFunc(data.GroupMessages(group.Name, after), func(m model.GroupMessage) bool {
+		return !readable[fmt.Sprintf("%s/%d", m.Sender, m.Epoch)]
+	})
+
+	if err := json.NewEncoder(w).Encode(msgs); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"server/etc"
+	"server/logging"
+	"server/store"
+	"strconv"
+	"time"
+	"util"
+	"util/model"
+)
+
+const (
+	// entradas por página del historial si no se indica y como mucho
+	historyPageSize    = 50
+	maxHistoryPageSize = 200
+
+	// tamaño máximo de una entrada cifrada
+	maxHistoryEntry = 64 * 1024
+)
+
+// SetHistoryHandler activa o desactiva el historial en el servidor. Al desactivarlo se borra todo lo guardado
+func SetHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	reqUser := etc.GetUsername(req)
+
+	var settings model.HistorySettings
+	if err := util.DecodeJSON(req.Body, &settings); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data := etc.GetDb(req)
+
+	_, err := data.UpdateUser(reqUser, func(u *model.User) error {
+		if settings.Enabled && !u.History {
+			u.HistoryEpoch = time.Now().UnixNano()
+		}
+		u.History = settings.Enabled
+		return nil
+	})
+	if err == store.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !settings.Enabled {
+		if err := data.DeleteHistory(reqUser); err != nil {
+			logging.SendLogRemote(fmt.Sprintf("ERROR: Borrando historial. %s", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// historyUser devuelve el usuario o responde 403 si no tiene activado el historial
+func historyUser(w http.ResponseWriter, req *http.Request) (model.User, bool) {
+	u, ok := etc.GetDb(req).GetUser(etc.GetUsername(req))
+	if !ok || !u.History {
+		w.WriteHeader(http.StatusForbidden)
+		return u, false
+	}
+	return u, true
+}
+
+// AppendHistoryHandler guarda en el historial del usuario un mensaje de su conversación con otherUser y devuelve la
+// entrada con su seq
+func AppendHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	otherUser := req.PathValue("user")
+	reqUser := etc.GetUsername(req)
+
+	if _, ok := historyUser(w, req); !ok {
+		return
+	}
+
+	var entry model.HistoryEntry
+	if err := util.DecodeJSON(req.Body, &entry); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if entry.MessageId <= 0 || len(entry.Ciphertext) == 0 || len(entry.Ciphertext) > maxHistoryEntry {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	entry, err := etc.GetDb(req).AppendHistory(reqUser, otherUser, entry)
+	if err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Guardando historial. %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(entry); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetHistoryHandler devuelve el historial de la conversación con otherUser a partir del cursor after
+func GetHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	otherUser := req.PathValue("user")
+	reqUser := etc.GetUsername(req)
+
+	u, ok := historyUser(w, req)
+	if !ok {
+		return
+	}
+
+	query := req.URL.Query()
+	after, limit := int64(0), historyPageSize
+
+	if s := query.Get("after"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxHistoryPageSize)
+	}
+
+	// se pide una más para saber si quedan
+	entries := etc.GetDb(req).History(reqUser, otherUser, after, limit+1)
+
+	page := model.HistoryPage{Entries: entries, Next: after, Epoch: u.HistoryEpoch}
+	if len(entries) > limit {
+		page.Entries, page.More = entries[:limit], true
+	}
+	if len(page.Entries) > 0 {
+		page.Next = page.Entries[len(page.Entries)-1].Seq
+	}
+
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -14,7 +14,7 @@ import (
 func CreatePostHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	logging.SendLogRemote(fmt.Sprintf("Publicar post de %s", req.Header.Get("Username")))
+	logging.SendLogRemote(fmt.Sprintf("Publicar post de %s", etc.GetUsername(req)))
 
 	var postContent model.PostContent
 	util.DecodeJSON(req.Body, &postContent)
@@ -22,7 +22,7 @@ func CreatePostHandler(w http.ResponseWriter, req *http.Request) {
 
 	data := etc.GetDb(req)
 
-	post, err := repository.CreatePost(data, postContent.Content, req.Header.Get("Username"), "")
+	post, err := repository.CreatePost(data, postContent.Content, postContent.Signature, etc.GetUsername(req), "")
 
 	if err != nil {
 		w.WriteHeader(400)
@@ -43,7 +43,7 @@ func CreateGroupPostHandler(w http.ResponseWriter, req *http.Request) {
 
 	groupName := req.PathValue("group")
 
-	logging.SendLogRemote(fmt.Sprintf("Publicar post de %s en %s", req.Header.Get("Username"), groupName))
+	logging.SendLogRemote(fmt.Sprintf("Publicar post de %s en %s", etc.GetUsername(req), groupName))
 
 	var postContent model.PostContent
 	util.DecodeJSON(req.Body, &postContent)
@@ -51,7 +51,7 @@ func CreateGroupPostHandler(w http.ResponseWriter, req *http.Request) {
 
 	data := etc.GetDb(req)
 
-	post, err := repository.CreatePost(data, postContent.Content, req.Header.Get("Username"), groupName)
+	post, err := repository.CreatePost(data, postContent.Content, postContent.Signature, etc.GetUsername(req), groupName)
 
 	if err != nil {
 		w.WriteHeader(400)
@@ -75,7 +75,9 @@ func GetPostsHandler(w http.ResponseWriter, req *http.Request) {
 
 	data := etc.GetDb(req)
 
-	page, size, err := etc.GetPaginationSizes(req, len(data.PostIds))
+	allPostIds := data.PostIds()
+
+	page, size, err := etc.GetPaginationSizes(req, len(allPostIds))
 
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -84,7 +86,7 @@ func GetPostsHandler(w http.ResponseWriter, req *http.Request) {
 
 	start := page * size
 	end := start + size
-	n := len(data.PostIds)
+	n := len(allPostIds)
 	if end > n {
 		end = n
 	}
@@ -98,12 +100,12 @@ func GetPostsHandler(w http.ResponseWriter, req *http.Request) {
 		if n < end {
 			end = n
 		}
-		postids = data.PostIds[start:end]
+		postids = allPostIds[start:end]
 	}
 
 	posts := make([]model.Post, end-start)
 	for i, id := range postids {
-		posts[i] = data.Posts[id]
+		posts[i], _ = data.GetPost(id)
 	}
 
 	logging.SendLogRemote(fmt.Sprintf("Enviados posts con id: %v", postids))
@@ -123,14 +125,14 @@ func GetGroupPostsHandler(w http.ResponseWriter, req *http.Request) {
 	data := etc.GetDb(req)
 
 	group := req.PathValue("group")
-	if _, ok := data.Groups[group]; !ok {
+	if _, ok := data.GetGroup(group); !ok {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	postIds, ok := data.GroupPostIds[group]
+	postIds := data.GroupPostIds(group)
 
-	if !ok {
+	if len(postIds) == 0 {
 		w.Write([]byte("[]"))
 		return
 	}
@@ -163,7 +165,7 @@ func GetGroupPostsHandler(w http.ResponseWriter, req *http.Request) {
 
 	posts := make([]model.Post, end-start)
 	for i, id := range postids {
-		posts[i] = data.GroupPosts[id]
+		posts[i], _ = data.GetGroupPost(id)
 	}
 
 	logging.SendLogRemote(fmt.Sprintf("Enviados posts con id: %v", postids))
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"server/etc"
+	"server/logging"
+	"util"
+	"util/model"
+)
+
+// prekeys de un solo uso que se aceptan en una subida
+const maxPreKeysUpload = 100
+
+// PublishPreKeysHandler guarda las prekeys X25519 del usuario. La prekey firmada tiene que venir firmada con su clave RSA
+func PublishPreKeysHandler(w http.ResponseWriter, req *http.Request) {
+	reqUser := etc.GetUsername(req)
+
+	var bundle model.PreKeyBundle
+	if err := util.DecodeJSON(req.Body, &bundle); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := checkBundle(bundle); err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Prekeys de %s. %s", reqUser, err.Error()))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data := etc.GetDb(req)
+
+	u, ok := data.GetUser(reqUser)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if util.CheckSignatureRSA(bundle.SignedData(), bundle.Signature, util.ParsePublicKey(u.PubKey)) != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Firma de prekeys incorrecta de %s", reqUser))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := data.PublishPreKeys(reqUser, bundle); err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Guardando prekeys. %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+func checkBundle(bundle model.PreKeyBundle) error {
+	if len(bundle.IdentityKey) != 32 || len(bundle.SignedPreKey) != 32 {
+		return fmt.Errorf("claves X25519 no válidas")
+	}
+
+	if len(bundle.OneTimePreKeys) > maxPreKeysUpload {
+		return fmt.Errorf("demasiadas prekeys")
+	}
+
+	for _, otk := range bundle.OneTimePreKeys {
+		if otk.Id == 0 || len(otk.Key) != 32 {
+			return fmt.Errorf("prekey de un solo uso no válida")
+		}
+	}
+
+	return nil
+}
+
+// GetPreKeyStatusHandler devuelve lo que el usuario tiene publicado, para que sepa si tiene que subir más prekeys
+func GetPreKeyStatusHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	reqUser := etc.GetUsername(req)
+
+	data := etc.GetDb(req)
+
+	if err := json.NewEncoder(w).Encode(data.PreKeyStatus(reqUser)); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetPreKeyBundleHandler entrega las prekeys de otherUser para empezar un chat con él, gastando una de un solo uso
+func GetPreKeyBundleHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	otherUser := req.PathValue("user")
+
+	data := etc.GetDb(req)
+
+	bundle, ok, err := data.TakePreKeyBundle(otherUser)
+	if err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Leyendo prekeys. %s", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(bundle); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"server/etc"
+	"server/logging"
+	"server/store"
+	"time"
+	"util"
+	"util/model"
+)
+
+const (
+	// sin actividad durante onlineWindow pasa a away y durante awayWindow a offline
+	onlineWindow = 2 * time.Minute
+	awayWindow   = 15 * time.Minute
+)
+
+// presence calcula en now la presencia de u. online indica si tiene algún chat abierto
+func presence(u model.User, online bool, now time.Time) model.Presence {
+	lastSeen := u.Active
+	if u.Seen.After(lastSeen) {
+		lastSeen = u.Seen
+	}
+
+	p := model.Presence{User: u.Name, Status: model.PresenceOffline, LastSeen: lastSeen}
+	switch idle := now.Sub(lastSeen); {
+	case online || idle < onlineWindow:
+		p.Status = model.PresenceOnline
+	case idle < awayWindow:
+		p.Status = model.PresenceAway
+	}
+
+	return p
+}
+
+// GetPresenceHandler devuelve la presencia de otherUser, o hidden si la ha ocultado y no es el propio usuario
+func GetPresenceHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	otherUser := req.PathValue("user")
+	reqUser := etc.GetUsername(req)
+
+	u, ok := etc.GetDb(req).GetUser(otherUser)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	p := presence(u, etc.GetHub(req).Online(otherUser), time.Now())
+	if otherUser == reqUser {
+		p.Hidden = u.HidePresence
+	} else if u.HidePresence {
+		p = model.Presence{User: u.Name, Status: model.PresenceHidden}
+	}
+
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// SetPresenceHandler oculta o vuelve a mostrar la presencia del usuario a los demás
+func SetPresenceHandler(w http.ResponseWriter, req *http.Request) {
+	reqUser := etc.GetUsername(req)
+
+	var settings model.PresenceSettings
+	if err := util.DecodeJSON(req.Body, &settings); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	_, err := etc.GetDb(req).UpdateUser(reqUser, func(u *model.User) error {
+		u.HidePresence = settings.Hidden
+		return nil
+	})
+	if err == store.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
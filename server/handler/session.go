@@ -0,0 +1,193 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"server/etc"
+	"server/logging"
+	"server/session"
+	"server/store"
+	"strings"
+	"time"
+	"util"
+	"util/model"
+)
+
+const (
+	// sesiones abiertas como mucho por usuario, al pasarse se cierran las más antiguas
+	maxSessions = 20
+
+	maxDeviceName = 64
+)
+
+// startSession abre una sesión de u en device y responde al login con sus tokens
+func startSession(w http.ResponseWriter, data store.Store, u model.User, device string, msg string) {
+	now := time.Now()
+
+	device = strings.TrimSpace(device)
+	if device == "" {
+		device = "desconocido"
+	} else if len(device) > maxDeviceName {
+		device = device[:maxDeviceName]
+	}
+
+	s, refresh := session.New(u.Name, device, now)
+	if err := data.CreateSession(s); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		etc.ResponseAuth(w, false, "Error guardando la sesión", model.User{})
+		return
+	}
+
+	pruneSessions(data, u.Name, now)
+
+	token, _ := session.Issue(s, u.Role, now)
+	user := model.User{Name: u.Name, Role: u.Role, History: u.History, HistoryEpoch: u.HistoryEpoch, HidePresence: u.HidePresence, TwoFactor: u.TwoFactor, Token: token}
+	etc.ResponseSession(w, msg, user, refresh)
+}
+
+// pruneSessions cierra las sesiones caducadas de user y las que sobren de maxSessions, las más antiguas
+func pruneSessions(data store.Store, user string, now time.Time) {
+	keep := make(map[string]bool)
+	for _, s := range data.Sessions(user) {
+		if !session.Expired(s, now) && len(keep) < maxSessions {
+			keep[s.Id] = true
+		}
+	}
+
+	if _, err := revokeSessions(data, user, func(s model.Session) bool { return !keep[s.Id] }); err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Cerrando sesiones de %s. %s", user, err.Error()))
+	}
+}
+
+// revokeSessions borra las sesiones de user para las que del devuelve true e invalida los tokens de acceso que les
+// queden
+func revokeSessions(data store.Store, user string, del func(s model.Session) bool) (int, error) {
+	now := time.Now()
+	return data.DeleteSessions(user, func(s model.Session) bool {
+		if !del(s) {
+			return false
+		}
+
+		session.Revoke(s.Id, now)
+		return true
+	})
+}
+
+// RefreshSessionHandler cambia el refresh token de una sesión por un par nuevo. No lleva Authorization porque el token
+// de acceso puede haber caducado
+func RefreshSessionHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body model.RefreshRequest
+	if err := util.DecodeJSON(req.Body, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, err := session.Id(body.Refresh)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	data := etc.GetDb(req)
+
+	u, ok := data.GetUser(body.User)
+	if !ok || u.Blocked {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var tokens model.SessionTokens
+
+	// dentro de UpdateSession para que el mismo refresh token no sirva dos veces
+	now := time.Now()
+	s, err := data.UpdateSession(body.User, id, func(s *model.Session) error {
+		if err := session.CheckRefresh(*s, body.Refresh, now); err != nil {
+			return err
+		}
+
+		tokens.Refresh = session.Rotate(s, now)
+		return nil
+	})
+	if err == store.ErrNotFound || err == session.ErrInvalid || err == session.ErrExpired {
+		logging.SendLogRemote(fmt.Sprintf("Error renovando la sesión de %s. %s", body.User, err.Error()))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	tokens.Token, tokens.Expires = session.Issue(s, u.Role, now)
+
+	if err := json.NewEncoder(w).Encode(tokens); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// LogoutHandler cierra la sesión con la que se hace la petición
+func LogoutHandler(w http.ResponseWriter, req *http.Request) {
+	reqUser := etc.GetUsername(req)
+	current := etc.GetSessionId(req)
+
+	if _, err := revokeSessions(etc.GetDb(req), reqUser, func(s model.Session) bool { return s.Id == current }); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetSessionsHandler devuelve las sesiones abiertas del usuario, marcando la de la petición
+func GetSessionsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	reqUser := etc.GetUsername(req)
+	current := etc.GetSessionId(req)
+
+	now := time.Now()
+	sessions := make([]model.SessionInfo, 0)
+	for _, s := range etc.GetDb(req).Sessions(reqUser) {
+		if !session.Expired(s, now) {
+			sessions = append(sessions, session.Info(s, current))
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(sessions); err != nil {
+		logging.SendLogRemote("ERROR: Error json")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// RevokeSessionHandler cierra una sesión del usuario, que puede ser la de la petición
+func RevokeSessionHandler(w http.ResponseWriter, req *http.Request) {
+	reqUser := etc.GetUsername(req)
+	id := req.PathValue("id")
+
+	n, err := revokeSessions(etc.GetDb(req), reqUser, func(s model.Session) bool { return s.Id == id })
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+}
+
+// RevokeSessionsHandler cierra todas las sesiones del usuario menos la de la petición, que se cierra con /logout
+func RevokeSessionsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	reqUser := etc.GetUsername(req)
+	current := etc.GetSessionId(req)
+
+	n, err := revokeSessions(etc.GetDb(req), reqUser, func(s model.Session) bool { return s.Id != current })
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	etc.ResponseSimple(w, true, fmt.Sprintf("%d sesiones cerradas", n))
+}
@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"server/etc"
+	"server/hub"
+	"server/logging"
+	"server/store"
+	"time"
+	"util/model"
+
+	"github.com/gorilla/websocket"
+)
+
+// el servidor manda un ping cada pingInterval y corta la conexión si no recibe nada del cliente en pongWait
+const (
+	pingInterval = 30 * time.Second
+	pongWait     = 60 * time.Second
+	writeWait    = 10 * time.Second
+
+	maxFrameSize = 64 * 1024
+)
+
+var upgrader = websocket.Upgrader{}
+
+/*
+SocketHandler abre el websocket de chat del usuario. Por una sola conexión van todas sus conversaciones: envía,
+confirma y marca como leídos mensajes, avisa de que está escribiendo y recibe los mensajes, confirmaciones de lectura y
+avisos de los demás. El formato de los mensajes está en model.SocketFrame.
+
+Gorilla solo admite un escritor a la vez, así que todo lo que se envía pasa por socketWriter.
+*/
+func SocketHandler(w http.ResponseWriter, req *http.Request) {
+	reqUser := etc.GetUsername(req)
+
+	data := etc.GetDb(req)
+	chats := etc.GetHub(req)
+
+	if chats == nil {
+		logging.SendLogRemote("ERROR: Websocket no disponible")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// Upgrade ya ha respondido con el error
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Abriendo websocket. %s", err.Error()))
+		return
+	}
+	defer conn.Close()
+
+	events, cancel := chats.Subscribe(reqUser)
+
+	out := make(chan model.SocketFrame, 16)
+	done := make(chan struct{})
+	go socketWriter(conn, events, out, done)
+
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	conn.SetReadLimit(maxFrameSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		var frame model.SocketFrame
+		if err := conn.ReadJSON(&frame); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+
+		for _, reply := range handleFrame(data, chats, reqUser, frame) {
+			select {
+			case out <- reply:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+// handleFrame procesa un mensaje del cliente y devuelve las respuestas que hay que mandarle
+func handleFrame(data store.Store, chats *hub.Hub, reqUser string, frame model.SocketFrame) []model.SocketFrame {
+	switch frame.Type {
+	case model.FrameSend:
+		if frame.Message == nil {
+			return []model.SocketFrame{{Type: model.FrameError, Ref: frame.Ref, Error: "mensaje vacío"}}
+		}
+
+		msg, err := sendMessage(data, chats, reqUser, frame.User, *frame.Message)
+		if err != nil {
+			return []model.SocketFrame{{Type: model.FrameError, Ref: frame.Ref, Error: err.Error()}}
+		}
+
+		return []model.SocketFrame{{Type: model.FrameSent, User: frame.User, Ref: frame.Ref, Id: msg.Id}}
+	case model.FrameSync:
+		if frame.Id > 0 {
+			if err := data.AckMessages(frame.User, reqUser, frame.Id); err != nil {
+				logging.SendLogRemote(fmt.Sprintf("ERROR: Confirmando mensajes. %s", err.Error()))
+			}
+			updateReceipt(data, chats, frame.User, reqUser, frame.Id, 0)
+		}
+
+		replies := make([]model.SocketFrame, 0)
+		for _, msg := range data.PendingMessages(frame.User, reqUser, frame.Id) {
+			replies = append(replies, messageFrame(frame.User, msg))
+		}
+		return replies
+	case model.FrameAck:
+		if err := data.AckMessages(frame.User, reqUser, frame.Id); err != nil {
+			logging.SendLogRemote(fmt.Sprintf("ERROR: Confirmando mensajes. %s", err.Error()))
+			return []model.SocketFrame{{Type: model.FrameError, Ref: frame.Ref, Error: "error confirmando mensajes"}}
+		}
+
+		if updateReceipt(data, chats, frame.User, reqUser, frame.Id, 0) != nil {
+			return []model.SocketFrame{{Type: model.FrameError, Ref: frame.Ref, Error: "error confirmando mensajes"}}
+		}
+	case model.FrameRead:
+		if readMessages(data, chats, frame.User, reqUser, frame.Id) != nil {
+			return []model.SocketFrame{{Type: model.FrameError, Ref: frame.Ref, Error: "error confirmando lectura"}}
+		}
+	case model.FrameTyping:
+		chats.Publish(hub.Event{Type: hub.EventTyping, From: reqUser, To: frame.User})
+	default:
+		return []model.SocketFrame{{Type: model.FrameError, Ref: frame.Ref, Error: fmt.Sprintf("tipo desconocido: %s", frame.Type)}}
+	}
+
+	return nil
+}
+
+func messageFrame(sender string, msg model.Message) model.SocketFrame {
+	return model.SocketFrame{Type: model.FrameMessage, User: sender, Id: msg.Id, Message: &msg}
+}
+
+// socketWriter escribe los eventos del hub y las respuestas del handler hasta que se cierra la suscripción
+func socketWriter(conn *websocket.Conn, events <-chan hub.Event, out <-chan model.SocketFrame, done chan<- struct{}) {
+	defer close(done)
+	// cerrar la conexión desbloquea la lectura del handler
+	defer conn.Close()
+
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	for {
+		var frame model.SocketFrame
+
+		select {
+		case e, ok := <-events:
+			if !ok {
+				// servidor apagándose o cliente demasiado lento, el cliente debe reconectar
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(writeWait))
+				return
+			}
+
+			switch e.Type {
+			case hub.EventMessage:
+				frame = messageFrame(e.From, e.Message)
+			case hub.EventTyping:
+				frame = model.SocketFrame{Type: model.FrameTyping, User: e.From}
+			case hub.EventReceipt:
+				frame = model.SocketFrame{Type: model.FrameReceipt, User: e.From, Receipt: &e.Receipt}
+			case hub.EventExpiry:
+				frame = model.SocketFrame{Type: model.FrameExpiry, User: e.From, Expiry: &e.Expiry}
+			}
+		case frame = <-out:
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+			continue
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := conn.WriteJSON(frame); err != nil {
+			return
+		}
+	}
+}
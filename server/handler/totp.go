@@ -0,0 +1,227 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"server/etc"
+	"server/logging"
+	"server/store"
+	"server/totp"
+	"slices"
+	"time"
+	"util"
+	"util/model"
+)
+
+const (
+	// tiempo para meter el código tras la contraseña y fallos permitidos antes de tener que empezar de nuevo
+	ticketLifetime = 5 * time.Minute
+	ticketAttempts = 5
+)
+
+var (
+	errBadCode      = fmt.Errorf("código de verificación incorrecto")
+	errNoTwoFactor  = fmt.Errorf("la verificación en dos pasos no está activada")
+	errTwoFactorOn  = fmt.Errorf("la verificación en dos pasos ya está activada")
+	errNoEnrollment = fmt.Errorf("no hay ninguna activación pendiente")
+)
+
+// checkCode comprueba dentro de UpdateUser un código TOTP o de recuperación de u y lo gasta
+func checkCode(u *model.User, code string, now time.Time) error {
+	if !u.TwoFactor {
+		return errNoTwoFactor
+	}
+
+	if step, ok := totp.Check(u.TOTPSecret, code, u.TOTPStep, now); ok {
+		u.TOTPStep = step
+		return nil
+	}
+
+	if i, ok := totp.CheckRecovery(u.RecoveryCodes, code); ok {
+		// copia nueva, la anterior puede estar compartida con quien haya leído el usuario
+		u.RecoveryCodes = slices.Delete(slices.Clone(u.RecoveryCodes), i, i+1)
+		return nil
+	}
+
+	return errBadCode
+}
+
+// secondFactor responde con un ticket para /login/totp si u tiene la verificación en dos pasos, y entonces devuelve true
+func secondFactor(w http.ResponseWriter, data store.Store, u model.User, device string) bool {
+	if !u.TwoFactor {
+		return false
+	}
+
+	if u.Blocked {
+		w.WriteHeader(401)
+		etc.ResponseAuth(w, false, "Usuario bloqueado por el administrador", model.User{})
+		return true
+	}
+
+	id := make([]byte, 32)
+	rand.Read(id)
+	ticket := hex.EncodeToString(id)
+
+	data.SetLoginTicket(ticket, model.LoginTicket{User: u.Name, Device: device, Expires: time.Now().Add(ticketLifetime)})
+	etc.ResponseTicket(w, "Introduce el código de verificación", ticket)
+	return true
+}
+
+// LoginTOTPHandler es el segundo paso del login: con el ticket de la contraseña y un código correcto abre la sesión
+func LoginTOTPHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var login model.TOTPLogin
+	util.DecodeJSON(req.Body, &login)
+	req.Body.Close()
+
+	logging.SendLogRemote(fmt.Sprintf("Login, segundo paso: %s", login.User))
+
+	data := etc.GetDb(req)
+	now := time.Now()
+
+	ticket, ok := data.TakeLoginTicket(login.Ticket, now)
+	if !ok || ticket.User != login.User {
+		w.WriteHeader(401)
+		etc.ResponseAuth(w, false, "El login ha caducado, vuelve a empezar", model.User{})
+		return
+	}
+
+	u, err := data.UpdateUser(ticket.User, func(u *model.User) error {
+		if err := checkCode(u, login.Code, now); err != nil {
+			return err
+		}
+		return touchLogin(u)
+	})
+	switch err {
+	case nil:
+	case errBadCode:
+		if ticket.Attempts++; ticket.Attempts < ticketAttempts {
+			data.SetLoginTicket(login.Ticket, ticket)
+		}
+		w.WriteHeader(401)
+		etc.ResponseAuth(w, false, "Código incorrecto", model.User{})
+		return
+	case errBlocked:
+		w.WriteHeader(401)
+		etc.ResponseAuth(w, false, "Usuario bloqueado por el administrador", model.User{})
+		return
+	case errNoTwoFactor, store.ErrNotFound:
+		w.WriteHeader(401)
+		etc.ResponseAuth(w, false, "El login ha caducado, vuelve a empezar", model.User{})
+		return
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		etc.ResponseAuth(w, false, "Error guardando el usuario", model.User{})
+		return
+	}
+
+	startSession(w, data, u, ticket.Device, "Credenciales válidas")
+}
+
+// StartTOTPHandler genera un secreto para la verificación en dos pasos, que no se activa hasta confirmarlo con un código
+func StartTOTPHandler(w http.ResponseWriter, req *http.Request) {
+	reqUser := etc.GetUsername(req)
+	secret := totp.NewSecret()
+
+	_, err := etc.GetDb(req).UpdateUser(reqUser, func(u *model.User) error {
+		if u.TwoFactor {
+			return errTwoFactorOn
+		}
+		u.TOTPPending = secret
+		return nil
+	})
+	if !totpResponse(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(model.TOTPEnrollment{Secret: totp.Encode(secret), URI: totp.URI(reqUser, secret)})
+	util.FailOnError(err)
+}
+
+// ConfirmTOTPHandler activa la verificación en dos pasos con el primer código y devuelve los códigos de recuperación
+func ConfirmTOTPHandler(w http.ResponseWriter, req *http.Request) {
+	reqUser := etc.GetUsername(req)
+
+	var body model.TOTPCode
+	if err := util.DecodeJSON(req.Body, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes := totp.NewRecoveryCodes()
+	now := time.Now()
+
+	_, err := etc.GetDb(req).UpdateUser(reqUser, func(u *model.User) error {
+		if u.TwoFactor {
+			return errTwoFactorOn
+		}
+		if u.TOTPPending == nil {
+			return errNoEnrollment
+		}
+
+		step, ok := totp.Check(u.TOTPPending, body.Code, 0, now)
+		if !ok {
+			return errBadCode
+		}
+
+		u.TwoFactor, u.TOTPSecret, u.TOTPPending, u.TOTPStep, u.RecoveryCodes = true, u.TOTPPending, nil, step, hashes
+		return nil
+	})
+	if !totpResponse(w, err) {
+		return
+	}
+
+	logging.SendLogRemote(fmt.Sprintf("Verificación en dos pasos activada: %s", reqUser))
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(model.RecoveryCodes{Codes: codes})
+	util.FailOnError(err)
+}
+
+// DisableTOTPHandler desactiva la verificación en dos pasos, pidiendo un código o uno de recuperación
+func DisableTOTPHandler(w http.ResponseWriter, req *http.Request) {
+	reqUser := etc.GetUsername(req)
+
+	var body model.TOTPCode
+	if err := util.DecodeJSON(req.Body, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	_, err := etc.GetDb(req).UpdateUser(reqUser, func(u *model.User) error {
+		if err := checkCode(u, body.Code, time.Now()); err != nil {
+			return err
+		}
+
+		u.TwoFactor, u.TOTPSecret, u.TOTPPending, u.TOTPStep, u.RecoveryCodes = false, nil, nil, 0, nil
+		return nil
+	})
+	if !totpResponse(w, err) {
+		return
+	}
+
+	logging.SendLogRemote(fmt.Sprintf("Verificación en dos pasos desactivada: %s", reqUser))
+}
+
+// totpResponse responde al error de UpdateUser y devuelve si se puede seguir. Un código mal es 403 y no 401, que el
+// cliente toma como token caducado
+func totpResponse(w http.ResponseWriter, err error) bool {
+	switch err {
+	case nil:
+		return true
+	case errBadCode:
+		w.WriteHeader(http.StatusForbidden)
+	case errTwoFactorOn, errNoTwoFactor, errNoEnrollment:
+		w.WriteHeader(http.StatusConflict)
+	case store.ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	return false
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"server/etc"
 	"server/logging"
+	"server/store"
 	"strings"
 	"util"
 	"util/model"
@@ -23,8 +24,10 @@ func GetUserNamesHandler(w http.ResponseWriter, req *http.Request) {
 
 	var users []model.UserPublicData
 
+	userNames := data.UserNames()
+
 	if name == "" {
-		n := len(data.UserNames)
+		n := len(userNames)
 		page, size, err := etc.GetPaginationSizes(req, n)
 
 		start, end := etc.PageAndSizeToStartEnd(page, size, n)
@@ -38,8 +41,9 @@ func GetUserNamesHandler(w http.ResponseWriter, req *http.Request) {
 		}
 
 		i := 0
-		for _, u := range data.UserNames[start:end] {
-			users[i] = model.UserPublicData{Name: u, Blocked: data.Users[u].Blocked, Role: data.Users[u].Role}
+		for _, username := range userNames[start:end] {
+			u, _ := data.GetUser(username)
+			users[i] = model.MakeUserPublicData(u)
 			i++
 		}
 	} else {
@@ -70,7 +74,7 @@ func GetUserNamesHandler(w http.ResponseWriter, req *http.Request) {
 		users = make([]model.UserPublicData, 0)
 
 		i := 0
-		for _, u := range data.UserNames {
+		for _, u := range userNames {
 			logging.SendLogRemote(fmt.Sprintf("%v", u))
 
 			if strings.Contains(u, name) {
@@ -78,7 +82,8 @@ func GetUserNamesHandler(w http.ResponseWriter, req *http.Request) {
 
 				if start <= i && i < end {
 					logging.SendLogRemote(fmt.Sprintf("%v esta entre %v y %v", u, start, end))
-					users = append(users, model.MakeUserPublicData(data.Users[u]))
+					user, _ := data.GetUser(u)
+					users = append(users, model.MakeUserPublicData(user))
 				}
 
 				i++
@@ -98,12 +103,6 @@ func SetBlocked(w http.ResponseWriter, req *http.Request) {
 	otherUser := req.PathValue("user")
 
 	data := etc.GetDb(req)
-	u, ok := data.Users[otherUser]
-
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
 
 	var block model.Block
 	err := util.DecodeJSON(req.Body, &block)
@@ -114,9 +113,26 @@ func SetBlocked(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	u.Blocked = block.Blocked
+	_, err = data.UpdateUser(otherUser, func(u *model.User) error {
+		u.Blocked = block.Blocked
+		return nil
+	})
+
+	if err == store.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	data.Users[otherUser] = u
+	// al bloquearlo se cierran todas sus sesiones
+	if block.Blocked {
+		if _, err := revokeSessions(data, otherUser, func(model.Session) bool { return true }); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,121 @@
+/*
+Reparto en tiempo real de eventos de chat. Cada conexión abierta (stream SSE o websocket) se suscribe a los eventos que
+recibe un usuario: los mensajes nuevos, las confirmaciones de entrega y lectura de los que ha enviado y los avisos de que
+alguien le está escribiendo, además de los cambios en los mensajes temporales de sus conversaciones.
+
+El hub no guarda nada: los mensajes se persisten en el Store antes de publicarse y un suscriptor que se quede atrás o se
+reconecte los recupera de ahí. Las confirmaciones también están en el Store y los avisos de escritura son efímeros, así
+que ambos se pueden perder.
+*/
+package hub
+
+import (
+	"sync"
+	"util/model"
+)
+
+// eventos que puede acumular un suscriptor lento antes de desconectarlo
+const bufferSize = 64
+
+const (
+	EventMessage = "message"
+	EventTyping  = "typing"
+	EventReceipt = "receipt"
+	EventExpiry  = "expiry"
+)
+
+type Event struct {
+	Type    string
+	From    string
+	To      string
+	Message model.Message
+	Receipt model.Receipt
+	Expiry  model.Expiry
+}
+
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[string]map[chan Event]struct{}
+	closed bool
+}
+
+func New() *Hub {
+	return &Hub{subs: make(map[string]map[chan Event]struct{})}
+}
+
+// Subscribe devuelve un canal con los eventos dirigidos a user. El canal se cierra al llamar a cancel o a Close
+func (h *Hub) Subscribe(user string) (<-chan Event, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan Event, bufferSize)
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	if h.subs[user] == nil {
+		h.subs[user] = make(map[chan Event]struct{})
+	}
+	h.subs[user][ch] = struct{}{}
+
+	cancel := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		h.remove(user, ch)
+	}
+
+	return ch, cancel
+}
+
+// se llama con mu bloqueado
+func (h *Hub) remove(user string, ch chan Event) {
+	if _, ok := h.subs[user][ch]; !ok {
+		return
+	}
+
+	delete(h.subs[user], ch)
+	if len(h.subs[user]) == 0 {
+		delete(h.subs, user)
+	}
+	close(ch)
+}
+
+// Publish no bloquea nunca. Si un suscriptor tiene el buffer lleno, los avisos y confirmaciones se descartan y con un
+// mensaje se le cierra el canal, al reconectar recupera del Store lo que se haya perdido
+func (h *Hub) Publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs[e.To] {
+		select {
+		case ch <- e:
+		default:
+			if e.Type == EventMessage {
+				h.remove(e.To, ch)
+			}
+		}
+	}
+}
+
+// Online indica si user tiene abierto algún stream o websocket
+func (h *Hub) Online(user string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.subs[user]) > 0
+}
+
+// Close cierra todos los suscriptores, se usa al apagar el servidor para que las conexiones abiertas terminen
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for user, subs := range h.subs {
+		for ch := range subs {
+			h.remove(user, ch)
+		}
+	}
+}
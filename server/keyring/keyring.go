@@ -0,0 +1,152 @@
+/*
+Gestión de la clave de la base de datos.
+
+Los datos se cifran con una clave de datos aleatoria de 32 bytes. Esa clave se guarda cifrada (envuelta) con una clave
+derivada de la frase de paso del administrador con Argon2id. La cabecera con la sal, los parámetros de Argon2 y la
+clave envuelta va junto a los datos, así que cambiar la frase de paso solo reescribe la cabecera.
+*/
+package keyring
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"util"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var magic = []byte("GSKH")
+
+var wrapAD = []byte("keyring")
+
+// parámetros por defecto de Argon2id (memoria en KiB)
+const (
+	defaultTime    = 3
+	defaultMemory  = 64 * 1024
+	defaultThreads = 4
+)
+
+// límites de los parámetros que se aceptan al leer una cabecera: con Threads 0 Argon2 entra en pánico y con una memoria
+// enorme se agota la del servidor
+const (
+	maxTime    = 16
+	minMemory  = 8 * 1024
+	maxMemory  = 1024 * 1024
+	maxThreads = 64
+	minSalt    = 16
+)
+
+type Header struct {
+	Salt    []byte
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	Wrapped []byte
+}
+
+func (h Header) kek(passphrase []byte) []byte {
+	return argon2.IDKey(passphrase, h.Salt, h.Time, h.Memory, h.Threads, 32)
+}
+
+// New genera una clave de datos aleatoria y la cabecera que la envuelve con la frase de paso
+func New(passphrase []byte) (Header, []byte) {
+	dataKey := make([]byte, 32)
+	rand.Read(dataKey)
+
+	return Wrap(dataKey, passphrase), dataKey
+}
+
+// Wrap envuelve una clave de datos ya existente con una sal nueva
+func Wrap(dataKey []byte, passphrase []byte) Header {
+	h := Header{Salt: make([]byte, 16), Time: defaultTime, Memory: defaultMemory, Threads: defaultThreads}
+	rand.Read(h.Salt)
+
+	h.Wrapped = util.EncryptAD(dataKey, h.kek(passphrase), wrapAD)
+	return h
+}
+
+// Unwrap recupera la clave de datos. Falla si la frase de paso no es la correcta
+func (h Header) Unwrap(passphrase []byte) ([]byte, error) {
+	dataKey, err := util.DecryptAD(h.Wrapped, h.kek(passphrase), wrapAD)
+	if err != nil {
+		return nil, fmt.Errorf("clave incorrecta")
+	}
+
+	return dataKey, nil
+}
+
+// Rewrap cambia la frase de paso sin tocar la clave de datos
+func (h Header) Rewrap(oldPassphrase []byte, newPassphrase []byte) (Header, error) {
+	dataKey, err := h.Unwrap(oldPassphrase)
+	if err != nil {
+		return h, err
+	}
+
+	return Wrap(dataKey, newPassphrase), nil
+}
+
+// Marshal codifica la cabecera como [GSKH][longitud uint32][json]
+func (h Header) Marshal() []byte {
+	jsonData, err := json.Marshal(h)
+	util.FailOnError(err)
+
+	out := make([]byte, len(magic)+4, len(magic)+4+len(jsonData))
+	copy(out, magic)
+	binary.BigEndian.PutUint32(out[len(magic):], uint32(len(jsonData)))
+
+	return append(out, jsonData...)
+}
+
+// HasHeader indica si data empieza por una cabecera. Los archivos anteriores no la tienen
+func HasHeader(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// Parse lee la cabecera del principio de data y devuelve lo que va detrás
+func Parse(data []byte) (Header, []byte, error) {
+	var h Header
+
+	if !HasHeader(data) || len(data) < len(magic)+4 {
+		return h, nil, fmt.Errorf("cabecera de clave no encontrada")
+	}
+
+	n := int(binary.BigEndian.Uint32(data[len(magic):]))
+	start := len(magic) + 4
+	if len(data) < start+n {
+		return h, nil, fmt.Errorf("cabecera de clave incompleta")
+	}
+
+	if err := json.Unmarshal(data[start:start+n], &h); err != nil {
+		return h, nil, err
+	}
+
+	if err := h.validate(); err != nil {
+		return h, nil, err
+	}
+
+	return h, data[start+n:], nil
+}
+
+func (h Header) validate() error {
+	switch {
+	case h.Time == 0 || h.Time > maxTime:
+		return fmt.Errorf("cabecera de clave no válida: %d iteraciones", h.Time)
+	case h.Threads == 0 || h.Threads > maxThreads:
+		return fmt.Errorf("cabecera de clave no válida: %d hilos", h.Threads)
+	case h.Memory < minMemory || h.Memory > maxMemory:
+		return fmt.Errorf("cabecera de clave no válida: %d KiB de memoria", h.Memory)
+	case len(h.Salt) < minSalt:
+		return fmt.Errorf("cabecera de clave no válida: sal de %d bytes", len(h.Salt))
+	case len(h.Wrapped) == 0:
+		return fmt.Errorf("cabecera de clave no válida: sin clave envuelta")
+	}
+	return nil
+}
+
+// LegacyKey es la clave que se usaba antes de tener cabecera: sha256 de la frase de paso
+func LegacyKey(passphrase []byte) []byte {
+	return util.Hash(passphrase)
+}
@@ -5,32 +5,163 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 	"util"
+	"util/model"
 )
 
+// credencial para el servidor de logs y backups, es independiente de la clave de la base de datos
 var key []byte
 
 var client *http.Client
 
+// URL base del servidor de logs y backups
+var url = "https://localhost:10444"
+
+/*
+Los logs y los backups se envían en segundo plano para no bloquear las peticiones. Los logs se encolan en orden y, si
+la cola se llena, SendLogRemote espera. De los backups solo interesa el último, así que uno nuevo sustituye al que
+todavía no se haya enviado. Close vacía las colas antes de apagar el servidor.
+*/
+var (
+	logs    = make(chan string, 1024)
+	backups = make(chan []byte, 1)
+	stopped = make(chan struct{})
+
+	mu     sync.RWMutex
+	closed bool
+)
+
 func init() {
 
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
-	client = &http.Client{Transport: tr}
+	client = &http.Client{Transport: tr, Timeout: 10 * time.Second}
+
+	go sender()
 }
 
-func SetKey(serverKey []byte) {
-	key = serverKey
+func SetKey(logKey []byte) {
+	key = logKey
+}
+
+func SetURL(logURL string) {
+	url = logURL
 }
 
 func SendLogRemote(action string) {
 	currentTime := time.Now().Format("2006/01/02 15:04:05")
 	logMessage := fmt.Sprintf("%s INFO %s", currentTime, action)
 
-	req, err := http.NewRequest("POST", "https://localhost:10444/logs", bytes.NewReader([]byte(logMessage)))
-	req.Header.Set("Authorization", util.Encode64(key))
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if closed {
+		fmt.Println(logMessage)
+		return
+	}
+
+	logs <- logMessage
+}
+
+// SendBackup encola una copia cifrada de la base de datos para el servidor de logs
+func SendBackup(backup []byte) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if closed {
+		return
+	}
+
+	for {
+		select {
+		case backups <- backup:
+			return
+		case <-backups:
+			// se descarta el backup pendiente, el nuevo es más reciente
+		}
+	}
+}
+
+// Close deja de aceptar logs y backups y espera como mucho timeout a que se envíen los pendientes
+func Close(timeout time.Duration) error {
+	mu.Lock()
+	if !closed {
+		closed = true
+		close(logs)
+		close(backups)
+	}
+	mu.Unlock()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("quedan logs o backups sin enviar")
+	}
+}
+
+func sender() {
+	defer close(stopped)
+
+	// copias locales para poder anular cada canal cuando se cierra
+	logs, backups := logs, backups
+
+	for logs != nil || backups != nil {
+		select {
+		case msg, ok := <-logs:
+			if !ok {
+				logs = nil
+				continue
+			}
+			sendLog(msg)
+		case backup, ok := <-backups:
+			if !ok {
+				backups = nil
+				continue
+			}
+			if err := sendBackup(backup); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+func sendLog(logMessage string) {
+	req, err := http.NewRequest("POST", url+"/logs", bytes.NewReader([]byte(logMessage)))
 	util.FailOnError(err)
-	client.Do(req)
+	req.Header.Set("Authorization", util.Encode64(key))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
+
+func sendBackup(backup []byte) error {
+	req, err := http.NewRequest("POST", url+"/backup", bytes.NewReader(backup))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Authorization", util.Encode64(key))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var r = model.Resp{}
+	util.DecodeJSON(resp.Body, &r)
+
+	if !r.Ok {
+		msg, _ := util.Decode64(r.Msg)
+		return fmt.Errorf("backup rechazado: %s", msg)
+	}
+
+	return nil
 }
@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Close no vuelve hasta que se han enviado los logs encolados y el último backup
+func TestCloseFlushesQueue(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string][]string)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		mu.Lock()
+		received[req.URL.Path] = append(received[req.URL.Path], string(body))
+		mu.Unlock()
+		w.Write([]byte(`{"Ok":true}`))
+	}))
+	defer srv.Close()
+
+	SetURL(srv.URL)
+
+	for i := 0; i < 50; i++ {
+		SendLogRemote("log")
+	}
+	SendBackup([]byte("backup"))
+
+	if err := Close(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if n := len(received["/logs"]); n != 50 {
+		t.Errorf("%d logs enviados, se esperaban 50", n)
+	}
+	if b := received["/backup"]; len(b) == 0 || b[len(b)-1] != "backup" {
+		t.Errorf("backup no enviado: %v", b)
+	}
+}
@@ -3,16 +3,21 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha256"
-	"crypto/tls"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"server/config"
+	"server/etc"
 	"server/handler"
+	"server/hub"
 	"server/logging"
 	"server/middleware"
+	"server/password"
+	"server/session"
+	"server/store"
 	"strconv"
 	"strings"
 	"syscall"
@@ -21,154 +26,230 @@ import (
 	"util/model"
 )
 
-var key []byte //clave para encriptar y desencriptar la base de datos, se introduce manualmente al arrancar el servidor
+var data store.Store
 
-var data model.Database
+var stdin = bufio.NewReader(os.Stdin)
 
-// este metodo guarda la info de la base de datos en un archivo json sin encriptar para que podamos ver el contenido
+// debugDump activa el volcado en claro de saveDatabaseJSON
+var debugDump bool
+
+// este metodo guarda la info de la base de datos en un archivo json sin encriptar para que podamos ver el contenido.
+// Solo con la opción de depuración, y sin los secretos de login
 func saveDatabaseJSON() {
-	jsonData := util.EncodeJSON(data)
+	if !debugDump {
+		return
+	}
 
-	err := os.WriteFile("db.json", jsonData, 0644)
+	db, err := data.Export()
 	util.FailOnError(err)
-}
 
-func saveDatabase() {
-	jsonData := util.EncodeJSON(data)
-
-	encryptedData := util.Encrypt(jsonData, key)
+	jsonData := util.EncodeJSON(redact(db))
 
-	err := os.WriteFile("db.enc", encryptedData, 0644)
+	err = os.WriteFile("db.json", jsonData, 0600)
 	util.FailOnError(err)
 
-	buffer := bytes.NewBuffer(encryptedData)
-
-	req, err := http.NewRequest("POST", "https://localhost:10444/backup", buffer)
-	util.FailOnError(err)
+	// WriteFile no cambia los permisos si el archivo ya existía
+	util.FailOnError(os.Chmod("db.json", 0600))
+}
 
-	req.Header.Add("Authorization", util.Encode64(key))
+// redact quita de la copia lo que permitiría entrar como otro usuario: hashes y sales de contraseñas, tokens,
+// secretos TOTP, códigos de recuperación, refresh de las sesiones y retos de login pendientes
+func redact(db model.Database) model.Database {
+	for name, u := range db.Users {
+		u.Salt, u.Hash, u.Token = nil, nil, nil
+		u.TOTPSecret, u.TOTPPending, u.RecoveryCodes = nil, nil, nil
+		db.Users[name] = u
+	}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	for key, s := range db.Sessions {
+		s.RefreshHash = nil
+		db.Sessions[key] = s
 	}
-	client := &http.Client{Transport: tr}
-	resp, err := client.Do(req)
+
+	db.PendingCertLogin = nil
+	return db
+}
+
+func saveDatabase() {
+	err := data.Save()
 	util.FailOnError(err)
 
-	var r = model.RespAuth{}
-	util.DecodeJSON(resp.Body, &r)
+	buffer := new(bytes.Buffer)
+	err = data.Backup(buffer)
+	util.FailOnError(err)
 
-	if !r.Ok {
-		fmt.Println(util.Decode64(r.Msg))
-	}
+	logging.SendBackup(buffer.Bytes())
 }
 
-func loadDatabase() error {
-	encryptedData, err := os.ReadFile("db.enc")
-	if err != nil {
-		if os.IsNotExist(err) {
-			fmt.Println("El archivo de la base de datos no existe.")
-			data = model.Database{
-				Users:            make(map[string]model.User),
-				Groups:           make(map[string]model.Group),
-				Posts:            make(map[int]model.Post),
-				GroupPosts:       make(map[int]model.Post),
-				UserPosts:        make(map[string][]int),
-				GroupPostIds:     make(map[string][]int),
-				GroupUsers:       make(map[string][]string),
-				UserGroups:       make(map[string][]string),
-				UserNames:        make([]string, 0),
-				PendingCertLogin: make(map[string][]byte),
-				PendingMessages:  make(map[string][]model.Message),
-				NextPostId:       0,
-			}
-			return nil
-		}
+func prompt(msg string) []byte {
+	fmt.Print(msg)
+	line, err := stdin.ReadString('\n')
+	util.FailOnError(err)
+	return []byte(strings.TrimSpace(line))
+}
 
-		return err
-	}
+// rotateKey cambia la frase de paso de la base de datos. Se ejecuta con el servidor parado: server rotate-key
+func rotateKey(backend string) {
+	oldPassphrase := prompt("Introduce la clave actual de la base de datos: ")
+	newPassphrase := prompt("Introduce la clave nueva: ")
 
-	jsonData, err := util.Decrypt(encryptedData, key)
+	if !bytes.Equal(newPassphrase, prompt("Repite la clave nueva: ")) {
+		fmt.Println("Las claves no coinciden")
+		os.Exit(1)
+	}
 
-	if err != nil {
-		return fmt.Errorf("clave incorrecta")
+	if err := store.RotateKey(backend, oldPassphrase, newPassphrase); err != nil {
+		fmt.Printf("Error cambiando la clave: %v\n", err)
+		os.Exit(1)
 	}
 
-	err = json.Unmarshal(jsonData, &data)
+	fmt.Println("Clave cambiada")
+}
 
+// readKey obtiene una clave del origen configurado, pidiéndola por la terminal si es "prompt"
+func readKey(source, file, env, msg string) []byte {
+	key, err := config.ReadKey(source, file, env, func() []byte { return prompt(msg) })
 	if err != nil {
-		return fmt.Errorf("clave incorrecta")
+		fmt.Printf("Error leyendo la clave: %v\n", err)
+		os.Exit(1)
 	}
-	fmt.Println("Base de datos cargada desde db.enc")
-
-	data.PendingCertLogin = make(map[string][]byte)
+	return key
+}
 
-	if data.GroupPosts == nil {
-		data.GroupPosts = make(map[int]model.Post)
-	}
+// saveState guarda periódicamente hasta que se cancela ctx. El guardado final lo hace shutdown
+func saveState(ctx context.Context, intervalo time.Duration, done chan<- struct{}) {
+	defer close(done)
 
-	return nil
-}
+	ticker := time.NewTicker(intervalo)
+	defer ticker.Stop()
 
-func saveState(intervalo int) {
-	ticker := time.NewTicker(time.Duration(intervalo) * time.Second)
 	for {
 		saveDatabase()
 		saveDatabaseJSON()
-		<-ticker.C
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
-func setupInterruptHandler() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGINT)
-	go func() {
-		<-c
-		fmt.Println("Guardando la base de datos")
-		saveDatabase()
-		saveDatabaseJSON()
-		os.Exit(1)
-	}()
+// cada cuánto se borran los mensajes pendientes y los adjuntos que han caducado
+const purgeInterval = time.Minute
+
+// purgeExpired borra periódicamente los mensajes temporales caducados, sus adjuntos y las subidas que llevan más de
+// uploadTTL sin terminar hasta que se cancela ctx
+func purgeExpired(ctx context.Context, intervalo time.Duration, uploadTTL time.Duration) {
+	ticker := time.NewTicker(intervalo)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := data.PurgeExpired(now)
+			if err != nil {
+				logging.SendLogRemote(fmt.Sprintf("ERROR: Borrando mensajes caducados. %s", err.Error()))
+			} else if n > 0 {
+				logging.SendLogRemote(fmt.Sprintf("Borrados %d mensajes caducados", n))
+			}
+
+			n, err = data.PurgeBlobs(now, now.Add(-uploadTTL))
+			if err != nil {
+				logging.SendLogRemote(fmt.Sprintf("ERROR: Borrando adjuntos. %s", err.Error()))
+			} else if n > 0 {
+				logging.SendLogRemote(fmt.Sprintf("Borrados %d adjuntos caducados o sin terminar", n))
+			}
+		}
+	}
 }
 
-func main() {
-	fmt.Printf("Introduce la clave para desencriptar la base de datos: ")
-	introducedKey, err := bufio.NewReader(os.Stdin).ReadString('\n')
-	util.FailOnError(err)
-	hash := sha256.Sum256([]byte(strings.TrimSpace(introducedKey)))
-	key = hash[:]
+// rotateKeys cambia la clave de firma de los tokens de acceso cada intervalo hasta que se cancela ctx
+func rotateKeys(ctx context.Context, intervalo time.Duration) {
+	ticker := time.NewTicker(intervalo)
+	defer ticker.Stop()
 
-	err = loadDatabase()
-	if err != nil {
-		logging.SendLogRemote(err.Error())
-		os.Exit(1)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			session.RotateKey(now)
+		}
 	}
-	setupInterruptHandler()
+}
 
-	logging.SetKey(key)
+// shutdown espera a que terminen las peticiones en curso, guarda una última vez y envía los logs pendientes
+func shutdown(server *http.Server, timeout time.Duration, saved <-chan struct{}) {
+	fmt.Println("Apagando el servidor")
 
-	intervalo := 30 //intervalo por defecto = 30 segundos
-	if len(os.Args) == 2 {
-		intervaloStr := os.Args[1]
-		intervalo, err = strconv.Atoi(intervaloStr)
-		util.FailOnError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Printf("No todas las peticiones han terminado a tiempo: %v\n", err)
 	}
 
-	go saveState(intervalo) //multiplico por 1000 para que sean segundos
+	<-saved
+
+	fmt.Println("Guardando la base de datos")
+	saveDatabase()
+	saveDatabaseJSON()
+	util.FailOnError(data.Close())
+
+	if err := logging.Close(timeout); err != nil {
+		fmt.Println(err)
+	}
+}
 
+// authLimit se aplica a los endpoints de login y registro
+func newRouter(authLimit func(next http.Handler) http.Handler) *http.ServeMux {
 	router := http.NewServeMux()
 
 	// auth
-	router.HandleFunc("POST /register", handler.RegisterHandler)
-	router.HandleFunc("POST /login", handler.LoginHandler)
-	router.HandleFunc("GET /login/cert", handler.GetLoginCertHandler)
-	router.HandleFunc("POST /login/cert", handler.PostLoginCertHandler)
+	router.Handle("POST /register", authLimit(http.HandlerFunc(handler.RegisterHandler)))
+	router.Handle("POST /login", authLimit(http.HandlerFunc(handler.LoginHandler)))
+	router.Handle("GET /login/cert", authLimit(http.HandlerFunc(handler.GetLoginCertHandler)))
+	router.Handle("POST /login/cert", authLimit(http.HandlerFunc(handler.PostLoginCertHandler)))
+	router.Handle("POST /login/totp", authLimit(http.HandlerFunc(handler.LoginTOTPHandler)))
+	router.HandleFunc("POST /sessions/refresh", handler.RefreshSessionHandler)
+	router.Handle("POST /logout", middleware.Authorization(http.HandlerFunc(handler.LogoutHandler)))
+	router.Handle("GET /sessions", middleware.Authorization(http.HandlerFunc(handler.GetSessionsHandler)))
+	router.Handle("DELETE /sessions", middleware.Authorization(http.HandlerFunc(handler.RevokeSessionsHandler)))
+	router.Handle("DELETE /sessions/{id}", middleware.Authorization(http.HandlerFunc(handler.RevokeSessionHandler)))
+	router.Handle("POST /totp", middleware.Authorization(http.HandlerFunc(handler.StartTOTPHandler)))
+	router.Handle("POST /totp/confirm", middleware.Authorization(http.HandlerFunc(handler.ConfirmTOTPHandler)))
+	router.Handle("DELETE /totp", middleware.Authorization(http.HandlerFunc(handler.DisableTOTPHandler)))
 
 	// users
 	router.HandleFunc("GET /users", handler.GetUserNamesHandler)
+	router.Handle("GET /users/{user}/presence", middleware.Authorization(http.HandlerFunc(handler.GetPresenceHandler)))
 	router.Handle("POST /chat/{user}/message", middleware.Authorization(http.HandlerFunc(handler.SendMessageHandler)))
 	router.Handle("GET /chat/{user}/message", middleware.Authorization(http.HandlerFunc(handler.GetPendingMessages)))
+	router.Handle("GET /chat/{user}/events", middleware.Authorization(http.HandlerFunc(handler.ChatEventsHandler)))
+	router.Handle("POST /chat/{user}/ack", middleware.Authorization(http.HandlerFunc(handler.AckMessagesHandler)))
+	router.Handle("POST /chat/{user}/read", middleware.Authorization(http.HandlerFunc(handler.ReadMessagesHandler)))
+	router.Handle("GET /chat/{user}/receipts", middleware.Authorization(http.HandlerFunc(handler.GetReceiptsHandler)))
+	router.Handle("POST /chat/{user}/typing", middleware.Authorization(http.HandlerFunc(handler.TypingHandler)))
+	router.Handle("GET /chats", middleware.Authorization(http.HandlerFunc(handler.GetChatsHandler)))
+	router.Handle("GET /ws", middleware.Authorization(http.HandlerFunc(handler.SocketHandler)))
 	router.Handle("GET /chat/{user}/pubkey", http.HandlerFunc(handler.GetPubKeyHandler))
+	router.Handle("GET /chat/{user}/prekeys", middleware.Authorization(http.HandlerFunc(handler.GetPreKeyBundleHandler)))
+	router.Handle("GET /prekeys", middleware.Authorization(http.HandlerFunc(handler.GetPreKeyStatusHandler)))
+	router.Handle("POST /prekeys", middleware.Authorization(http.HandlerFunc(handler.PublishPreKeysHandler)))
+	router.Handle("GET /chat/{user}/history", middleware.Authorization(http.HandlerFunc(handler.GetHistoryHandler)))
+	router.Handle("POST /chat/{user}/history", middleware.Authorization(http.HandlerFunc(handler.AppendHistoryHandler)))
+	router.Handle("POST /history", middleware.Authorization(http.HandlerFunc(handler.SetHistoryHandler)))
+	router.Handle("POST /presence", middleware.Authorization(http.HandlerFunc(handler.SetPresenceHandler)))
+	router.Handle("GET /chat/{user}/expiry", middleware.Authorization(http.HandlerFunc(handler.GetExpiryHandler)))
+	router.Handle("POST /chat/{user}/expiry", middleware.Authorization(http.HandlerFunc(handler.SetExpiryHandler)))
+	router.Handle("POST /blobs", middleware.Authorization(http.HandlerFunc(handler.CreateBlobHandler)))
+	router.Handle("GET /blobs/{id}", middleware.Authorization(http.HandlerFunc(handler.GetBlobHandler)))
+	router.Handle("PUT /blobs/{id}/{n}", middleware.Authorization(http.HandlerFunc(handler.PutBlobChunkHandler)))
+	router.Handle("GET /blobs/{id}/{n}", middleware.Authorization(http.HandlerFunc(handler.GetBlobChunkHandler)))
+	router.Handle("DELETE /blobs/{id}", middleware.Authorization(http.HandlerFunc(handler.DeleteBlobHandler)))
 
 	// posts
 	router.Handle("POST /posts", middleware.Authorization(http.HandlerFunc(handler.CreatePostHandler)))
@@ -179,21 +260,85 @@ func main() {
 	router.Handle("POST /groups/{group}", middleware.Authorization(http.HandlerFunc(handler.JoinGroupHandler)))
 	router.Handle("POST /groups/{group}/post", middleware.Authorization(http.HandlerFunc(handler.CreateGroupPostHandler)))
 	router.Handle("GET /groups/{group}/access", middleware.Authorization(http.HandlerFunc(handler.UserCanAccessGroupHandler)))
+	router.Handle("POST /groups/{group}/leave", middleware.Authorization(http.HandlerFunc(handler.LeaveGroupHandler)))
+	router.Handle("GET /groups/{group}/members", middleware.Authorization(http.HandlerFunc(handler.GetGroupMembersHandler)))
+	router.Handle("GET /groups/{group}/keys", middleware.Authorization(http.HandlerFunc(handler.GetSenderKeysHandler)))
+	router.Handle("POST /groups/{group}/keys", middleware.Authorization(http.HandlerFunc(handler.PutSenderKeyHandler)))
+	router.Handle("GET /groups/{group}/messages", middleware.Authorization(http.HandlerFunc(handler.GetGroupMessagesHandler)))
+	router.Handle("POST /groups/{group}/messages", middleware.Authorization(http.HandlerFunc(handler.SendGroupMessageHandler)))
 
 	// cosas admin
 	router.Handle("POST /users/{user}/block", middleware.Authorization(middleware.Admin(http.HandlerFunc(handler.SetBlocked))))
-	router.Handle("POST /noauth/users/{user}/block", http.HandlerFunc(handler.SetBlocked))
 
-	// chat no auth
-	router.Handle("POST /noauth/chat/{user}/message", http.HandlerFunc(handler.SendMessageHandler))
-	router.Handle("GET /noauth/chat/{user}/message", http.HandlerFunc(handler.GetPendingMessages))
-	router.Handle("GET /noauth/groups/{group}/posts", http.HandlerFunc(handler.GetGroupPostsHandler))
+	return router
+}
+
+func main() {
+	cfg, args, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Printf("Error en la configuración: %v\n", err)
+		os.Exit(2)
+	}
 
-	server := http.Server{
-		Addr:    ":10443",
-		Handler: middleware.InjectData(&data)(router),
+	if len(args) > 0 && args[0] == "rotate-key" {
+		rotateKey(cfg.Store)
+		return
 	}
 
-	fmt.Printf("Servidor escuchando en https://localhost:10443\n")
-	util.FailOnError(server.ListenAndServeTLS("localhost.crt", "localhost.key"))
+	// compatibilidad: el intervalo de guardado se podía pasar como argumento suelto en segundos
+	if len(args) == 1 {
+		segundos, err := strconv.Atoi(args[0])
+		util.FailOnError(err)
+		cfg.SaveInterval.Duration = time.Duration(segundos) * time.Second
+	}
+
+	logging.SetURL(cfg.LogURL)
+	session.SetLifetimes(cfg.TokenLifetime.Duration, cfg.RefreshLifetime.Duration)
+	etc.SetPageLimits(cfg.PageSize, cfg.MaxPageSize)
+	password.SetPool(cfg.HashWorkers, cfg.HashQueue)
+	handler.SetBlobQuota(int64(cfg.BlobQuota))
+	debugDump = cfg.DebugDump
+
+	logKey := readKey(cfg.LogKeySource, cfg.LogKeyFile, config.EnvLogKey, "Introduce la clave del servidor de logs: ")
+	logging.SetKey(util.Hash(logKey))
+
+	passphrase := readKey(cfg.DBKeySource, cfg.DBKeyFile, config.EnvDBKey, "Introduce la clave para desencriptar la base de datos: ")
+	data, err = store.Open(cfg.Store, passphrase)
+	if err != nil {
+		fmt.Println(err)
+		logging.SendLogRemote(err.Error())
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	saved := make(chan struct{})
+	go saveState(ctx, cfg.SaveInterval.Duration, saved)
+	go purgeExpired(ctx, purgeInterval, cfg.BlobUploadTTL.Duration)
+
+	session.RotateKey(time.Now())
+	go rotateKeys(ctx, cfg.KeyRotation.Duration)
+
+	chats := hub.New()
+
+	server := &http.Server{
+		Addr:    cfg.Addr,
+		Handler: middleware.InjectData(data)(middleware.InjectHub(chats)(newRouter(middleware.AuthLimit(cfg.AuthRate, cfg.AuthLockout.Duration)))),
+	}
+	// los streams abiertos no terminan solos, Shutdown esperaría hasta el timeout
+	server.RegisterOnShutdown(chats.Close)
+
+	go func() {
+		fmt.Printf("Servidor escuchando en %s\n", cfg.Addr)
+		if err := server.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile); !errors.Is(err, http.ErrServerClosed) {
+			util.FailOnError(err)
+		}
+	}()
+
+	<-ctx.Done()
+	// una segunda señal mata el proceso sin esperar
+	stop()
+
+	shutdown(server, cfg.ShutdownTimeout.Duration, saved)
 }
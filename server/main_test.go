@@ -0,0 +1,1105 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"server/config"
+	"server/handler"
+	"server/hub"
+	"server/middleware"
+	"server/session"
+	"server/store"
+	"server/totp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"util"
+	"util/model"
+	"util/ratchet"
+
+	"github.com/gorilla/websocket"
+)
+
+// los tests hacen muchos logins desde la misma IP, así que van sin límite de intentos salvo el suyo
+func newTestServer(t *testing.T) (*httptest.Server, store.Store) {
+	return newLimitedTestServer(t, func(next http.Handler) http.Handler { return next })
+}
+
+func newLimitedTestServer(t *testing.T, authLimit func(next http.Handler) http.Handler) (*httptest.Server, store.Store) {
+	db, err := store.OpenMemory(filepath.Join(t.TempDir(), "db.enc"), bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(middleware.InjectData(db)(middleware.InjectHub(hub.New())(newRouter(authLimit))))
+	t.Cleanup(srv.Close)
+
+	return srv, db
+}
+
+func newPubKey(t *testing.T) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pubKey
+}
+
+func register(t *testing.T, url string, name string, pubKey []byte) model.User {
+	var r model.RespAuth
+	if _, err := doRequest("POST", url+"/register", "", nil, model.RegisterCredentials{User: name, Pass: "pass", PubKey: pubKey}, &r); err != nil || !r.Ok {
+		t.Fatalf("registro de %s: %v %s", name, err, r.Msg)
+	}
+	return r.User
+}
+
+// doRequest devuelve solo el status y decodifica la respuesta en out si no es nil
+func doRequest(method, url, user string, token []byte, body any, out any) (int, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(util.EncodeJSON(body)))
+	if err != nil {
+		return 0, err
+	}
+
+	if user != "" {
+		req.Header.Add("Username", user)
+		req.Header.Add("Authorization", util.Encode64(token))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+	}
+
+	return resp.StatusCode, err
+}
+
+// registro, posts y mensajes en paralelo mientras se guarda la base de datos, pensado para go test -race
+func TestParallelTraffic(t *testing.T) {
+	const users = 6
+	const rounds = 10
+
+	srv, db := newTestServer(t)
+	pubKey := newPubKey(t)
+
+	stop := make(chan struct{})
+	saved := make(chan struct{})
+	go func() {
+		defer close(saved)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				if err := db.Save(); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			name := fmt.Sprintf("user%d", i)
+			other := fmt.Sprintf("user%d", (i+1)%users)
+
+			var r model.RespAuth
+			_, err := doRequest("POST", srv.URL+"/register", "", nil, model.RegisterCredentials{User: name, Pass: "pass", PubKey: pubKey}, &r)
+			if err != nil || !r.Ok {
+				t.Errorf("registro de %s: %v %s", name, err, r.Msg)
+				return
+			}
+
+			for j := 0; j < rounds; j++ {
+				status, err := doRequest("POST", srv.URL+"/posts", name, r.User.Token, model.PostContent{Content: "hola"}, nil)
+				if err != nil || status != http.StatusOK {
+					t.Errorf("post de %s: %v %v", name, status, err)
+				}
+
+				// el destinatario puede no estar registrado todavía, solo importa que no haya carreras
+				doRequest("POST", srv.URL+"/chat/"+other+"/message", name, r.User.Token, model.Message{Message: "hola"}, nil)
+				doRequest("GET", srv.URL+"/chat/"+other+"/message", name, r.User.Token, nil, nil)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(stop)
+	<-saved
+
+	if n := len(db.UserNames()); n != users {
+		t.Errorf("%d usuarios registrados, se esperaban %d", n, users)
+	}
+
+	if n := len(db.PostIds()); n != users*rounds {
+		t.Errorf("%d posts, se esperaban %d", n, users*rounds)
+	}
+}
+
+// readEvent lee el siguiente evento SSE saltándose los comentarios del heartbeat
+func readEvent(r *bufio.Reader) (id string, data string, err error) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", "", err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && id != "":
+			return id, data, nil
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func openEvents(t *testing.T, url string, user model.User, lastId string) *http.Response {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("Username", user.Name)
+	req.Header.Add("Authorization", util.Encode64(user.Token))
+	if lastId != "" {
+		req.Header.Add("Last-Event-ID", lastId)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d abriendo el stream", resp.StatusCode)
+	}
+
+	return resp
+}
+
+// el stream entrega primero los pendientes y después los nuevos; al reconectar con Last-Event-ID se borran los recibidos
+func TestChatEvents(t *testing.T) {
+	srv, db := newTestServer(t)
+	pubKey := newPubKey(t)
+
+	alice := register(t, srv.URL, "alice", pubKey)
+	bob := register(t, srv.URL, "bob", pubKey)
+
+	send := func(text string) {
+		status, err := doRequest("POST", srv.URL+"/chat/bob/message", "alice", alice.Token, model.Message{Message: text}, nil)
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("enviando mensaje: %v %v", status, err)
+		}
+	}
+
+	send("pendiente")
+
+	resp := openEvents(t, srv.URL+"/chat/alice/events", bob, "")
+	events := bufio.NewReader(resp.Body)
+
+	send("en directo")
+
+	var lastId string
+	for _, want := range []string{"pendiente", "en directo"} {
+		id, data, err := readEvent(events)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var msg model.Message
+		if err := json.Unmarshal([]byte(data), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Message != want || msg.Sender != "alice" || fmt.Sprint(msg.Id) != id {
+			t.Fatalf("evento %s inesperado: %+v", id, msg)
+		}
+		lastId = id
+	}
+	resp.Body.Close()
+
+	if n := len(db.PendingMessages("alice", "bob", 0)); n != 2 {
+		t.Fatalf("%d pendientes antes de confirmar, se esperaban 2", n)
+	}
+
+	resp = openEvents(t, srv.URL+"/chat/alice/events", bob, lastId)
+	resp.Body.Close()
+
+	if n := len(db.PendingMessages("alice", "bob", 0)); n != 0 {
+		t.Errorf("%d pendientes tras reconectar con Last-Event-ID", n)
+	}
+}
+
+func dialSocket(t *testing.T, srvURL string, user model.User) *websocket.Conn {
+	header := http.Header{}
+	header.Add("Username", user.Name)
+	header.Add("Authorization", util.Encode64(user.Token))
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srvURL, "http")+"/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn, frameType string) model.SocketFrame {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for {
+		var frame model.SocketFrame
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("esperando %s: %v", frameType, err)
+		}
+		if frame.Type == frameType {
+			return frame
+		}
+	}
+}
+
+// por el websocket se envía, se recibe, se avisa de que se escribe y se confirma; lo enviado por REST también llega
+func TestChatSocket(t *testing.T) {
+	srv, db := newTestServer(t)
+	pubKey := newPubKey(t)
+
+	alice := register(t, srv.URL, "alice", pubKey)
+	bob := register(t, srv.URL, "bob", pubKey)
+
+	doRequest("POST", srv.URL+"/chat/bob/message", "alice", alice.Token, model.Message{Message: "por rest"}, nil)
+
+	aliceConn := dialSocket(t, srv.URL, alice)
+	bobConn := dialSocket(t, srv.URL, bob)
+
+	bobConn.WriteJSON(model.SocketFrame{Type: model.FrameSync, User: "alice"})
+	pending := readFrame(t, bobConn, model.FrameMessage)
+	if pending.User != "alice" || pending.Message.Message != "por rest" {
+		t.Fatalf("pendiente inesperado: %+v", pending)
+	}
+
+	aliceConn.WriteJSON(model.SocketFrame{Type: model.FrameSend, User: "bob", Ref: 7, Message: &model.Message{Message: "por socket"}})
+	sent := readFrame(t, aliceConn, model.FrameSent)
+	if sent.Ref != 7 || sent.Id <= pending.Id {
+		t.Fatalf("confirmación de envío inesperada: %+v", sent)
+	}
+
+	live := readFrame(t, bobConn, model.FrameMessage)
+	if live.Id != sent.Id || live.Message.Sender != "alice" || live.Message.Message != "por socket" {
+		t.Fatalf("mensaje en directo inesperado: %+v", live)
+	}
+
+	bobConn.WriteJSON(model.SocketFrame{Type: model.FrameTyping, User: "alice"})
+	if typing := readFrame(t, aliceConn, model.FrameTyping); typing.User != "bob" {
+		t.Fatalf("aviso de escritura inesperado: %+v", typing)
+	}
+
+	aliceConn.WriteJSON(model.SocketFrame{Type: model.FrameSend, User: "alice", Ref: 8, Message: &model.Message{}})
+	if e := readFrame(t, aliceConn, model.FrameError); e.Ref != 8 {
+		t.Fatalf("error inesperado: %+v", e)
+	}
+
+	bobConn.WriteJSON(model.SocketFrame{Type: model.FrameAck, User: "alice", Id: live.Id})
+	// los frames se procesan en orden: cuando llega el aviso de escritura el ack ya está hecho
+	bobConn.WriteJSON(model.SocketFrame{Type: model.FrameTyping, User: "alice"})
+	readFrame(t, aliceConn, model.FrameTyping)
+
+	if n := len(db.PendingMessages("alice", "bob", 0)); n != 0 {
+		t.Errorf("%d pendientes tras el ack", n)
+	}
+}
+
+// el emisor recibe por el websocket cuándo se entregan y se leen sus mensajes y puede consultarlo por REST
+func TestReceipts(t *testing.T) {
+	srv, _ := newTestServer(t)
+	pubKey := newPubKey(t)
+
+	alice := register(t, srv.URL, "alice", pubKey)
+	bob := register(t, srv.URL, "bob", pubKey)
+
+	aliceConn := dialSocket(t, srv.URL, alice)
+
+	var msg model.Message
+	status, err := doRequest("POST", srv.URL+"/chat/bob/message", "alice", alice.Token, model.Message{Message: "hola"}, &msg)
+	if err != nil || status != http.StatusOK || msg.Id <= 0 {
+		t.Fatalf("enviando mensaje: %v %v %+v", status, err, msg)
+	}
+
+	var unread []model.Message
+	doRequest("GET", srv.URL+"/chat/alice/message", "bob", bob.Token, nil, &unread)
+	if len(unread) != 1 {
+		t.Fatalf("%d mensajes descargados", len(unread))
+	}
+
+	delivered := readFrame(t, aliceConn, model.FrameReceipt)
+	if delivered.User != "bob" || delivered.Receipt.Status(msg.Id) != model.StatusDelivered {
+		t.Fatalf("confirmación de entrega inesperada: %+v", delivered.Receipt)
+	}
+
+	if status, _ := doRequest("POST", srv.URL+"/chat/alice/read", "bob", bob.Token, model.MessageAck{Id: msg.Id}, nil); status != http.StatusOK {
+		t.Fatalf("marcando como leído: %v", status)
+	}
+
+	if read := readFrame(t, aliceConn, model.FrameReceipt); read.Receipt.Status(msg.Id) != model.StatusRead {
+		t.Fatalf("confirmación de lectura inesperada: %+v", read.Receipt)
+	}
+
+	var receipt model.Receipt
+	doRequest("GET", srv.URL+"/chat/bob/receipts", "alice", alice.Token, nil, &receipt)
+	if receipt.User != "bob" || receipt.Read != msg.Id {
+		t.Errorf("confirmación consultada: %+v", receipt)
+	}
+}
+
+// solo se aceptan prekeys firmadas con la clave RSA de la cuenta y cada una de un solo uso se entrega una vez
+func TestPreKeys(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	bob := register(t, srv.URL, "bob", pubKey)
+	alice := register(t, srv.URL, "alice", newPubKey(t))
+
+	id, err := ratchet.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, _ := id.Bundle(2)
+
+	if status, _ := doRequest("POST", srv.URL+"/prekeys", "bob", bob.Token, bundle, nil); status != http.StatusBadRequest {
+		t.Errorf("prekeys sin firma aceptadas: %v", status)
+	}
+
+	bundle.Signature, _ = util.SignRSA(bundle.SignedData(), key)
+	if status, _ := doRequest("POST", srv.URL+"/prekeys", "bob", bob.Token, bundle, nil); status != http.StatusOK {
+		t.Fatalf("publicando prekeys: %v", status)
+	}
+
+	var status model.PreKeyStatus
+	doRequest("GET", srv.URL+"/prekeys", "bob", bob.Token, nil, &status)
+	if status.OneTimePreKeys != 2 || status.SignedPreKeyId != bundle.SignedPreKeyId {
+		t.Fatalf("estado de las prekeys: %+v", status)
+	}
+
+	seen := make(map[uint32]bool)
+	for i := 0; i < 3; i++ {
+		var got model.PreKeyBundle
+		doRequest("GET", srv.URL+"/chat/bob/prekeys", "alice", alice.Token, nil, &got)
+
+		if util.CheckSignatureRSA(got.SignedData(), got.Signature, &key.PublicKey) != nil {
+			t.Fatal("bundle con firma incorrecta")
+		}
+		for _, otk := range got.OneTimePreKeys {
+			if seen[otk.Id] {
+				t.Fatalf("prekey %d entregada dos veces", otk.Id)
+			}
+			seen[otk.Id] = true
+		}
+	}
+
+	if len(seen) != 2 {
+		t.Errorf("%d prekeys de un solo uso entregadas, se esperaban 2", len(seen))
+	}
+
+	if status, _ := doRequest("GET", srv.URL+"/chat/alice/prekeys", "bob", bob.Token, nil, nil); status != http.StatusNotFound {
+		t.Errorf("bundle de un usuario sin prekeys: %v", status)
+	}
+}
+
+// el servidor guarda y devuelve las firmas de posts y mensajes sin tocarlas
+func TestSignaturesStored(t *testing.T) {
+	srv, _ := newTestServer(t)
+	pubKey := newPubKey(t)
+
+	alice := register(t, srv.URL, "alice", pubKey)
+	bob := register(t, srv.URL, "bob", pubKey)
+
+	signature := []byte("firma")
+
+	doRequest("POST", srv.URL+"/posts", "alice", alice.Token, model.PostContent{Content: "hola", Signature: signature}, nil)
+
+	var posts []model.Post
+	doRequest("GET", srv.URL+"/posts", "", nil, nil, &posts)
+	if len(posts) != 1 || !bytes.Equal(posts[0].Signature, signature) {
+		t.Errorf("posts devueltos: %+v", posts)
+	}
+
+	doRequest("POST", srv.URL+"/chat/bob/message", "alice", alice.Token, model.Message{Message: "cifrado", Signature: signature, Unverified: true}, nil)
+
+	var msgs []model.Message
+	doRequest("GET", srv.URL+"/chat/alice/message", "bob", bob.Token, nil, &msgs)
+	if len(msgs) != 1 || !bytes.Equal(msgs[0].Signature, signature) || msgs[0].Unverified {
+		t.Errorf("mensajes devueltos: %+v", msgs)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	srv, _ := newTestServer(t)
+	pubKey := newPubKey(t)
+
+	alice := register(t, srv.URL, "alice", pubKey)
+	register(t, srv.URL, "bob", pubKey)
+
+	url := srv.URL + "/chat/bob/history"
+
+	// sin activarlo no se guarda nada
+	if status, _ := doRequest("POST", url, "alice", alice.Token, model.HistoryEntry{MessageId: 1, Ciphertext: []byte("c")}, nil); status != http.StatusForbidden {
+		t.Fatalf("historial sin activar: %d", status)
+	}
+
+	doRequest("POST", srv.URL+"/history", "alice", alice.Token, model.HistorySettings{Enabled: true}, nil)
+
+	for id := int64(1); id <= 3; id++ {
+		var e model.HistoryEntry
+		if status, err := doRequest("POST", url, "alice", alice.Token, model.HistoryEntry{MessageId: id, Ciphertext: []byte("c")}, &e); status != http.StatusOK || err != nil || e.Seq != id {
+			t.Fatalf("entrada %+v: %d %v", e, status, err)
+		}
+	}
+
+	var page model.HistoryPage
+	doRequest("GET", url+"?limit=2", "alice", alice.Token, nil, &page)
+	if len(page.Entries) != 2 || !page.More || page.Next != 2 || page.Epoch == 0 {
+		t.Fatalf("primera página %+v", page)
+	}
+	epoch := page.Epoch
+
+	doRequest("GET", fmt.Sprintf("%s?after=%d", url, page.Next), "alice", alice.Token, nil, &page)
+	if len(page.Entries) != 1 || page.More || page.Next != 3 {
+		t.Fatalf("segunda página %+v", page)
+	}
+
+	// al desactivarlo se borra y al volver a activarlo el cliente sabe que tiene que subirlo todo
+	doRequest("POST", srv.URL+"/history", "alice", alice.Token, model.HistorySettings{Enabled: false}, nil)
+	doRequest("POST", srv.URL+"/history", "alice", alice.Token, model.HistorySettings{Enabled: true}, nil)
+	doRequest("GET", url, "alice", alice.Token, nil, &page)
+	if len(page.Entries) != 0 || page.Epoch == epoch {
+		t.Fatalf("historial tras desactivarlo %+v", page)
+	}
+}
+
+func TestGroupChat(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	keys := make(map[string]*rsa.PrivateKey)
+	users := make(map[string]model.User)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKey, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		keys[name], users[name] = key, register(t, srv.URL, name, pubKey)
+	}
+
+	do := func(method, path, user string, body any, out any) int {
+		status, _ := doRequest(method, srv.URL+path, user, users[user].Token, body, out)
+		return status
+	}
+
+	// reparte una sender key a members firmada por sender
+	senderKey := func(sender string, epoch int64, members ...string) model.SenderKey {
+		k := model.SenderKey{Group: "g", Sender: sender, Epoch: epoch, Keys: make(map[string]model.SealedKey)}
+		for _, m := range members {
+			k.Keys[m] = model.SealedKey{Key: []byte("clave de " + m)}
+			sealed := k.Keys[m]
+			sealed.Signature, _ = util.SignRSA(k.SignedData(m), keys[sender])
+			k.Keys[m] = sealed
+		}
+		return k
+	}
+
+	do("POST", "/groups", "alice", model.Group{Name: "g"}, nil)
+	do("POST", "/groups/g", "bob", nil, nil)
+
+	var info model.GroupInfo
+	do("GET", "/groups/g/members", "alice", nil, &info)
+	if len(info.Members) != 2 || info.Epoch != 2 {
+		t.Fatalf("miembros %+v", info)
+	}
+
+	if status := do("GET", "/groups/g/members", "carol", nil, nil); status != http.StatusForbidden {
+		t.Errorf("miembros pedidos por quien no es miembro: %d", status)
+	}
+
+	// sin clave repartida no se acepta el mensaje, ni la clave si falta algún miembro
+	if status := do("POST", "/groups/g/messages", "alice", model.GroupMessage{Epoch: 2, Message: "c"}, nil); status != http.StatusConflict {
+		t.Errorf("mensaje sin sender key: %d", status)
+	}
+	if status := do("POST", "/groups/g/keys", "alice", senderKey("alice", 2, "alice"), nil); status != http.StatusConflict {
+		t.Errorf("sender key sin todos los miembros: %d", status)
+	}
+
+	if status := do("POST", "/groups/g/keys", "alice", senderKey("alice", 2, "alice", "bob"), nil); status != http.StatusOK {
+		t.Fatalf("sender key: %d", status)
+	}
+	if status := do("POST", "/groups/g/messages", "alice", model.GroupMessage{Epoch: 2, Message: "antes"}, nil); status != http.StatusOK {
+		t.Fatalf("mensaje: %d", status)
+	}
+
+	// al entrar carol cambia el epoch: la clave anterior ya no sirve y ella no ve lo de antes
+	do("POST", "/groups/g", "carol", nil, nil)
+	if status := do("POST", "/groups/g/messages", "alice", model.GroupMessage{Epoch: 2, Message: "viejo"}, nil); status != http.StatusConflict {
+		t.Errorf("mensaje con el epoch anterior: %d", status)
+	}
+
+	do("POST", "/groups/g/keys", "alice", senderKey("alice", 3, "alice", "bob", "carol"), nil)
+	do("POST", "/groups/g/messages", "alice", model.GroupMessage{Epoch: 3, Message: "después"}, nil)
+
+	var msgs []model.GroupMessage
+	do("GET", "/groups/g/messages", "carol", nil, &msgs)
+	if len(msgs) != 1 || msgs[0].Message != "después" || msgs[0].Sender != "alice" {
+		t.Fatalf("mensajes de carol %+v", msgs)
+	}
+	do("GET", "/groups/g/messages?after=0", "bob", nil, &msgs)
+	if len(msgs) != 2 {
+		t.Fatalf("mensajes de bob %+v", msgs)
+	}
+
+	// cada uno solo recibe su copia
+	var got []model.SenderKey
+	do("GET", "/groups/g/keys", "carol", nil, &got)
+	if len(got) != 1 || len(got[0].Keys) != 1 || string(got[0].Keys["carol"].Key) != "clave de carol" {
+		t.Fatalf("sender keys de carol %+v", got)
+	}
+
+	do("POST", "/groups/g/leave", "bob", nil, nil)
+	if status := do("GET", "/groups/g/messages", "bob", nil, nil); status != http.StatusForbidden {
+		t.Errorf("mensajes tras salir del grupo: %d", status)
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	srv, _ := newTestServer(t)
+	alice := register(t, srv.URL, "alice", newPubKey(t))
+	bob := register(t, srv.URL, "bob", newPubKey(t))
+
+	// los trozos van en crudo, no en JSON
+	putChunk := func(user model.User, id string, n int, data []byte) int {
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/blobs/%s/%d", srv.URL, id, n), bytes.NewReader(data))
+		req.Header.Add("Username", user.Name)
+		req.Header.Add("Authorization", util.Encode64(user.Token))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	tooBig := model.Blob{Size: model.MaxBlobSize + 1, Chunks: model.BlobChunks(model.MaxBlobSize + 1)}
+	if status, _ := doRequest("POST", srv.URL+"/blobs", alice.Name, alice.Token, tooBig, nil); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("adjunto demasiado grande: %d", status)
+	}
+
+	size := int64(model.BlobChunkSize + 10)
+	var blob model.Blob
+	if status, err := doRequest("POST", srv.URL+"/blobs", alice.Name, alice.Token, model.Blob{Size: size, Chunks: 2}, &blob); status != http.StatusOK || err != nil || blob.Id == "" {
+		t.Fatalf("crear adjunto: %d %v %+v", status, err, blob)
+	}
+
+	if status := putChunk(bob, blob.Id, 0, []byte("ajeno")); status != http.StatusForbidden {
+		t.Errorf("trozo subido por otro usuario: %d", status)
+	}
+	if status := putChunk(alice, blob.Id, 0, make([]byte, model.BlobChunkSize+1024)); status != http.StatusBadRequest {
+		t.Errorf("trozo demasiado grande: %d", status)
+	}
+
+	putChunk(alice, blob.Id, 1, []byte("segundo"))
+
+	// sin terminar no se puede bajar, pero se ve qué falta para continuar
+	if status, _ := doRequest("GET", fmt.Sprintf("%s/blobs/%s/1", srv.URL, blob.Id), bob.Name, bob.Token, nil, nil); status != http.StatusConflict {
+		t.Errorf("bajada de un adjunto incompleto: %d", status)
+	}
+	doRequest("GET", srv.URL+"/blobs/"+blob.Id, alice.Name, alice.Token, nil, &blob)
+	if blob.Uploaded[0] || !blob.Uploaded[1] {
+		t.Fatalf("estado del adjunto %+v", blob)
+	}
+
+	putChunk(alice, blob.Id, 0, []byte("primero"))
+	if status := putChunk(alice, blob.Id, 0, []byte("cambiado")); status != http.StatusConflict {
+		t.Errorf("trozo cambiado tras completar: %d", status)
+	}
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/blobs/%s/0", srv.URL, blob.Id), nil)
+	req.Header.Add("Username", bob.Name)
+	req.Header.Add("Authorization", util.Encode64(bob.Token))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var data bytes.Buffer
+	data.ReadFrom(resp.Body)
+	if data.String() != "primero" {
+		t.Errorf("trozo bajado %q", data.String())
+	}
+
+	// solo lo borra su dueño, y con él los trozos
+	if status, _ := doRequest("DELETE", srv.URL+"/blobs/"+blob.Id, bob.Name, bob.Token, nil, nil); status != http.StatusForbidden {
+		t.Errorf("adjunto borrado por otro usuario: %d", status)
+	}
+	if status, _ := doRequest("DELETE", srv.URL+"/blobs/"+blob.Id, alice.Name, alice.Token, nil, nil); status != http.StatusOK {
+		t.Errorf("borrar adjunto: %d", status)
+	}
+	if status, _ := doRequest("GET", fmt.Sprintf("%s/blobs/%s/0", srv.URL, blob.Id), bob.Name, bob.Token, nil, nil); status != http.StatusNotFound {
+		t.Errorf("trozo de un adjunto borrado: %d", status)
+	}
+
+	handler.SetBlobQuota(model.MaxBlobSize)
+	defer handler.SetBlobQuota(int64(config.Default().BlobQuota))
+
+	full := model.Blob{Size: model.MaxBlobSize, Chunks: model.BlobChunks(model.MaxBlobSize)}
+	if status, _ := doRequest("POST", srv.URL+"/blobs", alice.Name, alice.Token, full, nil); status != http.StatusOK {
+		t.Errorf("adjunto dentro de la cuota: %d", status)
+	}
+	if status, _ := doRequest("POST", srv.URL+"/blobs", alice.Name, alice.Token, model.Blob{Size: 1, Chunks: 1}, nil); status != http.StatusInsufficientStorage {
+		t.Errorf("adjunto fuera de la cuota: %d", status)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	srv, _ := newTestServer(t)
+	alice := register(t, srv.URL, "alice", newPubKey(t))
+	bob := register(t, srv.URL, "bob", newPubKey(t))
+
+	propose := func(user model.User, other string, ttl time.Duration) model.Expiry {
+		var e model.Expiry
+		if status, err := doRequest("POST", srv.URL+"/chat/"+other+"/expiry", user.Name, user.Token, model.Expiry{TTL: ttl}, &e); status != http.StatusOK || err != nil {
+			t.Fatalf("propuesta de %s: %d %v", user.Name, status, err)
+		}
+		return e
+	}
+
+	send := func() model.Message {
+		var sent model.Message
+		doRequest("POST", srv.URL+"/chat/bob/message", alice.Name, alice.Token, model.Message{Message: "m"}, &sent)
+		return sent
+	}
+
+	if status, _ := doRequest("POST", srv.URL+"/chat/bob/expiry", alice.Name, alice.Token, model.Expiry{TTL: time.Second}, nil); status != http.StatusBadRequest {
+		t.Errorf("TTL demasiado corto: %d", status)
+	}
+
+	if e := propose(alice, "bob", time.Hour); e.TTL != 0 || e.Proposed != time.Hour || e.ProposedBy != "alice" {
+		t.Fatalf("propuesta %+v", e)
+	}
+
+	// hasta que el otro no acepta no se aplica
+	if m := send(); !m.Expires.IsZero() {
+		t.Errorf("mensaje con caducidad sin acuerdo %+v", m)
+	}
+
+	var e model.Expiry
+	doRequest("GET", srv.URL+"/chat/alice/expiry", bob.Name, bob.Token, nil, &e)
+	if e.ProposedBy != "alice" {
+		t.Fatalf("bob no ve la propuesta %+v", e)
+	}
+
+	if e := propose(bob, "alice", time.Hour); e.TTL != time.Hour || e.ProposedBy != "" {
+		t.Fatalf("tras aceptar %+v", e)
+	}
+
+	if m := send(); m.Expires.Sub(m.Timestamp) != time.Hour {
+		t.Errorf("caducidad del mensaje %+v", m)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	srv, db := newTestServer(t)
+
+	// nombres que no salen en otros tests: la última actividad se recuerda en memoria entre servidores
+	dora := register(t, srv.URL, "dora", newPubKey(t))
+	eva := register(t, srv.URL, "eva", newPubKey(t))
+
+	presence := func(user model.User, other string) model.Presence {
+		var p model.Presence
+		if status, err := doRequest("GET", srv.URL+"/users/"+other+"/presence", user.Name, user.Token, nil, &p); status != http.StatusOK || err != nil {
+			t.Fatalf("presencia de %s: %d %v", other, status, err)
+		}
+		return p
+	}
+
+	idle := func(d time.Duration) {
+		db.UpdateUser("dora", func(u *model.User) error {
+			u.Seen, u.Active = time.Now().Add(-d), time.Now().Add(-d)
+			return nil
+		})
+	}
+
+	if p := presence(eva, "dora"); p.Status != model.PresenceOnline {
+		t.Errorf("recién registrada %+v", p)
+	}
+
+	idle(5 * time.Minute)
+	if p := presence(eva, "dora"); p.Status != model.PresenceAway {
+		t.Errorf("tras 5 minutos %+v", p)
+	}
+
+	idle(20 * time.Minute)
+	if p := presence(eva, "dora"); p.Status != model.PresenceOffline || time.Since(p.LastSeen) < 20*time.Minute {
+		t.Errorf("tras 20 minutos %+v", p)
+	}
+
+	// cualquier petición autenticada cuenta como actividad
+	if p := presence(dora, "dora"); p.Status != model.PresenceOnline || p.Hidden {
+		t.Errorf("tras una petición %+v", p)
+	}
+
+	doRequest("POST", srv.URL+"/presence", dora.Name, dora.Token, model.PresenceSettings{Hidden: true}, nil)
+	if p := presence(eva, "dora"); p.Status != model.PresenceHidden || !p.LastSeen.IsZero() {
+		t.Errorf("presencia oculta %+v", p)
+	}
+	if p := presence(dora, "dora"); p.Status != model.PresenceOnline || !p.Hidden {
+		t.Errorf("la propia presencia oculta %+v", p)
+	}
+
+	if status, _ := doRequest("GET", srv.URL+"/users/nadie/presence", eva.Name, eva.Token, nil, nil); status != http.StatusNotFound {
+		t.Errorf("usuario que no existe: %d", status)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	srv, _ := newTestServer(t)
+	register(t, srv.URL, "alice", newPubKey(t))
+
+	login := func(device string) model.RespAuth {
+		var r model.RespAuth
+		if _, err := doRequest("POST", srv.URL+"/login", "", nil, model.Credentials{User: "alice", Pass: "pass", Device: device}, &r); err != nil || !r.Ok {
+			t.Fatalf("login en %s: %v %s", device, err, r.Msg)
+		}
+		return r
+	}
+
+	status := func(token []byte) int {
+		status, _ := doRequest("GET", srv.URL+"/prekeys", "alice", token, nil, nil)
+		return status
+	}
+
+	laptop, phone := login("portátil"), login("móvil")
+
+	// el segundo login no cierra el primero
+	if status(laptop.User.Token) != http.StatusOK || status(phone.User.Token) != http.StatusOK {
+		t.Fatal("las dos sesiones deberían valer")
+	}
+
+	var sessions []model.SessionInfo
+	doRequest("GET", srv.URL+"/sessions", "alice", phone.User.Token, nil, &sessions)
+	if len(sessions) != 3 || sessions[0].Device != "móvil" || !sessions[0].Current || sessions[1].Current {
+		t.Fatalf("sesiones %+v", sessions)
+	}
+
+	var tokens model.SessionTokens
+	if status, _ := doRequest("POST", srv.URL+"/sessions/refresh", "", nil, model.RefreshRequest{User: "alice", Refresh: laptop.Refresh}, &tokens); status != http.StatusOK {
+		t.Fatalf("refresh: %d", status)
+	}
+	if status(tokens.Token) != http.StatusOK {
+		t.Fatal("el token renovado no vale")
+	}
+
+	// cada refresh token solo sirve una vez
+	if status, _ := doRequest("POST", srv.URL+"/sessions/refresh", "", nil, model.RefreshRequest{User: "alice", Refresh: laptop.Refresh}, nil); status != http.StatusUnauthorized {
+		t.Fatalf("refresh repetido: %d", status)
+	}
+
+	if status, _ := doRequest("DELETE", srv.URL+"/sessions/"+sessions[1].Id, "alice", phone.User.Token, nil, nil); status != http.StatusOK {
+		t.Fatalf("cerrar sesión: %d", status)
+	}
+	// los tokens de acceso firmados dejan de valer aunque no hayan caducado
+	if status(tokens.Token) != http.StatusUnauthorized || status(laptop.User.Token) != http.StatusUnauthorized || status(phone.User.Token) != http.StatusOK {
+		t.Fatal("solo debería cerrarse la sesión del portátil")
+	}
+
+	doRequest("DELETE", srv.URL+"/sessions", "alice", phone.User.Token, nil, nil)
+	doRequest("GET", srv.URL+"/sessions", "alice", phone.User.Token, nil, &sessions)
+	if len(sessions) != 1 || !sessions[0].Current {
+		t.Fatalf("tras cerrar las demás %+v", sessions)
+	}
+
+	doRequest("POST", srv.URL+"/logout", "alice", phone.User.Token, nil, nil)
+	if status(phone.User.Token) != http.StatusUnauthorized {
+		t.Fatal("el token sigue valiendo tras el logout")
+	}
+}
+
+// quien hace la petición sale del token: sin cabecera Username vale, con la de otro no, y ya no hay rutas /noauth
+func TestIdentityFromToken(t *testing.T) {
+	srv, db := newTestServer(t)
+	frank := register(t, srv.URL, "frank", newPubKey(t))
+	register(t, srv.URL, "gina", newPubKey(t))
+
+	send := func(method, path, username string, token []byte) int {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if username != "" {
+			req.Header.Add("Username", username)
+		}
+		if token != nil {
+			req.Header.Add("Authorization", util.Encode64(token))
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := send("GET", "/sessions", "", frank.Token); code != http.StatusOK {
+		t.Fatalf("sin cabecera Username: status %d", code)
+	}
+	if code := send("GET", "/chat/frank/message", "gina", frank.Token); code != http.StatusUnauthorized {
+		t.Fatalf("token de frank como gina: status %d", code)
+	}
+
+	if code := send("POST", "/noauth/users/gina/block", "frank", nil); code != http.StatusNotFound {
+		t.Fatalf("/noauth sigue respondiendo: status %d", code)
+	}
+	if u, _ := db.GetUser("gina"); u.Blocked {
+		t.Fatal("gina bloqueada sin autenticar")
+	}
+}
+
+// con la verificación en dos pasos la contraseña solo da un ticket, y el token llega con un código que no se puede repetir
+func TestTwoFactor(t *testing.T) {
+	srv, _ := newTestServer(t)
+	hugo := register(t, srv.URL, "hugo", newPubKey(t))
+
+	var enroll model.TOTPEnrollment
+	if status, _ := doRequest("POST", srv.URL+"/totp", "hugo", hugo.Token, nil, &enroll); status != http.StatusOK || !strings.HasPrefix(enroll.URI, "otpauth://totp/") {
+		t.Fatalf("alta: %d %+v", status, enroll)
+	}
+	secret, err := totp.Decode(enroll.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := totp.Step(time.Now())
+
+	// fuera de la ventana de periodos que se aceptan
+	if status, _ := doRequest("POST", srv.URL+"/totp/confirm", "hugo", hugo.Token, model.TOTPCode{Code: totp.Code(secret, step+5)}, nil); status != http.StatusForbidden {
+		t.Fatalf("confirmar con un código mal: %d", status)
+	}
+
+	var recovery model.RecoveryCodes
+	if status, _ := doRequest("POST", srv.URL+"/totp/confirm", "hugo", hugo.Token, model.TOTPCode{Code: totp.Code(secret, step)}, &recovery); status != http.StatusOK || len(recovery.Codes) == 0 {
+		t.Fatalf("confirmar: %d", status)
+	}
+
+	login := func() model.RespAuth {
+		var r model.RespAuth
+		doRequest("POST", srv.URL+"/login", "", nil, model.Credentials{User: "hugo", Pass: "pass"}, &r)
+		if r.Ok || r.Ticket == "" || r.User.Token != nil {
+			t.Fatalf("la contraseña sola no debería dar token: %+v", r)
+		}
+		return r
+	}
+	second := func(ticket, code string) (int, model.RespAuth) {
+		var r model.RespAuth
+		status, _ := doRequest("POST", srv.URL+"/login/totp", "", nil, model.TOTPLogin{User: "hugo", Ticket: ticket, Code: code}, &r)
+		return status, r
+	}
+
+	// el código ya usado para activarla no vale, el siguiente sí
+	ticket := login().Ticket
+	if status, _ := second(ticket, totp.Code(secret, step)); status != http.StatusUnauthorized {
+		t.Fatalf("código repetido: %d", status)
+	}
+	status, r := second(ticket, totp.Code(secret, step+1))
+	if status != http.StatusOK || !r.Ok || !r.User.TwoFactor || r.User.Token == nil {
+		t.Fatalf("segundo paso: %d %+v", status, r)
+	}
+
+	// el ticket no sirve dos veces
+	if status, _ := second(ticket, recovery.Codes[0]); status != http.StatusUnauthorized {
+		t.Fatalf("ticket reutilizado: %d", status)
+	}
+
+	// cada código de recuperación sirve una vez
+	if status, _ := second(login().Ticket, strings.ToUpper(recovery.Codes[0])); status != http.StatusOK {
+		t.Fatalf("código de recuperación: %d", status)
+	}
+	if status, _ := second(login().Ticket, recovery.Codes[0]); status != http.StatusUnauthorized {
+		t.Fatalf("código de recuperación repetido: %d", status)
+	}
+
+	// tras ticketAttempts fallos hay que volver a meter la contraseña
+	ticket = login().Ticket
+	for i := 0; i < 5; i++ {
+		second(ticket, "abcd-efgh")
+	}
+	if status, _ := second(ticket, recovery.Codes[1]); status != http.StatusUnauthorized {
+		t.Fatalf("ticket tras varios fallos: %d", status)
+	}
+
+	if status, _ := doRequest("DELETE", srv.URL+"/totp", "hugo", r.User.Token, model.TOTPCode{Code: recovery.Codes[2]}, nil); status != http.StatusOK {
+		t.Fatalf("desactivar: %d", status)
+	}
+	var plain model.RespAuth
+	if doRequest("POST", srv.URL+"/login", "", nil, model.Credentials{User: "hugo", Pass: "pass"}, &plain); !plain.Ok || plain.User.Token == nil {
+		t.Fatalf("login sin verificación: %+v", plain)
+	}
+}
+
+// los fallos de login hacen esperar a la cuenta y a la IP, y cada IP tiene un cupo de peticiones por minuto
+func TestAuthLimit(t *testing.T) {
+	srv, _ := newLimitedTestServer(t, middleware.AuthLimit(20, time.Minute))
+	register(t, srv.URL, "ivan", newPubKey(t))
+
+	login := func(pass string) *http.Response {
+		resp, err := http.Post(srv.URL+"/login", "application/json", bytes.NewReader(util.EncodeJSON(model.Credentials{User: "ivan", Pass: pass})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp := login("mal"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("fallo %d: status %d", i, resp.StatusCode)
+		}
+	}
+
+	// tras el tercer fallo hay que esperar, aunque la contraseña sea buena
+	resp := login("pass")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("tras tres fallos: status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if resp := login("pass"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("después de esperar: status %d", resp.StatusCode)
+	}
+
+	// el cupo de la IP se acaba aunque todo vaya bien; el registro gasta la primera
+	srv, _ = newLimitedTestServer(t, middleware.AuthLimit(2, time.Minute))
+	register(t, srv.URL, "ivan", newPubKey(t))
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		if status, _ := doRequest("POST", srv.URL+"/login", "", nil, model.Credentials{User: "ivan", Pass: "pass"}, nil); status != want {
+			t.Fatalf("login %d con cupo de 2: status %d", i, status)
+		}
+	}
+}
+
+// el volcado de depuración no lleva nada con lo que se pueda entrar como otro usuario
+func TestRedactedDump(t *testing.T) {
+	srv, db := newTestServer(t)
+	register(t, srv.URL, "alice", newPubKey(t))
+
+	_, err := db.UpdateUser("alice", func(u *model.User) error {
+		u.TOTPSecret, u.TOTPPending, u.RecoveryCodes = []byte("secreto"), []byte("pendiente"), [][]byte{[]byte("código")}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	export, err := db.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Sessions) == 0 {
+		t.Fatal("el registro no ha abierto sesión")
+	}
+
+	dump := redact(export)
+	if u := dump.Users["alice"]; u.Hash != nil || u.Salt != nil || u.TOTPSecret != nil || u.TOTPPending != nil || u.RecoveryCodes != nil {
+		t.Errorf("secretos en el volcado: %+v", u)
+	}
+	for _, s := range dump.Sessions {
+		if s.RefreshHash != nil {
+			t.Errorf("refresh de la sesión %s en el volcado", s.Id)
+		}
+	}
+}
+
+// un nombre con '>' se confundiría con las claves emisor->receptor de otras conversaciones
+func TestRegisterInvalidName(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	var r model.RespAuth
+	if _, err := doRequest("POST", srv.URL+"/register", "", nil, model.RegisterCredentials{User: "ana->bel", Pass: "pass", PubKey: newPubKey(t)}, &r); err != nil || r.Ok {
+		t.Fatalf("registro con '>': %v %+v", err, r)
+	}
+}
+
+// el rol y el bloqueo se leen del Store al renovar el token y en las rutas de admin, no del token
+func TestRoleFromStore(t *testing.T) {
+	srv, db := newTestServer(t)
+	alice := register(t, srv.URL, "alice", newPubKey(t))
+	register(t, srv.URL, "bob", newPubKey(t))
+
+	// token de hace diez minutos, ya toca renovarlo
+	oldToken := func(user string, role model.Role) []byte {
+		token, _ := session.Issue(db.Sessions(user)[0], role, time.Now().Add(-10*time.Minute))
+		return token
+	}
+
+	get := func(user string, token []byte) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+"/prekeys", nil)
+		req.Header.Add("Username", user)
+		req.Header.Add("Authorization", util.Encode64(token))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	db.UpdateUser("alice", func(u *model.User) error {
+		u.Role = model.NormalUser
+		return nil
+	})
+
+	if status, _ := doRequest("POST", srv.URL+"/users/bob/block", "alice", alice.Token, model.Block{Blocked: true}, nil); status != http.StatusUnauthorized {
+		t.Errorf("admin con el rol quitado: %d", status)
+	}
+
+	resp := get("alice", oldToken("alice", model.Admin))
+	renewed, _ := util.Decode64(resp.Header.Get(middleware.HeaderAccessToken))
+	if claims, err := session.Verify(renewed, time.Now()); resp.StatusCode != http.StatusOK || err != nil || claims.Role != model.NormalUser {
+		t.Errorf("renovación %d con rol %v %v", resp.StatusCode, claims.Role, err)
+	}
+
+	// bloqueado sin cerrarle las sesiones: el token sigue firmado pero no se renueva
+	db.UpdateUser("bob", func(u *model.User) error {
+		u.Blocked = true
+		return nil
+	})
+	if resp := get("bob", oldToken("bob", model.NormalUser)); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("renovación de un usuario bloqueado: %d", resp.StatusCode)
+	}
+}
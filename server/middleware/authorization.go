@@ -1,15 +1,32 @@
 package middleware
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"net/http"
 	"server/logging"
+	"server/session"
+	"server/store"
+	"sync"
 	"time"
 	"util"
 	"util/model"
 )
 
+// la actividad de un usuario para la presencia se guarda como mucho una vez cada activeResolution
+const activeResolution = 30 * time.Second
+
+// cabecera con la que se le da al cliente un token de acceso nuevo antes de que caduque el que usa
+const HeaderAccessToken = "Access-Token"
+
+var (
+	activeMu   sync.Mutex
+	lastActive = make(map[string]time.Time)
+)
+
+// Authorization comprueba el token de acceso firmado sin leer el Store y deja sus Claims en el contexto, que es de
+// donde los handlers sacan quién hace la petición. Si al token le queda poco, devuelve uno nuevo en la cabecera
+// Access-Token
 func Authorization(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		token, err := util.Decode64(req.Header.Get("Authorization"))
@@ -22,7 +39,7 @@ func Authorization(next http.Handler) http.Handler {
 			return
 		}
 
-		data := req.Context().Value(ContextKeyData).(*model.Database)
+		data, _ := req.Context().Value(ContextKeyData).(store.Store)
 
 		if data == nil {
 			logging.SendLogRemote("DB nil")
@@ -30,34 +47,44 @@ func Authorization(next http.Handler) http.Handler {
 			return
 		}
 
-		username := req.Header.Get("Username")
+		now := time.Now()
 
-		if err := validarToken(username, token, data); err != nil {
+		claims, err := validarToken(req.Header.Get("Username"), token, now)
+		if err != nil {
 			logging.SendLogRemote(fmt.Sprintf("Error de login. %s", err.Error()))
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		if data.Users[username].Blocked {
-			logging.SendLogRemote(fmt.Sprintf("Error de login. %s esta bloqueado", username))
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+		if session.NeedsRenewal(claims, now) {
+			if claims, err = renewToken(w, data, claims, now); err != nil {
+				logging.SendLogRemote(fmt.Sprintf("Error de login. %s", err.Error()))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 		}
 
-		next.ServeHTTP(w, req)
+		touchActive(data, claims.User, now)
+
+		ctx := context.WithValue(req.Context(), ContextKeyClaims, claims)
+		next.ServeHTTP(w, req.WithContext(ctx))
 	})
 }
 
+// Admin deja pasar solo a los administradores. El rol se lee del Store y no del token, que podría ser de antes de
+// quitárselo o de bloquearlo
 func Admin(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		username := req.Header.Get("Username")
-
-		data := req.Context().Value(ContextKeyData).(*model.Database)
+		claims, _ := req.Context().Value(ContextKeyClaims).(session.Claims)
+		data, _ := req.Context().Value(ContextKeyData).(store.Store)
 
-		user := data.Users[username]
+		var u model.User
+		if data != nil {
+			u, _ = data.GetUser(claims.User)
+		}
 
-		if user.Role != model.Admin {
-			logging.SendLogRemote(fmt.Sprintf("Error de autorización. Usuario '%s' no es admin", username))
+		if u.Name == "" || u.Blocked || u.Role != model.Admin {
+			logging.SendLogRemote(fmt.Sprintf("Error de autorización. Usuario '%s' no es admin", claims.User))
 
 			w.WriteHeader(http.StatusUnauthorized)
 			return
@@ -67,23 +94,67 @@ func Admin(next http.Handler) http.Handler {
 	})
 }
 
-func validarToken(user string, token []byte, data *model.Database) error {
-	if user == "" {
-		return fmt.Errorf("nombre de usuario no proporcionado")
+// validarToken comprueba que token es un token de acceso vigente y devuelve lo que dice. El usuario sale del token;
+// la cabecera Username es opcional y, si viene, tiene que coincidir
+func validarToken(user string, token []byte, now time.Time) (session.Claims, error) {
+	if token == nil {
+		return session.Claims{}, fmt.Errorf("token no proporcionado")
 	}
 
-	if token == nil {
-		return fmt.Errorf("token no proporcionado")
+	claims, err := session.Verify(token, now)
+	if err != nil {
+		return claims, err
 	}
 
-	u, ok := data.Users[user] // ¿existe ya el usuario?
-	if !ok {
-		return fmt.Errorf("usuario no encontrado")
-	} else if time.Since(u.Seen).Minutes() > 60 {
-		return fmt.Errorf("token expirado")
-	} else if !bytes.EqualFold(u.Token, token) {
-		return fmt.Errorf(fmt.Sprintf("token incorrecto. Real: %v. Proporcionado: %v", u.Token, token))
+	if user != "" && claims.User != user {
+		return claims, fmt.Errorf("el token es de otro usuario")
 	}
 
-	return nil
+	return claims, nil
+}
+
+/*
+renewToken firma un token nuevo para la sesión de claims, alarga la sesión y devuelve los claims nuevos. El usuario se
+vuelve a leer del Store para que el token lleve su rol actual; si ya no existe o está bloqueado no se renueva y los
+tokens que queden de la sesión dejan de valer. También falla si la sesión ya no existe
+*/
+func renewToken(w http.ResponseWriter, data store.Store, claims session.Claims, now time.Time) (session.Claims, error) {
+	u, ok := data.GetUser(claims.User)
+	if !ok || u.Blocked {
+		session.Revoke(claims.Session, now)
+		return claims, fmt.Errorf("usuario %s bloqueado o borrado", claims.User)
+	}
+
+	s, err := data.UpdateSession(claims.User, claims.Session, func(s *model.Session) error {
+		session.Touch(s, now)
+		return nil
+	})
+	if err == store.ErrNotFound {
+		return claims, session.ErrRevoked
+	} else if err != nil {
+		return claims, err
+	}
+
+	token, _ := session.Issue(s, u.Role, now)
+	w.Header().Set(HeaderAccessToken, util.Encode64(token))
+
+	return session.Verify(token, now)
+}
+
+// touchActive guarda la actividad de user para la presencia, sin escribir en cada petición
+func touchActive(data store.Store, user string, now time.Time) {
+	activeMu.Lock()
+	if now.Sub(lastActive[user]) < activeResolution {
+		activeMu.Unlock()
+		return
+	}
+	lastActive[user] = now
+	activeMu.Unlock()
+
+	if _, err := data.UpdateUser(user, func(u *model.User) error {
+		u.Active = now
+		return nil
+	}); err != nil {
+		logging.SendLogRemote(fmt.Sprintf("ERROR: Guardando la actividad de %s. %s", user, err.Error()))
+	}
 }
@@ -3,16 +3,19 @@ package middleware
 import (
 	"context"
 	"net/http"
-	"util/model"
+	"server/hub"
+	"server/store"
 )
 
 type contextKey string
 
 const (
-	ContextKeyData = contextKey("db")
+	ContextKeyData   = contextKey("db")
+	ContextKeyHub    = contextKey("hub")
+	ContextKeyClaims = contextKey("claims") // session.Claims del token de la petición, lo pone Authorization
 )
 
-func InjectData(data *model.Database) func(next http.Handler) http.Handler {
+func InjectData(data store.Store) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			ctx := context.WithValue(req.Context(), ContextKeyData, data)
@@ -20,3 +23,12 @@ func InjectData(data *model.Database) func(next http.Handler) http.Handler {
 		})
 	}
 }
+
+func InjectHub(h *hub.Hub) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx := context.WithValue(req.Context(), ContextKeyHub, h)
+			next.ServeHTTP(w, req.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"server/logging"
+	"strconv"
+	"sync"
+	"time"
+	"util/model"
+)
+
+/*
+Límites de los endpoints de autenticación. Cada IP tiene un cupo de peticiones por minuto y, además, los fallos (400,
+401, 403 y 404) se cuentan por IP y por cuenta: a partir de authFreeFailures cada fallo dobla la espera hasta el
+siguiente intento y con authLockoutFailures la cuenta o la IP quedan bloqueadas el tiempo de lockout. Los fallos se
+olvidan tras lockout sin ninguno nuevo. Mientras toca esperar se responde 429 con Retry-After.
+*/
+
+const (
+	authFreeFailures    = 3
+	authLockoutFailures = 10
+	authBackoff         = time.Second
+
+	// lo que se lee como mucho del cuerpo para saber la cuenta
+	authMaxBody = 64 * 1024
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type failures struct {
+	n     int
+	last  time.Time
+	until time.Time
+}
+
+type limiter struct {
+	rate    int // peticiones por minuto de cada IP
+	lockout time.Duration
+
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	failures map[string]*failures // "ip:..." o "user:..."
+	swept    time.Time
+}
+
+// AuthLimit crea un límite de intentos con rate peticiones por minuto de cada IP y bloqueos de lockout, que se comparte
+// entre todos los endpoints a los que se aplica
+func AuthLimit(rate int, lockout time.Duration) func(next http.Handler) http.Handler {
+	limits := &limiter{rate: rate, lockout: lockout, buckets: make(map[string]*bucket), failures: make(map[string]*failures)}
+
+	return func(next http.Handler) http.Handler {
+		return limits.handler(next)
+	}
+}
+
+func (l *limiter) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ip := clientIP(req)
+		keys := []string{"ip:" + ip}
+		if user := account(req); user != "" {
+			keys = append(keys, "user:"+user)
+		}
+
+		now := time.Now()
+		if wait := l.allow(ip, keys, now); wait > 0 {
+			logging.SendLogRemote(fmt.Sprintf("Demasiados intentos de %v en %s", keys, req.URL.Path))
+			tooManyRequests(w, wait)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, req)
+
+		switch rec.status {
+		case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			l.fail(keys, time.Now())
+		}
+	})
+}
+
+// allow gasta una petición del cupo de ip y devuelve cuánto hay que esperar si no quedan o si keys están bloqueadas
+func (l *limiter) allow(ip string, keys []string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	var wait time.Duration
+	for _, k := range keys {
+		if f, ok := l.failures[k]; ok && f.until.After(now) {
+			wait = max(wait, f.until.Sub(now))
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	// cubo de rate peticiones que se rellena a rate por minuto
+	perSecond := float64(l.rate) / 60
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: float64(l.rate), last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = min(float64(l.rate), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// fail apunta un fallo en keys y calcula hasta cuándo tienen que esperar
+func (l *limiter) fail(keys []string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, k := range keys {
+		f, ok := l.failures[k]
+		if !ok || now.Sub(f.last) > l.lockout {
+			f = &failures{}
+			l.failures[k] = f
+		}
+
+		f.n++
+		f.last = now
+		f.until = now.Add(l.backoff(f.n))
+	}
+}
+
+func (l *limiter) backoff(n int) time.Duration {
+	switch {
+	case n < authFreeFailures:
+		return 0
+	case n >= authLockoutFailures:
+		return l.lockout
+	}
+	return min(authBackoff<<(n-authFreeFailures), l.lockout)
+}
+
+// sweep olvida como mucho una vez por minuto los cubos llenos y los fallos pasados
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > time.Minute {
+			delete(l.buckets, k)
+		}
+	}
+	for k, f := range l.failures {
+		if now.Sub(f.last) > l.lockout && now.After(f.until) {
+			delete(l.failures, k)
+		}
+	}
+}
+
+// clientIP es la dirección de la conexión; las cabeceras tipo X-Forwarded-For las pone el cliente y no se miran
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// account saca la cuenta del parámetro user o del campo User del cuerpo JSON, que se deja como estaba para el handler
+func account(req *http.Request) string {
+	if user := req.URL.Query().Get("user"); user != "" {
+		return user
+	}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return ""
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, authMaxBody))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), req.Body), req.Body}
+	if err != nil {
+		return ""
+	}
+
+	var body struct{ User string }
+	json.Unmarshal(data, &body)
+	return body.User
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(model.Resp{Ok: false, Msg: fmt.Sprintf("Demasiados intentos, espera %d s", seconds)})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
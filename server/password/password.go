@@ -0,0 +1,76 @@
+/*
+Hash de las contraseñas con Argon2. Cada cálculo usa 32 MiB, así que se hacen en un número fijo de workers con una cola
+acotada: si está llena la petición se rechaza con ErrBusy en vez de esperar, para que una ráfaga de logins no agote la
+memoria del servidor.
+*/
+package password
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var ErrBusy = fmt.Errorf("demasiadas contraseñas comprobándose a la vez")
+
+var (
+	workers = runtime.NumCPU()
+	queue   = 32
+
+	startOnce sync.Once
+	jobs      chan job
+)
+
+type job struct {
+	password []byte
+	salt     []byte
+	out      chan []byte
+}
+
+// SetPool cambia los workers (0 = uno por CPU) y el tamaño de la cola (0 = sin cola, solo los workers libres). Los
+// valores negativos se ignoran. Solo tiene efecto antes del primer Hash
+func SetPool(n int, q int) {
+	if n > 0 {
+		workers = n
+	}
+	if q >= 0 {
+		queue = q
+	}
+}
+
+func start() {
+	jobs = make(chan job, queue)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := range jobs {
+				j.out <- argon2.Key(j.password, j.salt, 3, 32*1024, 4, 32)
+			}
+		}()
+	}
+}
+
+// Hash calcula el hash de password con salt, o devuelve ErrBusy si no cabe en la cola
+func Hash(password string, salt []byte) ([]byte, error) {
+	startOnce.Do(start)
+
+	j := job{password: []byte(password), salt: salt, out: make(chan []byte, 1)}
+	select {
+	case jobs <- j:
+	default:
+		return nil, ErrBusy
+	}
+
+	return <-j.out, nil
+}
+
+// Check dice si password es la contraseña de hash
+func Check(password string, salt []byte, hash []byte) (bool, error) {
+	h, err := Hash(password, salt)
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(h, hash) == 1, nil
+}
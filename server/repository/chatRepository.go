@@ -1,26 +1,16 @@
 package repository
 
 import (
-	"fmt"
+	"server/store"
 	"time"
 	"util/model"
 )
 
-func CreateMessage(db *model.Database, sender string, receiver string, message string) {
-	key := fmt.Sprintf("%s->%s", sender, receiver)
-	if _, ok := db.PendingMessages[key]; !ok {
-		db.PendingMessages[key] = make([]model.Message, 0)
-	}
-
-	db.PendingMessages[key] = append(db.PendingMessages[key], model.Message{Sender: sender, Message: message, Timestamp: time.Now()})
+func CreateMessage(db store.Store, sender string, receiver string, message string) error {
+	_, err := db.AppendMessage(sender, receiver, model.Message{Sender: sender, Message: message, Timestamp: time.Now()})
+	return err
 }
 
-func GetMessages(db *model.Database, sender string, receiver string) []model.Message {
-	key := fmt.Sprintf("%s->%s", sender, receiver)
-
-	c := db.PendingMessages[key]
-
-	db.PendingMessages[key] = make([]model.Message, 0)
-
-	return c
+func GetMessages(db store.Store, sender string, receiver string) ([]model.Message, error) {
+	return db.TakeMessages(sender, receiver)
 }
@@ -2,41 +2,26 @@ package repository
 
 import (
 	"fmt"
+	"server/store"
 	"slices"
 	"util/model"
 )
 
-func CreateGroup(db *model.Database, name string) (model.Group, error) {
+func CreateGroup(db store.Store, name string) (model.Group, error) {
 	group := model.Group{Name: name}
 
-	if _, existe := db.Groups[name]; existe {
+	err := db.CreateGroup(group)
+	if err == store.ErrExists {
 		return group, fmt.Errorf("el grupo ya existe")
-	} else {
-		(*db).Groups[name] = group
 	}
 
-	return group, nil
+	return group, err
 }
 
-func JoinGroup(db *model.Database, group string, user string) bool {
-
-	if (*db).GroupUsers[group] == nil {
-		(*db).GroupUsers[group] = make([]string, 0)
-	}
-
-	if slices.Contains((*db).GroupUsers[group], user) {
-		return false
-	} else {
-		(*db).GroupUsers[group] = append((*db).GroupUsers[group], user)
-	}
-
-	return true
+func JoinGroup(db store.Store, group string, user string) bool {
+	return db.AddGroupUser(group, user) == nil
 }
 
-func UserCanAccessGroup(db *model.Database, group string, user string) bool {
-	if (*db).GroupUsers[group] == nil {
-		return false
-	}
-
-	return slices.Contains((*db).GroupUsers[group], user)
+func UserCanAccessGroup(db store.Store, group string, user string) bool {
+	return slices.Contains(db.GroupUsers(group), user)
 }
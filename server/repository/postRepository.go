@@ -2,36 +2,23 @@ package repository
 
 import (
 	"fmt"
-	"slices"
+	"server/store"
 	"strings"
 	"time"
 	"util/model"
 )
 
-func CreatePost(db *model.Database, content string, author string, group string) (model.Post, error) {
+// CreatePost guarda el post con la firma del autor tal cual, la comprueban los clientes al mostrarlo
+func CreatePost(db store.Store, content string, signature []byte, author string, group string) (model.Post, error) {
 	if strings.TrimSpace(content) == "" {
 		return model.Post{}, fmt.Errorf("no puedes publicar un post vacío")
 	}
-	post := model.Post{Id: db.NextPostId, Content: strings.TrimSpace(content), Author: author, Group: group, Date: time.Now()}
+	post := model.Post{Content: strings.TrimSpace(content), Author: author, Group: group, Date: time.Now(), Signature: signature}
 
 	// Si post pertenece a grupo, solo sale en feed de grupo, si no, sale publicamente para todos
-	if post.Group != "" {
-		if !UserCanAccessGroup(db, group, author) {
-			return post, fmt.Errorf("el usuario no tiene acceso al grupo")
-		}
-
-		(*db).GroupPosts[post.Id] = post
-		(*db).GroupPostIds[post.Group] = append((*db).GroupPostIds[post.Group], post.Id)
-	} else {
-		(*db).Posts[post.Id] = post
-		newPost := make([]int, 1)
-		newPost[0] = post.Id
-		(*db).PostIds = slices.Concat(newPost, (*db).PostIds)
+	if post.Group != "" && !UserCanAccessGroup(db, group, author) {
+		return post, fmt.Errorf("el usuario no tiene acceso al grupo")
 	}
 
-	(*db).UserPosts[post.Author] = append((*db).UserPosts[post.Author], post.Id)
-
-	db.NextPostId++
-
-	return post, nil
+	return db.CreatePost(post)
 }
@@ -0,0 +1,104 @@
+/*
+Sesiones de los usuarios. Cada login crea una sesión con un refresh token, que se guarda en el Store, y le da un token de
+acceso firmado (token.go), que es el que va en la cabecera Authorization y se comprueba sin leer el Store. Cada refresh
+cambia el refresh token, así que solo sirve una vez.
+
+El refresh token es el id de la sesión seguido de un secreto aleatorio; el servidor guarda solo su sha256 y con el id
+encuentra la sesión sin tener que buscar por el token.
+*/
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"time"
+	"util/model"
+)
+
+const (
+	idSize     = 16
+	secretSize = 32
+)
+
+var (
+	tokenLifetime   = 15 * time.Minute
+	refreshLifetime = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalid = fmt.Errorf("token no válido")
+	ErrExpired = fmt.Errorf("token expirado")
+	ErrRevoked = fmt.Errorf("sesión cerrada")
+)
+
+func SetLifetimes(token time.Duration, refresh time.Duration) {
+	tokenLifetime = token
+	refreshLifetime = refresh
+}
+
+// New crea la sesión de user en device y devuelve también su refresh token, que no se guarda
+func New(user string, device string, now time.Time) (s model.Session, refresh []byte) {
+	id := make([]byte, idSize)
+	rand.Read(id)
+
+	s = model.Session{Id: hex.EncodeToString(id), User: user, Device: device, Created: now}
+	return s, Rotate(&s, now)
+}
+
+// Rotate cambia el refresh token de s y alarga su caducidad a partir de now
+func Rotate(s *model.Session, now time.Time) []byte {
+	id, _ := hex.DecodeString(s.Id)
+
+	refresh := make([]byte, idSize+secretSize)
+	copy(refresh, id)
+	rand.Read(refresh[idSize:])
+
+	s.RefreshHash = hash(refresh)
+	Touch(s, now)
+	return refresh
+}
+
+// Touch apunta en s que se ha usado en now, lo que alarga lo que le queda para caducar
+func Touch(s *model.Session, now time.Time) {
+	s.Seen = now
+	s.RefreshExpires = now.Add(refreshLifetime)
+}
+
+func hash(token []byte) []byte {
+	sum := sha256.Sum256(token)
+	return sum[:]
+}
+
+// Id devuelve el id de la sesión a la que pertenece el refresh token
+func Id(refresh []byte) (string, error) {
+	if len(refresh) != idSize+secretSize {
+		return "", ErrInvalid
+	}
+	return hex.EncodeToString(refresh[:idSize]), nil
+}
+
+// CheckRefresh comprueba en now que refresh es el refresh token vigente de s
+func CheckRefresh(s model.Session, refresh []byte, now time.Time) error {
+	if subtle.ConstantTimeCompare(s.RefreshHash, hash(refresh)) != 1 {
+		return ErrInvalid
+	}
+
+	if Expired(s, now) {
+		return ErrExpired
+	}
+
+	return nil
+}
+
+// Expired indica si s ya no se puede renovar
+func Expired(s model.Session, now time.Time) bool {
+	return !now.Before(s.RefreshExpires)
+}
+
+// Info es lo que se enseña de s a su usuario. current es el id de la sesión de la petición
+func Info(s model.Session, current string) model.SessionInfo {
+	return model.SessionInfo{Id: s.Id, Device: s.Device, Created: s.Created, Seen: s.Seen, Expires: s.RefreshExpires, Current: s.Id == current}
+}
@@ -0,0 +1,168 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+	"util/model"
+)
+
+/*
+Tokens de acceso. Son los Claims en JSON seguidos de su HMAC-SHA256, así el middleware sabe quién es y de qué sesión
+sin leer nada del Store. Las claves solo están en memoria y cambian cada cierto tiempo; las retiradas se guardan
+mientras pueda quedar algún token firmado con ellas. Al reiniciar el servidor los tokens dejan de valer y los
+clientes los renuevan con el refresh token.
+
+Como no se guardan, un token sigue valiendo hasta que caduca aunque se cierre su sesión; por eso las sesiones cerradas
+se apuntan en revoked mientras les pueda quedar algún token vigente.
+*/
+type Claims struct {
+	User    string
+	Role    model.Role
+	Session string
+	Key     string // id de la clave que lo firma
+	Issued  time.Time
+	Expires time.Time
+}
+
+type signingKey struct {
+	id      string
+	key     []byte
+	retired time.Time // cuándo dejó de firmar, cero la actual
+}
+
+var (
+	keysMu sync.RWMutex
+	keys   []signingKey // la última es la que firma
+
+	revokedMu sync.Mutex
+	revoked   = make(map[string]time.Time) // id de sesión -> caducidad del último token que puede tener
+)
+
+// RotateKey pone una clave nueva para firmar y olvida las retiradas con las que ya no queda ningún token vigente
+func RotateKey(now time.Time) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	keysMu.Lock()
+	defer keysMu.Unlock()
+
+	kept := make([]signingKey, 0, len(keys)+1)
+	for _, k := range keys {
+		if k.retired.IsZero() {
+			k.retired = now
+		}
+		if now.Sub(k.retired) < tokenLifetime {
+			kept = append(kept, k)
+		}
+	}
+	keys = append(kept, signingKey{id: hex.EncodeToString(id), key: key})
+
+	revokedMu.Lock()
+	defer revokedMu.Unlock()
+	for id, until := range revoked {
+		if !now.Before(until) {
+			delete(revoked, id)
+		}
+	}
+}
+
+func signingKeyFor(id string) (signingKey, bool) {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+
+	for _, k := range keys {
+		if k.id == id {
+			return k, true
+		}
+	}
+	return signingKey{}, false
+}
+
+// currentKey devuelve la clave que firma, creando la primera si hace falta
+func currentKey() signingKey {
+	keysMu.RLock()
+	n := len(keys)
+	var k signingKey
+	if n > 0 {
+		k = keys[n-1]
+	}
+	keysMu.RUnlock()
+
+	if n == 0 {
+		RotateKey(time.Now())
+		return currentKey()
+	}
+	return k
+}
+
+func mac(key []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// Issue firma un token de acceso para la sesión s de un usuario con role. Devuelve también su caducidad
+func Issue(s model.Session, role model.Role, now time.Time) ([]byte, time.Time) {
+	k := currentKey()
+
+	c := Claims{User: s.User, Role: role, Session: s.Id, Key: k.id, Issued: now, Expires: now.Add(tokenLifetime)}
+	data, _ := json.Marshal(c)
+
+	return append(data, mac(k.key, data)...), c.Expires
+}
+
+// Verify comprueba la firma de token y que en now siga vigente y su sesión abierta
+func Verify(token []byte, now time.Time) (Claims, error) {
+	var c Claims
+	if len(token) <= sha256.Size {
+		return c, ErrInvalid
+	}
+
+	data, sum := token[:len(token)-sha256.Size], token[len(token)-sha256.Size:]
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, ErrInvalid
+	}
+
+	k, ok := signingKeyFor(c.Key)
+	if !ok || !hmac.Equal(sum, mac(k.key, data)) {
+		return c, ErrInvalid
+	}
+
+	if !now.Before(c.Expires) {
+		return c, ErrExpired
+	}
+
+	if Revoked(c.Session, now) {
+		return c, ErrRevoked
+	}
+
+	return c, nil
+}
+
+// NeedsRenewal indica si a c le queda menos de la mitad de su vida y hay que darle al cliente uno nuevo
+func NeedsRenewal(c Claims, now time.Time) bool {
+	return c.Expires.Sub(now) < c.Expires.Sub(c.Issued)/2
+}
+
+// Revoke invalida en now los tokens de acceso que queden de la sesión id
+func Revoke(id string, now time.Time) {
+	revokedMu.Lock()
+	defer revokedMu.Unlock()
+
+	revoked[id] = now.Add(tokenLifetime)
+}
+
+func Revoked(id string, now time.Time) bool {
+	revokedMu.Lock()
+	defer revokedMu.Unlock()
+
+	until, ok := revoked[id]
+	return ok && now.Before(until)
+}
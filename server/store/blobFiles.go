@@ -0,0 +1,76 @@
+package store
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"util"
+	"util/model"
+)
+
+/*
+Trozos de los adjuntos del almacenamiento en memoria. No van en la foto, que se reescribe entera en cada guardado y se
+cargaría entera en memoria: cada trozo es un archivo <db>.blobs/<id en hex>/<n> cifrado con la clave de datos y ligado a
+su adjunto y posición. El journal solo apunta que el trozo ha llegado, el archivo se escribe antes.
+*/
+type blobFiles struct {
+	dir string
+	key []byte
+}
+
+func (f blobFiles) blobDir(id string) string {
+	return filepath.Join(f.dir, hex.EncodeToString([]byte(id)))
+}
+
+func blobChunkAD(id string, n int) []byte {
+	return []byte("blob:" + blobChunkKey(id, n))
+}
+
+func (f blobFiles) write(id string, n int, data []byte) error {
+	dir := f.blobDir(id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(dir, strconv.Itoa(n)), util.EncryptAD(data, f.key, blobChunkAD(id, n)), 0600)
+}
+
+func (f blobFiles) read(id string, n int) ([]byte, bool) {
+	enc, err := os.ReadFile(filepath.Join(f.blobDir(id), strconv.Itoa(n)))
+	if err != nil {
+		return nil, false
+	}
+
+	data, err := util.DecryptAD(enc, f.key, blobChunkAD(id, n))
+	return data, err == nil
+}
+
+func (f blobFiles) remove(id string) error {
+	return os.RemoveAll(f.blobDir(id))
+}
+
+// sweep borra los trozos de adjuntos que ya no existen, que quedan si el servidor se para entre borrar el adjunto y
+// sus archivos
+func (f blobFiles) sweep(blobs map[string]model.Blob) error {
+	entries, err := os.ReadDir(f.dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if id, err := hex.DecodeString(e.Name()); err == nil {
+			if _, ok := blobs[string(id)]; ok {
+				continue
+			}
+		}
+
+		if err := os.RemoveAll(filepath.Join(f.dir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
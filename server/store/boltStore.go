@@ -0,0 +1,1307 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"server/keyring"
+	"slices"
+	"time"
+	"util"
+	"util/model"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore guarda cada registro cifrado por separado en un archivo bbolt, de forma que cada escritura solo cifra lo que cambia
+type BoltStore struct {
+	*certChallenges
+	*loginTickets
+
+	db  *bolt.DB
+	key []byte
+}
+
+var (
+	bucketUsers        = []byte("users")
+	bucketUserNames    = []byte("usernames")
+	bucketGroups       = []byte("groups")
+	bucketGroupUsers   = []byte("group_users")
+	bucketUserGroups   = []byte("user_groups")
+	bucketPosts        = []byte("posts")
+	bucketGroupPosts   = []byte("group_posts")
+	bucketGroupPostIds = []byte("group_post_ids")
+	bucketUserPosts    = []byte("user_posts")
+	bucketMessages     = []byte("messages")
+	bucketChatActivity = []byte("chat_activity")
+	bucketReceipts     = []byte("receipts")
+	bucketPreKeys      = []byte("prekeys")
+	bucketHistory      = []byte("history")
+	bucketHistoryIds   = []byte("history_ids")
+	bucketGroupMsgs    = []byte("group_messages")
+	bucketSenderKeys   = []byte("sender_keys")
+	bucketExpiry       = []byte("expiry")
+	bucketBlobs        = []byte("blobs")
+	bucketBlobChunks   = []byte("blob_chunks")
+	bucketSessions     = []byte("sessions")
+	bucketMeta         = []byte("meta")
+
+	keyNextPostId    = []byte("next_post_id")
+	keyNextMessageId = []byte("next_message_id")
+	keyKeyHeader     = []byte("key_header")
+)
+
+var buckets = [][]byte{
+	bucketUsers, bucketUserNames, bucketGroups, bucketGroupUsers, bucketUserGroups, bucketPosts,
+	bucketGroupPosts, bucketGroupPostIds, bucketUserPosts, bucketMessages, bucketChatActivity, bucketReceipts,
+	bucketPreKeys, bucketHistory, bucketHistoryIds, bucketGroupMsgs, bucketSenderKeys, bucketExpiry,
+	bucketBlobs, bucketBlobChunks, bucketSessions, bucketMeta,
+}
+
+// OpenBolt abre el archivo desbloqueando la clave de datos con la frase de paso. La cabecera de la clave va en el
+// bucket meta. En archivos anteriores a la cabecera la clave de datos es sha256 de la frase y se envuelve tal cual,
+// porque cambiarla obligaría a volver a cifrar todos los registros; solo se reescriben los que sigan en el formato antiguo
+func OpenBolt(path string, passphrase []byte) (*BoltStore, error) {
+	db, err := openBoltFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		meta := tx.Bucket(bucketMeta)
+		if enc := meta.Get(keyKeyHeader); enc != nil {
+			header, _, err := keyring.Parse(enc)
+			if err != nil {
+				return err
+			}
+
+			key, err = header.Unwrap(passphrase)
+			return err
+		}
+
+		var header keyring.Header
+		if first, _ := tx.Bucket(bucketUsers).Cursor().First(); first == nil {
+			header, key = keyring.New(passphrase)
+		} else {
+			key = keyring.LegacyKey(passphrase)
+			header = keyring.Wrap(key, passphrase)
+
+			if err := migrateLegacyRecords(tx, key); err != nil {
+				return err
+			}
+		}
+
+		return meta.Put(keyKeyHeader, header.Marshal())
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{certChallenges: newCertChallenges(), loginTickets: newLoginTickets(), db: db, key: key}, nil
+}
+
+// migrateLegacyRecords vuelve a cifrar en el formato autenticado los registros que aún están en el antiguo. Se hace
+// una vez, al poner la cabecera de clave, y después get ya no acepta el formato antiguo
+func migrateLegacyRecords(tx *bolt.Tx, key []byte) error {
+	for _, name := range buckets {
+		// los índices de nombres y los contadores no van cifrados
+		if bytes.Equal(name, bucketUserNames) || bytes.Equal(name, bucketMeta) {
+			continue
+		}
+
+		b := tx.Bucket(name)
+
+		// no se puede escribir en el bucket mientras se recorre, se recogen primero
+		migrated := make(map[string][]byte)
+		err := b.ForEach(func(k, v []byte) error {
+			if v == nil || util.IsEnvelope(v) {
+				return nil
+			}
+
+			data, err := util.DecryptLegacy(v, key)
+			if err != nil {
+				return err
+			}
+			if !json.Valid(data) {
+				return fmt.Errorf("clave incorrecta")
+			}
+
+			migrated[string(k)] = util.EncryptAD(data, key, recordAD(name, k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for k, v := range migrated {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// el archivo queda bloqueado mientras el servidor lo tiene abierto, si no se consigue en un segundo se da error
+func openBoltFile(path string) (*bolt.DB, error) {
+	return bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+}
+
+// RotateBoltKey cambia la frase de paso reescribiendo solo la cabecera. El servidor debe estar parado
+func RotateBoltKey(path string, oldPassphrase []byte, newPassphrase []byte) error {
+	db, err := openBoltFile(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketMeta)
+		if meta == nil || meta.Get(keyKeyHeader) == nil {
+			return fmt.Errorf("cabecera de clave no encontrada")
+		}
+
+		header, _, err := keyring.Parse(meta.Get(keyKeyHeader))
+		if err != nil {
+			return err
+		}
+
+		header, err = header.Rewrap(oldPassphrase, newPassphrase)
+		if err != nil {
+			return err
+		}
+
+		return meta.Put(keyKeyHeader, header.Marshal())
+	})
+}
+
+func itob(id int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
+
+func btoi(b []byte) int {
+	return int(binary.BigEndian.Uint64(b))
+}
+
+// cada registro se autentica junto con su bucket y clave para que no se pueda mover a otro sitio
+func recordAD(bucket []byte, k []byte) []byte {
+	return slices.Concat(bucket, []byte("/"), k)
+}
+
+// get descifra y decodifica el valor de k en el bucket. Devuelve false si no existe
+func (s *BoltStore) get(tx *bolt.Tx, bucket []byte, k []byte, v any) (bool, error) {
+	enc := tx.Bucket(bucket).Get(k)
+	if enc == nil {
+		return false, nil
+	}
+
+	jsonData, err := util.DecryptAD(enc, s.key, recordAD(bucket, k))
+	if err != nil {
+		return false, err
+	}
+
+	return true, json.Unmarshal(jsonData, v)
+}
+
+func (s *BoltStore) put(tx *bolt.Tx, bucket []byte, k []byte, v any) error {
+	return tx.Bucket(bucket).Put(k, util.EncryptAD(util.EncodeJSON(v), s.key, recordAD(bucket, k)))
+}
+
+// view ejecuta una lectura; los errores de disco o de descifrado se tratan como registro inexistente
+func (s *BoltStore) view(bucket []byte, k []byte, v any) bool {
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		ok, err = s.get(tx, bucket, k, v)
+		return err
+	})
+
+	return err == nil && ok
+}
+
+func (s *BoltStore) GetUser(name string) (model.User, bool) {
+	var u model.User
+	ok := s.view(bucketUsers, []byte(name), &u)
+	return u, ok
+}
+
+func (s *BoltStore) CreateUser(user model.User) (model.User, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketUsers).Get([]byte(user.Name)) != nil {
+			return ErrExists
+		}
+
+		names := tx.Bucket(bucketUserNames)
+		if first, _ := names.Cursor().First(); first == nil {
+			user.Role = model.Admin
+		}
+
+		seq, err := names.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		if err := names.Put(itob(int(seq)), []byte(user.Name)); err != nil {
+			return err
+		}
+
+		return s.put(tx, bucketUsers, []byte(user.Name), user)
+	})
+
+	return user, err
+}
+
+func (s *BoltStore) UpdateUser(name string, fn func(user *model.User) error) (model.User, error) {
+	var u model.User
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		ok, err := s.get(tx, bucketUsers, []byte(name), &u)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return ErrNotFound
+		}
+
+		if err := fn(&u); err != nil {
+			return err
+		}
+
+		return s.put(tx, bucketUsers, []byte(name), u)
+	})
+
+	return u, err
+}
+
+func (s *BoltStore) UserNames() []string {
+	names := make([]string, 0)
+
+	s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketUserNames).ForEach(func(k, v []byte) error {
+			names = append(names, string(v))
+			return nil
+		})
+	})
+
+	return names
+}
+
+func (s *BoltStore) GetGroup(name string) (model.Group, bool) {
+	var g model.Group
+	ok := s.view(bucketGroups, []byte(name), &g)
+	return g, ok
+}
+
+func (s *BoltStore) CreateGroup(group model.Group) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketGroups).Get([]byte(group.Name)) != nil {
+			return ErrExists
+		}
+
+		return s.put(tx, bucketGroups, []byte(group.Name), group)
+	})
+}
+
+func (s *BoltStore) GroupUsers(group string) []string {
+	users := make([]string, 0)
+	s.view(bucketGroupUsers, []byte(group), &users)
+	return users
+}
+
+func (s *BoltStore) AddGroupUser(group string, user string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var users, groups []string
+
+		if _, err := s.get(tx, bucketGroupUsers, []byte(group), &users); err != nil {
+			return err
+		}
+
+		if slices.Contains(users, user) {
+			return ErrExists
+		}
+
+		if _, err := s.get(tx, bucketUserGroups, []byte(user), &groups); err != nil {
+			return err
+		}
+
+		if err := s.put(tx, bucketGroupUsers, []byte(group), append(users, user)); err != nil {
+			return err
+		}
+
+		if err := s.put(tx, bucketUserGroups, []byte(user), append(groups, group)); err != nil {
+			return err
+		}
+
+		return s.nextEpoch(tx, group)
+	})
+}
+
+func (s *BoltStore) RemoveGroupUser(group string, user string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var users, groups []string
+
+		if _, err := s.get(tx, bucketGroupUsers, []byte(group), &users); err != nil {
+			return err
+		}
+
+		if !slices.Contains(users, user) {
+			return ErrNotFound
+		}
+
+		if _, err := s.get(tx, bucketUserGroups, []byte(user), &groups); err != nil {
+			return err
+		}
+
+		users = slices.DeleteFunc(users, func(u string) bool { return u == user })
+		if err := s.put(tx, bucketGroupUsers, []byte(group), users); err != nil {
+			return err
+		}
+
+		groups = slices.DeleteFunc(groups, func(g string) bool { return g == group })
+		if err := s.put(tx, bucketUserGroups, []byte(user), groups); err != nil {
+			return err
+		}
+
+		return s.nextEpoch(tx, group)
+	})
+}
+
+func (s *BoltStore) nextEpoch(tx *bolt.Tx, group string) error {
+	var g model.Group
+	if _, err := s.get(tx, bucketGroups, []byte(group), &g); err != nil {
+		return err
+	}
+
+	g.Name = group
+	g.Epoch++
+	return s.put(tx, bucketGroups, []byte(group), g)
+}
+
+func (s *BoltStore) CreatePost(post model.Post) (model.Post, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketMeta)
+		if next := meta.Get(keyNextPostId); next != nil {
+			post.Id = btoi(next)
+		}
+
+		if post.Group != "" {
+			var ids []int
+			if _, err := s.get(tx, bucketGroupPostIds, []byte(post.Group), &ids); err != nil {
+				return err
+			}
+
+			if err := s.put(tx, bucketGroupPosts, itob(post.Id), post); err != nil {
+				return err
+			}
+
+			if err := s.put(tx, bucketGroupPostIds, []byte(post.Group), append(ids, post.Id)); err != nil {
+				return err
+			}
+		} else if err := s.put(tx, bucketPosts, itob(post.Id), post); err != nil {
+			return err
+		}
+
+		var userPosts []int
+		if _, err := s.get(tx, bucketUserPosts, []byte(post.Author), &userPosts); err != nil {
+			return err
+		}
+
+		if err := s.put(tx, bucketUserPosts, []byte(post.Author), append(userPosts, post.Id)); err != nil {
+			return err
+		}
+
+		return meta.Put(keyNextPostId, itob(post.Id+1))
+	})
+
+	return post, err
+}
+
+func (s *BoltStore) GetPost(id int) (model.Post, bool) {
+	var p model.Post
+	ok := s.view(bucketPosts, itob(id), &p)
+	return p, ok
+}
+
+func (s *BoltStore) GetGroupPost(id int) (model.Post, bool) {
+	var p model.Post
+	ok := s.view(bucketGroupPosts, itob(id), &p)
+	return p, ok
+}
+
+// los ids son crecientes, se recorren al revés para devolver primero los posts más recientes
+func (s *BoltStore) PostIds() []int {
+	ids := make([]int, 0)
+
+	s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketPosts).Cursor()
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			ids = append(ids, btoi(k))
+		}
+		return nil
+	})
+
+	return ids
+}
+
+func (s *BoltStore) GroupPostIds(group string) []int {
+	ids := make([]int, 0)
+	s.view(bucketGroupPostIds, []byte(group), &ids)
+	return ids
+}
+
+func (s *BoltStore) AppendMessage(sender string, receiver string, msg model.Message) (model.Message, error) {
+	key := []byte(messagesKey(sender, receiver))
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketMeta)
+		msg.Id = 1
+		if next := meta.Get(keyNextMessageId); next != nil {
+			msg.Id = int64(btoi(next))
+		}
+
+		var msgs []model.Message
+		if _, err := s.get(tx, bucketMessages, key, &msgs); err != nil {
+			return err
+		}
+
+		if err := s.put(tx, bucketMessages, key, append(msgs, msg)); err != nil {
+			return err
+		}
+
+		if err := s.touchChat(tx, sender, receiver, msg.Timestamp); err != nil {
+			return err
+		}
+
+		if err := s.touchChat(tx, receiver, sender, msg.Timestamp); err != nil {
+			return err
+		}
+
+		return meta.Put(keyNextMessageId, itob(int(msg.Id+1)))
+	})
+
+	return msg, err
+}
+
+func (s *BoltStore) TakeMessages(sender string, receiver string) ([]model.Message, error) {
+	key := []byte(messagesKey(sender, receiver))
+	msgs := make([]model.Message, 0)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := s.get(tx, bucketMessages, key, &msgs); err != nil {
+			return err
+		}
+
+		return tx.Bucket(bucketMessages).Delete(key)
+	})
+
+	return msgs, err
+}
+
+func (s *BoltStore) PendingMessages(sender string, receiver string, after int64) []model.Message {
+	var msgs []model.Message
+	s.view(bucketMessages, []byte(messagesKey(sender, receiver)), &msgs)
+	return messagesAfter(msgs, after)
+}
+
+func (s *BoltStore) AckMessages(sender string, receiver string, upTo int64) error {
+	key := []byte(messagesKey(sender, receiver))
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var msgs []model.Message
+		if _, err := s.get(tx, bucketMessages, key, &msgs); err != nil {
+			return err
+		}
+
+		if pending := messagesAfter(msgs, upTo); len(pending) > 0 {
+			return s.put(tx, bucketMessages, key, pending)
+		}
+
+		return tx.Bucket(bucketMessages).Delete(key)
+	})
+}
+
+func (s *BoltStore) GetReceipt(sender string, receiver string) model.Receipt {
+	r := model.Receipt{User: receiver}
+	s.view(bucketReceipts, []byte(messagesKey(sender, receiver)), &r)
+	return r
+}
+
+func (s *BoltStore) UpdateReceipt(sender string, receiver string, delivered int64, read int64) (model.Receipt, error) {
+	key := []byte(messagesKey(sender, receiver))
+
+	var r model.Receipt
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var current model.Receipt
+		if _, err := s.get(tx, bucketReceipts, key, &current); err != nil {
+			return err
+		}
+
+		var changed bool
+		r, changed = mergeReceipt(current, receiver, delivered, read)
+		if !changed {
+			return nil
+		}
+
+		return s.put(tx, bucketReceipts, key, r)
+	})
+
+	return r, err
+}
+
+func (s *BoltStore) PublishPreKeys(user string, bundle model.PreKeyBundle) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var current model.PreKeyBundle
+		if _, err := s.get(tx, bucketPreKeys, []byte(user), &current); err != nil {
+			return err
+		}
+
+		return s.put(tx, bucketPreKeys, []byte(user), mergePreKeys(current, bundle))
+	})
+}
+
+func (s *BoltStore) TakePreKeyBundle(user string) (model.PreKeyBundle, bool, error) {
+	var taken model.PreKeyBundle
+	var ok bool
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var current model.PreKeyBundle
+		var err error
+		if ok, err = s.get(tx, bucketPreKeys, []byte(user), &current); err != nil || !ok {
+			return err
+		}
+
+		var rest model.PreKeyBundle
+		taken, rest = takePreKey(current)
+		if len(taken.OneTimePreKeys) == 0 {
+			return nil
+		}
+
+		return s.put(tx, bucketPreKeys, []byte(user), rest)
+	})
+
+	return taken, ok, err
+}
+
+func (s *BoltStore) PreKeyStatus(user string) model.PreKeyStatus {
+	var b model.PreKeyBundle
+	s.view(bucketPreKeys, []byte(user), &b)
+	return preKeyStatus(b)
+}
+
+func (s *BoltStore) AppendGroupMessage(msg model.GroupMessage) (model.GroupMessage, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var msgs []model.GroupMessage
+		if _, err := s.get(tx, bucketGroupMsgs, []byte(msg.Group), &msgs); err != nil {
+			return err
+		}
+
+		msgs, msg = appendGroupMessage(msgs, msg)
+		return s.put(tx, bucketGroupMsgs, []byte(msg.Group), msgs)
+	})
+
+	return msg, err
+}
+
+func (s *BoltStore) GroupMessages(group string, after int64) []model.GroupMessage {
+	var msgs []model.GroupMessage
+	s.view(bucketGroupMsgs, []byte(group), &msgs)
+	return groupMessagesAfter(msgs, after)
+}
+
+func (s *BoltStore) PutSenderKey(key model.SenderKey) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var keys []model.SenderKey
+		if _, err := s.get(tx, bucketSenderKeys, []byte(key.Group), &keys); err != nil {
+			return err
+		}
+
+		return s.put(tx, bucketSenderKeys, []byte(key.Group), putSenderKey(keys, key))
+	})
+}
+
+func (s *BoltStore) SenderKeys(group string) []model.SenderKey {
+	keys := make([]model.SenderKey, 0)
+	s.view(bucketSenderKeys, []byte(group), &keys)
+	return keys
+}
+
+func (s *BoltStore) GetExpiry(a string, b string) model.Expiry {
+	var e model.Expiry
+	s.view(bucketExpiry, []byte(conversationKey(a, b)), &e)
+	return e
+}
+
+func (s *BoltStore) UpdateExpiry(a string, b string, fn func(e *model.Expiry) error) (model.Expiry, error) {
+	key := []byte(conversationKey(a, b))
+
+	var e model.Expiry
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := s.get(tx, bucketExpiry, key, &e); err != nil {
+			return err
+		}
+
+		if err := fn(&e); err != nil {
+			return err
+		}
+
+		return s.put(tx, bucketExpiry, key, e)
+	})
+
+	return e, err
+}
+
+func (s *BoltStore) PurgeExpired(now time.Time) (int, error) {
+	purged := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// no se puede escribir en el bucket mientras se recorre
+		changed := make(map[string][]model.Message)
+		err := tx.Bucket(bucketMessages).ForEach(func(k, v []byte) error {
+			var msgs []model.Message
+			if _, err := s.get(tx, bucketMessages, k, &msgs); err != nil {
+				return err
+			}
+
+			if left, n := unexpired(msgs, now); n > 0 {
+				changed[string(k)] = left
+				purged += n
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for key, left := range changed {
+			if len(left) == 0 {
+				err = tx.Bucket(bucketMessages).Delete([]byte(key))
+			} else {
+				err = s.put(tx, bucketMessages, []byte(key), left)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return purged, err
+}
+
+// la cuota se cuenta recorriendo los adjuntos, solo se hace al reservar uno
+func (s *BoltStore) CreateBlob(blob model.Blob, quota int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketBlobs).Get([]byte(blob.Id)) != nil {
+			return ErrExists
+		}
+
+		if quota > 0 {
+			used := blob.Size
+			err := tx.Bucket(bucketBlobs).ForEach(func(k, v []byte) error {
+				var b model.Blob
+				if _, err := s.get(tx, bucketBlobs, k, &b); err != nil {
+					return err
+				}
+				if b.Owner == blob.Owner {
+					used += b.Size
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			if used > quota {
+				return ErrQuota
+			}
+		}
+
+		return s.put(tx, bucketBlobs, []byte(blob.Id), blob)
+	})
+}
+
+func (s *BoltStore) GetBlob(id string) (model.Blob, bool) {
+	var b model.Blob
+	ok := s.view(bucketBlobs, []byte(id), &b)
+	return b, ok
+}
+
+// los trozos se guardan cifrados tal cual, sin pasar por JSON
+func (s *BoltStore) PutBlobChunk(id string, n int, data []byte) (model.Blob, error) {
+	var blob model.Blob
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		ok, err := s.get(tx, bucketBlobs, []byte(id), &blob)
+		if err != nil {
+			return err
+		}
+
+		if !ok || n < 0 || n >= len(blob.Uploaded) {
+			return ErrNotFound
+		}
+		if blob.Complete() {
+			return ErrComplete
+		}
+
+		k := []byte(blobChunkKey(id, n))
+		if err := tx.Bucket(bucketBlobChunks).Put(k, util.EncryptAD(data, s.key, recordAD(bucketBlobChunks, k))); err != nil {
+			return err
+		}
+
+		blob.Uploaded[n] = true
+		return s.put(tx, bucketBlobs, []byte(id), blob)
+	})
+
+	return blob, err
+}
+
+func (s *BoltStore) BlobChunk(id string, n int) ([]byte, bool) {
+	var data []byte
+
+	k := []byte(blobChunkKey(id, n))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		enc := tx.Bucket(bucketBlobChunks).Get(k)
+		if enc == nil {
+			return nil
+		}
+
+		var err error
+		data, err = util.DecryptAD(enc, s.key, recordAD(bucketBlobChunks, k))
+		return err
+	})
+
+	return data, err == nil && data != nil
+}
+
+func (s *BoltStore) ExpireBlobs(owner string, ids []string, expires time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			var blob model.Blob
+			ok, err := s.get(tx, bucketBlobs, []byte(id), &blob)
+			if err != nil {
+				return err
+			}
+			if !ok || blob.Owner != owner {
+				continue
+			}
+
+			blob.Expires = expires
+			if err := s.put(tx, bucketBlobs, []byte(id), blob); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) DeleteBlob(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketBlobs).Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		return deleteBlobs(tx, []string{id})
+	})
+}
+
+func (s *BoltStore) PurgeBlobs(now time.Time, incomplete time.Time) (int, error) {
+	var ids []string
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(bucketBlobs).ForEach(func(k, v []byte) error {
+			var b model.Blob
+			if _, err := s.get(tx, bucketBlobs, k, &b); err != nil {
+				return err
+			}
+			if purgeable(b, now, incomplete) {
+				ids = append(ids, b.Id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return deleteBlobs(tx, ids)
+	})
+
+	return len(ids), err
+}
+
+// deleteBlobs borra los adjuntos con todos sus trozos
+func deleteBlobs(tx *bolt.Tx, ids []string) error {
+	for _, id := range ids {
+		if err := tx.Bucket(bucketBlobs).Delete([]byte(id)); err != nil {
+			return err
+		}
+
+		// no se puede borrar mientras se recorre con el cursor
+		prefix := []byte(id + "/")
+		keys := make([][]byte, 0)
+		c := tx.Bucket(bucketBlobChunks).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, slices.Clone(k))
+		}
+
+		for _, k := range keys {
+			if err := tx.Bucket(bucketBlobChunks).Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *BoltStore) CreateSession(session model.Session) error {
+	k := []byte(sessionKey(session.User, session.Id))
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketSessions).Get(k) != nil {
+			return ErrExists
+		}
+
+		return s.put(tx, bucketSessions, k, session)
+	})
+}
+
+func (s *BoltStore) GetSession(user string, id string) (model.Session, bool) {
+	var session model.Session
+	ok := s.view(bucketSessions, []byte(sessionKey(user, id)), &session)
+	return session, ok
+}
+
+func (s *BoltStore) UpdateSession(user string, id string, fn func(session *model.Session) error) (model.Session, error) {
+	k := []byte(sessionKey(user, id))
+
+	var session model.Session
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		ok, err := s.get(tx, bucketSessions, k, &session)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return ErrNotFound
+		}
+
+		if err := fn(&session); err != nil {
+			return err
+		}
+
+		return s.put(tx, bucketSessions, k, session)
+	})
+
+	return session, err
+}
+
+// sessions recorre con el prefijo del usuario sus sesiones
+func (s *BoltStore) sessions(tx *bolt.Tx, user string) ([]model.Session, error) {
+	prefix := []byte(sessionKey(user, ""))
+
+	sessions := make([]model.Session, 0)
+	c := tx.Bucket(bucketSessions).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		var session model.Session
+		if _, err := s.get(tx, bucketSessions, k, &session); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+func (s *BoltStore) Sessions(user string) []model.Session {
+	var sessions []model.Session
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		sessions, err = s.sessions(tx, user)
+		return err
+	})
+	if err != nil {
+		return make([]model.Session, 0)
+	}
+
+	sortSessions(sessions)
+	return sessions
+}
+
+func (s *BoltStore) DeleteSessions(user string, del func(session model.Session) bool) (int, error) {
+	deleted := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		sessions, err := s.sessions(tx, user)
+		if err != nil {
+			return err
+		}
+
+		for _, session := range sessions {
+			if !del(session) {
+				continue
+			}
+
+			if err := tx.Bucket(bucketSessions).Delete([]byte(sessionKey(user, session.Id))); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+
+	return deleted, err
+}
+
+// las entradas del historial van en registros <dueño>-><otro>\x00<seq> para poder recorrerlas en orden con un
+// cursor; history_ids guarda con <dueño>-><otro>\x00<id del mensaje> la seq de cada mensaje ya guardado
+func historyPrefix(owner string, other string) []byte {
+	return append([]byte(messagesKey(owner, other)), 0)
+}
+
+func historyKey(prefix []byte, n int64) []byte {
+	return slices.Concat(prefix, itob(int(n)))
+}
+
+func (s *BoltStore) AppendHistory(owner string, other string, entry model.HistoryEntry) (model.HistoryEntry, error) {
+	prefix := historyPrefix(owner, other)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var seq int64
+		ok, err := s.get(tx, bucketHistoryIds, historyKey(prefix, entry.MessageId), &seq)
+		if err != nil {
+			return err
+		}
+		if ok {
+			_, err := s.get(tx, bucketHistory, historyKey(prefix, seq), &entry)
+			return err
+		}
+
+		// la última de la conversación es la anterior a la mayor seq posible
+		c := tx.Bucket(bucketHistory).Cursor()
+		k, _ := c.Seek(historyKey(prefix, -1))
+		if k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+
+		entry.Seq = 1
+		if k != nil && bytes.HasPrefix(k, prefix) {
+			entry.Seq = int64(btoi(k[len(prefix):])) + 1
+		}
+
+		if err := s.put(tx, bucketHistory, historyKey(prefix, entry.Seq), entry); err != nil {
+			return err
+		}
+
+		return s.put(tx, bucketHistoryIds, historyKey(prefix, entry.MessageId), entry.Seq)
+	})
+
+	return entry, err
+}
+
+func (s *BoltStore) History(owner string, other string, after int64, limit int) []model.HistoryEntry {
+	prefix := historyPrefix(owner, other)
+	entries := make([]model.HistoryEntry, 0)
+
+	s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketHistory).Cursor()
+		for k, _ := c.Seek(historyKey(prefix, after+1)); k != nil && bytes.HasPrefix(k, prefix) && len(entries) < limit; k, _ = c.Next() {
+			var e model.HistoryEntry
+			if _, err := s.get(tx, bucketHistory, k, &e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+
+	return entries
+}
+
+func (s *BoltStore) DeleteHistory(owner string) error {
+	prefix := []byte(messagesKey(owner, ""))
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketHistory, bucketHistoryIds} {
+			// no se puede borrar mientras se recorre con el cursor
+			keys := make([][]byte, 0)
+			c := tx.Bucket(name).Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				keys = append(keys, slices.Clone(k))
+			}
+
+			for _, k := range keys {
+				if err := tx.Bucket(name).Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) touchChat(tx *bolt.Tx, user string, other string, t time.Time) error {
+	activity := make(map[string]time.Time)
+	if _, err := s.get(tx, bucketChatActivity, []byte(user), &activity); err != nil {
+		return err
+	}
+
+	if !t.After(activity[other]) {
+		return nil
+	}
+
+	activity[other] = t
+	return s.put(tx, bucketChatActivity, []byte(user), activity)
+}
+
+func (s *BoltStore) Chats(user string) []model.ChatSummary {
+	chats := make([]model.ChatSummary, 0)
+
+	s.db.View(func(tx *bolt.Tx) error {
+		activity := make(map[string]time.Time)
+		if _, err := s.get(tx, bucketChatActivity, []byte(user), &activity); err != nil {
+			return err
+		}
+
+		for other, last := range activity {
+			var pending []model.Message
+			if _, err := s.get(tx, bucketMessages, []byte(messagesKey(other, user)), &pending); err != nil {
+				return err
+			}
+
+			chats = append(chats, model.ChatSummary{User: other, Pending: len(pending), LastActivity: last})
+		}
+
+		return nil
+	})
+
+	sortChats(chats)
+	return chats
+}
+
+// cada escritura ya es persistente
+func (s *BoltStore) Save() error {
+	return s.db.Sync()
+}
+
+// la copia contiene los registros ya cifrados
+func (s *BoltStore) Backup(w io.Writer) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+func (s *BoltStore) Export() (model.Database, error) {
+	data := NewDatabase()
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(bucketUsers).ForEach(func(k, v []byte) error {
+			var u model.User
+			_, err := s.get(tx, bucketUsers, k, &u)
+			data.Users[u.Name] = u
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(bucketGroups).ForEach(func(k, v []byte) error {
+			var g model.Group
+			_, err := s.get(tx, bucketGroups, k, &g)
+			data.Groups[g.Name] = g
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(bucketPosts).ForEach(func(k, v []byte) error {
+			var p model.Post
+			_, err := s.get(tx, bucketPosts, k, &p)
+			data.Posts[p.Id] = p
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(bucketGroupPosts).ForEach(func(k, v []byte) error {
+			var p model.Post
+			_, err := s.get(tx, bucketGroupPosts, k, &p)
+			data.GroupPosts[p.Id] = p
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		lists := map[string]map[string][]string{
+			string(bucketGroupUsers): data.GroupUsers,
+			string(bucketUserGroups): data.UserGroups,
+		}
+		for name, table := range lists {
+			err = tx.Bucket([]byte(name)).ForEach(func(k, v []byte) error {
+				var l []string
+				_, err := s.get(tx, []byte(name), k, &l)
+				table[string(k)] = l
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		ids := map[string]map[string][]int{
+			string(bucketGroupPostIds): data.GroupPostIds,
+			string(bucketUserPosts):    data.UserPosts,
+		}
+		for name, table := range ids {
+			err = tx.Bucket([]byte(name)).ForEach(func(k, v []byte) error {
+				var l []int
+				_, err := s.get(tx, []byte(name), k, &l)
+				table[string(k)] = l
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.Bucket(bucketMessages).ForEach(func(k, v []byte) error {
+			var msgs []model.Message
+			_, err := s.get(tx, bucketMessages, k, &msgs)
+			data.PendingMessages[string(k)] = msgs
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(bucketChatActivity).ForEach(func(k, v []byte) error {
+			activity := make(map[string]time.Time)
+			_, err := s.get(tx, bucketChatActivity, k, &activity)
+			data.ChatActivity[string(k)] = activity
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(bucketPreKeys).ForEach(func(k, v []byte) error {
+			var b model.PreKeyBundle
+			_, err := s.get(tx, bucketPreKeys, k, &b)
+			data.PreKeys[string(k)] = b
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(bucketHistory).ForEach(func(k, v []byte) error {
+			var e model.HistoryEntry
+			_, err := s.get(tx, bucketHistory, k, &e)
+			chat := string(k[:bytes.IndexByte(k, 0)])
+			data.History[chat] = append(data.History[chat], e)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(bucketGroupMsgs).ForEach(func(k, v []byte) error {
+			var msgs []model.GroupMessage
+			_, err := s.get(tx, bucketGroupMsgs, k, &msgs)
+			data.GroupMessages[string(k)] = msgs
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(bucketSenderKeys).ForEach(func(k, v []byte) error {
+			var keys []model.SenderKey
+			_, err := s.get(tx, bucketSenderKeys, k, &keys)
+			data.SenderKeys[string(k)] = keys
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(bucketExpiry).ForEach(func(k, v []byte) error {
+			var e model.Expiry
+			_, err := s.get(tx, bucketExpiry, k, &e)
+			data.Expiry[string(k)] = e
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(bucketBlobs).ForEach(func(k, v []byte) error {
+			var b model.Blob
+			_, err := s.get(tx, bucketBlobs, k, &b)
+			data.Blobs[b.Id] = b
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(bucketSessions).ForEach(func(k, v []byte) error {
+			var session model.Session
+			_, err := s.get(tx, bucketSessions, k, &session)
+			data.Sessions[string(k)] = session
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(bucketReceipts).ForEach(func(k, v []byte) error {
+			var r model.Receipt
+			_, err := s.get(tx, bucketReceipts, k, &r)
+			data.Receipts[string(k)] = r
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if next := tx.Bucket(bucketMeta).Get(keyNextPostId); next != nil {
+			data.NextPostId = btoi(next)
+		}
+
+		if next := tx.Bucket(bucketMeta).Get(keyNextMessageId); next != nil {
+			data.LastMessageId = int64(btoi(next)) - 1
+		}
+
+		return nil
+	})
+
+	data.UserNames = s.UserNames()
+	data.PostIds = s.PostIds()
+
+	return data, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,342 @@
+package store
+
+import (
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"util"
+	"util/model"
+)
+
+/*
+Journal de escritura anticipada del MemoryStore. Cada modificación se añade cifrada al final de <db>.journal y se hace
+fsync antes de aplicarla en memoria, así que un crash solo pierde la operación que se estaba escribiendo.
+
+Formato: una secuencia de registros [longitud uint32 big endian][entrada cifrada]. Un último registro incompleto
+(crash a mitad de escritura) se ignora al reproducir.
+
+Compactación: al guardar, el journal activo se renombra a <db>.journal.<seq>, se escribe la foto en db.enc de forma
+atómica y después se borran los journals renombrados. Cada entrada lleva un número de secuencia y la foto guarda el
+último incluido, por lo que si el proceso muere entre medias las entradas repetidas se saltan al reproducir.
+*/
+
+const (
+	opCreateUser   = "createUser"
+	opPutUser      = "putUser"
+	opCreateGroup  = "createGroup"
+	opAddGroupUser = "addGroupUser"
+	opDelGroupUser = "removeGroupUser"
+	opGroupMsg     = "groupMessage"
+	opSenderKey    = "senderKey"
+	opCreatePost   = "createPost"
+	opAppendMsg    = "appendMessage"
+	opTakeMsgs     = "takeMessages"
+	opAckMsgs      = "ackMessages"
+	opReceipt      = "receipt"
+	opPreKeys      = "preKeys"
+	opHistory      = "history"
+	opDelHistory   = "deleteHistory"
+	opExpiry       = "expiry"
+	opPurgeExpired = "purgeExpired"
+	opCreateBlob   = "createBlob"
+	opBlobChunk    = "blobChunk"
+	opExpireBlobs  = "expireBlobs"
+	opDelBlobs     = "deleteBlobs"
+	opSession      = "session"
+	opDelSessions  = "deleteSessions"
+)
+
+type journalEntry struct {
+	Seq int64
+	Op  string
+
+	User    *model.User         `json:",omitempty"`
+	Group   *model.Group        `json:",omitempty"`
+	Post    *model.Post         `json:",omitempty"`
+	Message *model.Message      `json:",omitempty"`
+	Receipt *model.Receipt      `json:",omitempty"`
+	PreKeys *model.PreKeyBundle `json:",omitempty"`
+	History *model.HistoryEntry `json:",omitempty"`
+
+	GroupMessage *model.GroupMessage `json:",omitempty"`
+	SenderKey    *model.SenderKey    `json:",omitempty"`
+
+	Expiry *model.Expiry `json:",omitempty"`
+	Blob   *model.Blob   `json:",omitempty"`
+	Chunk  []byte        `json:",omitempty"` // solo en journals de cuando los trozos iban en la foto
+
+	Session *model.Session `json:",omitempty"`
+	Ids     []string       `json:",omitempty"`
+
+	// nombres que identifican el registro afectado (grupo, emisor, receptor...)
+	A string `json:",omitempty"`
+	B string `json:",omitempty"`
+	N int64  `json:",omitempty"`
+}
+
+// journalFile es lo que usa el journal del archivo abierto, los tests lo cambian para simular errores de disco
+type journalFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+	Close() error
+}
+
+type journal struct {
+	path string
+	key  []byte
+	file journalFile
+
+	// broken es el error que dejó el journal en un estado desconocido, a partir de ahí no se escribe más
+	broken error
+
+	// legacy acepta al leer registros del formato antiguo, mientras se migra una base de datos sin cabecera de clave
+	legacy bool
+}
+
+func openJournal(path string, key []byte) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &journal{path: path, key: key, file: file}, nil
+}
+
+/*
+append escribe la entrada y espera a que esté en disco. Si la escritura falla a medias se corta el archivo por donde
+estaba, porque un registro incompleto seguido de otros haría ilegible todo lo que hay detrás. Si no se puede cortar, o
+falla el Sync y no se sabe qué ha llegado al disco, el journal queda roto y no acepta más entradas hasta reiniciar.
+*/
+func (j *journal) append(entry journalEntry) error {
+	if j.broken != nil {
+		return fmt.Errorf("journal inutilizable: %w", j.broken)
+	}
+
+	info, err := j.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	enc := util.EncryptAD(util.EncodeJSON(entry), j.key, adJournal)
+
+	record := make([]byte, 4+len(enc))
+	binary.BigEndian.PutUint32(record, uint32(len(enc)))
+	copy(record[4:], enc)
+
+	if _, err := j.file.Write(record); err != nil {
+		if terr := j.file.Truncate(info.Size()); terr != nil {
+			j.broken = err
+		}
+		return err
+	}
+
+	if err := j.file.Sync(); err != nil {
+		j.broken = err
+		return err
+	}
+
+	return nil
+}
+
+// rotate aparta el journal activo como <path>.<seq> y abre uno vacío. Si no hay nada escrito no hace falta
+func (j *journal) rotate(seq int64) error {
+	info, err := j.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 {
+		return nil
+	}
+
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(j.path, fmt.Sprintf("%s.%d", j.path, seq)); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	j.file = file
+	return nil
+}
+
+// rotated devuelve los journals apartados que aún no se han compactado
+func (j *journal) rotated() ([]string, error) {
+	matches, err := filepath.Glob(j.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(matches))
+	for _, m := range matches {
+		if _, err := strconv.ParseInt(strings.TrimPrefix(m, j.path+"."), 10, 64); err == nil {
+			files = append(files, m)
+		}
+	}
+
+	return files, nil
+}
+
+func (j *journal) removeRotated() error {
+	files, err := j.rotated()
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// entries lee todos los journals (apartados y activo) y devuelve las entradas posteriores a seq ordenadas
+func (j *journal) entries(after int64) ([]journalEntry, error) {
+	files, err := j.rotated()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]journalEntry, 0)
+	for _, f := range append(files, j.path) {
+		read, end, err := readJournalFile(f, j.key, j.legacy)
+		if err != nil {
+			return nil, fmt.Errorf("journal %s: %w", f, err)
+		}
+
+		// el registro a medias de un crash se quita para que lo siguiente no se escriba detrás
+		if f == j.path {
+			if err := j.file.Truncate(end); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, e := range read {
+			if e.Seq > after {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b journalEntry) int {
+		return cmp.Compare(a.Seq, b.Seq)
+	})
+
+	return entries, nil
+}
+
+// readJournalFile devuelve las entradas del archivo y dónde acaba el último registro completo
+func readJournalFile(path string, key []byte, legacy bool) ([]journalEntry, int64, error) {
+	decrypt := util.DecryptAD
+	if legacy {
+		decrypt = decryptMigrating
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	entries := make([]journalEntry, 0)
+	header := make([]byte, 4)
+	var end int64
+
+	for {
+		if _, err := io.ReadFull(file, header); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return entries, end, nil
+			}
+			return nil, 0, err
+		}
+
+		enc := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(file, enc); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				// registro a medias por un crash, todo lo anterior es válido
+				return entries, end, nil
+			}
+			return nil, 0, err
+		}
+
+		jsonData, err := decrypt(enc, key, adJournal)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var e journalEntry
+		if err := json.Unmarshal(jsonData, &e); err != nil {
+			return nil, 0, err
+		}
+
+		entries = append(entries, e)
+		end += int64(len(header) + len(enc))
+	}
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+// writeFileAtomic escribe en un temporal del mismo directorio y lo renombra, nunca queda un archivo a medias
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// fsync del directorio para que el rename sobreviva a un corte de luz
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,1005 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"server/keyring"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"util"
+	"util/model"
+)
+
+// MemoryStore mantiene toda la base de datos en mapas. Cada cambio se apunta en un journal antes de aplicarse y Save
+// vuelca la foto completa y cifrada al archivo, vaciando el journal. Los trozos de los adjuntos van en archivos aparte.
+// mu protege data y el journal; saveMu evita que dos Save escriban el archivo a la vez
+type MemoryStore struct {
+	*certChallenges
+	*loginTickets
+
+	path    string
+	header  keyring.Header
+	key     []byte
+	journal *journal
+	blobs   blobFiles
+
+	mu     sync.RWMutex
+	saveMu sync.Mutex
+	data   model.Database
+}
+
+func NewDatabase() model.Database {
+	return model.Database{
+		Users:            make(map[string]model.User),
+		Groups:           make(map[string]model.Group),
+		Posts:            make(map[int]model.Post),
+		GroupPosts:       make(map[int]model.Post),
+		UserPosts:        make(map[string][]int),
+		GroupPostIds:     make(map[string][]int),
+		GroupUsers:       make(map[string][]string),
+		UserGroups:       make(map[string][]string),
+		UserNames:        make([]string, 0),
+		PendingCertLogin: make(map[string][]byte),
+		PendingMessages:  make(map[string][]model.Message),
+		ChatActivity:     make(map[string]map[string]time.Time),
+		Receipts:         make(map[string]model.Receipt),
+		PreKeys:          make(map[string]model.PreKeyBundle),
+		History:          make(map[string][]model.HistoryEntry),
+		GroupMessages:    make(map[string][]model.GroupMessage),
+		SenderKeys:       make(map[string][]model.SenderKey),
+		Blobs:            make(map[string]model.Blob),
+		Expiry:           make(map[string]model.Expiry),
+		Sessions:         make(map[string]model.Session),
+		NextPostId:       0,
+	}
+}
+
+// OpenMemory carga el archivo desbloqueando la clave de datos con la frase de paso. Los archivos sin cabecera de
+// clave (cifrados directamente con sha256 de la frase) se migran a una clave de datos nueva al abrirlos
+func OpenMemory(path string, passphrase []byte) (*MemoryStore, error) {
+	s := &MemoryStore{certChallenges: newCertChallenges(), loginTickets: newLoginTickets(), path: path}
+	save := false
+	legacy := false
+
+	var oldChunks struct{ BlobChunks map[string][]byte }
+
+	encryptedData, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		fmt.Println("El archivo de la base de datos no existe.")
+		s.header, s.key = keyring.New(passphrase)
+		s.data = NewDatabase()
+
+		// se guarda ya para que la cabecera con la clave exista antes de escribir en el journal
+		save = true
+	} else {
+		body := encryptedData
+
+		if keyring.HasHeader(encryptedData) {
+			s.header, body, err = keyring.Parse(encryptedData)
+			if err != nil {
+				return nil, err
+			}
+
+			s.key, err = s.header.Unwrap(passphrase)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			fmt.Println("Base de datos sin cabecera de clave, se migra a una clave de datos nueva")
+			s.key = keyring.LegacyKey(passphrase)
+			save = true
+			legacy = true
+		}
+
+		decrypt := util.DecryptAD
+		if legacy {
+			decrypt = decryptMigrating
+		}
+
+		jsonData, err := decrypt(body, s.key, adDatabase)
+		if err != nil {
+			return nil, fmt.Errorf("clave incorrecta")
+		}
+
+		err = json.Unmarshal(jsonData, &s.data)
+		if err != nil {
+			return nil, fmt.Errorf("clave incorrecta")
+		}
+
+		// las fotos anteriores llevaban dentro los trozos de los adjuntos, se pasan a sus archivos
+		if err := json.Unmarshal(jsonData, &oldChunks); err != nil {
+			return nil, err
+		}
+		fmt.Printf("Base de datos cargada desde %s\n", path)
+
+		fillEmptyTables(&s.data)
+	}
+
+	s.journal, err = openJournal(strings.TrimSuffix(path, filepath.Ext(path))+".journal", s.key)
+	if err != nil {
+		return nil, err
+	}
+	s.journal.legacy = legacy
+
+	entries, err := s.journal.entries(s.data.JournalSeq)
+	if err != nil {
+		s.journal.close()
+		return nil, err
+	}
+
+	for _, e := range entries {
+		s.apply(e)
+	}
+
+	if len(entries) > 0 {
+		fmt.Printf("Reproducidas %d operaciones del journal\n", len(entries))
+	}
+
+	if save && s.header.Wrapped == nil {
+		s.header, s.key = keyring.New(passphrase)
+		s.journal.key = s.key
+		s.journal.legacy = false
+	}
+
+	s.blobs = blobFiles{dir: strings.TrimSuffix(path, filepath.Ext(path)) + ".blobs", key: s.key}
+	if err := s.migrateChunks(oldChunks.BlobChunks, entries); err != nil {
+		s.journal.close()
+		return nil, err
+	}
+	if len(oldChunks.BlobChunks) > 0 {
+		save = true
+	}
+
+	if err := s.blobs.sweep(s.data.Blobs); err != nil {
+		s.journal.close()
+		return nil, err
+	}
+
+	if save {
+		if err := s.Save(); err != nil {
+			s.journal.close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// migrateChunks escribe en archivos los trozos que venían en la foto o en el journal, de antes de guardarlos aparte
+func (s *MemoryStore) migrateChunks(chunks map[string][]byte, entries []journalEntry) error {
+	for key, data := range chunks {
+		i := strings.LastIndex(key, "/")
+		n, err := strconv.Atoi(key[i+1:])
+		if i < 0 || err != nil {
+			return fmt.Errorf("trozo de adjunto no válido: %s", key)
+		}
+
+		if err := s.blobs.write(key[:i], n, data); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range entries {
+		if e.Op == opBlobChunk && e.Chunk != nil {
+			if err := s.blobs.write(e.A, int(e.N), e.Chunk); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// RotateMemoryKey cambia la frase de paso del archivo reescribiendo solo la cabecera. El servidor debe estar parado
+func RotateMemoryKey(path string, oldPassphrase []byte, newPassphrase []byte) error {
+	encryptedData, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	header, body, err := keyring.Parse(encryptedData)
+	if err != nil {
+		return err
+	}
+
+	header, err = header.Rewrap(oldPassphrase, newPassphrase)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, slices.Concat(header.Marshal(), body), 0600)
+}
+
+// commit apunta la entrada en el journal y después la aplica. Se llama con mu bloqueado para escritura
+func (s *MemoryStore) commit(e journalEntry) error {
+	e.Seq = s.data.JournalSeq + 1
+
+	if err := s.journal.append(e); err != nil {
+		return err
+	}
+
+	s.apply(e)
+	return nil
+}
+
+// apply hace el cambio en memoria, se usa tanto al escribir como al reproducir el journal
+func (s *MemoryStore) apply(e journalEntry) {
+	switch e.Op {
+	case opCreateUser:
+		s.data.Users[e.User.Name] = *e.User
+		s.data.UserNames = append(s.data.UserNames, e.User.Name)
+	case opPutUser:
+		s.data.Users[e.User.Name] = *e.User
+	case opCreateGroup:
+		s.data.Groups[e.Group.Name] = *e.Group
+	case opAddGroupUser:
+		s.data.GroupUsers[e.A] = append(s.data.GroupUsers[e.A], e.B)
+		s.data.UserGroups[e.B] = append(s.data.UserGroups[e.B], e.A)
+		s.nextEpoch(e.A)
+	case opDelGroupUser:
+		s.data.GroupUsers[e.A] = slices.DeleteFunc(s.data.GroupUsers[e.A], func(u string) bool { return u == e.B })
+		s.data.UserGroups[e.B] = slices.DeleteFunc(s.data.UserGroups[e.B], func(g string) bool { return g == e.A })
+		s.nextEpoch(e.A)
+	case opGroupMsg:
+		s.data.GroupMessages[e.A], _ = appendGroupMessage(s.data.GroupMessages[e.A], *e.GroupMessage)
+	case opSenderKey:
+		s.data.SenderKeys[e.A] = putSenderKey(s.data.SenderKeys[e.A], *e.SenderKey)
+	case opExpiry:
+		s.data.Expiry[e.A] = *e.Expiry
+	case opPurgeExpired:
+		// la hora va en la entrada para que al reproducir se borre lo mismo
+		now := time.Unix(0, e.N)
+		for key, msgs := range s.data.PendingMessages {
+			if left, _ := unexpired(msgs, now); len(left) > 0 {
+				s.data.PendingMessages[key] = left
+			} else {
+				delete(s.data.PendingMessages, key)
+			}
+		}
+	case opCreateBlob:
+		s.data.Blobs[e.Blob.Id] = *e.Blob
+	case opBlobChunk:
+		blob := s.data.Blobs[e.A]
+		blob.Uploaded = slices.Clone(blob.Uploaded)
+		blob.Uploaded[e.N] = true
+		s.data.Blobs[e.A] = blob
+	case opExpireBlobs:
+		for _, id := range e.Ids {
+			if blob, ok := s.data.Blobs[id]; ok && blob.Owner == e.A {
+				blob.Expires = time.Unix(0, e.N)
+				s.data.Blobs[id] = blob
+			}
+		}
+	case opDelBlobs:
+		for _, id := range e.Ids {
+			delete(s.data.Blobs, id)
+		}
+	case opSession:
+		s.data.Sessions[sessionKey(e.Session.User, e.Session.Id)] = *e.Session
+	case opDelSessions:
+		for _, id := range e.Ids {
+			delete(s.data.Sessions, sessionKey(e.A, id))
+		}
+	case opCreatePost:
+		post := *e.Post
+
+		// Si post pertenece a grupo, solo sale en feed de grupo, si no, sale publicamente para todos
+		if post.Group != "" {
+			s.data.GroupPosts[post.Id] = post
+			s.data.GroupPostIds[post.Group] = append(s.data.GroupPostIds[post.Group], post.Id)
+		} else {
+			s.data.Posts[post.Id] = post
+			s.data.PostIds = slices.Concat([]int{post.Id}, s.data.PostIds)
+		}
+
+		s.data.UserPosts[post.Author] = append(s.data.UserPosts[post.Author], post.Id)
+		s.data.NextPostId = post.Id + 1
+	case opAppendMsg:
+		key := messagesKey(e.A, e.B)
+		s.data.PendingMessages[key] = append(s.data.PendingMessages[key], *e.Message)
+		s.data.LastMessageId = max(s.data.LastMessageId, e.Message.Id)
+		s.touchChat(e.A, e.B, e.Message.Timestamp)
+		s.touchChat(e.B, e.A, e.Message.Timestamp)
+	case opTakeMsgs:
+		delete(s.data.PendingMessages, messagesKey(e.A, e.B))
+	case opPreKeys:
+		s.data.PreKeys[e.A] = *e.PreKeys
+	case opHistory:
+		key := messagesKey(e.A, e.B)
+		s.data.History[key] = append(s.data.History[key], *e.History)
+	case opDelHistory:
+		for key := range s.data.History {
+			if strings.HasPrefix(key, messagesKey(e.A, "")) {
+				delete(s.data.History, key)
+			}
+		}
+	case opReceipt:
+		s.data.Receipts[messagesKey(e.A, e.B)] = *e.Receipt
+	case opAckMsgs:
+		key := messagesKey(e.A, e.B)
+		if pending := messagesAfter(s.data.PendingMessages[key], e.N); len(pending) > 0 {
+			s.data.PendingMessages[key] = pending
+		} else {
+			delete(s.data.PendingMessages, key)
+		}
+	}
+
+	s.data.JournalSeq = e.Seq
+}
+
+// los mapas vacíos se serializan como null, se vuelven a crear al cargar
+func fillEmptyTables(data *model.Database) {
+	empty := NewDatabase()
+
+	if data.Users == nil {
+		data.Users = empty.Users
+	}
+	if data.Groups == nil {
+		data.Groups = empty.Groups
+	}
+	if data.Posts == nil {
+		data.Posts = empty.Posts
+	}
+	if data.GroupPosts == nil {
+		data.GroupPosts = empty.GroupPosts
+	}
+	if data.UserPosts == nil {
+		data.UserPosts = empty.UserPosts
+	}
+	if data.GroupPostIds == nil {
+		data.GroupPostIds = empty.GroupPostIds
+	}
+	if data.GroupUsers == nil {
+		data.GroupUsers = empty.GroupUsers
+	}
+	if data.UserGroups == nil {
+		data.UserGroups = empty.UserGroups
+	}
+	if data.PendingMessages == nil {
+		data.PendingMessages = empty.PendingMessages
+	}
+	if data.ChatActivity == nil {
+		data.ChatActivity = empty.ChatActivity
+	}
+	if data.Receipts == nil {
+		data.Receipts = empty.Receipts
+	}
+	if data.PreKeys == nil {
+		data.PreKeys = empty.PreKeys
+	}
+	if data.History == nil {
+		data.History = empty.History
+	}
+	if data.GroupMessages == nil {
+		data.GroupMessages = empty.GroupMessages
+	}
+	if data.SenderKeys == nil {
+		data.SenderKeys = empty.SenderKeys
+	}
+	if data.Blobs == nil {
+		data.Blobs = empty.Blobs
+	}
+	if data.Expiry == nil {
+		data.Expiry = empty.Expiry
+	}
+	if data.Sessions == nil {
+		data.Sessions = empty.Sessions
+	}
+
+	data.PendingCertLogin = empty.PendingCertLogin
+}
+
+func (s *MemoryStore) GetUser(name string) (model.User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.data.Users[name]
+	return u, ok
+}
+
+func (s *MemoryStore) CreateUser(user model.User) (model.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data.Users[user.Name]; ok {
+		return user, ErrExists
+	}
+
+	if len(s.data.UserNames) == 0 {
+		user.Role = model.Admin
+	}
+
+	return user, s.commit(journalEntry{Op: opCreateUser, User: &user})
+}
+
+func (s *MemoryStore) UpdateUser(name string, fn func(user *model.User) error) (model.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.data.Users[name]
+	if !ok {
+		return u, ErrNotFound
+	}
+
+	if err := fn(&u); err != nil {
+		return u, err
+	}
+
+	return u, s.commit(journalEntry{Op: opPutUser, User: &u})
+}
+
+func (s *MemoryStore) UserNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.data.UserNames)
+}
+
+func (s *MemoryStore) GetGroup(name string) (model.Group, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	g, ok := s.data.Groups[name]
+	return g, ok
+}
+
+func (s *MemoryStore) CreateGroup(group model.Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data.Groups[group.Name]; ok {
+		return ErrExists
+	}
+
+	return s.commit(journalEntry{Op: opCreateGroup, Group: &group})
+}
+
+func (s *MemoryStore) GroupUsers(group string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.data.GroupUsers[group])
+}
+
+func (s *MemoryStore) AddGroupUser(group string, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if slices.Contains(s.data.GroupUsers[group], user) {
+		return ErrExists
+	}
+
+	return s.commit(journalEntry{Op: opAddGroupUser, A: group, B: user})
+}
+
+func (s *MemoryStore) RemoveGroupUser(group string, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !slices.Contains(s.data.GroupUsers[group], user) {
+		return ErrNotFound
+	}
+
+	return s.commit(journalEntry{Op: opDelGroupUser, A: group, B: user})
+}
+
+func (s *MemoryStore) nextEpoch(group string) {
+	g := s.data.Groups[group]
+	g.Epoch++
+	s.data.Groups[group] = g
+}
+
+func (s *MemoryStore) CreatePost(post model.Post) (model.Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	post.Id = s.data.NextPostId
+
+	return post, s.commit(journalEntry{Op: opCreatePost, Post: &post})
+}
+
+func (s *MemoryStore) GetPost(id int) (model.Post, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.data.Posts[id]
+	return p, ok
+}
+
+func (s *MemoryStore) GetGroupPost(id int) (model.Post, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.data.GroupPosts[id]
+	return p, ok
+}
+
+func (s *MemoryStore) PostIds() []int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.data.PostIds)
+}
+
+func (s *MemoryStore) GroupPostIds(group string) []int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.data.GroupPostIds[group])
+}
+
+func (s *MemoryStore) AppendMessage(sender string, receiver string, msg model.Message) (model.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg.Id = s.data.LastMessageId + 1
+
+	return msg, s.commit(journalEntry{Op: opAppendMsg, A: sender, B: receiver, Message: &msg})
+}
+
+func (s *MemoryStore) TakeMessages(sender string, receiver string) ([]model.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := messagesKey(sender, receiver)
+
+	msgs, ok := s.data.PendingMessages[key]
+	if !ok {
+		return make([]model.Message, 0), nil
+	}
+
+	return msgs, s.commit(journalEntry{Op: opTakeMsgs, A: sender, B: receiver})
+}
+
+func (s *MemoryStore) PendingMessages(sender string, receiver string, after int64) []model.Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return messagesAfter(s.data.PendingMessages[messagesKey(sender, receiver)], after)
+}
+
+func (s *MemoryStore) AckMessages(sender string, receiver string, upTo int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := s.data.PendingMessages[messagesKey(sender, receiver)]
+	if !slices.ContainsFunc(msgs, func(m model.Message) bool { return m.Id <= upTo }) {
+		return nil
+	}
+
+	return s.commit(journalEntry{Op: opAckMsgs, A: sender, B: receiver, N: upTo})
+}
+
+func (s *MemoryStore) GetReceipt(sender string, receiver string) model.Receipt {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	r, ok := s.data.Receipts[messagesKey(sender, receiver)]
+	if !ok {
+		r.User = receiver
+	}
+	return r
+}
+
+func (s *MemoryStore) UpdateReceipt(sender string, receiver string, delivered int64, read int64) (model.Receipt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, changed := mergeReceipt(s.data.Receipts[messagesKey(sender, receiver)], receiver, delivered, read)
+	if !changed {
+		return r, nil
+	}
+
+	return r, s.commit(journalEntry{Op: opReceipt, A: sender, B: receiver, Receipt: &r})
+}
+
+func (s *MemoryStore) PublishPreKeys(user string, bundle model.PreKeyBundle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := mergePreKeys(s.data.PreKeys[user], bundle)
+	return s.commit(journalEntry{Op: opPreKeys, A: user, PreKeys: &next})
+}
+
+func (s *MemoryStore) TakePreKeyBundle(user string) (model.PreKeyBundle, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.data.PreKeys[user]
+	if !ok {
+		return current, false, nil
+	}
+
+	taken, rest := takePreKey(current)
+	if len(taken.OneTimePreKeys) == 0 {
+		return taken, true, nil
+	}
+
+	return taken, true, s.commit(journalEntry{Op: opPreKeys, A: user, PreKeys: &rest})
+}
+
+func (s *MemoryStore) PreKeyStatus(user string) model.PreKeyStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return preKeyStatus(s.data.PreKeys[user])
+}
+
+func (s *MemoryStore) AppendHistory(owner string, other string, entry model.HistoryEntry) (model.HistoryEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := s.data.History[messagesKey(owner, other)]
+	if i := slices.IndexFunc(entries, func(e model.HistoryEntry) bool { return e.MessageId == entry.MessageId }); i >= 0 {
+		return entries[i], nil
+	}
+
+	entry.Seq = 1
+	if len(entries) > 0 {
+		entry.Seq = entries[len(entries)-1].Seq + 1
+	}
+
+	return entry, s.commit(journalEntry{Op: opHistory, A: owner, B: other, History: &entry})
+}
+
+func (s *MemoryStore) History(owner string, other string, after int64, limit int) []model.HistoryEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return historyAfter(s.data.History[messagesKey(owner, other)], after, limit)
+}
+
+func (s *MemoryStore) DeleteHistory(owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.commit(journalEntry{Op: opDelHistory, A: owner})
+}
+
+func (s *MemoryStore) AppendGroupMessage(msg model.GroupMessage) (model.GroupMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, msg = appendGroupMessage(s.data.GroupMessages[msg.Group], msg)
+
+	return msg, s.commit(journalEntry{Op: opGroupMsg, A: msg.Group, GroupMessage: &msg})
+}
+
+func (s *MemoryStore) GroupMessages(group string, after int64) []model.GroupMessage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return groupMessagesAfter(s.data.GroupMessages[group], after)
+}
+
+func (s *MemoryStore) PutSenderKey(key model.SenderKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.commit(journalEntry{Op: opSenderKey, A: key.Group, SenderKey: &key})
+}
+
+func (s *MemoryStore) SenderKeys(group string) []model.SenderKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.data.SenderKeys[group])
+}
+
+func (s *MemoryStore) GetExpiry(a string, b string) model.Expiry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.data.Expiry[conversationKey(a, b)]
+}
+
+func (s *MemoryStore) UpdateExpiry(a string, b string, fn func(e *model.Expiry) error) (model.Expiry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := conversationKey(a, b)
+	e := s.data.Expiry[key]
+	if err := fn(&e); err != nil {
+		return e, err
+	}
+
+	return e, s.commit(journalEntry{Op: opExpiry, A: key, Expiry: &e})
+}
+
+func (s *MemoryStore) PurgeExpired(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for _, msgs := range s.data.PendingMessages {
+		_, n := unexpired(msgs, now)
+		purged += n
+	}
+
+	if purged == 0 {
+		return 0, nil
+	}
+
+	return purged, s.commit(journalEntry{Op: opPurgeExpired, N: now.UnixNano()})
+}
+
+func (s *MemoryStore) CreateBlob(blob model.Blob, quota int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data.Blobs[blob.Id]; ok {
+		return ErrExists
+	}
+
+	if quota > 0 {
+		used := blob.Size
+		for _, b := range s.data.Blobs {
+			if b.Owner == blob.Owner {
+				used += b.Size
+			}
+		}
+		if used > quota {
+			return ErrQuota
+		}
+	}
+
+	return s.commit(journalEntry{Op: opCreateBlob, Blob: &blob})
+}
+
+func (s *MemoryStore) GetBlob(id string) (model.Blob, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, ok := s.data.Blobs[id]
+	return b, ok
+}
+
+func (s *MemoryStore) PutBlobChunk(id string, n int, data []byte) (model.Blob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blob, ok := s.data.Blobs[id]
+	if !ok || n < 0 || n >= len(blob.Uploaded) {
+		return blob, ErrNotFound
+	}
+	if blob.Complete() {
+		return blob, ErrComplete
+	}
+
+	if err := s.blobs.write(id, n, data); err != nil {
+		return blob, err
+	}
+
+	if err := s.commit(journalEntry{Op: opBlobChunk, A: id, N: int64(n)}); err != nil {
+		return blob, err
+	}
+
+	return s.data.Blobs[id], nil
+}
+
+func (s *MemoryStore) BlobChunk(id string, n int) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	blob, ok := s.data.Blobs[id]
+	if !ok || n < 0 || n >= len(blob.Uploaded) || !blob.Uploaded[n] {
+		return nil, false
+	}
+
+	return s.blobs.read(id, n)
+}
+
+func (s *MemoryStore) ExpireBlobs(owner string, ids []string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	owned := slices.ContainsFunc(ids, func(id string) bool {
+		return s.data.Blobs[id].Owner == owner
+	})
+	if !owned {
+		return nil
+	}
+
+	return s.commit(journalEntry{Op: opExpireBlobs, A: owner, Ids: ids, N: expires.UnixNano()})
+}
+
+func (s *MemoryStore) DeleteBlob(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data.Blobs[id]; !ok {
+		return ErrNotFound
+	}
+
+	return s.deleteBlobs([]string{id})
+}
+
+func (s *MemoryStore) PurgeBlobs(now time.Time, incomplete time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []string
+	for id, b := range s.data.Blobs {
+		if purgeable(b, now, incomplete) {
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	return len(ids), s.deleteBlobs(ids)
+}
+
+// deleteBlobs borra los adjuntos y después sus archivos; si algo se queda a medias lo recoge sweep al abrir
+func (s *MemoryStore) deleteBlobs(ids []string) error {
+	if err := s.commit(journalEntry{Op: opDelBlobs, Ids: ids}); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := s.blobs.remove(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) CreateSession(session model.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data.Sessions[sessionKey(session.User, session.Id)]; ok {
+		return ErrExists
+	}
+
+	return s.commit(journalEntry{Op: opSession, Session: &session})
+}
+
+func (s *MemoryStore) GetSession(user string, id string) (model.Session, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, ok := s.data.Sessions[sessionKey(user, id)]
+	return session, ok
+}
+
+func (s *MemoryStore) UpdateSession(user string, id string, fn func(session *model.Session) error) (model.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.data.Sessions[sessionKey(user, id)]
+	if !ok {
+		return session, ErrNotFound
+	}
+
+	if err := fn(&session); err != nil {
+		return session, err
+	}
+
+	return session, s.commit(journalEntry{Op: opSession, Session: &session})
+}
+
+func (s *MemoryStore) Sessions(user string) []model.Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sessions := make([]model.Session, 0)
+	for _, session := range s.data.Sessions {
+		if session.User == user {
+			sessions = append(sessions, session)
+		}
+	}
+
+	sortSessions(sessions)
+	return sessions
+}
+
+func (s *MemoryStore) DeleteSessions(user string, del func(session model.Session) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, 0)
+	for _, session := range s.data.Sessions {
+		if session.User == user && del(session) {
+			ids = append(ids, session.Id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	return len(ids), s.commit(journalEntry{Op: opDelSessions, A: user, Ids: ids})
+}
+
+func (s *MemoryStore) touchChat(user string, other string, t time.Time) {
+	if s.data.ChatActivity[user] == nil {
+		s.data.ChatActivity[user] = make(map[string]time.Time)
+	}
+
+	if t.After(s.data.ChatActivity[user][other]) {
+		s.data.ChatActivity[user][other] = t
+	}
+}
+
+func (s *MemoryStore) Chats(user string) []model.ChatSummary {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chats := make([]model.ChatSummary, 0, len(s.data.ChatActivity[user]))
+	for other, last := range s.data.ChatActivity[user] {
+		pending := len(s.data.PendingMessages[messagesKey(other, user)])
+		chats = append(chats, model.ChatSummary{User: other, Pending: pending, LastActivity: last})
+	}
+
+	sortChats(chats)
+	return chats
+}
+
+// el JSON se genera con el lock de lectura para tener una foto consistente; el cifrado y la escritura van fuera del lock
+func (s *MemoryStore) snapshot() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return util.EncodeJSON(s.data)
+}
+
+// Save compacta el journal en una foto nueva. La foto y el cambio de journal se hacen con el lock de escritura para
+// que ninguna operación quede fuera de los dos
+func (s *MemoryStore) Save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	jsonData := util.EncodeJSON(s.data)
+	err := s.journal.rotate(s.data.JournalSeq)
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(s.path, s.encrypt(jsonData), 0600); err != nil {
+		return err
+	}
+
+	return s.journal.removeRotated()
+}
+
+// la copia lleva la cabecera, se restaura con la misma frase de paso
+func (s *MemoryStore) Backup(w io.Writer) error {
+	_, err := w.Write(s.encrypt(s.snapshot()))
+	return err
+}
+
+func (s *MemoryStore) encrypt(jsonData []byte) []byte {
+	return slices.Concat(s.header.Marshal(), util.EncryptAD(jsonData, s.key, adDatabase))
+}
+
+// devuelve una copia para que quien la use no comparta los mapas con los handlers
+func (s *MemoryStore) Export() (model.Database, error) {
+	var data model.Database
+	err := json.Unmarshal(s.snapshot(), &data)
+	return data, err
+}
+
+func (s *MemoryStore) Close() error {
+	if err := s.Save(); err != nil {
+		return err
+	}
+
+	return s.journal.close()
+}
@@ -0,0 +1,399 @@
+/*
+Capa de almacenamiento del servidor. Los handlers y el repositorio solo acceden a los datos a través de la interfaz Store,
+de forma que el backend (mapas en memoria volcados a db.enc o un archivo bbolt en disco) se elige al arrancar.
+
+Todas las implementaciones deben poder usarse desde varias goroutines a la vez: cada handler, el guardado periódico y los
+timeouts del login por certificado acceden en paralelo. Las operaciones de leer-modificar-escribir van en un solo método
+(CreateUser, UpdateUser, TakeMessages...) para que sean atómicas.
+*/
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+	"util"
+	"util/model"
+)
+
+var (
+	ErrExists   = fmt.Errorf("ya existe")
+	ErrNotFound = fmt.Errorf("no encontrado")
+	ErrQuota    = fmt.Errorf("cuota superada")
+	ErrComplete = fmt.Errorf("adjunto ya completo")
+)
+
+type Store interface {
+	// usuarios. CreateUser falla con ErrExists si el nombre está cogido y hace admin al primer usuario.
+	// UpdateUser aplica fn sobre el usuario de forma atómica, si fn devuelve error no se guarda nada
+	GetUser(name string) (model.User, bool)
+	CreateUser(user model.User) (model.User, error)
+	UpdateUser(name string, fn func(user *model.User) error) (model.User, error)
+	UserNames() []string
+
+	// grupos. AddGroupUser y RemoveGroupUser suben el epoch del grupo
+	GetGroup(name string) (model.Group, bool)
+	CreateGroup(group model.Group) error
+	GroupUsers(group string) []string
+	AddGroupUser(group string, user string) error
+	RemoveGroupUser(group string, user string) error
+
+	// posts. CreatePost asigna el id del post
+	CreatePost(post model.Post) (model.Post, error)
+	GetPost(id int) (model.Post, bool)
+	GetGroupPost(id int) (model.Post, bool)
+	PostIds() []int
+	GroupPostIds(group string) []int
+
+	// mensajes pendientes de sender a receiver. AppendMessage asigna el id, TakeMessages los devuelve y los borra.
+	// PendingMessages devuelve los posteriores a after sin borrarlos y AckMessages borra los que tengan id <= upTo
+	AppendMessage(sender string, receiver string, msg model.Message) (model.Message, error)
+	TakeMessages(sender string, receiver string) ([]model.Message, error)
+	PendingMessages(sender string, receiver string, after int64) []model.Message
+	AckMessages(sender string, receiver string, upTo int64) error
+
+	// confirmaciones de lo que sender ha enviado a receiver. UpdateReceipt solo hace avanzar los ids y un mensaje
+	// leído cuenta también como entregado
+	GetReceipt(sender string, receiver string) model.Receipt
+	UpdateReceipt(sender string, receiver string, delivered int64, read int64) (model.Receipt, error)
+
+	// prekeys X25519 de user para empezar chats cifrados. PublishPreKeys sustituye la identidad y la prekey firmada y
+	// añade las de un solo uso, que se descartan si cambia la identidad. TakePreKeyBundle devuelve como mucho una de
+	// un solo uso y la borra
+	PublishPreKeys(user string, bundle model.PreKeyBundle) error
+	TakePreKeyBundle(user string) (model.PreKeyBundle, bool, error)
+	PreKeyStatus(user string) model.PreKeyStatus
+
+	// historial cifrado que owner guarda de su conversación con other. AppendHistory asigna Seq y si el mensaje ya
+	// estaba devuelve la entrada guardada. History devuelve como mucho limit entradas posteriores a after y
+	// DeleteHistory borra todas las conversaciones de owner
+	AppendHistory(owner string, other string, entry model.HistoryEntry) (model.HistoryEntry, error)
+	History(owner string, other string, after int64, limit int) []model.HistoryEntry
+	DeleteHistory(owner string) error
+
+	// chat cifrado de los grupos. AppendGroupMessage asigna el id y solo se guardan los últimos maxGroupMessages;
+	// GroupMessages devuelve los posteriores a after. PutSenderKey sustituye la clave de Sender para ese epoch
+	AppendGroupMessage(msg model.GroupMessage) (model.GroupMessage, error)
+	GroupMessages(group string, after int64) []model.GroupMessage
+	PutSenderKey(key model.SenderKey) error
+	SenderKeys(group string) []model.SenderKey
+
+	// mensajes temporales de la conversación entre a y b, da igual el orden. UpdateExpiry aplica fn de forma atómica
+	// y PurgeExpired borra los mensajes pendientes que han caducado antes de now y devuelve cuántos
+	GetExpiry(a string, b string) model.Expiry
+	UpdateExpiry(a string, b string, fn func(e *model.Expiry) error) (model.Expiry, error)
+	PurgeExpired(now time.Time) (int, error)
+
+	// adjuntos cifrados que se suben por trozos. CreateBlob falla con ErrExists si el id está cogido y con ErrQuota si
+	// los adjuntos del dueño pasarían de quota bytes (0 = sin límite); PutBlobChunk guarda el trozo n, lo marca como
+	// subido y devuelve el blob actualizado, o ErrComplete si ya estaban todos. Los trozos no van en la foto de Export ni de Backup.
+	// ExpireBlobs hace que los adjuntos ids de owner caduquen con el mensaje que los lleva y PurgeBlobs borra los
+	// caducados antes de now y los que siguen sin completar desde antes de incomplete, y devuelve cuántos
+	CreateBlob(blob model.Blob, quota int64) error
+	GetBlob(id string) (model.Blob, bool)
+	PutBlobChunk(id string, n int, data []byte) (model.Blob, error)
+	BlobChunk(id string, n int) ([]byte, bool)
+	ExpireBlobs(owner string, ids []string, expires time.Time) error
+	DeleteBlob(id string) error
+	PurgeBlobs(now time.Time, incomplete time.Time) (int, error)
+
+	// sesiones de los usuarios en cada dispositivo. CreateSession falla con ErrExists si el id está cogido,
+	// UpdateSession aplica fn de forma atómica y DeleteSessions borra las de user para las que del devuelve true
+	CreateSession(session model.Session) error
+	GetSession(user string, id string) (model.Session, bool)
+	UpdateSession(user string, id string, fn func(session *model.Session) error) (model.Session, error)
+	Sessions(user string) []model.Session
+	DeleteSessions(user string, del func(session model.Session) bool) (int, error)
+
+	// conversaciones de user, de la más reciente a la más antigua
+	Chats(user string) []model.ChatSummary
+
+	// retos de login por certificado, no se persisten. TakeCertChallenge consume el reto y
+	// ExpireCertChallenge solo lo borra si sigue siendo el mismo
+	SetCertChallenge(user string, challenge []byte)
+	TakeCertChallenge(user string) ([]byte, bool)
+	ExpireCertChallenge(user string, challenge []byte) bool
+
+	// logins a falta del código de verificación, tampoco se persisten. TakeLoginTicket lo consume y no devuelve los
+	// caducados
+	SetLoginTicket(id string, ticket model.LoginTicket)
+	TakeLoginTicket(id string, now time.Time) (model.LoginTicket, bool)
+
+	// Save persiste el estado, Backup escribe una copia cifrada en w y Export devuelve todo el contenido en claro
+	Save() error
+	Backup(w io.Writer) error
+	Export() (model.Database, error)
+	Close() error
+}
+
+// Open abre el backend indicado ("memory" o "bolt"), la clave de datos se desbloquea con la frase de paso
+func Open(backend string, passphrase []byte) (Store, error) {
+	switch backend {
+	case "", "memory":
+		return OpenMemory("db.enc", passphrase)
+	case "bolt":
+		return OpenBolt("db.bolt", passphrase)
+	}
+
+	return nil, fmt.Errorf("backend de almacenamiento desconocido: %s", backend)
+}
+
+// RotateKey cambia la frase de paso del backend sin volver a cifrar los datos
+func RotateKey(backend string, oldPassphrase []byte, newPassphrase []byte) error {
+	switch backend {
+	case "", "memory":
+		return RotateMemoryKey("db.enc", oldPassphrase, newPassphrase)
+	case "bolt":
+		return RotateBoltKey("db.bolt", oldPassphrase, newPassphrase)
+	}
+
+	return fmt.Errorf("backend de almacenamiento desconocido: %s", backend)
+}
+
+// datos adicionales del cifrado autenticado, impiden que un bloque cifrado se use en otro sitio
+var (
+	adDatabase = []byte("db.enc")
+	adJournal  = []byte("db.journal")
+)
+
+// decryptMigrating descifra datos guardados antes o después del cifrado autenticado. Solo se usa al migrar los
+// archivos sin cabecera de clave, en el resto de sitios los datos del formato antiguo se rechazan
+func decryptMigrating(data, key, ad []byte) ([]byte, error) {
+	if util.IsEnvelope(data) {
+		return util.DecryptAD(data, key, ad)
+	}
+	return util.DecryptLegacy(data, key)
+}
+
+// los nombres no pueden llevar '>', así que "usuario->" solo es prefijo de las conversaciones de ese usuario
+func messagesKey(sender string, receiver string) string {
+	return fmt.Sprintf("%s->%s", sender, receiver)
+}
+
+// la configuración de una conversación es la misma la pida quien la pida
+func conversationKey(a string, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return messagesKey(a, b)
+}
+
+// unexpired devuelve los mensajes que no han caducado en now y cuántos se han quitado
+func unexpired(msgs []model.Message, now time.Time) ([]model.Message, int) {
+	out := slices.DeleteFunc(slices.Clone(msgs), func(m model.Message) bool {
+		return !m.Expires.IsZero() && m.Expires.Before(now)
+	})
+	return out, len(msgs) - len(out)
+}
+
+// purgeable indica si hay que borrar el adjunto: caducó con su mensaje o la subida se dejó a medias antes de incomplete
+func purgeable(b model.Blob, now time.Time, incomplete time.Time) bool {
+	if !b.Expires.IsZero() && b.Expires.Before(now) {
+		return true
+	}
+	return !b.Complete() && b.Created.Before(incomplete)
+}
+
+// las sesiones de un usuario van juntas, en bolt se recorren con su prefijo
+func sessionKey(user string, id string) string {
+	return user + "/" + id
+}
+
+func messagesAfter(msgs []model.Message, after int64) []model.Message {
+	out := make([]model.Message, 0)
+	for _, m := range msgs {
+		if m.Id > after {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func historyAfter(entries []model.HistoryEntry, after int64, limit int) []model.HistoryEntry {
+	out := make([]model.HistoryEntry, 0)
+	for _, e := range entries {
+		if e.Seq > after && len(out) < limit {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+const (
+	// mensajes y sender keys que se guardan como mucho por grupo, se quedan los más nuevos
+	maxGroupMessages = 1000
+	maxSenderKeys    = 500
+)
+
+// appendGroupMessage añade msg con el siguiente id del grupo
+func appendGroupMessage(msgs []model.GroupMessage, msg model.GroupMessage) ([]model.GroupMessage, model.GroupMessage) {
+	msg.Id = 1
+	if len(msgs) > 0 {
+		msg.Id = msgs[len(msgs)-1].Id + 1
+	}
+
+	msgs = append(msgs, msg)
+	if len(msgs) > maxGroupMessages {
+		msgs = slices.Clone(msgs[len(msgs)-maxGroupMessages:])
+	}
+
+	return msgs, msg
+}
+
+func groupMessagesAfter(msgs []model.GroupMessage, after int64) []model.GroupMessage {
+	out := make([]model.GroupMessage, 0)
+	for _, m := range msgs {
+		if m.Id > after {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// putSenderKey sustituye la clave del mismo emisor y epoch o la añade al final
+func putSenderKey(keys []model.SenderKey, key model.SenderKey) []model.SenderKey {
+	keys = slices.DeleteFunc(slices.Clone(keys), func(k model.SenderKey) bool {
+		return k.Sender == key.Sender && k.Epoch == key.Epoch
+	})
+
+	keys = append(keys, key)
+	if len(keys) > maxSenderKeys {
+		keys = keys[len(keys)-maxSenderKeys:]
+	}
+
+	return keys
+}
+
+func blobChunkKey(id string, n int) string {
+	return fmt.Sprintf("%s/%d", id, n)
+}
+
+// mergeReceipt devuelve r avanzado con delivered y read y si ha cambiado algo
+func mergeReceipt(r model.Receipt, receiver string, delivered int64, read int64) (model.Receipt, bool) {
+	next := model.Receipt{User: receiver, Read: max(r.Read, read)}
+	next.Delivered = max(r.Delivered, delivered, next.Read)
+
+	return next, next != r
+}
+
+// prekeys de un solo uso que se guardan como mucho por usuario, se quedan las más nuevas
+const maxOneTimePreKeys = 200
+
+// mergePreKeys devuelve lo publicado tras añadir bundle a current
+func mergePreKeys(current model.PreKeyBundle, bundle model.PreKeyBundle) model.PreKeyBundle {
+	next := bundle
+	next.OneTimePreKeys = make([]model.OneTimePreKey, 0, len(current.OneTimePreKeys)+len(bundle.OneTimePreKeys))
+
+	if bytes.Equal(current.IdentityKey, bundle.IdentityKey) {
+		next.OneTimePreKeys = append(next.OneTimePreKeys, current.OneTimePreKeys...)
+	}
+	next.OneTimePreKeys = append(next.OneTimePreKeys, bundle.OneTimePreKeys...)
+
+	if len(next.OneTimePreKeys) > maxOneTimePreKeys {
+		next.OneTimePreKeys = next.OneTimePreKeys[len(next.OneTimePreKeys)-maxOneTimePreKeys:]
+	}
+
+	return next
+}
+
+// takePreKey separa lo que se entrega (con la primera prekey de un solo uso) de lo que queda publicado
+func takePreKey(current model.PreKeyBundle) (taken model.PreKeyBundle, rest model.PreKeyBundle) {
+	taken, rest = current, current
+	taken.OneTimePreKeys = nil
+
+	if len(current.OneTimePreKeys) > 0 {
+		taken.OneTimePreKeys = current.OneTimePreKeys[:1]
+		rest.OneTimePreKeys = slices.Clone(current.OneTimePreKeys[1:])
+	}
+
+	return taken, rest
+}
+
+func preKeyStatus(b model.PreKeyBundle) model.PreKeyStatus {
+	return model.PreKeyStatus{IdentityKey: b.IdentityKey, SignedPreKeyId: b.SignedPreKeyId, OneTimePreKeys: len(b.OneTimePreKeys)}
+}
+
+func sortChats(chats []model.ChatSummary) {
+	slices.SortFunc(chats, func(a, b model.ChatSummary) int {
+		return b.LastActivity.Compare(a.LastActivity)
+	})
+}
+
+// las sesiones más recientes primero
+func sortSessions(sessions []model.Session) {
+	slices.SortFunc(sessions, func(a, b model.Session) int {
+		return b.Created.Compare(a.Created)
+	})
+}
+
+type certChallenges struct {
+	mu         sync.Mutex
+	challenges map[string][]byte
+}
+
+func newCertChallenges() *certChallenges {
+	return &certChallenges{challenges: make(map[string][]byte)}
+}
+
+func (c *certChallenges) SetCertChallenge(user string, challenge []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.challenges[user] = challenge
+}
+
+func (c *certChallenges) TakeCertChallenge(user string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	challenge, ok := c.challenges[user]
+	delete(c.challenges, user)
+	return challenge, ok
+}
+
+func (c *certChallenges) ExpireCertChallenge(user string, challenge []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if current, ok := c.challenges[user]; !ok || !bytes.Equal(current, challenge) {
+		return false
+	}
+
+	delete(c.challenges, user)
+	return true
+}
+
+type loginTickets struct {
+	mu      sync.Mutex
+	tickets map[string]model.LoginTicket
+}
+
+func newLoginTickets() *loginTickets {
+	return &loginTickets{tickets: make(map[string]model.LoginTicket)}
+}
+
+func (l *loginTickets) SetLoginTicket(id string, ticket model.LoginTicket) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// de paso se olvidan los que nadie ha terminado
+	for k, t := range l.tickets {
+		if t.Expires.Before(time.Now()) {
+			delete(l.tickets, k)
+		}
+	}
+
+	l.tickets[id] = ticket
+}
+
+func (l *loginTickets) TakeLoginTicket(id string, now time.Time) (model.LoginTicket, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ticket, ok := l.tickets[id]
+	delete(l.tickets, id)
+	return ticket, ok && ticket.Expires.After(now)
+}
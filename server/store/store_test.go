@@ -0,0 +1,1083 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"server/keyring"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+	"util"
+	"util/model"
+
+	bbolt "go.etcd.io/bbolt"
+)
+
+var testPassphrase = []byte("frase de paso")
+
+func openBackends(t *testing.T) map[string]Store {
+	dir := t.TempDir()
+
+	memory, err := OpenMemory(filepath.Join(dir, "db.enc"), testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bolt, err := OpenBolt(filepath.Join(dir, "db.bolt"), testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		memory.Close()
+		bolt.Close()
+	})
+
+	return map[string]Store{"memory": memory, "bolt": bolt}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	const workers = 16
+	const perWorker = 20
+
+	for name, db := range openBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			created := make(chan string, workers)
+
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+
+					// todos intentan registrar el mismo nombre, solo uno puede conseguirlo
+					if _, err := db.CreateUser(model.User{Name: "dup"}); err == nil {
+						created <- "dup"
+					}
+
+					user := fmt.Sprintf("user%d", i)
+					if _, err := db.CreateUser(model.User{Name: user}); err != nil {
+						t.Error(err)
+						return
+					}
+
+					for j := 0; j < perWorker; j++ {
+						if _, err := db.UpdateUser("dup", func(u *model.User) error {
+							u.Token = append(u.Token, 1)
+							return nil
+						}); err != nil {
+							t.Error(err)
+						}
+
+						if _, err := db.CreatePost(model.Post{Author: user, Content: "post"}); err != nil {
+							t.Error(err)
+						}
+
+						if _, err := db.AppendMessage(user, "dup", model.Message{Sender: user, Message: "hola"}); err != nil {
+							t.Error(err)
+						}
+					}
+
+					if err := db.Save(); err != nil {
+						t.Error(err)
+					}
+
+					if _, err := db.Export(); err != nil {
+						t.Error(err)
+					}
+				}(i)
+			}
+
+			wg.Wait()
+			close(created)
+
+			if len(created) != 1 {
+				t.Fatalf("%d usuarios 'dup' creados, se esperaba 1", len(created))
+			}
+
+			dup, _ := db.GetUser("dup")
+			if len(dup.Token) != workers*perWorker {
+				t.Errorf("se han perdido actualizaciones: %d de %d", len(dup.Token), workers*perWorker)
+			}
+
+			admins := 0
+			for _, name := range db.UserNames() {
+				if u, _ := db.GetUser(name); u.Role == model.Admin {
+					admins++
+				}
+			}
+			if admins != 1 {
+				t.Errorf("%d admins, se esperaba 1", admins)
+			}
+
+			ids := make(map[int]bool)
+			for _, id := range db.PostIds() {
+				if ids[id] {
+					t.Fatalf("id de post %d repetido", id)
+				}
+				ids[id] = true
+			}
+			if len(ids) != workers*perWorker {
+				t.Errorf("%d posts, se esperaban %d", len(ids), workers*perWorker)
+			}
+
+			for i := 0; i < workers; i++ {
+				msgs, err := db.TakeMessages(fmt.Sprintf("user%d", i), "dup")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(msgs) != perWorker {
+					t.Errorf("user%d: %d mensajes, se esperaban %d", i, len(msgs), perWorker)
+				}
+			}
+		})
+	}
+}
+
+func TestCertChallenges(t *testing.T) {
+	c := newCertChallenges()
+
+	c.SetCertChallenge("alice", []byte("a"))
+	c.SetCertChallenge("alice", []byte("b"))
+
+	// el timeout del primer reto no debe borrar el segundo
+	if c.ExpireCertChallenge("alice", []byte("a")) {
+		t.Fatal("se ha expirado un reto que ya no era el actual")
+	}
+
+	if challenge, ok := c.TakeCertChallenge("alice"); !ok || string(challenge) != "b" {
+		t.Fatalf("reto incorrecto: %q", challenge)
+	}
+
+	if _, ok := c.TakeCertChallenge("alice"); ok {
+		t.Fatal("el reto se ha podido usar dos veces")
+	}
+}
+
+// sin llamar a Save, todo lo escrito tiene que recuperarse del journal aunque el último registro esté a medias
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.enc")
+
+	db, err := OpenMemory(path, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.CreateUser(model.User{Name: "alice"})
+	db.CreatePost(model.Post{Author: "alice", Content: "antes de guardar"})
+
+	if err := db.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	db.CreateUser(model.User{Name: "bob"})
+	db.AppendMessage("alice", "bob", model.Message{Sender: "alice", Message: "hola"})
+	db.AppendMessage("alice", "bob", model.Message{Sender: "alice", Message: "adios"})
+	db.TakeMessages("alice", "bob")
+	db.AppendMessage("bob", "alice", model.Message{Sender: "bob", Message: "hola"})
+	db.CreatePost(model.Post{Author: "bob", Content: "despues de guardar"})
+
+	// crash: el journal se queda sin compactar y con un registro cortado al final
+	db.journal.file.Write([]byte{0, 0, 1, 0, 42})
+	db.journal.close()
+
+	db, err = OpenMemory(path, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, ok := db.GetUser("bob"); !ok {
+		t.Error("el usuario creado después de guardar se ha perdido")
+	}
+
+	if ids := db.PostIds(); len(ids) != 2 || ids[0] != 1 {
+		t.Errorf("posts recuperados: %v", ids)
+	}
+
+	if msgs, _ := db.TakeMessages("alice", "bob"); len(msgs) != 0 {
+		t.Errorf("mensajes ya leídos recuperados: %v", msgs)
+	}
+
+	if msgs, _ := db.TakeMessages("bob", "alice"); len(msgs) != 1 {
+		t.Errorf("mensajes pendientes recuperados: %v", msgs)
+	}
+}
+
+// si el proceso muere entre apartar el journal y escribir la foto, las entradas no se aplican dos veces
+// shortWriter escribe la mitad de cada registro y falla, como un disco lleno
+type shortWriter struct {
+	journalFile
+}
+
+func (w shortWriter) Write(p []byte) (int, error) {
+	n, _ := w.journalFile.Write(p[:len(p)/2])
+	return n, fmt.Errorf("disco lleno")
+}
+
+// un registro a medias no puede quedar delante de otros: ni por un fallo al escribir ni por un crash al reabrir
+func TestJournalPartialRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.enc")
+
+	db, err := OpenMemory(path, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.CreateUser(model.User{Name: "alice"})
+
+	file := db.journal.file
+	db.journal.file = shortWriter{file}
+	if _, err := db.CreateUser(model.User{Name: "bob"}); err == nil {
+		t.Fatal("escritura fallida sin error")
+	}
+	db.journal.file = file
+
+	if _, err := db.CreateUser(model.User{Name: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// crash con un registro cortado al final; al reabrir se quita y lo siguiente se escribe detrás de lo válido
+	db.journal.file.Write([]byte{0, 0, 1, 0, 42})
+	db.journal.close()
+
+	db, err = OpenMemory(path, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CreateUser(model.User{Name: "dave"})
+	db.journal.close()
+
+	db, err = OpenMemory(path, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for name, want := range map[string]bool{"alice": true, "bob": false, "carol": true, "dave": true} {
+		if _, ok := db.GetUser(name); ok != want {
+			t.Errorf("%s: está %v, se esperaba %v", name, ok, want)
+		}
+	}
+}
+
+// si aun así hay un registro cortado entre otros, abrir falla en vez de saltarse entradas
+func TestJournalTruncatedMiddleRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.enc")
+
+	db, err := OpenMemory(path, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.CreateUser(model.User{Name: "alice"})
+	info, _ := db.journal.file.Stat()
+	db.CreateUser(model.User{Name: "bob"})
+	db.journal.close()
+
+	journalPath := db.journal.path
+	enc, err := os.ReadFile(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// el registro de alice, la mitad del de bob y otra vez el de alice
+	first := enc[:info.Size()]
+	second := enc[info.Size():]
+	corrupt := slices.Concat(first, second[:len(second)/2], first)
+	if err := os.WriteFile(journalPath, corrupt, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err := OpenMemory(path, testPassphrase); err == nil {
+		db.Close()
+		t.Fatal("journal con un registro cortado en medio aceptado")
+	}
+}
+
+func TestJournalRotatedNotReappliedAfterSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.enc")
+
+	db, err := OpenMemory(path, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.AppendMessage("alice", "bob", model.Message{Sender: "alice", Message: "hola"})
+
+	db.mu.Lock()
+	seq := db.data.JournalSeq
+	db.journal.rotate(seq)
+	db.mu.Unlock()
+
+	// foto escrita pero journal apartado sin borrar
+	if err := writeFileAtomic(path, db.encrypt(db.snapshot()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db.journal.close()
+
+	db, err = OpenMemory(path, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if msgs, _ := db.TakeMessages("alice", "bob"); len(msgs) != 1 {
+		t.Errorf("%d mensajes, se esperaba 1", len(msgs))
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	dir := t.TempDir()
+	newPassphrase := []byte("frase nueva")
+
+	memPath := filepath.Join(dir, "db.enc")
+	boltPath := filepath.Join(dir, "db.bolt")
+
+	open := map[string]func(passphrase []byte) (Store, error){
+		"memory": func(passphrase []byte) (Store, error) { return OpenMemory(memPath, passphrase) },
+		"bolt":   func(passphrase []byte) (Store, error) { return OpenBolt(boltPath, passphrase) },
+	}
+	rotate := map[string]func() error{
+		"memory": func() error { return RotateMemoryKey(memPath, testPassphrase, newPassphrase) },
+		"bolt":   func() error { return RotateBoltKey(boltPath, testPassphrase, newPassphrase) },
+	}
+
+	for name, openStore := range open {
+		t.Run(name, func(t *testing.T) {
+			db, err := openStore(testPassphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.CreateUser(model.User{Name: "alice"})
+			db.Close()
+
+			if err := rotate[name](); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := openStore(testPassphrase); err == nil {
+				t.Fatal("la clave antigua sigue abriendo la base de datos")
+			}
+
+			db, err = openStore(newPassphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			if _, ok := db.GetUser("alice"); !ok {
+				t.Error("datos perdidos al cambiar la clave")
+			}
+		})
+	}
+}
+
+// un db.enc cifrado con sha256 de la frase, sin cabecera, se abre y se reescribe con cabecera
+// una cabecera con parámetros de Argon2 fuera de rango se rechaza antes de derivar la clave
+func TestInvalidKeyHeader(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, change := range map[string]func(h *keyring.Header){
+		"hilos":       func(h *keyring.Header) { h.Threads = 0 },
+		"iteraciones": func(h *keyring.Header) { h.Time = 0 },
+		"memoria":     func(h *keyring.Header) { h.Memory = 1 << 31 },
+		"sal":         func(h *keyring.Header) { h.Salt = nil },
+	} {
+		header, key := keyring.New(testPassphrase)
+		change(&header)
+
+		path := filepath.Join(dir, name+".enc")
+		if err := os.WriteFile(path, slices.Concat(header.Marshal(), util.EncryptAD(util.EncodeJSON(NewDatabase()), key, adDatabase)), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if db, err := OpenMemory(path, testPassphrase); err == nil {
+			db.Close()
+			t.Errorf("%s: cabecera no válida aceptada", name)
+		}
+	}
+}
+
+func TestLegacyDatabaseMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.enc")
+
+	legacy := NewDatabase()
+	legacy.Users["alice"] = model.User{Name: "alice"}
+	legacy.UserNames = append(legacy.UserNames, "alice")
+
+	if err := os.WriteFile(path, util.EncryptAD(util.EncodeJSON(legacy), keyring.LegacyKey(testPassphrase), adDatabase), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenMemory(path, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if enc, _ := os.ReadFile(path); !keyring.HasHeader(enc) {
+		t.Fatal("el archivo no se ha migrado")
+	}
+
+	db, err = OpenMemory(path, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, ok := db.GetUser("alice"); !ok {
+		t.Error("datos perdidos al migrar")
+	}
+}
+
+// los ids de mensaje crecen en todos los backends y el ack solo borra hasta el id indicado, también tras reabrir
+// encryptLegacy cifra como util.Encrypt antes del sobre autenticado (AES-CTR con el IV delante)
+func encryptLegacy(t *testing.T, data, key []byte) []byte {
+	out := make([]byte, 16+len(data))
+	rand.Read(out[:16])
+	out[0] = 0
+
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher.NewCTR(blk, out[:16]).XORKeyStream(out[16:], data)
+	return out
+}
+
+func TestLegacyCTRMigration(t *testing.T) {
+	dir := t.TempDir()
+	key := keyring.LegacyKey(testPassphrase)
+
+	// memoria: db.enc y journal del formato antiguo
+	legacy := NewDatabase()
+	legacy.Users["alice"] = model.User{Name: "alice"}
+	legacy.UserNames = append(legacy.UserNames, "alice")
+
+	path := filepath.Join(dir, "db.enc")
+	if err := os.WriteFile(path, encryptLegacy(t, util.EncodeJSON(legacy), key), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	enc := encryptLegacy(t, util.EncodeJSON(journalEntry{Seq: 1, Op: opCreateUser, User: &model.User{Name: "bob"}}), key)
+	record := binary.BigEndian.AppendUint32(nil, uint32(len(enc)))
+	if err := os.WriteFile(filepath.Join(dir, "db.journal"), append(record, enc...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	memory, err := OpenMemory(path, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory.Close()
+
+	memory, err = OpenMemory(path, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer memory.Close()
+
+	// bolt: registro del formato antiguo sin cabecera de clave
+	boltPath := filepath.Join(dir, "db.bolt")
+	raw, err := openBoltFile(boltPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = raw.Update(func(tx *bbolt.Tx) error {
+		users, err := tx.CreateBucketIfNotExists(bucketUsers)
+		if err != nil {
+			return err
+		}
+		return users.Put([]byte("alice"), encryptLegacy(t, util.EncodeJSON(model.User{Name: "alice"}), key))
+	})
+	raw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bolt, err := OpenBolt(boltPath, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+
+	for name, db := range map[string]Store{"memory": memory, "bolt": bolt} {
+		if _, ok := db.GetUser("alice"); !ok {
+			t.Errorf("%s: alice perdida al migrar", name)
+		}
+	}
+	if _, ok := memory.GetUser("bob"); !ok {
+		t.Error("memory: journal antiguo no reproducido")
+	}
+
+	// ya migrado, un registro del formato antiguo no se acepta
+	err = bolt.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketUsers).Put([]byte("mallory"), encryptLegacy(t, util.EncodeJSON(model.User{Name: "mallory"}), bolt.key))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bolt.GetUser("mallory"); ok {
+		t.Error("bolt: registro sin autenticar aceptado después de migrar")
+	}
+}
+
+func TestMessageIdsAndAck(t *testing.T) {
+	dir := t.TempDir()
+
+	open := map[string]func() (Store, error){
+		"memory": func() (Store, error) { return OpenMemory(filepath.Join(dir, "db.enc"), testPassphrase) },
+		"bolt":   func() (Store, error) { return OpenBolt(filepath.Join(dir, "db.bolt"), testPassphrase) },
+	}
+
+	for name, openStore := range open {
+		t.Run(name, func(t *testing.T) {
+			db, err := openStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []int64
+			for i := 0; i < 3; i++ {
+				msg, err := db.AppendMessage("alice", "bob", model.Message{Sender: "alice", Message: "hola"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, msg.Id)
+			}
+
+			if ids[0] <= 0 || ids[1] <= ids[0] || ids[2] <= ids[1] {
+				t.Fatalf("ids no crecientes: %v", ids)
+			}
+
+			if pending := db.PendingMessages("alice", "bob", ids[0]); len(pending) != 2 {
+				t.Errorf("%d pendientes después del primero, se esperaban 2", len(pending))
+			}
+
+			if err := db.AckMessages("alice", "bob", ids[1]); err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+
+			db, err = openStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			if pending := db.PendingMessages("alice", "bob", 0); len(pending) != 1 || pending[0].Id != ids[2] {
+				t.Errorf("pendientes tras el ack: %v", pending)
+			}
+
+			if msg, _ := db.AppendMessage("alice", "bob", model.Message{}); msg.Id <= ids[2] {
+				t.Errorf("id %d reutilizado tras reabrir", msg.Id)
+			}
+		})
+	}
+}
+
+func TestChats(t *testing.T) {
+	for name, db := range openBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now()
+
+			db.AppendMessage("alice", "bob", model.Message{Sender: "alice", Timestamp: start})
+			db.AppendMessage("alice", "bob", model.Message{Sender: "alice", Timestamp: start.Add(time.Second)})
+			db.AppendMessage("carol", "bob", model.Message{Sender: "carol", Timestamp: start.Add(2 * time.Second)})
+			db.AppendMessage("bob", "alice", model.Message{Sender: "bob", Timestamp: start.Add(3 * time.Second)})
+
+			chats := db.Chats("bob")
+			if len(chats) != 2 {
+				t.Fatalf("conversaciones de bob: %+v", chats)
+			}
+
+			// la respuesta de bob también cuenta como actividad de la conversación
+			if chats[0].User != "alice" || chats[0].Pending != 2 || !chats[0].LastActivity.Equal(start.Add(3*time.Second)) {
+				t.Errorf("primera conversación: %+v", chats[0])
+			}
+			if chats[1].User != "carol" || chats[1].Pending != 1 {
+				t.Errorf("segunda conversación: %+v", chats[1])
+			}
+
+			db.TakeMessages("alice", "bob")
+			if chats := db.Chats("bob"); chats[0].Pending != 0 {
+				t.Errorf("pendientes tras leerlos: %+v", chats[0])
+			}
+
+			if chats := db.Chats("alice"); len(chats) != 1 || chats[0].User != "bob" || chats[0].Pending != 1 {
+				t.Errorf("conversaciones de alice: %+v", chats)
+			}
+		})
+	}
+}
+
+func TestReceipts(t *testing.T) {
+	dir := t.TempDir()
+
+	open := map[string]func() (Store, error){
+		"memory": func() (Store, error) { return OpenMemory(filepath.Join(dir, "db.enc"), testPassphrase) },
+		"bolt":   func() (Store, error) { return OpenBolt(filepath.Join(dir, "db.bolt"), testPassphrase) },
+	}
+
+	for name, openStore := range open {
+		t.Run(name, func(t *testing.T) {
+			db, err := openStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if r := db.GetReceipt("alice", "bob"); r != (model.Receipt{User: "bob"}) {
+				t.Errorf("confirmación inicial %+v", r)
+			}
+
+			db.UpdateReceipt("alice", "bob", 5, 0)
+			db.UpdateReceipt("alice", "bob", 3, 4)
+			db.Close()
+
+			db, err = openStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			// los ids no retroceden
+			if r := db.GetReceipt("alice", "bob"); r.Delivered != 5 || r.Read != 4 {
+				t.Errorf("confirmación tras reabrir %+v", r)
+			}
+
+			// leer implica haber recibido
+			if r, _ := db.UpdateReceipt("alice", "bob", 0, 7); r.Delivered != 7 || r.Read != 7 {
+				t.Errorf("confirmación tras leer %+v", r)
+			}
+
+			if r := db.GetReceipt("bob", "alice"); r.Delivered != 0 {
+				t.Errorf("la confirmación se aplica en los dos sentidos: %+v", r)
+			}
+
+			if r := (model.Receipt{Delivered: 7, Read: 4}); r.Status(3) != model.StatusRead || r.Status(5) != model.StatusDelivered || r.Status(8) != model.StatusSent {
+				t.Errorf("estados incorrectos para %+v", r)
+			}
+		})
+	}
+}
+
+func TestPreKeys(t *testing.T) {
+	otk := func(ids ...uint32) []model.OneTimePreKey {
+		keys := make([]model.OneTimePreKey, 0)
+		for _, id := range ids {
+			keys = append(keys, model.OneTimePreKey{Id: id, Key: []byte{byte(id)}})
+		}
+		return keys
+	}
+
+	for name, db := range openBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, ok, _ := db.TakePreKeyBundle("bob"); ok {
+				t.Fatal("bundle de un usuario sin prekeys")
+			}
+
+			db.PublishPreKeys("bob", model.PreKeyBundle{IdentityKey: []byte("id1"), SignedPreKeyId: 1, OneTimePreKeys: otk(1, 2)})
+			db.PublishPreKeys("bob", model.PreKeyBundle{IdentityKey: []byte("id1"), SignedPreKeyId: 2, OneTimePreKeys: otk(3)})
+
+			if status := db.PreKeyStatus("bob"); status.SignedPreKeyId != 2 || status.OneTimePreKeys != 3 {
+				t.Fatalf("estado tras publicar %+v", status)
+			}
+
+			// cada prekey de un solo uso se entrega una vez
+			for _, want := range []uint32{1, 2, 3} {
+				b, ok, err := db.TakePreKeyBundle("bob")
+				if err != nil || !ok || len(b.OneTimePreKeys) != 1 || b.OneTimePreKeys[0].Id != want {
+					t.Fatalf("bundle %+v %v %v, se esperaba la prekey %d", b, ok, err, want)
+				}
+			}
+
+			if b, ok, _ := db.TakePreKeyBundle("bob"); !ok || len(b.OneTimePreKeys) != 0 || b.SignedPreKeyId != 2 {
+				t.Fatalf("bundle sin prekeys de un solo uso %+v", b)
+			}
+
+			// con una identidad nueva las prekeys anteriores ya no sirven
+			db.PublishPreKeys("bob", model.PreKeyBundle{IdentityKey: []byte("id1"), SignedPreKeyId: 2, OneTimePreKeys: otk(4)})
+			db.PublishPreKeys("bob", model.PreKeyBundle{IdentityKey: []byte("id2"), SignedPreKeyId: 1, OneTimePreKeys: otk(1)})
+			if status := db.PreKeyStatus("bob"); string(status.IdentityKey) != "id2" || status.OneTimePreKeys != 1 {
+				t.Fatalf("estado tras cambiar de identidad %+v", status)
+			}
+		})
+	}
+}
+
+func TestHistory(t *testing.T) {
+	for name, db := range openBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			for id := int64(1); id <= 5; id++ {
+				e, err := db.AppendHistory("alice", "bob", model.HistoryEntry{MessageId: id * 10, Ciphertext: []byte{byte(id)}})
+				if err != nil || e.Seq != id {
+					t.Fatalf("entrada %+v %v, se esperaba seq %d", e, err, id)
+				}
+			}
+			db.AppendHistory("alice", "carol", model.HistoryEntry{MessageId: 60})
+			db.AppendHistory("bob", "alice", model.HistoryEntry{MessageId: 10})
+
+			// un mensaje repetido no se guarda otra vez
+			if e, _ := db.AppendHistory("alice", "bob", model.HistoryEntry{MessageId: 30}); e.Seq != 3 || e.Ciphertext[0] != 3 {
+				t.Fatalf("mensaje repetido %+v", e)
+			}
+
+			page := db.History("alice", "bob", 1, 2)
+			if len(page) != 2 || page[0].Seq != 2 || page[1].Seq != 3 {
+				t.Fatalf("página %+v", page)
+			}
+			if rest := db.History("alice", "bob", 3, 10); len(rest) != 2 || rest[1].MessageId != 50 {
+				t.Fatalf("resto %+v", rest)
+			}
+
+			if err := db.DeleteHistory("alice"); err != nil {
+				t.Fatal(err)
+			}
+			if len(db.History("alice", "bob", 0, 10)) != 0 || len(db.History("alice", "carol", 0, 10)) != 0 {
+				t.Fatal("historial sin borrar")
+			}
+			if len(db.History("bob", "alice", 0, 10)) != 1 {
+				t.Fatal("borrado el historial de otro usuario")
+			}
+
+			// tras borrar se empieza de nuevo
+			if e, _ := db.AppendHistory("alice", "bob", model.HistoryEntry{MessageId: 30}); e.Seq != 1 {
+				t.Fatalf("entrada tras borrar %+v", e)
+			}
+		})
+	}
+}
+
+// nombres que empiezan igual no comparten historial: borrar el de "ana" no toca el de "ana-" ni el de "ana-bel"
+func TestHistoryPrefixNames(t *testing.T) {
+	for name, db := range openBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			owners := []string{"ana", "ana-", "ana-bel"}
+			for _, owner := range owners {
+				db.AppendHistory(owner, "-bel", model.HistoryEntry{MessageId: 1})
+				db.AppendHistory(owner, "bel", model.HistoryEntry{MessageId: 1})
+			}
+
+			if err := db.DeleteHistory("ana"); err != nil {
+				t.Fatal(err)
+			}
+			if len(db.History("ana", "bel", 0, 10)) != 0 || len(db.History("ana", "-bel", 0, 10)) != 0 {
+				t.Fatal("historial sin borrar")
+			}
+
+			for _, owner := range owners[1:] {
+				for _, other := range []string{"-bel", "bel"} {
+					if len(db.History(owner, other, 0, 10)) != 1 {
+						t.Errorf("borrado el historial de %s con %s", owner, other)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGroupChat(t *testing.T) {
+	for name, db := range openBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			db.CreateGroup(model.Group{Name: "g"})
+			db.AddGroupUser("g", "alice")
+			db.AddGroupUser("g", "bob")
+
+			if g, _ := db.GetGroup("g"); g.Epoch != 2 {
+				t.Fatalf("epoch tras dos altas %d", g.Epoch)
+			}
+
+			if err := db.RemoveGroupUser("g", "carol"); err != ErrNotFound {
+				t.Fatalf("baja de quien no es miembro: %v", err)
+			}
+			if err := db.RemoveGroupUser("g", "bob"); err != nil {
+				t.Fatal(err)
+			}
+			if g, _ := db.GetGroup("g"); g.Epoch != 3 || len(db.GroupUsers("g")) != 1 {
+				t.Fatalf("grupo tras la baja %+v %v", g, db.GroupUsers("g"))
+			}
+
+			for i := int64(1); i <= 3; i++ {
+				if m, err := db.AppendGroupMessage(model.GroupMessage{Group: "g", Sender: "alice"}); err != nil || m.Id != i {
+					t.Fatalf("mensaje %+v %v", m, err)
+				}
+			}
+			if msgs := db.GroupMessages("g", 1); len(msgs) != 2 || msgs[0].Id != 2 {
+				t.Fatalf("mensajes %+v", msgs)
+			}
+
+			db.PutSenderKey(model.SenderKey{Group: "g", Sender: "alice", Epoch: 2})
+			db.PutSenderKey(model.SenderKey{Group: "g", Sender: "alice", Epoch: 3})
+			db.PutSenderKey(model.SenderKey{Group: "g", Sender: "alice", Epoch: 3, Keys: map[string]model.SealedKey{"alice": {Key: []byte("k")}}})
+
+			keys := db.SenderKeys("g")
+			if len(keys) != 2 || keys[1].Epoch != 3 || string(keys[1].Keys["alice"].Key) != "k" {
+				t.Fatalf("sender keys %+v", keys)
+			}
+		})
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	for name, db := range openBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			blob := model.Blob{Id: "b", Owner: "alice", Size: 10, Chunks: 2, Uploaded: make([]bool, 2)}
+			if err := db.CreateBlob(blob, 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.CreateBlob(blob, 0); err != ErrExists {
+				t.Fatalf("blob repetido: %v", err)
+			}
+
+			if _, err := db.PutBlobChunk("b", 2, []byte("x")); err != ErrNotFound {
+				t.Fatalf("trozo fuera de rango: %v", err)
+			}
+
+			b, err := db.PutBlobChunk("b", 1, []byte("segundo"))
+			if err != nil || b.Complete() || !b.Uploaded[1] {
+				t.Fatalf("tras el segundo trozo %+v %v", b, err)
+			}
+
+			if _, ok := db.BlobChunk("b", 0); ok {
+				t.Fatal("trozo sin subir")
+			}
+
+			db.PutBlobChunk("b", 0, []byte("primero"))
+			if b, _ := db.GetBlob("b"); !b.Complete() {
+				t.Fatalf("blob incompleto %+v", b)
+			}
+
+			if data, ok := db.BlobChunk("b", 1); !ok || string(data) != "segundo" {
+				t.Fatalf("trozo %q %v", data, ok)
+			}
+
+			// completo ya no se puede cambiar, aunque se repita un trozo
+			if _, err := db.PutBlobChunk("b", 1, []byte("cambiado")); err != ErrComplete {
+				t.Fatalf("trozo de un blob completo: %v", err)
+			}
+			if data, _ := db.BlobChunk("b", 1); string(data) != "segundo" {
+				t.Fatalf("trozo cambiado a %q", data)
+			}
+		})
+	}
+}
+
+func TestBlobQuotaAndPurge(t *testing.T) {
+	now := time.Now()
+
+	for name, db := range openBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			create := func(id string, size int64, created time.Time) error {
+				return db.CreateBlob(model.Blob{Id: id, Owner: "alice", Size: size, Chunks: 1, Uploaded: make([]bool, 1), Created: created}, 100)
+			}
+
+			if err := create("viejo", 40, now.Add(-time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if err := create("temporal", 40, now); err != nil {
+				t.Fatal(err)
+			}
+			if err := create("grande", 30, now); err != ErrQuota {
+				t.Fatalf("cuota superada: %v", err)
+			}
+			if err := db.CreateBlob(model.Blob{Id: "ajeno", Owner: "bob", Size: 30, Chunks: 1, Uploaded: make([]bool, 1), Created: now}, 100); err != nil {
+				t.Fatalf("la cuota es de cada usuario: %v", err)
+			}
+
+			db.PutBlobChunk("temporal", 0, []byte("trozo"))
+
+			// solo el dueño puede ponerle caducidad
+			db.ExpireBlobs("bob", []string{"temporal"}, now.Add(-time.Minute))
+			if b, _ := db.GetBlob("temporal"); !b.Expires.IsZero() {
+				t.Fatal("caducidad puesta por otro usuario")
+			}
+			if err := db.ExpireBlobs("alice", []string{"temporal"}, now.Add(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+
+			// el incompleto de hace una hora se borra, el temporal aún no ha caducado
+			if n, err := db.PurgeBlobs(now, now.Add(-30*time.Minute)); n != 1 || err != nil {
+				t.Fatalf("borrados %d %v", n, err)
+			}
+			if _, ok := db.GetBlob("viejo"); ok {
+				t.Error("subida sin terminar no borrada")
+			}
+			if data, ok := db.BlobChunk("temporal", 0); !ok || string(data) != "trozo" {
+				t.Fatalf("trozo %q %v", data, ok)
+			}
+
+			// el espacio borrado vuelve a estar libre
+			if err := create("grande", 30, now); err != nil {
+				t.Fatal(err)
+			}
+
+			if n, err := db.PurgeBlobs(now.Add(2*time.Minute), now.Add(-30*time.Minute)); n != 1 || err != nil {
+				t.Fatalf("borrados al caducar %d %v", n, err)
+			}
+			if _, ok := db.BlobChunk("temporal", 0); ok {
+				t.Error("trozo de un adjunto caducado")
+			}
+
+			if err := db.DeleteBlob("grande"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.DeleteBlob("grande"); err != ErrNotFound {
+				t.Fatalf("borrado dos veces: %v", err)
+			}
+		})
+	}
+}
+
+// los trozos van en archivos aparte de la foto, sobreviven al reabrir y se borran con el adjunto
+func TestBlobChunkFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.enc")
+
+	db, err := OpenMemory(path, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.CreateBlob(model.Blob{Id: "b", Owner: "alice", Size: 5, Chunks: 1, Uploaded: make([]bool, 1)}, 0)
+	if _, err := db.PutBlobChunk("b", 0, []byte("trozo")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if enc, _ := os.ReadFile(path); len(enc) > 4096 {
+		t.Fatalf("la foto ocupa %d bytes", len(enc))
+	}
+
+	db, err = OpenMemory(path, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if data, ok := db.BlobChunk("b", 0); !ok || string(data) != "trozo" {
+		t.Fatalf("trozo tras reabrir %q %v", data, ok)
+	}
+
+	if err := db.DeleteBlob("b"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(db.blobs.dir); len(entries) != 0 {
+		t.Errorf("quedan %d archivos de adjuntos", len(entries))
+	}
+}
+
+// las fotos de antes llevaban los trozos dentro, al abrirlas se pasan a archivos
+func TestBlobChunksMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.enc")
+
+	old := struct {
+		model.Database
+		BlobChunks map[string][]byte
+	}{NewDatabase(), map[string][]byte{"b/0": []byte("trozo")}}
+	old.Blobs["b"] = model.Blob{Id: "b", Owner: "alice", Size: 5, Chunks: 1, Uploaded: []bool{true}}
+
+	header, key := keyring.New(testPassphrase)
+	if err := os.WriteFile(path, slices.Concat(header.Marshal(), util.EncryptAD(util.EncodeJSON(old), key, adDatabase)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenMemory(path, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if data, ok := db.BlobChunk("b", 0); !ok || string(data) != "trozo" {
+		t.Fatalf("trozo migrado %q %v", data, ok)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	for name, db := range openBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			db.UpdateExpiry("bob", "alice", func(e *model.Expiry) error {
+				e.TTL = time.Hour
+				return nil
+			})
+			if e := db.GetExpiry("alice", "bob"); e.TTL != time.Hour {
+				t.Fatalf("la conversación depende del orden %+v", e)
+			}
+
+			now := time.Now()
+			db.AppendMessage("alice", "bob", model.Message{Message: "caducado", Expires: now.Add(-time.Second)})
+			db.AppendMessage("alice", "bob", model.Message{Message: "vigente", Expires: now.Add(time.Hour)})
+			db.AppendMessage("alice", "bob", model.Message{Message: "sin caducidad"})
+			db.AppendMessage("bob", "alice", model.Message{Message: "caducado", Expires: now.Add(-time.Minute)})
+
+			if n, err := db.PurgeExpired(now); err != nil || n != 2 {
+				t.Fatalf("purgados %d %v", n, err)
+			}
+
+			if msgs := db.PendingMessages("alice", "bob", 0); len(msgs) != 2 || msgs[0].Message != "vigente" {
+				t.Fatalf("pendientes %+v", msgs)
+			}
+			if msgs := db.PendingMessages("bob", "alice", 0); len(msgs) != 0 {
+				t.Fatalf("pendientes %+v", msgs)
+			}
+
+			if n, _ := db.PurgeExpired(now); n != 0 {
+				t.Fatalf("segunda purga %d", n)
+			}
+		})
+	}
+}
+
+func TestSessions(t *testing.T) {
+	for name, db := range openBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			for i, user := range []string{"alice", "alice", "alice", "alicia"} {
+				s := model.Session{Id: fmt.Sprintf("s%d", i), User: user, Created: now.Add(time.Duration(i) * time.Minute)}
+				if err := db.CreateSession(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := db.CreateSession(model.Session{Id: "s0", User: "alice"}); err != ErrExists {
+				t.Fatalf("id repetido: %v", err)
+			}
+
+			// el prefijo de alice no puede coger las de alicia
+			if sessions := db.Sessions("alice"); len(sessions) != 3 || sessions[0].Id != "s2" {
+				t.Fatalf("sesiones %+v", sessions)
+			}
+
+			s, err := db.UpdateSession("alice", "s1", func(s *model.Session) error {
+				s.Device = "portátil"
+				return nil
+			})
+			if err != nil || s.Device != "portátil" {
+				t.Fatalf("actualizada %+v %v", s, err)
+			}
+			if _, err := db.UpdateSession("alicia", "s1", func(s *model.Session) error { return nil }); err != ErrNotFound {
+				t.Fatalf("sesión de otro usuario: %v", err)
+			}
+
+			n, err := db.DeleteSessions("alice", func(s model.Session) bool { return s.Id != "s1" })
+			if err != nil || n != 2 {
+				t.Fatalf("borradas %d %v", n, err)
+			}
+
+			if _, ok := db.GetSession("alice", "s0"); ok {
+				t.Fatal("sigue la sesión borrada")
+			}
+			if s, ok := db.GetSession("alice", "s1"); !ok || s.Device != "portátil" {
+				t.Fatalf("sesión que se queda %+v", s)
+			}
+			if sessions := db.Sessions("alicia"); len(sessions) != 1 {
+				t.Fatalf("sesiones de alicia %+v", sessions)
+			}
+		})
+	}
+}
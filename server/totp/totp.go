@@ -0,0 +1,136 @@
+/*
+Verificación en dos pasos con TOTP (RFC 6238): HMAC-SHA1, códigos de 6 dígitos y periodos de 30 segundos, que es lo
+que esperan las aplicaciones de autenticación al leer la URI otpauth://. Se acepta el periodo anterior y el siguiente
+por si el reloj del móvil va desfasado.
+
+Los códigos de recuperación sirven una vez cada uno en lugar de un código TOTP; el servidor guarda solo su sha256.
+*/
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	Issuer = "RedSocial"
+
+	period     = 30
+	digits     = 6
+	secretSize = 20
+
+	// periodos de más o de menos que se aceptan
+	skew = 1
+
+	recoveryCodes = 10
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func NewSecret() []byte {
+	secret := make([]byte, secretSize)
+	rand.Read(secret)
+	return secret
+}
+
+// Encode escribe secret en base32, como se teclea en la aplicación si no se puede leer el QR
+func Encode(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+func Decode(s string) ([]byte, error) {
+	return encoding.DecodeString(strings.ToUpper(strings.ReplaceAll(s, " ", "")))
+}
+
+// URI devuelve la URI otpauth:// de secret para user, que es lo que va en el QR
+func URI(user string, secret []byte) string {
+	q := url.Values{}
+	q.Set("secret", Encode(secret))
+	q.Set("issuer", Issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(digits))
+	q.Set("period", fmt.Sprint(period))
+
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(Issuer), url.PathEscape(user), q.Encode())
+}
+
+func Step(now time.Time) int64 {
+	return now.Unix() / period
+}
+
+// Code calcula el código de secret en el periodo step
+func Code(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", digits, n%1000000)
+}
+
+// Check comprueba code contra secret en now. Solo vale un periodo posterior a last, así un código ya usado no vuelve a
+// servir; devuelve el periodo con el que coincide para guardarlo como el nuevo last
+func Check(secret []byte, code string, last int64, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != digits {
+		return 0, false
+	}
+
+	current := Step(now)
+	for step := current - skew; step <= current+skew; step++ {
+		if step > last && subtle.ConstantTimeCompare([]byte(Code(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// NewRecoveryCodes genera los códigos de recuperación en claro, para enseñarlos una vez, y sus hashes para guardar
+func NewRecoveryCodes() ([]string, [][]byte) {
+	codes := make([]string, recoveryCodes)
+	hashes := make([][]byte, recoveryCodes)
+
+	for i := range codes {
+		b := make([]byte, 5)
+		rand.Read(b)
+
+		s := strings.ToLower(encoding.EncodeToString(b))
+		codes[i] = s[:4] + "-" + s[4:]
+		hashes[i] = recoveryHash(codes[i])
+	}
+
+	return codes, hashes
+}
+
+// CheckRecovery busca code entre hashes y devuelve su posición
+func CheckRecovery(hashes [][]byte, code string) (int, bool) {
+	h := recoveryHash(code)
+	for i, stored := range hashes {
+		if subtle.ConstantTimeCompare(stored, h) == 1 {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// se comparan sin guiones, espacios ni mayúsculas
+func recoveryHash(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return sum[:]
+}
@@ -1,3 +1,5 @@
 module util
 
 go 1.22.1
+
+require golang.org/x/crypto v0.21.0
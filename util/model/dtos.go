@@ -6,24 +6,53 @@ type Resp struct {
 }
 
 type RespAuth struct {
-	Ok   bool
-	Msg  string
-	User User
+	Ok      bool
+	Msg     string
+	User    User   // User.Token es el token de acceso de la sesión
+	Refresh []byte `json:",omitempty"`
+
+	// si el usuario tiene la verificación en dos pasos, el login no da token sino esto para /login/totp
+	Ticket string `json:",omitempty"`
 }
 
 type Credentials struct {
-	User string
-	Pass string
+	User   string
+	Pass   string
+	Device string `json:",omitempty"` // nombre con el que sale la sesión en la lista
 }
 
 type RegisterCredentials struct {
 	User   string
 	Pass   string
 	PubKey []byte
+	Device string `json:",omitempty"`
+}
+
+// segundo paso del login, Code es un código TOTP o de recuperación
+type TOTPLogin struct {
+	User   string
+	Ticket string
+	Code   string
+}
+
+// secreto para dar de alta la verificación en dos pasos, en base32 y como URI otpauth:// para el QR
+type TOTPEnrollment struct {
+	Secret string
+	URI    string
+}
+
+type TOTPCode struct {
+	Code string
+}
+
+// códigos de recuperación en claro, solo se ven al activar la verificación
+type RecoveryCodes struct {
+	Codes []string
 }
 
 type PostContent struct {
-	Content string
+	Content   string
+	Signature []byte // firma del autor de Post.SignedData
 }
 
 type UserPublicData struct {
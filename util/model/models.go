@@ -1,6 +1,9 @@
 package model
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 // BD Principal
 type Database struct {
@@ -17,8 +20,20 @@ type Database struct {
 	UserNames        []string
 	PostIds          []int
 	NextPostId       int
+	LastMessageId    int64
 	PendingCertLogin map[string][]byte
 	PendingMessages  map[string][]Message
+	ChatActivity     map[string]map[string]time.Time // usuario -> otra parte -> último mensaje entre los dos
+	Receipts         map[string]Receipt              // emisor->receptor
+	PreKeys          map[string]PreKeyBundle
+	History          map[string][]HistoryEntry // dueño->otra parte
+	GroupMessages    map[string][]GroupMessage
+	SenderKeys       map[string][]SenderKey // grupo -> claves repartidas
+	Blobs            map[string]Blob
+	Expiry           map[string]Expiry  // conversación (usuarios en orden) -> mensajes temporales
+	Sessions         map[string]Session // usuario/id -> sesión
+
+	JournalSeq int64 // última entrada del journal incluida en esta foto
 }
 
 /*
@@ -43,10 +58,33 @@ type User struct {
 
 	Blocked bool
 	Role    Role
+	History bool // guarda su historial cifrado en el servidor
+
+	HistoryEpoch int64 `json:",omitempty"` // cambia cada vez que se activa el historial, que empieza vacío
+
+	// última petición autenticada; Seen es el último login
+	Active       time.Time
+	HidePresence bool `json:",omitempty"` // no deja ver a los demás si está conectado ni cuándo lo estuvo
+
+	// verificación en dos pasos. TOTPPending es el secreto mientras no se confirma con un primer código, TOTPStep el
+	// último periodo usado para que un código no valga dos veces y RecoveryCodes los sha256 de los códigos de recuperación
+	TwoFactor     bool     `json:",omitempty"`
+	TOTPSecret    []byte   `json:",omitempty"`
+	TOTPPending   []byte   `json:",omitempty"`
+	TOTPStep      int64    `json:",omitempty"`
+	RecoveryCodes [][]byte `json:",omitempty"`
 }
 
 type Group struct {
-	Name string
+	Name  string
+	Epoch int64 `json:",omitempty"` // sube con cada alta o baja, las claves del chat del grupo se cambian con él
+}
+
+// miembros actuales de un grupo
+type GroupInfo struct {
+	Name    string
+	Epoch   int64
+	Members []string
 }
 
 type GroupUser struct {
@@ -60,17 +98,372 @@ type Post struct {
 	Author  string
 	Group   string
 	Date    time.Time
+
+	Signature  []byte `json:",omitempty"` // firma RSA del autor, el servidor solo la guarda
+	Unverified bool   `json:",omitempty"` // solo en el cliente: la firma falta o no es del autor
+}
+
+// SignedData devuelve lo que firma el autor: el contenido ligado a su nombre y al grupo donde se publica
+func (p Post) SignedData() []byte {
+	return []byte(fmt.Sprintf("post\n%s\n%s\n%s", p.Author, p.Group, p.Content))
 }
 
 type Message struct {
+	Id        int64 // lo asigna el servidor, crece con cada mensaje
+	Sender    string
+	Message   string
+	Timestamp time.Time
+
+	Signature []byte    `json:",omitempty"` // firma RSA del emisor sobre el mensaje cifrado
+	Expires   time.Time `json:",omitempty"` // si la conversación tiene mensajes temporales, cuándo se borra
+	Blobs     []string  `json:",omitempty"` // ids de los adjuntos que lleva, para que el servidor los borre con el mensaje
+
+	// solo en el cliente
+	Status     DeliveryStatus `json:",omitempty"` // lo usa el emisor en su copia del chat
+	Unverified bool           `json:",omitempty"` // la firma falta o no es del emisor
+	Archived   bool           `json:",omitempty"` // ya está en el historial del servidor
+	Attachment *Attachment    `json:",omitempty"` // el mensaje es un adjunto, Message solo lo describe
+
+	Control *MessageControl `json:",omitempty"` // edita o borra otro mensaje, no se muestra
+	Edited  bool            `json:",omitempty"`
+	Deleted bool            `json:",omitempty"` // borrado por su emisor, queda solo la marca
+}
+
+/*
+Edición o borrado para todos de un mensaje ya enviado. Viaja cifrado como un mensaje más, así que el servidor no sabe
+qué es, y cada cliente lo aplica a su copia del chat. Solo vale para mensajes del mismo emisor.
+*/
+type MessageControl struct {
+	Type string
+	Ref  int64
+	Text string `json:",omitempty"`
+}
+
+const (
+	ControlEdit   = "edit"
+	ControlDelete = "delete"
+)
+
+// SignedData devuelve lo que firma el emisor: el mensaje tal como viaja, ligado a emisor y receptor
+func (m Message) SignedData(receiver string) []byte {
+	return []byte(fmt.Sprintf("msg\n%s\n%s\n%s", m.Sender, receiver, m.Message))
+}
+
+/*
+Mensaje del chat de un grupo, cifrado con la sender key que Sender repartió a los miembros en Epoch. Los miembros que
+entran o salen cambian el epoch y el servidor ya no acepta mensajes del anterior, así que hay que repartir otra clave.
+*/
+type GroupMessage struct {
+	Id        int64 // lo asigna el servidor, crece dentro de cada grupo
+	Group     string
 	Sender    string
+	Epoch     int64
 	Message   string
+	Signature []byte `json:",omitempty"` // firma RSA del emisor, la clave la tienen todos los miembros
 	Timestamp time.Time
+
+	Unverified bool `json:",omitempty"` // solo en el cliente
+}
+
+func (m GroupMessage) SignedData() []byte {
+	return []byte(fmt.Sprintf("gmsg\n%s\n%s\n%d\n%s", m.Group, m.Sender, m.Epoch, m.Message))
+}
+
+/*
+Sender key de Sender en el chat de Group para Epoch: una clave AES cifrada para cada miembro con su clave RSA pública
+y firmada por Sender. Al pedirlas, cada miembro solo recibe su copia en Keys.
+*/
+type SenderKey struct {
+	Group  string
+	Sender string
+	Epoch  int64
+	Keys   map[string]SealedKey // miembro -> su copia
+}
+
+type SealedKey struct {
+	Key       []byte
+	Signature []byte
+}
+
+// SignedData devuelve lo que firma el emisor de la copia de member
+func (k SenderKey) SignedData(member string) []byte {
+	return []byte(fmt.Sprintf("skey\n%s\n%s\n%d\n%s\n%x", k.Group, k.Sender, k.Epoch, member, k.Keys[member].Key))
+}
+
+/*
+Archivo cifrado que se sube por trozos para adjuntarlo en un chat. El servidor solo guarda los trozos cifrados; la clave
+va dentro del mensaje, cifrado de extremo a extremo, junto con el Id. Uploaded indica qué trozos han llegado, para
+continuar una subida cortada, y solo se puede bajar cuando están todos.
+*/
+type Blob struct {
+	Id       string
+	Owner    string
+	Size     int64 // tamaño del archivo sin cifrar
+	Chunks   int
+	Uploaded []bool
+	Created  time.Time
+	Expires  time.Time `json:",omitempty"` // va en un mensaje temporal y se borra cuando caduca
+}
+
+// Complete indica si ya se han subido todos los trozos
+func (b Blob) Complete() bool {
+	for _, ok := range b.Uploaded {
+		if !ok {
+			return false
+		}
+	}
+	return len(b.Uploaded) == b.Chunks
+}
+
+const (
+	// cada trozo se cifra por separado, así que el cifrado ocupa algo más
+	BlobChunkSize = 256 * 1024
+	MaxBlobSize   = 16 * 1024 * 1024
+)
+
+// BlobChunks devuelve en cuántos trozos se sube un archivo de size bytes
+func BlobChunks(size int64) int {
+	return int((size + BlobChunkSize - 1) / BlobChunkSize)
+}
+
+// referencia a un adjunto que viaja dentro de un mensaje cifrado
+type Attachment struct {
+	Id     string
+	Key    []byte
+	Name   string
+	Size   int64
+	Chunks int
+}
+
+/*
+Mensajes temporales de una conversación. Cualquiera de los dos propone un TTL y solo se aplica cuando el otro propone
+el mismo; mientras tanto sigue el anterior. Con TTL 0 los mensajes no caducan.
+*/
+type Expiry struct {
+	TTL time.Duration
+
+	Proposed   time.Duration `json:",omitempty"`
+	ProposedBy string        `json:",omitempty"`
+}
+
+// TTLs que se pueden proponer además de 0
+const (
+	MinExpiryTTL = 30 * time.Second
+	MaxExpiryTTL = 4 * 7 * 24 * time.Hour
+)
+
+type DeliveryStatus int8
+
+const (
+	StatusSent DeliveryStatus = iota + 1
+	StatusDelivered
+	StatusRead
+)
+
+/*
+Confirmaciones de entrega y lectura de los mensajes de una conversación. Como los ids crecen, basta con guardar hasta
+qué id ha recibido y leído User lo que le han enviado.
+*/
+type Receipt struct {
+	User      string
+	Delivered int64
+	Read      int64
+}
+
+// Status devuelve el estado de un mensaje enviado a r.User
+func (r Receipt) Status(id int64) DeliveryStatus {
+	switch {
+	case id <= r.Read:
+		return StatusRead
+	case id <= r.Delivered:
+		return StatusDelivered
+	}
+	return StatusSent
+}
+
+// resumen de una conversación para la bandeja de entrada
+type ChatSummary struct {
+	User         string
+	Pending      int // mensajes de User que aún no se han recibido
+	LastActivity time.Time
+}
+
+// confirma al servidor que se han recibido los mensajes hasta Id incluido
+type MessageAck struct {
+	Id int64
+}
+
+/*
+Mensajes del websocket de chat (/ws). User es siempre la otra parte de la conversación.
+
+Del cliente al servidor: send (Message cifrado, Ref para casar la respuesta), sync (pide los pendientes de User
+posteriores a Id y confirma los anteriores), ack (confirma hasta Id), read (leídos hasta Id) y typing.
+Del servidor al cliente: message, typing, receipt (Receipt de lo enviado a User), sent (Id asignado al mensaje con
+esa Ref), expiry (User ha cambiado los mensajes temporales de la conversación) y error.
+*/
+type SocketFrame struct {
+	Type    string
+	User    string   `json:",omitempty"`
+	Ref     int64    `json:",omitempty"`
+	Id      int64    `json:",omitempty"`
+	Message *Message `json:",omitempty"`
+	Receipt *Receipt `json:",omitempty"`
+	Expiry  *Expiry  `json:",omitempty"`
+	Error   string   `json:",omitempty"`
 }
 
+const (
+	FrameSend    = "send"
+	FrameSync    = "sync"
+	FrameAck     = "ack"
+	FrameTyping  = "typing"
+	FrameRead    = "read"
+	FrameReceipt = "receipt"
+	FrameMessage = "message"
+	FrameSent    = "sent"
+	FrameError   = "error"
+	FrameExpiry  = "expiry"
+)
+
+/*
+Copia local de una conversación. Session es el estado del double ratchet (util/ratchet) serializado: cada mensaje se
+cifra con una clave distinta y las antiguas se olvidan, así que hay que guardarlo cada vez que cambia.
+*/
 type Chat struct {
 	UserA    string
 	UserB    string
 	Messages []Message
-	Key      []byte
+	Session  []byte
+
+	// última entrada del historial del servidor ya incluida y de qué vez que se activó, si cambia hay que
+	// volver a subirlo todo
+	HistorySeq   int64
+	HistoryEpoch int64
+}
+
+/*
+Entrada del historial que un usuario guarda en el servidor para recuperar sus chats desde otro dispositivo. Ciphertext
+es el mensaje ya descifrado y vuelto a cifrar con una clave que sale de su clave RSA, así que el servidor no lo puede
+leer. Seq la asigna el servidor y crece dentro de cada conversación; MessageId evita guardar dos veces un mensaje.
+*/
+type HistoryEntry struct {
+	Seq        int64
+	MessageId  int64
+	Ciphertext []byte
+}
+
+// página del historial. Next es el cursor para pedir la siguiente, More indica si quedan más y Epoch es el de User
+type HistoryPage struct {
+	Entries []HistoryEntry
+	Next    int64
+	More    bool
+	Epoch   int64
+}
+
+type HistorySettings struct {
+	Enabled bool
+}
+
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+	PresenceHidden  = "hidden"
+)
+
+/*
+Presencia de un usuario: online si tiene un chat abierto o ha hecho algo hace poco, away si lleva un rato sin hacer
+nada y offline a partir de ahí. LastSeen es su última actividad; si la ha ocultado el estado es hidden y LastSeen
+va vacío. Hidden solo se rellena cuando el usuario pide su propia presencia.
+*/
+type Presence struct {
+	User     string
+	Status   string
+	LastSeen time.Time
+	Hidden   bool `json:",omitempty"`
+}
+
+type PresenceSettings struct {
+	Hidden bool
+}
+
+/*
+Sesión de un usuario en un dispositivo. Cada login crea una con su refresh token, que sirve para pedir tokens de acceso
+sin volver a hacer login. El refresh token empieza por el id de la sesión y el servidor solo guarda su sha256; los
+tokens de acceso van firmados y no se guardan. Seen es la última vez que se renovó algún token.
+*/
+type Session struct {
+	Id      string
+	User    string
+	Device  string
+	Created time.Time
+	Seen    time.Time
+
+	RefreshHash    []byte
+	RefreshExpires time.Time
+}
+
+// lo que ve el usuario de cada una de sus sesiones. Current es la de la petición
+type SessionInfo struct {
+	Id      string
+	Device  string
+	Created time.Time
+	Seen    time.Time
+	Expires time.Time
+	Current bool `json:",omitempty"`
+}
+
+// nuevo par de tokens tras un refresh. Expires es la caducidad del token de acceso
+type SessionTokens struct {
+	Token   []byte
+	Refresh []byte
+	Expires time.Time
+}
+
+type RefreshRequest struct {
+	User    string
+	Refresh []byte
+}
+
+/*
+Claves públicas X25519 que un usuario publica en el servidor para que otros puedan empezar una conversación cifrada
+con él sin que esté conectado. SignedPreKey va firmada con la clave RSA de la cuenta.
+
+Al publicar se mandan todas las OneTimePreKeys nuevas; al pedir las de otro usuario el servidor devuelve como mucho una
+y la borra, cada una solo se usa en un handshake.
+*/
+type PreKeyBundle struct {
+	IdentityKey    []byte
+	SignedPreKeyId uint32
+	SignedPreKey   []byte
+	Signature      []byte
+	OneTimePreKeys []OneTimePreKey `json:",omitempty"`
+}
+
+type OneTimePreKey struct {
+	Id  uint32
+	Key []byte
+}
+
+// SignedData devuelve lo que cubre Signature: la clave de identidad y la prekey firmada con su id
+func (b PreKeyBundle) SignedData() []byte {
+	data := make([]byte, 0, len(b.IdentityKey)+len(b.SignedPreKey)+4)
+	data = append(data, b.IdentityKey...)
+	data = append(data, byte(b.SignedPreKeyId>>24), byte(b.SignedPreKeyId>>16), byte(b.SignedPreKeyId>>8), byte(b.SignedPreKeyId))
+	return append(data, b.SignedPreKey...)
+}
+
+// lo que el servidor tiene publicado de un usuario, para saber si hay que subir más prekeys
+type PreKeyStatus struct {
+	IdentityKey    []byte
+	SignedPreKeyId uint32
+	OneTimePreKeys int
+}
+
+// login pendiente del segundo paso: la contraseña ya es correcta y falta el código de verificación
+type LoginTicket struct {
+	User     string
+	Device   string
+	Expires  time.Time
+	Attempts int
 }
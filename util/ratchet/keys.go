@@ -0,0 +1,342 @@
+/*
+Cifrado de extremo a extremo de los chats con secreto hacia adelante, siguiendo el esquema de Signal:
+
+  - X3DH: quien empieza la conversación combina sus claves X25519 con las prekeys que el otro ha publicado en el
+    servidor, y los dos llegan al mismo secreto sin que el otro tenga que estar conectado.
+  - Double Ratchet: a partir de ese secreto cada mensaje se cifra con una clave distinta. La cadena simétrica avanza
+    con cada mensaje y con cada respuesta se hace un nuevo intercambio DH, así que quien robe el estado actual no
+    puede descifrar los mensajes anteriores.
+
+El servidor solo guarda las claves públicas y reparte los mensajes; no puede descifrar nada.
+*/
+package ratchet
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+	"util/model"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrUnknownPreKey    = fmt.Errorf("prekey desconocida o ya usada")
+	ErrNoSession        = fmt.Errorf("no hay sesión con este usuario")
+	ErrSessionDiscarded = fmt.Errorf("mensaje de una sesión descartada")
+)
+
+var infoX3DH = []byte("social-x3dh")
+
+const (
+	// cada cuánto se cambia la prekey firmada
+	SignedPreKeyLifetime = 7 * 24 * time.Hour
+	// cuánto se guarda la anterior para los mensajes que empezaron con ella
+	SignedPreKeyGrace = 30 * 24 * time.Hour
+)
+
+type KeyPair struct {
+	Private []byte
+	Public  []byte
+}
+
+func GenerateKeyPair() (KeyPair, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return KeyPair{}, err
+	}
+
+	return KeyPair{Private: priv.Bytes(), Public: priv.PublicKey().Bytes()}, nil
+}
+
+func dh(private []byte, public []byte) ([]byte, error) {
+	curve := ecdh.X25519()
+
+	priv, err := curve.NewPrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := curve.NewPublicKey(public)
+	if err != nil {
+		return nil, fmt.Errorf("clave pública X25519 no válida")
+	}
+
+	return priv.ECDH(pub)
+}
+
+/*
+Identity son las claves privadas X25519 del usuario: la de identidad, la prekey firmada y las de un solo uso que aún
+no ha gastado nadie. No sale nunca del cliente.
+
+La prekey firmada se cambia cada SignedPreKeyLifetime con un id nuevo, y las anteriores se guardan en OldSignedPreKeys
+hasta SignedPreKeyGrace después para aceptar las conversaciones que alguien empezó con ellas.
+*/
+type Identity struct {
+	IdentityKey         KeyPair
+	SignedPreKey        KeyPair
+	SignedPreKeyId      uint32
+	SignedPreKeyCreated time.Time
+	OldSignedPreKeys    map[uint32]OldPreKey `json:",omitempty"`
+	OneTimePreKeys      map[uint32]KeyPair
+	NextPreKeyId        uint32
+}
+
+// OldPreKey es una prekey firmada ya cambiada, que se borra en Expires
+type OldPreKey struct {
+	KeyPair
+	Expires time.Time
+}
+
+func NewIdentity() (*Identity, error) {
+	identityKey, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	signedPreKey, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		IdentityKey:         identityKey,
+		SignedPreKey:        signedPreKey,
+		SignedPreKeyId:      1,
+		SignedPreKeyCreated: time.Now(),
+		OneTimePreKeys:      make(map[uint32]KeyPair),
+		NextPreKeyId:        1,
+	}, nil
+}
+
+/*
+RotateSignedPreKey cambia la prekey firmada si ya ha cumplido SignedPreKeyLifetime en now y borra las anteriores que
+han pasado su plazo. Devuelve si ha cambiado algo, y entonces hay que guardar la identidad y publicar el bundle nuevo.
+Las identidades de antes de la rotación no tienen fecha y se cambian la primera vez.
+*/
+func (id *Identity) RotateSignedPreKey(now time.Time) (bool, error) {
+	changed := false
+	for kid, old := range id.OldSignedPreKeys {
+		if !now.Before(old.Expires) {
+			delete(id.OldSignedPreKeys, kid)
+			changed = true
+		}
+	}
+
+	if now.Sub(id.SignedPreKeyCreated) < SignedPreKeyLifetime {
+		return changed, nil
+	}
+
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		return changed, err
+	}
+
+	if id.OldSignedPreKeys == nil {
+		id.OldSignedPreKeys = make(map[uint32]OldPreKey)
+	}
+	id.OldSignedPreKeys[id.SignedPreKeyId] = OldPreKey{KeyPair: id.SignedPreKey, Expires: now.Add(SignedPreKeyGrace)}
+
+	id.SignedPreKey = kp
+	id.SignedPreKeyId++
+	id.SignedPreKeyCreated = now
+	return true, nil
+}
+
+// signedPreKey busca la prekey firmada con el id que trae una cabecera, la actual o una anterior aún guardada
+func (id *Identity) signedPreKey(kid uint32) (KeyPair, bool) {
+	if kid == id.SignedPreKeyId {
+		return id.SignedPreKey, true
+	}
+
+	old, ok := id.OldSignedPreKeys[kid]
+	return old.KeyPair, ok
+}
+
+// Bundle genera n prekeys de un solo uso nuevas y devuelve lo que hay que publicar. La firma la pone quien llama
+func (id *Identity) Bundle(n int) (model.PreKeyBundle, error) {
+	bundle := model.PreKeyBundle{
+		IdentityKey:    id.IdentityKey.Public,
+		SignedPreKeyId: id.SignedPreKeyId,
+		SignedPreKey:   id.SignedPreKey.Public,
+		OneTimePreKeys: make([]model.OneTimePreKey, 0, n),
+	}
+
+	for i := 0; i < n; i++ {
+		kp, err := GenerateKeyPair()
+		if err != nil {
+			return bundle, err
+		}
+
+		id.OneTimePreKeys[id.NextPreKeyId] = kp
+		bundle.OneTimePreKeys = append(bundle.OneTimePreKeys, model.OneTimePreKey{Id: id.NextPreKeyId, Key: kp.Public})
+		id.NextPreKeyId++
+	}
+
+	return bundle, nil
+}
+
+/*
+PreKeyHeader va en todos los mensajes de quien inicia la conversación hasta que recibe una respuesta, con lo que el otro
+necesita para calcular el mismo secreto.
+*/
+type PreKeyHeader struct {
+	IdentityKey     []byte
+	EphemeralKey    []byte
+	SignedPreKeyId  uint32
+	OneTimePreKeyId uint32 // 0 si el servidor ya no tenía ninguna
+}
+
+// x3dh deriva el secreto compartido de los intercambios DH
+func x3dh(dhs ...[]byte) ([]byte, error) {
+	ikm := bytes.Repeat([]byte{0xFF}, 32)
+	for _, d := range dhs {
+		ikm = append(ikm, d...)
+	}
+
+	sk := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, ikm, make([]byte, 32), infoX3DH), sk)
+	return sk, err
+}
+
+/*
+Initiate empieza una conversación con el dueño de bundle, que tiene que venir con la firma ya comprobada. Los mensajes
+de la sesión llevan la cabecera de prekeys hasta que llegue la primera respuesta.
+*/
+func Initiate(id *Identity, bundle model.PreKeyBundle) (*Session, error) {
+	ek, err := GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	header := PreKeyHeader{IdentityKey: id.IdentityKey.Public, EphemeralKey: ek.Public, SignedPreKeyId: bundle.SignedPreKeyId}
+
+	dhs := make([][]byte, 0, 4)
+	for _, pair := range [][2][]byte{
+		{id.IdentityKey.Private, bundle.SignedPreKey},
+		{ek.Private, bundle.IdentityKey},
+		{ek.Private, bundle.SignedPreKey},
+	} {
+		out, err := dh(pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, out)
+	}
+
+	if len(bundle.OneTimePreKeys) > 0 {
+		otk := bundle.OneTimePreKeys[0]
+
+		out, err := dh(ek.Private, otk.Key)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, out)
+		header.OneTimePreKeyId = otk.Id
+	}
+
+	sk, err := x3dh(dhs...)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newInitiator(sk, bundle.SignedPreKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s.AD = slices.Concat(id.IdentityKey.Public, bundle.IdentityKey)
+	s.Handshake = ek.Public
+	s.PreKey = &header
+
+	return s, nil
+}
+
+// accept calcula la sesión que ha empezado el otro a partir de su cabecera de prekeys. No gasta la prekey de un solo
+// uso, eso se hace cuando el primer mensaje se ha descifrado bien
+func (id *Identity) accept(h PreKeyHeader) (*Session, error) {
+	spk, ok := id.signedPreKey(h.SignedPreKeyId)
+	if !ok {
+		return nil, ErrUnknownPreKey
+	}
+
+	dhs := make([][]byte, 0, 4)
+	for _, pair := range [][2][]byte{
+		{spk.Private, h.IdentityKey},
+		{id.IdentityKey.Private, h.EphemeralKey},
+		{spk.Private, h.EphemeralKey},
+	} {
+		out, err := dh(pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, out)
+	}
+
+	if h.OneTimePreKeyId != 0 {
+		otk, ok := id.OneTimePreKeys[h.OneTimePreKeyId]
+		if !ok {
+			return nil, ErrUnknownPreKey
+		}
+
+		out, err := dh(otk.Private, h.EphemeralKey)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, out)
+	}
+
+	sk, err := x3dh(dhs...)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newResponder(sk, spk)
+	s.AD = slices.Concat(h.IdentityKey, id.IdentityKey.Public)
+	s.Handshake = h.EphemeralKey
+
+	return s, nil
+}
+
+/*
+Receive descifra un mensaje de la conversación cuya sesión actual es s (nil si no hay). Si el mensaje abre una sesión
+nueva la acepta y la devuelve en lugar de s; en ese caso la prekey de un solo uso se borra de id y hay que guardarlo.
+*/
+func (id *Identity) Receive(s *Session, data []byte, ad []byte) (*Session, []byte, error) {
+	env, err := parseEnvelope(data)
+	if err != nil {
+		return s, nil, err
+	}
+
+	if env.PreKey != nil && (s == nil || !bytes.Equal(s.Handshake, env.PreKey.EphemeralKey)) {
+		// los dos han empezado a la vez: se queda la sesión de quien tenga la clave de identidad menor
+		if s != nil && s.PreKey != nil && bytes.Compare(s.PreKey.IdentityKey, env.PreKey.IdentityKey) < 0 {
+			return s, nil, ErrSessionDiscarded
+		}
+
+		next, err := id.accept(*env.PreKey)
+		if err != nil {
+			return s, nil, err
+		}
+
+		plaintext, err := next.decrypt(env, ad)
+		if err != nil {
+			return s, nil, err
+		}
+
+		delete(id.OneTimePreKeys, env.PreKey.OneTimePreKeyId)
+		return next, plaintext, nil
+	}
+
+	if s == nil {
+		return s, nil, ErrNoSession
+	}
+
+	plaintext, err := s.decrypt(env, ad)
+	return s, plaintext, err
+}
@@ -0,0 +1,260 @@
+package ratchet
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"util"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// mensajes que se pueden saltar en una cadena y claves de mensajes sin llegar que se guardan como mucho
+	maxSkip    = 1000
+	maxSkipped = 2000
+)
+
+var infoRatchet = []byte("social-ratchet")
+
+// Header va en claro en cada mensaje: la clave DH actual del emisor, la longitud de su cadena anterior y el número
+// del mensaje en la actual
+type Header struct {
+	DH []byte
+	PN uint32
+	N  uint32
+}
+
+func (h Header) bytes() []byte {
+	return binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(slices.Clone(h.DH), h.PN), h.N)
+}
+
+// Envelope es lo que viaja en model.Message.Message, serializado en JSON
+type Envelope struct {
+	Header     Header
+	PreKey     *PreKeyHeader `json:",omitempty"`
+	Ciphertext []byte
+}
+
+func parseEnvelope(data []byte) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil || len(env.Header.DH) == 0 {
+		return env, fmt.Errorf("mensaje con formato desconocido")
+	}
+	return env, nil
+}
+
+type skippedKey struct {
+	DH  []byte
+	N   uint32
+	Key []byte
+}
+
+// Session es el estado del double ratchet de una conversación, se guarda en JSON junto al chat
+type Session struct {
+	DHs KeyPair
+	DHr []byte
+	RK  []byte
+	CKs []byte
+	CKr []byte
+	Ns  uint32
+	Nr  uint32
+	PN  uint32
+
+	// claves de mensajes que se han saltado porque llegaron otros posteriores, de la más antigua a la más nueva
+	Skipped []skippedKey
+
+	AD        []byte        // claves de identidad de los dos, primero la de quien inició
+	Handshake []byte        // clave efímera del X3DH, identifica la sesión
+	PreKey    *PreKeyHeader `json:",omitempty"` // solo quien inició, hasta recibir respuesta
+}
+
+func newInitiator(sk []byte, remote []byte) (*Session, error) {
+	s := &Session{DHr: remote}
+
+	var err error
+	if s.DHs, err = GenerateKeyPair(); err != nil {
+		return nil, err
+	}
+
+	out, err := dh(s.DHs.Private, s.DHr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.RK, s.CKs, err = kdfRK(sk, out)
+	return s, err
+}
+
+func newResponder(sk []byte, signedPreKey KeyPair) *Session {
+	return &Session{DHs: signedPreKey, RK: sk}
+}
+
+func UnmarshalSession(data []byte) (*Session, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *Session) Marshal() []byte {
+	if s == nil {
+		return nil
+	}
+	return util.EncodeJSON(s)
+}
+
+// Encrypt cifra plaintext con la siguiente clave de la cadena de envío. ad se autentica junto con la cabecera
+func (s *Session) Encrypt(plaintext []byte, ad []byte) ([]byte, error) {
+	if s.CKs == nil {
+		return nil, fmt.Errorf("la sesión aún no puede enviar")
+	}
+
+	var mk []byte
+	s.CKs, mk = kdfCK(s.CKs)
+
+	h := Header{DH: s.DHs.Public, PN: s.PN, N: s.Ns}
+	s.Ns++
+
+	env := Envelope{Header: h, PreKey: s.PreKey, Ciphertext: util.EncryptAD(plaintext, mk, s.ad(h, ad))}
+	return json.Marshal(env)
+}
+
+// decrypt solo cambia la sesión si el mensaje se descifra bien, un mensaje falso no puede estropearla
+func (s *Session) decrypt(env Envelope, ad []byte) ([]byte, error) {
+	next := *s
+	next.Skipped = slices.Clone(s.Skipped)
+
+	plaintext, err := next.decryptInPlace(env, ad)
+	if err != nil {
+		return nil, err
+	}
+
+	// ha llegado algo del otro, ya tiene la sesión
+	next.PreKey = nil
+	*s = next
+	return plaintext, nil
+}
+
+func (s *Session) decryptInPlace(env Envelope, ad []byte) ([]byte, error) {
+	h := env.Header
+
+	// se rechaza antes de avanzar la cadena, DecryptAD fallaría igual pero con el estado ya tocado
+	if !util.IsEnvelope(env.Ciphertext) {
+		return nil, fmt.Errorf("mensaje con formato desconocido")
+	}
+
+	for i, skipped := range s.Skipped {
+		if skipped.N == h.N && bytes.Equal(skipped.DH, h.DH) {
+			s.Skipped = slices.Delete(s.Skipped, i, i+1)
+			return util.DecryptAD(env.Ciphertext, skipped.Key, s.ad(h, ad))
+		}
+	}
+
+	if !bytes.Equal(h.DH, s.DHr) {
+		if err := s.skip(h.PN); err != nil {
+			return nil, err
+		}
+		if err := s.dhRatchet(h); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.skip(h.N); err != nil {
+		return nil, err
+	}
+
+	var mk []byte
+	s.CKr, mk = kdfCK(s.CKr)
+	s.Nr++
+
+	return util.DecryptAD(env.Ciphertext, mk, s.ad(h, ad))
+}
+
+// skip guarda las claves de los mensajes de la cadena de recepción anteriores a until, que llegarán más tarde
+func (s *Session) skip(until uint32) error {
+	if s.CKr == nil {
+		return nil
+	}
+
+	if until < s.Nr {
+		return fmt.Errorf("mensaje repetido")
+	}
+	if until-s.Nr > maxSkip {
+		return fmt.Errorf("demasiados mensajes perdidos")
+	}
+
+	for s.Nr < until {
+		var mk []byte
+		s.CKr, mk = kdfCK(s.CKr)
+		s.Skipped = append(s.Skipped, skippedKey{DH: s.DHr, N: s.Nr, Key: mk})
+		s.Nr++
+	}
+
+	if len(s.Skipped) > maxSkipped {
+		s.Skipped = s.Skipped[len(s.Skipped)-maxSkipped:]
+	}
+
+	return nil
+}
+
+// dhRatchet pasa a la nueva clave DH del otro: nueva cadena de recepción y, con un par nuevo, nueva cadena de envío
+func (s *Session) dhRatchet(h Header) error {
+	s.PN = s.Ns
+	s.Ns = 0
+	s.Nr = 0
+	s.DHr = h.DH
+
+	out, err := dh(s.DHs.Private, s.DHr)
+	if err != nil {
+		return err
+	}
+	if s.RK, s.CKr, err = kdfRK(s.RK, out); err != nil {
+		return err
+	}
+
+	if s.DHs, err = GenerateKeyPair(); err != nil {
+		return err
+	}
+
+	out, err = dh(s.DHs.Private, s.DHr)
+	if err != nil {
+		return err
+	}
+	s.RK, s.CKs, err = kdfRK(s.RK, out)
+	return err
+}
+
+func (s *Session) ad(h Header, ad []byte) []byte {
+	return slices.Concat(s.AD, h.bytes(), ad)
+}
+
+// kdfRK deriva la nueva clave raíz y una clave de cadena a partir de un intercambio DH
+func kdfRK(rk []byte, dhOut []byte) ([]byte, []byte, error) {
+	out := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dhOut, rk, infoRatchet), out); err != nil {
+		return nil, nil, err
+	}
+	return out[:32], out[32:], nil
+}
+
+// kdfCK avanza una cadena simétrica y devuelve la siguiente clave de cadena y la clave del mensaje
+func kdfCK(ck []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x01})
+	mk := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, ck)
+	mac.Write([]byte{0x02})
+	return mac.Sum(nil), mk
+}
@@ -0,0 +1,190 @@
+package ratchet
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func newIdentity(t *testing.T) *Identity {
+	id, err := NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// initiate hace que alice empiece una sesión con bob como si hubiera pedido su bundle al servidor
+func initiate(t *testing.T, alice, bob *Identity) *Session {
+	bundle, err := bob.Bundle(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := Initiate(alice, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func encrypt(t *testing.T, s *Session, text string) []byte {
+	data, err := s.Encrypt([]byte(text), []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func receive(t *testing.T, id *Identity, s *Session, data []byte, want string) *Session {
+	s, plaintext, err := id.Receive(s, data, []byte("ad"))
+	if err != nil {
+		t.Fatalf("descifrando %q: %v", want, err)
+	}
+	if string(plaintext) != want {
+		t.Fatalf("descifrado %q, se esperaba %q", plaintext, want)
+	}
+	return s
+}
+
+func TestConversation(t *testing.T) {
+	alice, bob := newIdentity(t), newIdentity(t)
+	aliceSession := initiate(t, alice, bob)
+
+	first := encrypt(t, aliceSession, "hola")
+	second := encrypt(t, aliceSession, "¿estás?")
+
+	bobSession := receive(t, bob, nil, first, "hola")
+	if len(bob.OneTimePreKeys) != 0 {
+		t.Error("la prekey de un solo uso no se ha borrado")
+	}
+	bobSession = receive(t, bob, bobSession, second, "¿estás?")
+
+	// sin respuesta los mensajes siguen llevando la cabecera de prekeys
+	var env Envelope
+	json.Unmarshal(second, &env)
+	if env.PreKey == nil {
+		t.Error("mensaje sin cabecera de prekeys antes de la respuesta")
+	}
+
+	aliceSession = receive(t, alice, aliceSession, encrypt(t, bobSession, "sí"), "sí")
+	if aliceSession.PreKey != nil {
+		t.Error("la cabecera de prekeys sigue tras recibir respuesta")
+	}
+
+	// desordenados y a través de varios cambios de clave DH
+	late := encrypt(t, aliceSession, "tarde")
+	onTime := encrypt(t, aliceSession, "a tiempo")
+	bobSession = receive(t, bob, bobSession, onTime, "a tiempo")
+	aliceSession = receive(t, alice, aliceSession, encrypt(t, bobSession, "vale"), "vale")
+	bobSession = receive(t, bob, bobSession, encrypt(t, aliceSession, "otra"), "otra")
+	bobSession = receive(t, bob, bobSession, late, "tarde")
+
+	// el estado se puede guardar y recuperar
+	restored, err := UnmarshalSession(bobSession.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(t, bob, restored, encrypt(t, aliceSession, "después de guardar"), "después de guardar")
+
+	// un mensaje repetido no se descifra dos veces, la clave ya no existe
+	if _, _, err := bob.Receive(restored, late, []byte("ad")); err == nil {
+		t.Error("se ha descifrado dos veces el mismo mensaje")
+	}
+}
+
+func TestTampering(t *testing.T) {
+	alice, bob := newIdentity(t), newIdentity(t)
+	aliceSession := initiate(t, alice, bob)
+	data := encrypt(t, aliceSession, "hola")
+
+	if _, _, err := bob.Receive(nil, data, []byte("otro ad")); err == nil {
+		t.Error("descifrado con otros datos adicionales")
+	}
+
+	var env Envelope
+	json.Unmarshal(data, &env)
+	env.Ciphertext[len(env.Ciphertext)-1] ^= 1
+	tampered, _ := json.Marshal(env)
+
+	if _, _, err := bob.Receive(nil, tampered, []byte("ad")); err == nil {
+		t.Error("descifrado un mensaje modificado")
+	}
+
+	// los intentos fallidos no gastan la prekey ni impiden recibir el mensaje bueno
+	receive(t, bob, nil, data, "hola")
+}
+
+// si los dos empiezan a la vez, ambos acaban en la sesión de quien tiene la clave de identidad menor
+func TestSimultaneousInitiate(t *testing.T) {
+	alice, bob := newIdentity(t), newIdentity(t)
+	aliceSession := initiate(t, alice, bob)
+	bobSession := initiate(t, bob, alice)
+
+	fromAlice := encrypt(t, aliceSession, "de alice")
+	fromBob := encrypt(t, bobSession, "de bob")
+
+	winner, loser := "de alice", "de bob"
+	if bytes.Compare(alice.IdentityKey.Public, bob.IdentityKey.Public) > 0 {
+		winner, loser = loser, winner
+	}
+
+	aliceNext, aliceText, aliceErr := alice.Receive(aliceSession, fromBob, []byte("ad"))
+	bobNext, bobText, bobErr := bob.Receive(bobSession, fromAlice, []byte("ad"))
+
+	if winner == "de alice" {
+		if aliceErr != ErrSessionDiscarded || bobErr != nil || string(bobText) != winner {
+			t.Fatalf("alice: %v, bob: %q %v", aliceErr, bobText, bobErr)
+		}
+	} else if bobErr != ErrSessionDiscarded || aliceErr != nil || string(aliceText) != winner {
+		t.Fatalf("bob: %v, alice: %q %v (perdedor %q)", bobErr, aliceText, aliceErr, loser)
+	}
+
+	// a partir de aquí los dos hablan por la misma sesión
+	aliceNext = receive(t, alice, aliceNext, encrypt(t, bobNext, "ida"), "ida")
+	receive(t, bob, bobNext, encrypt(t, aliceNext, "vuelta"), "vuelta")
+}
+
+func TestSignedPreKeyRotation(t *testing.T) {
+	alice, bob, carol := newIdentity(t), newIdentity(t), newIdentity(t)
+	now := bob.SignedPreKeyCreated
+
+	if rotated, err := bob.RotateSignedPreKey(now.Add(time.Hour)); err != nil || rotated {
+		t.Fatalf("cambiada antes de tiempo: %v %v", rotated, err)
+	}
+
+	// alice y carol empiezan con la prekey 1 y sus mensajes llegan cuando bob ya la ha cambiado
+	aliceSession := initiate(t, alice, bob)
+	first := encrypt(t, aliceSession, "con la anterior")
+	late := encrypt(t, initiate(t, carol, bob), "tarde")
+
+	now = now.Add(SignedPreKeyLifetime)
+	if rotated, err := bob.RotateSignedPreKey(now); err != nil || !rotated {
+		t.Fatalf("no se ha cambiado: %v %v", rotated, err)
+	}
+	if bob.SignedPreKeyId != 2 {
+		t.Fatalf("id %d tras cambiarla", bob.SignedPreKeyId)
+	}
+
+	bobSession := receive(t, bob, nil, first, "con la anterior")
+	receive(t, alice, aliceSession, encrypt(t, bobSession, "recibido"), "recibido")
+
+	// las nuevas van con la 2
+	if s := initiate(t, carol, bob); s.PreKey.SignedPreKeyId != 2 {
+		t.Fatalf("sesión nueva con la prekey %d", s.PreKey.SignedPreKeyId)
+	} else {
+		receive(t, bob, nil, encrypt(t, s, "con la nueva"), "con la nueva")
+	}
+
+	// pasado el plazo la anterior se borra y lo que venga con ella se rechaza
+	if _, err := bob.RotateSignedPreKey(now.Add(SignedPreKeyGrace)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bob.OldSignedPreKeys[1]; ok || bob.SignedPreKeyId != 3 {
+		t.Fatalf("prekeys guardadas %v, id %d", bob.OldSignedPreKeys, bob.SignedPreKeyId)
+	}
+	if _, _, err := bob.Receive(nil, late, []byte("ad")); err != ErrUnknownPreKey {
+		t.Fatalf("mensaje con la prekey caducada: %v", err)
+	}
+}
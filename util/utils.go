@@ -13,12 +13,16 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"fmt"
 	"io"
 	"os"
+	"slices"
+	"strings"
 )
 
 // FailOnError comprueba y sale si hay errores (ahorra escritura en programas sencillos)
@@ -40,25 +44,95 @@ func EncodeJSON[T any](v T) []byte {
 	return buffer.Bytes()
 }
 
-// función para cifrar (AES-CTR 256), adjunta el IV al principio
+/*
+Cifrado simétrico autenticado. Formato del sobre (versión 1):
+
+	[0xA5 0x53][versión][nonce 12 bytes][datos cifrados + tag 16 bytes]
+
+Los datos adicionales (ad) se autentican pero no se cifran ni se guardan, quien descifra tiene que pasar los mismos
+(por ejemplo el emisor y receptor de un mensaje) y si no coinciden o alguien ha tocado el sobre falla Decrypt.
+
+Los datos que no empiezan por la cabecera son del formato antiguo (AES-CTR con el IV delante y sin integridad).
+Decrypt los rechaza; solo las migraciones explícitas los leen con DecryptLegacy y los vuelven a cifrar en el nuevo.
+*/
+
+var envelopeMagic = []byte{0xA5, 0x53}
+
+const (
+	envelopeV1     byte = 1 // AES-256-GCM
+	envelopeHeader      = 3
+)
+
+// EncryptAD cifra con AES-256-GCM y autentica ad junto con los datos
+func EncryptAD(data, key, ad []byte) []byte {
+	blk, err := aes.NewCipher(key)
+	FailOnError(err)
+	gcm, err := cipher.NewGCM(blk)
+	FailOnError(err)
+
+	out := make([]byte, envelopeHeader+gcm.NonceSize(), envelopeHeader+gcm.NonceSize()+len(data)+gcm.Overhead())
+	copy(out, envelopeMagic)
+	out[2] = envelopeV1
+	rand.Read(out[envelopeHeader:])
+
+	return gcm.Seal(out, out[envelopeHeader:], data, ad)
+}
+
+// DecryptAD descifra un sobre de EncryptAD con los mismos ad. Los datos sin cabecera se rechazan: el formato antiguo
+// no está autenticado y solo se lee con DecryptLegacy en las migraciones
+func DecryptAD(data, key, ad []byte) ([]byte, error) {
+	if !IsEnvelope(data) {
+		return nil, fmt.Errorf("datos sin cabecera de cifrado autenticado")
+	}
+
+	if data[2] != envelopeV1 {
+		return nil, fmt.Errorf("versión de cifrado desconocida: %d", data[2])
+	}
+
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(blk)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < envelopeHeader+gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("datos cifrados demasiado cortos")
+	}
+
+	nonce := data[envelopeHeader : envelopeHeader+gcm.NonceSize()]
+	return gcm.Open(nil, nonce, data[envelopeHeader+gcm.NonceSize():], ad)
+}
+
+// IsEnvelope indica si data tiene la cabecera del formato autenticado. Si no, es del formato antiguo
+func IsEnvelope(data []byte) bool {
+	return len(data) >= envelopeHeader && bytes.Equal(data[:2], envelopeMagic)
+}
+
+// función para cifrar (AES-GCM 256) sin datos adicionales
 func Encrypt(data, key []byte) (out []byte) {
-	out = make([]byte, len(data)+16)    // reservamos espacio para el IV al principio
-	rand.Read(out[:16])                 // generamos el IV
-	blk, err := aes.NewCipher(key)      // cifrador en bloque (AES), usa key
-	FailOnError(err)                    // comprobamos el error
-	ctr := cipher.NewCTR(blk, out[:16]) // cifrador en flujo: modo CTR, usa IV
-	ctr.XORKeyStream(out[16:], data)    // ciframos los datos
-	return
+	return EncryptAD(data, key, nil)
 }
 
-// función para descifrar (AES-CTR 256)
+// función para descifrar (AES-GCM 256) sin datos adicionales
 func Decrypt(data, key []byte) (out []byte, err error) {
+	return DecryptAD(data, key, nil)
+}
+
+// DecryptLegacy descifra el formato antiguo (AES-CTR 256 con el IV al principio). No comprueba la integridad, así que
+// solo se usa para migrar datos guardados antes del formato autenticado
+func DecryptLegacy(data, key []byte) (out []byte, err error) {
+	if len(data) < 16 {
+		return nil, fmt.Errorf("datos cifrados demasiado cortos")
+	}
+
 	out = make([]byte, len(data)-16) // la salida no va a tener el IV
 	blk, err := aes.NewCipher(key)   // cifrador en bloque (AES), usa key
 	if err != nil {
 		return
 	}
-	// FailOnError(err)                     // comprobamos el error
 	ctr := cipher.NewCTR(blk, data[:16]) // cifrador en flujo: modo CTR, usa IV
 	ctr.XORKeyStream(out, data[16:])     // desciframos (doble cifrado) los datos
 	return
@@ -102,6 +176,53 @@ func Hash(data []byte) []byte {
 	return h.Sum(nil) // obtenemos el resumen
 }
 
+// Fingerprint devuelve la huella SHA-256 de una clave pública en hexadecimal, en grupos de 4 para leerla en voz alta
+func Fingerprint(pubKey []byte) string {
+	h := fmt.Sprintf("%x", Hash(pubKey))
+
+	groups := make([]string, 0, len(h)/4)
+	for i := 0; i < len(h); i += 4 {
+		groups = append(groups, h[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+/*
+SafetyNumber devuelve el número de seguridad de una conversación, 60 cifras en grupos de 5. Sale igual en los dos
+lados, así que si dos usuarios lo comparan en persona y coincide, ninguno está usando una clave falsa del otro.
+
+Cada mitad sale de la clave y el nombre de uno de los usuarios, con el hash repetido para que no salga a cuenta buscar
+una clave falsa que dé el mismo número; las mitades se ordenan para no depender de quién lo calcule.
+*/
+func SafetyNumber(userA string, keyA []byte, userB string, keyB []byte) string {
+	halves := []string{safetyHalf(userA, keyA), safetyHalf(userB, keyB)}
+	slices.Sort(halves)
+
+	digits := halves[0] + halves[1]
+	groups := make([]string, 0, len(digits)/5)
+	for i := 0; i < len(digits); i += 5 {
+		groups = append(groups, digits[i:i+5])
+	}
+	return strings.Join(groups, " ")
+}
+
+const safetyIterations = 5200
+
+func safetyHalf(user string, key []byte) string {
+	h := sha512.Sum512(append(append([]byte{0, 0}, key...), user...))
+	for i := 1; i < safetyIterations; i++ {
+		h = sha512.Sum512(append(h[:], key...))
+	}
+
+	// 6 trozos de 5 bytes, cada uno como un número de 5 cifras
+	var digits strings.Builder
+	for i := 0; i < 30; i += 5 {
+		chunk := uint64(h[i])<<32 | uint64(h[i+1])<<24 | uint64(h[i+2])<<16 | uint64(h[i+3])<<8 | uint64(h[i+4])
+		fmt.Fprintf(&digits, "%05d", chunk%100000)
+	}
+	return digits.String()
+}
+
 func WriteECDSAKeyToFile(filename string, key *ecdsa.PrivateKey) {
 	keyBytes, err := x509.MarshalECPrivateKey(key)
 	FailOnError(err)
@@ -0,0 +1,117 @@
+package util
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"testing"
+)
+
+func testKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	key := testKey()
+	data := []byte("hola mundo")
+
+	enc := EncryptAD(data, key, []byte("ad"))
+	if !IsEnvelope(enc) {
+		t.Fatal("sin cabecera de sobre")
+	}
+
+	dec, err := DecryptAD(enc, key, []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec, data) {
+		t.Fatalf("descifrado %q, esperaba %q", dec, data)
+	}
+}
+
+func TestEnvelopeTampered(t *testing.T) {
+	key := testKey()
+	enc := EncryptAD([]byte("hola mundo"), key, nil)
+
+	for i := envelopeHeader; i < len(enc); i++ {
+		tampered := bytes.Clone(enc)
+		tampered[i] ^= 1
+
+		if _, err := DecryptAD(tampered, key, nil); err == nil {
+			t.Fatalf("byte %d modificado y se ha descifrado", i)
+		}
+	}
+
+	if _, err := DecryptAD(enc[:len(enc)-1], key, nil); err == nil {
+		t.Fatal("sobre recortado y se ha descifrado")
+	}
+}
+
+func TestEnvelopeStrippedMagic(t *testing.T) {
+	key := testKey()
+	enc := EncryptAD([]byte("hola mundo"), key, nil)
+
+	stripped := bytes.Clone(enc)
+	stripped[0] = 0
+	if _, err := DecryptAD(stripped, key, nil); err == nil {
+		t.Fatal("sin cabecera y se ha descifrado")
+	}
+
+	if _, err := DecryptAD(enc[2:], key, nil); err == nil {
+		t.Fatal("sin los bytes mágicos y se ha descifrado")
+	}
+
+	// datos del formato antiguo: Decrypt no los acepta aunque la clave sea buena
+	if _, err := Decrypt(encryptLegacy(t, []byte("hola mundo"), key), key); err == nil {
+		t.Fatal("formato antiguo aceptado por Decrypt")
+	}
+}
+
+func TestEnvelopeWrongAD(t *testing.T) {
+	key := testKey()
+	enc := EncryptAD([]byte("hola mundo"), key, []byte("alice->bob"))
+
+	if _, err := DecryptAD(enc, key, []byte("bob->alice")); err == nil {
+		t.Fatal("ad distinto y se ha descifrado")
+	}
+	if _, err := DecryptAD(enc, key, nil); err == nil {
+		t.Fatal("sin ad y se ha descifrado")
+	}
+	if _, err := DecryptAD(enc, testKey(), []byte("alice->bob")); err == nil {
+		t.Fatal("otra clave y se ha descifrado")
+	}
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	key := testKey()
+	data := []byte("hola mundo")
+
+	dec, err := DecryptLegacy(encryptLegacy(t, data, key), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec, data) {
+		t.Fatalf("descifrado %q, esperaba %q", dec, data)
+	}
+
+	if _, err := DecryptLegacy(make([]byte, 8), key); err == nil {
+		t.Fatal("datos cortos aceptados")
+	}
+}
+
+// encryptLegacy cifra como lo hacía Encrypt antes del sobre autenticado
+func encryptLegacy(t *testing.T, data, key []byte) []byte {
+	out := make([]byte, 16+len(data))
+	rand.Read(out[:16])
+	out[0] = 0 // que el IV no empiece por casualidad como un sobre
+
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher.NewCTR(blk, out[:16]).XORKeyStream(out[16:], data)
+	return out
+}